@@ -0,0 +1,97 @@
+package chat
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"reflect"
+)
+
+// fieldsDeclaration is implemented by the commands: fields returns the pointers
+// to the fields in the order they are encoded on the wire.
+// The size, the encoding and the decoding of the command are derived from
+// this single declaration, see sizeOfFields, writeFields and readFields,
+// so they can't drift apart.
+//
+// The supported field types are the ones handled by writeMany and readAny:
+// *string, *[]string, *map[string]string, *[]byte, *int (encoded as 4 bytes),
+// the pointers to fixed-size values (bool, byte, uint16, uint32, uint64, ...),
+// and the fieldCodec implementations for the nested values.
+type fieldsDeclaration interface {
+	fields() []any
+}
+
+// fieldCodec encodes a field that is not a basic type, for example a list of commands.
+type fieldCodec interface {
+	sizeNeeded() int
+	write(writer io.Writer) (int, error)
+	read(reader io.Reader) error
+}
+
+// sizeOfFields returns the bytes needed to encode the fields of the command.
+// It panics for an unsupported field type: it is a programming error
+// caught by the first encode of the command.
+func sizeOfFields(command fieldsDeclaration) int {
+	size := 0
+	for _, field := range command.fields() {
+		size += sizeOfField(field)
+	}
+	return size
+}
+
+func sizeOfField(field any) int {
+	switch field := field.(type) {
+	case fieldCodec:
+		return field.sizeNeeded()
+	case *int:
+		return chatProtocolUint32
+	case *string:
+		return chatProtocolStringLenSizeBytes + len(*field)
+	case *[]string:
+		return sizeOfStringSlice(*field)
+	case *[]byte:
+		return chatProtocolSizeUint16 + len(*field)
+	case *map[string]string:
+		return sizeOfStringMap(*field)
+	}
+	size := binary.Size(field)
+	if size < 0 || reflect.TypeOf(field).Kind() != reflect.Pointer {
+		panic(fmt.Sprintf("chat codec: unsupported field type %T", field))
+	}
+	return size
+}
+
+// writeFields encodes the fields of the command.
+func writeFields(writer io.Writer, command fieldsDeclaration) (int, error) {
+	written := 0
+	for _, field := range command.fields() {
+		var n int
+		var err error
+		if codec, ok := field.(fieldCodec); ok {
+			n, err = codec.write(writer)
+		} else {
+			n, err = writeMany(writer, reflect.ValueOf(field).Elem().Interface())
+		}
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// readFields decodes the fields of the command.
+func readFields(reader io.Reader, command fieldsDeclaration) error {
+	for _, field := range command.fields() {
+		var err error
+		if codec, ok := field.(fieldCodec); ok {
+			err = codec.read(reader)
+		} else {
+			err = readAny(reader, field)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
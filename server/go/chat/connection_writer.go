@@ -0,0 +1,163 @@
+package chat
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"gsantomaggio/chat/server/internal"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultWriteQueueSize is the number of frames queued on a connection
+	DefaultWriteQueueSize = 256
+	// DefaultWriteTimeout is how long Send waits when the queue is full
+	DefaultWriteTimeout = 5 * time.Second
+)
+
+var (
+	// ErrWriterClosed is returned by Send after Close
+	ErrWriterClosed = errors.New("connection writer closed")
+	// ErrWriteQueueFull is returned by Send when the queue stays full for the
+	// write timeout: the other side doesn't read
+	ErrWriteQueueFull = errors.New("connection write queue full")
+)
+
+// ConnectionWriter owns the writes of a connection. The frames are queued and
+// written in order by a dedicated goroutine, so a slow connection blocks only
+// the goroutines writing to it.
+// Send blocks while the queue is full (backpressure), up to the write timeout.
+// It is safe for concurrent use.
+type ConnectionWriter struct {
+	writer  *bufio.Writer
+	queue   chan []byte
+	timeout time.Duration
+	// stop is closed by Close or after a write error, to unblock the Send waiting
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+	// Send holds the read lock while it queues the frame,
+	// so Close can close the queue when no Send is running.
+	mutex  sync.RWMutex
+	closed bool
+	// err is the first write error
+	errMutex sync.Mutex
+	err      error
+}
+
+// NewConnectionWriter starts the goroutine writing on writer.
+// queueSize and timeout are DefaultWriteQueueSize and DefaultWriteTimeout when zero.
+// The caller must call Close.
+func NewConnectionWriter(writer io.Writer, queueSize int, timeout time.Duration) *ConnectionWriter {
+	if queueSize <= 0 {
+		queueSize = DefaultWriteQueueSize
+	}
+	if timeout <= 0 {
+		timeout = DefaultWriteTimeout
+	}
+	w := &ConnectionWriter{
+		writer:  bufio.NewWriter(writer),
+		queue:   make(chan []byte, queueSize),
+		timeout: timeout,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// Send encodes the command and queues the frame.
+// It returns the error of a previous write, the connection is not usable anymore.
+func (w *ConnectionWriter) Send(command internal.CommandWrite) error {
+	frame, err := EncodeFrame(command)
+	if err != nil {
+		return err
+	}
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	if w.closed {
+		return ErrWriterClosed
+	}
+	if err := w.writeError(); err != nil {
+		return err
+	}
+	select {
+	case w.queue <- frame:
+		return nil
+	default:
+	}
+	timer := time.NewTimer(w.timeout)
+	defer timer.Stop()
+	select {
+	case w.queue <- frame:
+		return nil
+	case <-w.stop:
+		if err := w.writeError(); err != nil {
+			return err
+		}
+		return ErrWriterClosed
+	case <-timer.C:
+		return fmt.Errorf("%w: %d frames not written in %s", ErrWriteQueueFull, len(w.queue), w.timeout)
+	}
+}
+
+// Close stops accepting frames and waits until the queued frames are written,
+// at most the write timeout: the caller closes the connection anyway.
+func (w *ConnectionWriter) Close() error {
+	w.stopOnce.Do(func() { close(w.stop) })
+	w.mutex.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.mutex.Unlock()
+	select {
+	case <-w.done:
+	case <-time.After(w.timeout):
+		return fmt.Errorf("%w: the queued frames were not written in %s", ErrWriteQueueFull, w.timeout)
+	}
+	return w.writeError()
+}
+
+// run writes the frames in order and flushes when the queue is empty,
+// so the frames queued together are written with one syscall.
+// After a write error the frames are discarded until Close.
+func (w *ConnectionWriter) run() {
+	defer close(w.done)
+	failed := false
+	for frame := range w.queue {
+		if failed {
+			continue
+		}
+		_, err := w.writer.Write(frame)
+		if err == nil && len(w.queue) == 0 {
+			err = w.writer.Flush()
+		}
+		if err != nil {
+			failed = true
+			w.fail(err)
+		}
+	}
+	if !failed {
+		if err := w.writer.Flush(); err != nil {
+			w.fail(err)
+		}
+	}
+}
+
+func (w *ConnectionWriter) fail(err error) {
+	w.errMutex.Lock()
+	if w.err == nil {
+		w.err = err
+	}
+	w.errMutex.Unlock()
+	w.stopOnce.Do(func() { close(w.stop) })
+}
+
+func (w *ConnectionWriter) writeError() error {
+	w.errMutex.Lock()
+	defer w.errMutex.Unlock()
+	return w.err
+}
@@ -0,0 +1,94 @@
+package chat
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// failingWriter fails every write
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("broken connection")
+}
+
+// syncBuffer is a bytes.Buffer safe for the writer goroutine and the test
+type syncBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.Write(p)
+}
+
+var _ = Describe("ConnectionWriter", func() {
+	It("writes the frames of many goroutines without mixing them", func() {
+		buffer := &syncBuffer{}
+		writer := NewConnectionWriter(buffer, 4, time.Second)
+		wg := sync.WaitGroup{}
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 20; j++ {
+					message := NewCommandMessageWithCorrelationId("hello", "from", "to", uint32(i*100+j), 10)
+					Expect(writer.Send(message)).To(Succeed())
+				}
+			}(i)
+		}
+		wg.Wait()
+		Expect(writer.Close()).To(Succeed())
+
+		reader := bufio.NewReader(bytes.NewReader(buffer.buffer.Bytes()))
+		seen := make(map[uint32]bool)
+		for {
+			frame, err := ReadFullBufferFromSource(reader)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			Expect(err).To(BeNil())
+			header := &ChatHeader{}
+			Expect(header.Read(frame)).To(Succeed())
+			Expect(header.Key()).To(Equal(CommandMessageKey))
+			message := &CommandMessage{}
+			Expect(message.Read(frame)).To(Succeed())
+			Expect(message.Message).To(Equal("hello"))
+			seen[message.CorrelationId()] = true
+		}
+		Expect(seen).To(HaveLen(200))
+	})
+
+	It("returns ErrWriteQueueFull when the other side doesn't read", func() {
+		pipeReader, pipeWriter := io.Pipe()
+		writer := NewConnectionWriter(pipeWriter, 1, 50*time.Millisecond)
+		var err error
+		for i := 0; i < 10 && err == nil; i++ {
+			err = writer.Send(NewCommandLogout())
+		}
+		Expect(err).To(MatchError(ErrWriteQueueFull))
+
+		// the frames queued are written when the other side reads
+		go func() { _, _ = io.Copy(io.Discard, pipeReader) }()
+		Expect(writer.Close()).To(Succeed())
+		Expect(writer.Send(NewCommandLogout())).To(MatchError(ErrWriterClosed))
+	})
+
+	It("returns the write error to the next Send", func() {
+		writer := NewConnectionWriter(failingWriter{}, 1, time.Second)
+		Expect(writer.Send(NewCommandLogout())).To(Succeed())
+		Eventually(func() error {
+			return writer.Send(NewCommandLogout())
+		}).Should(MatchError("broken connection"))
+		Expect(writer.Close()).To(MatchError("broken connection"))
+	})
+})
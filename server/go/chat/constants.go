@@ -1,12 +1,27 @@
 package chat
 
+import (
+	"math"
+	"time"
+)
+
 const (
-	CommandLoginKey    uint16 = 0x01
-	CommandMessageKey  uint16 = 0x02
-	GenericResponseKey uint16 = 0x03
-	Version1           byte   = 1
+	Version1 byte = 1
+
+	// DefaultMaxFrameSize is the max length of a frame (header + command)
+	// accepted by ReadFullBufferFromSource
+	DefaultMaxFrameSize uint32 = 1024 * 1024
+
+	// MaxStringLength is the max length of a string or a []byte field:
+	// the length is encoded in 2 bytes
+	MaxStringLength = math.MaxUint16
 
-	CommandCorrelationIdTest uint16 = 0x09
+	// DefaultHeartbeatInterval is the time between the heartbeats (CommandPing)
+	// of an idle connection
+	DefaultHeartbeatInterval = 10 * time.Second
+	// DefaultHeartbeatMaxMissed is the number of heartbeats without an answer
+	// before the connection is considered dead
+	DefaultHeartbeatMaxMissed = 3
 
 	chatProtocolHeaderSizeBytes = chatProtocolVersionSizeByte + // version
 		chatProtocolKeySizeBytes // command
@@ -21,11 +36,3 @@ const (
 	chatProtocolUint32                 = 4
 	chatProtocolUint64                 = 8
 )
-
-// / response codes
-const (
-	ResponseCodeOk uint16 = 0x01
-	//ResponseCodeError                   uint16 = 0x0002
-	ResponseCodeErrorUserNotFound      uint16 = 0x03
-	ResponseCodeErrorUserAlreadyLogged uint16 = 0x04
-)
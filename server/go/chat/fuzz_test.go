@@ -0,0 +1,202 @@
+package chat
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// wireCommand is implemented by the commands and by the header
+type wireCommand interface {
+	Read(reader *bufio.Reader) error
+	Write(writer *bufio.Writer) (int, error)
+	SizeNeeded() int
+}
+
+func encodeCommand(tb testing.TB, command wireCommand) []byte {
+	buff := &bytes.Buffer{}
+	wr := bufio.NewWriter(buff)
+	if _, err := command.Write(wr); err != nil {
+		tb.Fatalf("error encoding %T: %v", command, err)
+	}
+	if err := wr.Flush(); err != nil {
+		tb.Fatalf("error encoding %T: %v", command, err)
+	}
+	return buff.Bytes()
+}
+
+// fuzzRead checks that Read doesn't panic with any input, and that a decoded
+// command is encoded in SizeNeeded bytes and decoded again to the same value.
+// The seeds are the valid commands.
+func fuzzRead[T wireCommand](f *testing.F, newCommand func() T, seeds ...T) {
+	f.Add([]byte{})
+	for _, seed := range seeds {
+		encoded := encodeCommand(f, seed)
+		f.Add(encoded)
+		// the truncated frames
+		f.Add(encoded[:len(encoded)/2])
+		f.Add(encoded[:len(encoded)-1])
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		command := newCommand()
+		if err := command.Read(bufio.NewReader(bytes.NewReader(data))); err != nil {
+			return
+		}
+		encoded := encodeCommand(t, command)
+		if len(encoded) != command.SizeNeeded() {
+			t.Fatalf("%T encoded in %d bytes, SizeNeeded %d", command, len(encoded), command.SizeNeeded())
+		}
+		decoded := newCommand()
+		if err := decoded.Read(bufio.NewReader(bytes.NewReader(encoded))); err != nil {
+			t.Fatalf("error decoding %T encoded again: %v", command, err)
+		}
+		if !reflect.DeepEqual(command, decoded) {
+			t.Fatalf("%T decoded %+v, encoded again and decoded %+v", command, command, decoded)
+		}
+	})
+}
+
+func FuzzReadFullBufferFromSource(f *testing.F) {
+	const maxFrameSize = 1024
+	f.Add([]byte{})
+	f.Add([]byte{0x00, 0x00})
+	f.Add([]byte{0x00, 0x00, 0x00, 0x03, 0x01, 0x00, 0x01})
+	f.Add([]byte{0x00, 0x00, 0x00, 0x07, 0x01, 0x00, 0x01})
+	f.Add([]byte{0xFF, 0xFF, 0xFF, 0xFF})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		frame, err := ReadFullBufferFromSourceWithLimit(bytes.NewReader(data), maxFrameSize)
+		if err != nil {
+			return
+		}
+		header := &ChatHeader{}
+		if err := header.Read(frame); err != nil {
+			t.Fatalf("a frame without room for the header was accepted: %v", err)
+		}
+		rest, err := io.ReadAll(frame)
+		if err != nil {
+			t.Fatalf("error reading the frame: %v", err)
+		}
+		if header.SizeNeeded()+len(rest) > maxFrameSize {
+			t.Fatalf("a frame of %d bytes was accepted, max %d", header.SizeNeeded()+len(rest), maxFrameSize)
+		}
+	})
+}
+
+func FuzzChatHeaderRead(f *testing.F) {
+	fuzzRead(f, func() *ChatHeader { return &ChatHeader{} }, NewChatHeader(Version1, CommandLoginKey))
+}
+
+func FuzzCommandLoginRead(f *testing.F) {
+	fuzzRead(f, func() *CommandLogin { return &CommandLogin{} }, NewCommandLoginWithCorrelation("user", "password", 1))
+}
+
+func FuzzCommandRegisterRead(f *testing.F) {
+	fuzzRead(f, func() *CommandRegister { return &CommandRegister{} }, NewCommandRegister("user", "password"))
+}
+
+func FuzzCommandLogoutRead(f *testing.F) {
+	fuzzRead(f, func() *CommandLogout { return &CommandLogout{} }, NewCommandLogout())
+}
+
+func FuzzCommandMessageRead(f *testing.F) {
+	message := NewCommandMessageWithCorrelationId("hello", "from", "to", 1, 10)
+	message.Id = 42
+	message.Room = "room"
+	fuzzRead(f, func() *CommandMessage { return &CommandMessage{} }, message)
+}
+
+func FuzzCommandMessageAckRead(f *testing.F) {
+	fuzzRead(f, func() *CommandMessageAck { return &CommandMessageAck{} }, NewCommandMessageAck(42))
+}
+
+func FuzzCommandMessageReadRead(f *testing.F) {
+	fuzzRead(f, func() *CommandMessageRead { return &CommandMessageRead{} }, NewCommandMessageRead(42))
+}
+
+func FuzzCommandMessageStatusRead(f *testing.F) {
+	fuzzRead(f, func() *CommandMessageStatus { return &CommandMessageStatus{} },
+		NewCommandMessageStatus(42, "to", MessageStatusRead, 10))
+}
+
+func FuzzCommandMultiMessageRead(f *testing.F) {
+	fuzzRead(f, func() *CommandMultiMessage { return &CommandMultiMessage{} },
+		NewCommandMultiMessage("hello", "from", []string{"a", "b"}, 10),
+		NewCommandBroadcastMessage("hello", "from", 10))
+}
+
+func FuzzCommandListUsersRead(f *testing.F) {
+	fuzzRead(f, func() *CommandListUsers { return &CommandListUsers{} }, NewCommandListUsers())
+}
+
+func FuzzCommandServerGoingAwayRead(f *testing.F) {
+	fuzzRead(f, func() *CommandServerGoingAway { return &CommandServerGoingAway{} }, NewCommandServerGoingAway("shutdown"))
+}
+
+func FuzzCommandPingRead(f *testing.F) {
+	fuzzRead(f, func() *CommandPing { return &CommandPing{} }, NewCommandPing())
+}
+
+func FuzzCommandPongRead(f *testing.F) {
+	fuzzRead(f, func() *CommandPong { return &CommandPong{} }, NewCommandPong(7))
+}
+
+func FuzzCommandCreateRoomRead(f *testing.F) {
+	fuzzRead(f, func() *CommandCreateRoom { return &CommandCreateRoom{} }, NewCommandCreateRoom("room"))
+}
+
+func FuzzCommandJoinRoomRead(f *testing.F) {
+	fuzzRead(f, func() *CommandJoinRoom { return &CommandJoinRoom{} }, NewCommandJoinRoom("room"))
+}
+
+func FuzzCommandLeaveRoomRead(f *testing.F) {
+	fuzzRead(f, func() *CommandLeaveRoom { return &CommandLeaveRoom{} }, NewCommandLeaveRoom("room"))
+}
+
+func FuzzCommandListRoomMembersRead(f *testing.F) {
+	fuzzRead(f, func() *CommandListRoomMembers { return &CommandListRoomMembers{} }, NewCommandListRoomMembers("room"))
+}
+
+func FuzzCommandRoomMessageRead(f *testing.F) {
+	fuzzRead(f, func() *CommandRoomMessage { return &CommandRoomMessage{} },
+		NewCommandRoomMessage("room", "hello", "from", 10))
+}
+
+func FuzzCommandHistoryRead(f *testing.F) {
+	fuzzRead(f, func() *CommandHistory { return &CommandHistory{} }, NewCommandHistory("peer", 20, 10, 5))
+}
+
+func FuzzGenericResponseRead(f *testing.F) {
+	fuzzRead(f, func() *GenericResponse { return &GenericResponse{} }, NewGenericResponse(ResponseCodeOk))
+}
+
+func FuzzMultiMessageResponseRead(f *testing.F) {
+	fuzzRead(f, func() *MultiMessageResponse { return &MultiMessageResponse{} },
+		NewMultiMessageResponse(ResponseCodeOk, []string{"a"}, []string{"b"}, []string{"c"}, []string{"d"}))
+}
+
+func FuzzMessageSentResponseRead(f *testing.F) {
+	fuzzRead(f, func() *MessageSentResponse { return &MessageSentResponse{} }, NewMessageSentResponse(ResponseCodeOk, 42))
+}
+
+func FuzzUserListResponseRead(f *testing.F) {
+	fuzzRead(f, func() *UserListResponse { return &UserListResponse{} },
+		NewUserListResponse(ResponseCodeOk, []string{"a"}, []string{"b"}, map[string]string{"a": "now", "b": "then"}))
+}
+
+func FuzzRoomMembersResponseRead(f *testing.F) {
+	fuzzRead(f, func() *RoomMembersResponse { return &RoomMembersResponse{} },
+		NewRoomMembersResponse(ResponseCodeOk, "room", []string{"a", "b"}))
+}
+
+func FuzzHistoryResponseRead(f *testing.F) {
+	message := NewCommandMessageWithCorrelationId("hello", "from", "to", 1, 10)
+	message.Id = 42
+	fuzzRead(f, func() *HistoryResponse { return &HistoryResponse{} },
+		NewHistoryResponse(ResponseCodeOk, true, []*CommandMessage{message}))
+}
+
+func FuzzCorrelationIdTestRead(f *testing.F) {
+	fuzzRead(f, func() *CorrelationIdTest { return &CorrelationIdTest{} }, NewCorrelationIdCommand())
+}
@@ -0,0 +1,3 @@
+package chat
+
+//go:generate go run ../run/protocolgen -schema ../../../protocol/schema.json -go protocol_gen.go -readme ../../../README.md
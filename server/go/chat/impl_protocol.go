@@ -5,112 +5,148 @@ import (
 	"gsantomaggio/chat/server/internal"
 )
 
-// CommandLogin is a command to login into the chat server.
+// The command types are generated from protocol/schema.json in protocol_gen.go,
+// this file contains the constructors and the accessors.
 
-type CommandLogin struct {
-	correlationId uint32 // 4 bytes
-	username      string //  for example "gabriele" [8, 103, 97, 98, 114, 105, 101, 108, 101]
+func NewCommandLoginWithCorrelation(username, password string, correlationId uint32) *CommandLogin {
+	return &CommandLogin{username: username, password: password, correlationId: correlationId}
 }
 
-func NewCommandLoginWithCorrelation(username string, correlationId uint32) *CommandLogin {
-	return &CommandLogin{username: username, correlationId: correlationId}
-}
-
-func NewCommandLogin(username string) *CommandLogin {
-	return &CommandLogin{username: username}
+func NewCommandLogin(username, password string) *CommandLogin {
+	return &CommandLogin{username: username, password: password}
 }
 
 func (l *CommandLogin) Username() string {
 	return l.username
 }
 
+func (l *CommandLogin) Password() string {
+	return l.password
+}
+
 func (l *CommandLogin) GetCorrelationId() uint32 {
 	return l.correlationId
 }
 
-func (l *CommandLogin) Key() uint16 {
-	return CommandLoginKey
+/// ***** END LOGIN ***
+
+func NewCommandRegister(username, password string) *CommandRegister {
+	return &CommandRegister{username: username, password: password}
 }
 
-func (l *CommandLogin) SizeNeeded() int {
-	return chatProtocolUint32 + // correlationId
-		chatProtocolSizeUint16 + // size of the string
-		len(l.username)
+func (r *CommandRegister) Username() string {
+	return r.username
 }
 
-func (l *CommandLogin) SetCorrelationId(id uint32) {
-	l.correlationId = id
+func (r *CommandRegister) Password() string {
+	return r.password
 }
 
-func (l *CommandLogin) CorrelationId() uint32 {
-	return l.correlationId
+/// ***** END REGISTER ***
+
+func NewCommandLogout() *CommandLogout {
+	return &CommandLogout{}
 }
 
-func (l *CommandLogin) Version() byte {
-	return Version1
+/// ***** END LOGOUT ***
+
+func NewCommandMessage(message, from string, to string, time uint64) *CommandMessage {
+	return &CommandMessage{Message: message, From: from, To: to, Time: time}
 }
 
-func (l *CommandLogin) Write(writer *bufio.Writer) (int, error) {
-	return writeMany(writer, l.correlationId, l.username)
+func NewCommandMessageWithCorrelationId(message, from string, to string, correlationId uint32, time uint64) *CommandMessage {
+	return &CommandMessage{Message: message, From: from, To: to, correlationId: correlationId, Time: time}
 }
 
-func (l *CommandLogin) Read(reader *bufio.Reader) error {
-	return readMany(reader, &l.correlationId, &l.username)
+/// ***** END MESSAGE ***
+
+func NewCommandMessageAck(id uint64) *CommandMessageAck {
+	return &CommandMessageAck{Id: id}
 }
 
-/// ***** END LOGIN ***
+/// ***** END MESSAGE ACK ***
 
-type CommandMessage struct {
-	correlationId uint32
-	Message       string // payload would be better as a name
-	From          string
-	To            string
-	Time          uint64
+func NewCommandMessageRead(id uint64) *CommandMessageRead {
+	return &CommandMessageRead{Id: id}
 }
 
-func NewCommandMessage(message, from string, to string, time uint64) *CommandMessage {
-	return &CommandMessage{Message: message, From: from, To: to, Time: time}
+/// ***** END MESSAGE READ ***
+
+func NewCommandMessageStatus(id uint64, to string, status byte, time uint64) *CommandMessageStatus {
+	return &CommandMessageStatus{Id: id, To: to, Status: status, Time: time}
 }
 
-func NewCommandMessageWithCorrelationId(message, from string, to string, correlationId uint32, time uint64) *CommandMessage {
-	return &CommandMessage{Message: message, From: from, To: to, correlationId: correlationId, Time: time}
+/// ***** END MESSAGE STATUS ***
+
+func NewCommandMultiMessage(message, from string, to []string, time uint64) *CommandMultiMessage {
+	return &CommandMultiMessage{Message: message, From: from, To: to, Time: time}
 }
 
-func (m *CommandMessage) Read(reader *bufio.Reader) error {
-	return readMany(reader, &m.correlationId, &m.Message, &m.From, &m.To, &m.Time)
+func NewCommandBroadcastMessage(message, from string, time uint64) *CommandMultiMessage {
+	return &CommandMultiMessage{Message: message, From: from, To: []string{}, Broadcast: true, Time: time}
 }
 
-func (m *CommandMessage) Key() uint16 {
-	return CommandMessageKey
+/// ***** END MULTI MESSAGE ***
+
+func NewCommandListUsers() *CommandListUsers {
+	return &CommandListUsers{}
+}
+
+/// ***** END LIST USERS ***
+
+func NewCommandServerGoingAway(reason string) *CommandServerGoingAway {
+	return &CommandServerGoingAway{Reason: reason}
 }
 
-func (m *CommandMessage) SizeNeeded() int {
-	return chatProtocolUint32 + // correlationId
-		chatProtocolUint64 + // time
-		chatProtocolSizeUint16 + // size of the string message
-		len(m.Message) + // actual size of the message
-		chatProtocolSizeUint16 + // size of the string from
-		len(m.From) + // actual size of the "from"
-		chatProtocolSizeUint16 + // size of the string to
-		len(m.To) // actual size of the "to"
+/// ***** END SERVER GOING AWAY ***
+
+func NewCommandPing() *CommandPing {
+	return &CommandPing{}
 }
 
-func (m *CommandMessage) CorrelationId() uint32 {
-	return m.correlationId
+// NewCommandPong creates the answer to the ping with the correlationId of the ping.
+func NewCommandPong(correlationId uint32) *CommandPong {
+	return &CommandPong{correlationId: correlationId}
 }
 
-func (m *CommandMessage) SetCorrelationId(id uint32) {
-	m.correlationId = id
+/// ***** END HEARTBEAT ***
+
+func NewCommandCreateRoom(room string) *CommandCreateRoom {
+	return &CommandCreateRoom{Room: room}
 }
 
-func (m *CommandMessage) Version() byte {
-	return Version1
+/// ***** END CREATE ROOM ***
+
+func NewCommandJoinRoom(room string) *CommandJoinRoom {
+	return &CommandJoinRoom{Room: room}
 }
 
-func (m *CommandMessage) Write(writer *bufio.Writer) (int, error) {
-	return writeMany(writer, m.correlationId, m.Message, m.From, m.To, m.Time)
+/// ***** END JOIN ROOM ***
+
+func NewCommandLeaveRoom(room string) *CommandLeaveRoom {
+	return &CommandLeaveRoom{Room: room}
 }
 
+/// ***** END LEAVE ROOM ***
+
+func NewCommandListRoomMembers(room string) *CommandListRoomMembers {
+	return &CommandListRoomMembers{Room: room}
+}
+
+/// ***** END LIST ROOM MEMBERS ***
+
+func NewCommandRoomMessage(room, message, from string, time uint64) *CommandRoomMessage {
+	return &CommandRoomMessage{Room: room, Message: message, From: from, Time: time}
+}
+
+/// ***** END ROOM MESSAGE ***
+
+func NewCommandHistory(peer string, beforeId, afterId uint64, limit uint16) *CommandHistory {
+	return &CommandHistory{Peer: peer, BeforeId: beforeId, AfterId: afterId, Limit: limit}
+}
+
+/// ***** END HISTORY ***
+
 // ChatHeader is the header of the chat protocol.
 type ChatHeader struct {
 	// total size of this header + command content
@@ -127,11 +163,11 @@ func NewChatHeader(version byte, command uint16) *ChatHeader {
 }
 
 func (c *ChatHeader) Write(writer *bufio.Writer) (int, error) {
-	return writeMany(writer, c.version, c.command)
+	return writeFields(writer, c)
 }
 
 func (c *ChatHeader) Read(reader *bufio.Reader) error {
-	return readMany(reader, &c.version, &c.command)
+	return readFields(reader, c)
 }
 
 func (c *ChatHeader) Key() uint16 {
@@ -142,62 +178,73 @@ func (c *ChatHeader) Version() byte {
 	return c.version
 }
 
-func (c *ChatHeader) SizeNeeded() int {
-	return chatProtocolHeaderSizeBytes
+func (c *ChatHeader) fields() []any {
+	return []any{&c.version, &c.command}
 }
 
-type GenericResponse struct {
-	correlationId uint32
-	responseCode  uint16
+func (c *ChatHeader) SizeNeeded() int {
+	return sizeOfFields(c)
 }
 
-func (g *GenericResponse) Key() uint16 {
-	return GenericResponseKey
+func NewGenericResponse(responseCode uint16) *GenericResponse {
+	return &GenericResponse{
+		responseCode: responseCode,
+	}
 }
 
-func (g *GenericResponse) SizeNeeded() int {
-	return chatProtocolUint32 + // correlationId
-		chatProtocolSizeUint16 // responseCode
-}
+//// **** END GENERIC RESPONSE ****
 
-func (g *GenericResponse) Version() byte {
-	return Version1
+func NewMultiMessageResponse(responseCode uint16, delivered, queued, notFound, mailboxFull []string) *MultiMessageResponse {
+	return &MultiMessageResponse{
+		responseCode: responseCode,
+		Delivered:    delivered,
+		Queued:       queued,
+		NotFound:     notFound,
+		MailboxFull:  mailboxFull,
+	}
 }
 
-func (g *GenericResponse) SetCorrelationId(id uint32) {
-	g.correlationId = id
+//// **** END MULTI MESSAGE RESPONSE ****
+
+func NewMessageSentResponse(responseCode uint16, id uint64) *MessageSentResponse {
+	return &MessageSentResponse{responseCode: responseCode, Id: id}
 }
 
-func NewGenericResponse(responseCode uint16) *GenericResponse {
-	return &GenericResponse{
+//// **** END MESSAGE SENT RESPONSE ****
+
+func NewUserListResponse(responseCode uint16, online, offline []string, lastLogin map[string]string) *UserListResponse {
+	return &UserListResponse{
 		responseCode: responseCode,
+		Online:       online,
+		Offline:      offline,
+		LastLogin:    lastLogin,
 	}
 }
 
-func (g *GenericResponse) CorrelationId() uint32 {
-	return g.correlationId
-}
+//// **** END USER LIST RESPONSE ****
 
-func (g *GenericResponse) ResponseCode() uint16 {
-	return g.responseCode
+func NewRoomMembersResponse(responseCode uint16, room string, members []string) *RoomMembersResponse {
+	return &RoomMembersResponse{
+		responseCode: responseCode,
+		Room:         room,
+		Members:      members,
+	}
 }
 
-func (g *GenericResponse) Write(writer *bufio.Writer) (int, error) {
-	return writeMany(writer, g.correlationId, g.responseCode)
-}
+//// **** END ROOM MEMBERS RESPONSE ****
 
-func (g *GenericResponse) Read(reader *bufio.Reader) error {
-	return readMany(reader, &g.correlationId, &g.responseCode)
+func NewHistoryResponse(responseCode uint16, more bool, messages []*CommandMessage) *HistoryResponse {
+	return &HistoryResponse{
+		responseCode: responseCode,
+		More:         more,
+		Messages:     messages,
+	}
 }
 
-//// **** END GENERIC RESPONSE ****
+//// **** END HISTORY RESPONSE ****
 
 /// **** CORRELATION ID TEST ****
 
-type CorrelationIdTest struct {
-	correlationId uint32 // 4 bytes
-}
-
 func NewCorrelationIdCommand() *CorrelationIdTest {
 	return &CorrelationIdTest{}
 }
@@ -205,31 +252,3 @@ func NewCorrelationIdCommand() *CorrelationIdTest {
 func (l *CorrelationIdTest) GetCorrelationId() uint32 {
 	return l.correlationId
 }
-
-func (l *CorrelationIdTest) Key() uint16 {
-	return CommandCorrelationIdTest
-}
-
-func (l *CorrelationIdTest) SizeNeeded() int {
-	return chatProtocolUint32 // correlationId
-}
-
-func (l *CorrelationIdTest) SetCorrelationId(id uint32) {
-	l.correlationId = id
-}
-
-func (l *CorrelationIdTest) CorrelationId() uint32 {
-	return l.correlationId
-}
-
-func (l *CorrelationIdTest) Version() byte {
-	return Version1
-}
-
-func (l *CorrelationIdTest) Write(writer *bufio.Writer) (int, error) {
-	return writeMany(writer, l.correlationId)
-}
-
-func (l *CorrelationIdTest) Read(reader *bufio.Reader) error {
-	return readMany(reader, &l.correlationId)
-}
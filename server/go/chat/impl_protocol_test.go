@@ -5,6 +5,9 @@ import (
 	"bytes"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	"io"
+	"reflect"
+	"strings"
 	"time"
 )
 
@@ -46,8 +49,9 @@ var _ = Describe("Protocol", func() {
 
 	Context("CommandLogin", func() {
 		It("has the correct attributes", func() {
-			login := NewCommandLoginWithCorrelation("user", 1)
+			login := NewCommandLoginWithCorrelation("user", "pwd", 1)
 			Expect(login.Username()).To(Equal("user"))
+			Expect(login.Password()).To(Equal("pwd"))
 		})
 
 		It("can encode itself into a binary sequence", func() {
@@ -57,9 +61,12 @@ var _ = Describe("Protocol", func() {
 				0x00, 0x04, // uint 16 username len
 			}
 			byteSequence = append(byteSequence, []byte("user")...)
+			byteSequence = append(byteSequence, 0x00, 0x03) // uint 16 password len
+			byteSequence = append(byteSequence, []byte("pwd")...)
 			buff := bytes.NewReader(byteSequence)
 			Expect(login.Read(bufio.NewReader(buff))).To(Succeed())
 			Expect(login.Username()).To(Equal("user"))
+			Expect(login.Password()).To(Equal("pwd"))
 			Expect(login.GetCorrelationId()).To(BeNumerically("==", 1))
 
 			loginB := &CommandLogin{}
@@ -71,10 +78,11 @@ var _ = Describe("Protocol", func() {
 		})
 
 		It("can return the size needed to encode the frame", func() {
-			login := NewCommandLoginWithCorrelation("user", 1)
+			login := NewCommandLoginWithCorrelation("user", "pwd", 1)
 			expectedSize :=
 				4 + // correlation ID
-					2 + 4 // uint16 for the username string  + username string length
+					2 + 4 + // uint16 for the username string  + username string length
+					2 + 3 // uint16 for the password string  + password string length
 
 			Expect(login.SizeNeeded()).To(Equal(expectedSize))
 
@@ -87,11 +95,52 @@ var _ = Describe("Protocol", func() {
 				0x00, 0x00, 0x00, 0x01, // uint32 correlation id
 				0x00, 0x04, // uint 16 username len
 				0x75, 0x73, 0x65, 0x72, // user
+				0x00, 0x03, // uint 16 password len
+				0x70, 0x77, 0x64, // pwd
 			}))
 
 		})
 	})
 
+	Context("CommandRegister", func() {
+		It("can encode and decode itself", func() {
+			register := NewCommandRegister("user", "pwd")
+			register.SetCorrelationId(2)
+			Expect(register.SizeNeeded()).To(Equal(4 + 2 + 4 + 2 + 3))
+
+			buff := &bytes.Buffer{}
+			wr := bufio.NewWriter(buff)
+			Expect(register.Write(wr)).To(BeNumerically("==", register.SizeNeeded()))
+			Expect(wr.Flush()).To(Succeed())
+
+			registerRead := &CommandRegister{}
+			Expect(registerRead.Read(bufio.NewReader(buff))).To(Succeed())
+			Expect(registerRead.CorrelationId()).To(BeNumerically("==", 2))
+			Expect(registerRead.Username()).To(Equal("user"))
+			Expect(registerRead.Password()).To(Equal("pwd"))
+		})
+	})
+
+	Context("CommandLogout", func() {
+		It("can encode and decode itself", func() {
+			logout := NewCommandLogout()
+			logout.SetCorrelationId(7)
+			Expect(logout.SizeNeeded()).To(Equal(4))
+
+			buff := &bytes.Buffer{}
+			wr := bufio.NewWriter(buff)
+			Expect(logout.Write(wr)).To(BeNumerically("==", logout.SizeNeeded()))
+			Expect(wr.Flush()).To(Succeed())
+			Expect(buff.Bytes()).To(Equal([]byte{
+				0x00, 0x00, 0x00, 0x07, // uint32 correlation id
+			}))
+
+			logoutRead := &CommandLogout{}
+			Expect(logoutRead.Read(bufio.NewReader(buff))).To(Succeed())
+			Expect(logoutRead.CorrelationId()).To(BeNumerically("==", 7))
+		})
+	})
+
 	Context("CommandMessage", func() {
 		It("has the correct attributes", func() {
 			msg := NewCommandMessageWithCorrelationId("hello", "from", "to", 55, ConvertTimeToUint64(time.Now()))
@@ -114,22 +163,31 @@ var _ = Describe("Protocol", func() {
 			byteSequence = append(byteSequence, 0x00, 0x02) // uint 16 to len
 			byteSequence = append(byteSequence, []byte("to")...)
 			byteSequence = append(byteSequence, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0a) // time
+			byteSequence = append(byteSequence, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x2a) // id
+			byteSequence = append(byteSequence, 0x00, 0x04)                                     // uint 16 room len
+			byteSequence = append(byteSequence, []byte("room")...)
 
 			buff := bytes.NewReader(byteSequence)
 			Expect(msg.Read(bufio.NewReader(buff))).To(Succeed())
 			Expect(msg.Message).To(Equal("hello"))
 			Expect(msg.To).To(Equal("to"))
 			Expect(msg.From).To(Equal("from"))
+			Expect(msg.Time).To(BeNumerically("==", 10))
+			Expect(msg.Id).To(BeNumerically("==", 42))
+			Expect(msg.Room).To(Equal("room"))
 		})
 
 		It("can return the size needed to encode the frame", func() {
 			msg := NewCommandMessageWithCorrelationId("hello", "from", "to", 1, 10)
+			msg.Id = 42
 			expectedSize :=
 				4 + // correlation ID
 					2 + 5 + // uint16 for the message string  + uint32 message string length
 					2 + 4 + // from uint16 for the to string  + uint32 to string length
 					2 + 2 + // to uint16 for the to string  + uint32 to string length
-					8 // time
+					8 + // time
+					8 + // id
+					2 // room, empty for the direct messages
 
 			Expect(msg.SizeNeeded()).To(Equal(expectedSize))
 
@@ -146,14 +204,257 @@ var _ = Describe("Protocol", func() {
 				0x66, 0x72, 0x6f, 0x6d, // from
 				0x00, 0x02, // uint 16 to len
 				0x74, 0x6f, // to
-				0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0a,
+				0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0a, // time
+				0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x2a, // id
+				0x00, 0x00, // uint 16 room len
+			}))
+		})
+	})
+
+	Context("CommandMessageAck", func() {
+		It("can encode and decode itself", func() {
+			ack := NewCommandMessageAck(42)
+			Expect(ack.SizeNeeded()).To(Equal(4 + 8))
+
+			buff := &bytes.Buffer{}
+			wr := bufio.NewWriter(buff)
+			Expect(ack.Write(wr)).To(BeNumerically("==", ack.SizeNeeded()))
+			Expect(wr.Flush()).To(Succeed())
+			Expect(buff.Bytes()).To(Equal([]byte{
+				0x00, 0x00, 0x00, 0x00, // uint32 correlation id
+				0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x2a, // id
 			}))
+
+			ackRead := &CommandMessageAck{}
+			Expect(ackRead.Read(bufio.NewReader(buff))).To(Succeed())
+			Expect(ackRead.Id).To(BeNumerically("==", 42))
 		})
 	})
+	Context("CommandMultiMessage", func() {
+		It("can return the size needed to encode the frame", func() {
+			msg := NewCommandMultiMessage("hello", "from", []string{"a", "bb"}, 10)
+			msg.SetCorrelationId(1)
+			expectedSize :=
+				4 + // correlation ID
+					2 + 5 + // message
+					2 + 4 + // from
+					4 + 2 + 1 + 2 + 2 + // to: number of entries + entries
+					1 + // broadcast
+					8 // time
+			Expect(msg.SizeNeeded()).To(Equal(expectedSize))
+
+			buff := &bytes.Buffer{}
+			wr := bufio.NewWriter(buff)
+			Expect(msg.Write(wr)).To(BeNumerically("==", msg.SizeNeeded()))
+			Expect(wr.Flush()).To(Succeed())
+
+			msgRead := &CommandMultiMessage{}
+			Expect(msgRead.Read(bufio.NewReader(buff))).To(Succeed())
+			Expect(msgRead.CorrelationId()).To(BeNumerically("==", 1))
+			Expect(msgRead.Message).To(Equal("hello"))
+			Expect(msgRead.From).To(Equal("from"))
+			Expect(msgRead.To).To(Equal([]string{"a", "bb"}))
+			Expect(msgRead.Broadcast).To(BeFalse())
+			Expect(msgRead.Time).To(BeNumerically("==", 10))
+		})
+
+		It("can encode a broadcast", func() {
+			msg := NewCommandBroadcastMessage("hello", "from", 10)
+			buff := &bytes.Buffer{}
+			wr := bufio.NewWriter(buff)
+			Expect(msg.Write(wr)).To(BeNumerically("==", msg.SizeNeeded()))
+			Expect(wr.Flush()).To(Succeed())
+
+			msgRead := &CommandMultiMessage{}
+			Expect(msgRead.Read(bufio.NewReader(buff))).To(Succeed())
+			Expect(msgRead.Broadcast).To(BeTrue())
+			Expect(msgRead.To).To(BeEmpty())
+		})
+	})
+
+	Context("MultiMessageResponse", func() {
+		It("can encode and decode itself", func() {
+			resp := NewMultiMessageResponse(ResponseCodeOk, []string{"a"}, []string{"b", "c"}, []string{}, []string{"d"})
+			resp.SetCorrelationId(3)
+			buff := &bytes.Buffer{}
+			wr := bufio.NewWriter(buff)
+			Expect(resp.Write(wr)).To(BeNumerically("==", resp.SizeNeeded()))
+			Expect(wr.Flush()).To(Succeed())
+
+			respRead := &MultiMessageResponse{}
+			Expect(respRead.Read(bufio.NewReader(buff))).To(Succeed())
+			Expect(respRead.CorrelationId()).To(BeNumerically("==", 3))
+			Expect(respRead.ResponseCode()).To(Equal(ResponseCodeOk))
+			Expect(respRead.Delivered).To(Equal([]string{"a"}))
+			Expect(respRead.Queued).To(Equal([]string{"b", "c"}))
+			Expect(respRead.NotFound).To(BeEmpty())
+			Expect(respRead.MailboxFull).To(Equal([]string{"d"}))
+		})
+	})
+
+	Context("UserListResponse", func() {
+		It("can encode and decode itself", func() {
+			resp := NewUserListResponse(ResponseCodeOk, []string{"a"}, []string{"b"},
+				map[string]string{"a": "2024-01-01T10:00:00Z", "b": "2024-01-02T10:00:00Z"})
+			resp.SetCorrelationId(9)
+			Expect(resp.SizeNeeded()).To(Equal(4 + 2 + (4 + 2 + 1) + (4 + 2 + 1) + (4 + 2*(2+1+2+20))))
+
+			buff := &bytes.Buffer{}
+			wr := bufio.NewWriter(buff)
+			Expect(resp.Write(wr)).To(BeNumerically("==", resp.SizeNeeded()))
+			Expect(wr.Flush()).To(Succeed())
+
+			respRead := &UserListResponse{}
+			Expect(respRead.Read(bufio.NewReader(buff))).To(Succeed())
+			Expect(respRead.CorrelationId()).To(BeNumerically("==", 9))
+			Expect(respRead.Online).To(Equal([]string{"a"}))
+			Expect(respRead.Offline).To(Equal([]string{"b"}))
+			Expect(respRead.LastLogin).To(Equal(resp.LastLogin))
+		})
+	})
+
+	Context("Message status", func() {
+		It("CommandMessageStatus can encode and decode itself", func() {
+			status := NewCommandMessageStatus(42, "to", MessageStatusRead, 10)
+			Expect(status.SizeNeeded()).To(Equal(4 + 8 + 2 + 2 + 1 + 8))
+
+			buff := &bytes.Buffer{}
+			wr := bufio.NewWriter(buff)
+			Expect(status.Write(wr)).To(BeNumerically("==", status.SizeNeeded()))
+			Expect(wr.Flush()).To(Succeed())
+
+			statusRead := &CommandMessageStatus{}
+			Expect(statusRead.Read(bufio.NewReader(buff))).To(Succeed())
+			Expect(statusRead.Id).To(BeNumerically("==", 42))
+			Expect(statusRead.To).To(Equal("to"))
+			Expect(statusRead.Status).To(Equal(MessageStatusRead))
+			Expect(statusRead.Time).To(BeNumerically("==", 10))
+		})
+
+		It("CommandMessageRead can encode and decode itself", func() {
+			read := NewCommandMessageRead(42)
+			buff := &bytes.Buffer{}
+			wr := bufio.NewWriter(buff)
+			Expect(read.Write(wr)).To(BeNumerically("==", read.SizeNeeded()))
+			Expect(wr.Flush()).To(Succeed())
+
+			readRead := &CommandMessageRead{}
+			Expect(readRead.Read(bufio.NewReader(buff))).To(Succeed())
+			Expect(readRead.Id).To(BeNumerically("==", 42))
+		})
+
+		It("MessageSentResponse can encode and decode itself", func() {
+			resp := NewMessageSentResponse(ResponseCodeOk, 42)
+			resp.SetCorrelationId(5)
+			buff := &bytes.Buffer{}
+			wr := bufio.NewWriter(buff)
+			Expect(resp.Write(wr)).To(BeNumerically("==", resp.SizeNeeded()))
+			Expect(wr.Flush()).To(Succeed())
+
+			respRead := &MessageSentResponse{}
+			Expect(respRead.Read(bufio.NewReader(buff))).To(Succeed())
+			Expect(respRead.CorrelationId()).To(BeNumerically("==", 5))
+			Expect(respRead.ResponseCode()).To(Equal(ResponseCodeOk))
+			Expect(respRead.Id).To(BeNumerically("==", 42))
+		})
+	})
+
+	Context("Rooms", func() {
+		It("CommandJoinRoom can encode and decode itself", func() {
+			join := NewCommandJoinRoom("room")
+			join.SetCorrelationId(3)
+			Expect(join.SizeNeeded()).To(Equal(4 + 2 + 4))
+
+			buff := &bytes.Buffer{}
+			wr := bufio.NewWriter(buff)
+			Expect(join.Write(wr)).To(BeNumerically("==", join.SizeNeeded()))
+			Expect(wr.Flush()).To(Succeed())
+
+			joinRead := &CommandJoinRoom{}
+			Expect(joinRead.Read(bufio.NewReader(buff))).To(Succeed())
+			Expect(joinRead.CorrelationId()).To(BeNumerically("==", 3))
+			Expect(joinRead.Room).To(Equal("room"))
+		})
+
+		It("CommandRoomMessage can encode and decode itself", func() {
+			msg := NewCommandRoomMessage("room", "hello", "from", 10)
+			Expect(msg.SizeNeeded()).To(Equal(4 + 2 + 4 + 2 + 5 + 2 + 4 + 8))
+
+			buff := &bytes.Buffer{}
+			wr := bufio.NewWriter(buff)
+			Expect(msg.Write(wr)).To(BeNumerically("==", msg.SizeNeeded()))
+			Expect(wr.Flush()).To(Succeed())
+
+			msgRead := &CommandRoomMessage{}
+			Expect(msgRead.Read(bufio.NewReader(buff))).To(Succeed())
+			Expect(msgRead.Room).To(Equal("room"))
+			Expect(msgRead.Message).To(Equal("hello"))
+			Expect(msgRead.From).To(Equal("from"))
+			Expect(msgRead.Time).To(BeNumerically("==", 10))
+		})
+
+		It("RoomMembersResponse can encode and decode itself", func() {
+			resp := NewRoomMembersResponse(ResponseCodeOk, "room", []string{"a", "b"})
+			resp.SetCorrelationId(7)
+			buff := &bytes.Buffer{}
+			wr := bufio.NewWriter(buff)
+			Expect(resp.Write(wr)).To(BeNumerically("==", resp.SizeNeeded()))
+			Expect(wr.Flush()).To(Succeed())
+
+			respRead := &RoomMembersResponse{}
+			Expect(respRead.Read(bufio.NewReader(buff))).To(Succeed())
+			Expect(respRead.CorrelationId()).To(BeNumerically("==", 7))
+			Expect(respRead.ResponseCode()).To(Equal(ResponseCodeOk))
+			Expect(respRead.Room).To(Equal("room"))
+			Expect(respRead.Members).To(Equal([]string{"a", "b"}))
+		})
+	})
+
+	Context("History", func() {
+		It("CommandHistory can encode and decode itself", func() {
+			history := NewCommandHistory("peer", 20, 10, 5)
+			Expect(history.SizeNeeded()).To(Equal(4 + 2 + 4 + 8 + 8 + 2))
+
+			buff := &bytes.Buffer{}
+			wr := bufio.NewWriter(buff)
+			Expect(history.Write(wr)).To(BeNumerically("==", history.SizeNeeded()))
+			Expect(wr.Flush()).To(Succeed())
+
+			historyRead := &CommandHistory{}
+			Expect(historyRead.Read(bufio.NewReader(buff))).To(Succeed())
+			Expect(historyRead.Peer).To(Equal("peer"))
+			Expect(historyRead.BeforeId).To(BeNumerically("==", 20))
+			Expect(historyRead.AfterId).To(BeNumerically("==", 10))
+			Expect(historyRead.Limit).To(BeNumerically("==", 5))
+		})
+
+		It("HistoryResponse can encode and decode itself", func() {
+			first := NewCommandMessage("hello", "a", "b", 10)
+			first.Id = 1
+			second := NewCommandMessage("world", "b", "a", 11)
+			second.Id = 2
+			resp := NewHistoryResponse(ResponseCodeOk, true, []*CommandMessage{first, second})
+			resp.SetCorrelationId(4)
+			Expect(resp.SizeNeeded()).To(Equal(4 + 2 + 1 + 4 + first.SizeNeeded() + second.SizeNeeded()))
+
+			buff := &bytes.Buffer{}
+			wr := bufio.NewWriter(buff)
+			Expect(resp.Write(wr)).To(BeNumerically("==", resp.SizeNeeded()))
+			Expect(wr.Flush()).To(Succeed())
+
+			respRead := &HistoryResponse{}
+			Expect(respRead.Read(bufio.NewReader(buff))).To(Succeed())
+			Expect(respRead.CorrelationId()).To(BeNumerically("==", 4))
+			Expect(respRead.ResponseCode()).To(Equal(ResponseCodeOk))
+			Expect(respRead.More).To(BeTrue())
+			Expect(respRead.Messages).To(Equal([]*CommandMessage{first, second}))
+		})
+	})
+
 	Context("Header + Commands", func() {
 		It("Header + CommandLogin should encode and decode ", func() {
 
-			login := NewCommandLoginWithCorrelation("user", 1)
+			login := NewCommandLoginWithCorrelation("user", "pwd", 1)
 
 			buff := &bytes.Buffer{}
 			writer := bufio.NewWriter(buff)
@@ -170,7 +471,7 @@ var _ = Describe("Protocol", func() {
 
 			err = chatHeaderRead.Read(reader)
 			Expect(err).To(Succeed())
-			Expect(chatHeaderRead.Version()).To(BeNumerically("==", 0x0001))
+			Expect(chatHeaderRead.Version()).To(Equal(CommandLoginVersion))
 			Expect(chatHeaderRead.Key()).To(BeNumerically("==", 0x01))
 
 			err = loginRead.Read(reader)
@@ -179,6 +480,26 @@ var _ = Describe("Protocol", func() {
 			Expect(login.GetCorrelationId()).To(BeNumerically("==", 1))
 		})
 
+		It("Header + CommandLogin version 1 has no password", func() {
+			login := NewCommandLoginWithCorrelation("user1", "pw", 1)
+			login.SetVersion(Version1)
+			frame, err := EncodeFrame(login)
+			Expect(err).To(Succeed())
+			// the frame of the base protocol: length, header, correlationId, username
+			Expect(frame).To(Equal([]byte{0x00, 0x00, 0x00, 0x0E, 0x01, 0x00, 0x01,
+				0x00, 0x00, 0x00, 0x01, 0x00, 0x05, 'u', 's', 'e', 'r', '1'}))
+
+			reader, err := ReadFullBufferFromSource(bufio.NewReader(bytes.NewReader(frame)))
+			Expect(err).To(Succeed())
+			header := &ChatHeader{}
+			Expect(header.Read(reader)).To(Succeed())
+			loginRead := &CommandLogin{}
+			loginRead.SetVersion(header.Version())
+			Expect(loginRead.Read(reader)).To(Succeed())
+			Expect(loginRead.Username()).To(Equal("user1"))
+			Expect(loginRead.Password()).To(BeEmpty())
+		})
+
 		It("Header + CommandMessage should encode and decode ", func() {
 
 			msg := NewCommandMessageWithCorrelationId("hello", "user_from", "user_to", 14, 10)
@@ -199,7 +520,7 @@ var _ = Describe("Protocol", func() {
 
 			err = chatHeaderRead.Read(reader)
 			Expect(err).To(Succeed())
-			Expect(chatHeaderRead.Version()).To(BeNumerically("==", 0x0001))
+			Expect(chatHeaderRead.Version()).To(Equal(CommandMessageVersion))
 			Expect(chatHeaderRead.Key()).To(BeNumerically("==", 0x02))
 			err = msgRead.Read(reader)
 			Expect(err).To(Succeed())
@@ -208,6 +529,167 @@ var _ = Describe("Protocol", func() {
 			Expect(msgRead.To).To(Equal("user_to"))
 			Expect(msgRead.CorrelationId()).To(BeNumerically("==", 14))
 		})
+
+		It("Header + CommandMessage version 1 has no Id and no Room", func() {
+			msg := NewCommandMessageWithCorrelationId("hi", "a", "b", 3, 10)
+			msg.Id = 99
+			msg.Room = "room"
+			msg.SetVersion(Version1)
+			frame, err := EncodeFrame(msg)
+			Expect(err).To(Succeed())
+			// the frame of the base protocol: length, header, correlationId, Message, From, To, Time
+			Expect(frame).To(Equal([]byte{0x00, 0x00, 0x00, 0x19, 0x01, 0x00, 0x02,
+				0x00, 0x00, 0x00, 0x03, 0x00, 0x02, 'h', 'i', 0x00, 0x01, 'a', 0x00, 0x01, 'b',
+				0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0A}))
+
+			reader, err := ReadFullBufferFromSource(bufio.NewReader(bytes.NewReader(frame)))
+			Expect(err).To(Succeed())
+			header := &ChatHeader{}
+			Expect(header.Read(reader)).To(Succeed())
+			msgRead := &CommandMessage{}
+			msgRead.SetVersion(header.Version())
+			Expect(msgRead.Read(reader)).To(Succeed())
+			Expect(msgRead.Message).To(Equal("hi"))
+			Expect(msgRead.Time).To(BeNumerically("==", 10))
+			Expect(msgRead.Id).To(BeZero())
+			Expect(msgRead.Room).To(BeEmpty())
+		})
 	})
 
+	Context("Frames", func() {
+		frame := func(data ...byte) *bytes.Reader {
+			return bytes.NewReader(data)
+		}
+
+		It("reads a whole frame", func() {
+			reader, err := ReadFullBufferFromSource(frame(0x00, 0x00, 0x00, 0x07, 0x01, 0x00, 0x04, 0x00, 0x00, 0x00, 0x09))
+			Expect(err).To(BeNil())
+			header := &ChatHeader{}
+			Expect(header.Read(reader)).To(Succeed())
+			Expect(header.Key()).To(Equal(CommandLogoutKey))
+			Expect(PeekCorrelationId(reader)).To(Equal(uint32(9)))
+			logout := &CommandLogout{}
+			Expect(logout.Read(reader)).To(Succeed())
+			Expect(logout.CorrelationId()).To(Equal(uint32(9)))
+		})
+
+		It("refuses a frame larger than the limit before the allocation", func() {
+			_, err := ReadFullBufferFromSource(frame(0xFF, 0xFF, 0xFF, 0xFF))
+			Expect(err).To(MatchError(ErrFrameTooLarge))
+			_, err = ReadFullBufferFromSourceWithLimit(frame(0x00, 0x00, 0x00, 0x08, 0x01, 0x00, 0x04, 0, 0, 0, 0, 0), 7)
+			Expect(err).To(MatchError(ErrFrameTooLarge))
+		})
+
+		It("refuses a frame without room for the header", func() {
+			_, err := ReadFullBufferFromSource(frame(0x00, 0x00, 0x00, 0x00))
+			Expect(err).To(MatchError(ErrFrameTooShort))
+		})
+
+		It("returns the errors of a truncated frame", func() {
+			_, err := ReadFullBufferFromSource(frame())
+			Expect(err).To(MatchError(io.EOF))
+			_, err = ReadFullBufferFromSource(frame(0x00, 0x00))
+			Expect(err).To(MatchError(io.ErrUnexpectedEOF))
+			_, err = ReadFullBufferFromSource(frame(0x00, 0x00, 0x00, 0x07, 0x01, 0x00))
+			Expect(err).To(MatchError(io.ErrUnexpectedEOF))
+		})
+
+		It("returns the error of a string longer than the data", func() {
+			login := &CommandLogin{}
+			err := login.Read(bufio.NewReader(frame(0x00, 0x00, 0x00, 0x01, 0x00, 0x05, 'u', 's')))
+			Expect(err).To(MatchError(io.ErrUnexpectedEOF))
+		})
+
+		It("doesn't trust the number of entries of a list", func() {
+			users := &UserListResponse{}
+			err := users.Read(bufio.NewReader(frame(0x00, 0x00, 0x00, 0x01, 0x00, 0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0x00, 0x01, 'a')))
+			Expect(err).To(MatchError(io.EOF))
+		})
+	})
+
+	Context("Codec", func() {
+		message := NewCommandMessageWithCorrelationId("hello", "from", "to", 1, 10)
+		message.Id = 42
+		message.Room = "room"
+		commands := []fieldsDeclaration{
+			NewCommandLoginWithCorrelation("user", "password", 1),
+			NewCommandRegister("user", "password"),
+			NewCommandLogout(),
+			message,
+			NewCommandMessageAck(42),
+			NewCommandMessageRead(42),
+			NewCommandMessageStatus(42, "to", MessageStatusRead, 10),
+			NewCommandMultiMessage("hello", "from", []string{"a", "b"}, 10),
+			NewCommandBroadcastMessage("hello", "from", 10),
+			NewCommandListUsers(),
+			NewCommandServerGoingAway("shutdown"),
+			NewCommandPing(),
+			NewCommandPong(7),
+			NewCommandCreateRoom("room"),
+			NewCommandJoinRoom("room"),
+			NewCommandLeaveRoom("room"),
+			NewCommandListRoomMembers("room"),
+			NewCommandRoomMessage("room", "hello", "from", 10),
+			NewCommandHistory("peer", 20, 10, 5),
+			NewChatHeader(Version1, CommandLoginKey),
+			NewGenericResponse(ResponseCodeOk),
+			NewMultiMessageResponse(ResponseCodeOk, []string{"a"}, []string{"b"}, []string{"c"}, []string{"d"}),
+			NewMessageSentResponse(ResponseCodeOk, 42),
+			NewUserListResponse(ResponseCodeOk, []string{"a"}, []string{"b"}, map[string]string{"a": "now", "b": "then"}),
+			NewRoomMembersResponse(ResponseCodeOk, "room", []string{"a", "b"}),
+			NewHistoryResponse(ResponseCodeOk, true, []*CommandMessage{message}),
+			NewCorrelationIdCommand(),
+		}
+
+		It("encodes SizeNeeded bytes and decodes the same command", func() {
+			for _, command := range commands {
+				buff := &bytes.Buffer{}
+				wr := bufio.NewWriter(buff)
+				written, err := writeFields(wr, command)
+				Expect(err).To(BeNil())
+				Expect(wr.Flush()).To(Succeed())
+				Expect(written).To(Equal(sizeOfFields(command)), "%T", command)
+				Expect(buff.Len()).To(Equal(written), "%T", command)
+
+				decoded := reflect.New(reflect.TypeOf(command).Elem()).Interface().(fieldsDeclaration)
+				Expect(readFields(bufio.NewReader(buff), decoded)).To(Succeed())
+				Expect(decoded).To(Equal(command), "%T", command)
+			}
+		})
+
+		It("encodes a byte slice with the length", func() {
+			data := []byte{1, 2, 3}
+			buff := &bytes.Buffer{}
+			Expect(writeMany(buff, data)).To(Equal(2 + 3))
+			Expect(sizeOfField(&data)).To(Equal(2 + 3))
+			var read []byte
+			Expect(readAny(buff, &read)).To(Succeed())
+			Expect(read).To(Equal(data))
+		})
+
+		It("refuses the strings and the byte slices longer than MaxStringLength", func() {
+			buff := &bytes.Buffer{}
+			_, err := writeString(buff, strings.Repeat("a", MaxStringLength+1))
+			Expect(err).To(MatchError(ErrStringTooLong))
+			_, err = writeMany(buff, make([]byte, MaxStringLength+1))
+			Expect(err).To(MatchError(ErrStringTooLong))
+			Expect(buff.Len()).To(BeZero())
+
+			written, err := writeString(buff, strings.Repeat("a", MaxStringLength))
+			Expect(err).To(BeNil())
+			Expect(written).To(Equal(2 + MaxStringLength))
+
+			message := NewCommandMessage(strings.Repeat("a", 70_000), "from", "to", 10)
+			_, err = EncodeFrame(message)
+			Expect(err).To(MatchError(ErrStringTooLong))
+			frameBuff := &bytes.Buffer{}
+			Expect(WriteCommandWithHeader(message, bufio.NewWriter(frameBuff))).To(MatchError(ErrStringTooLong))
+			Expect(frameBuff.Len()).To(BeZero())
+		})
+
+		It("panics for an unsupported field type", func() {
+			Expect(func() { sizeOfField(&struct{ s string }{}) }).To(Panic())
+			Expect(func() { sizeOfField(uint32(1)) }).To(Panic())
+		})
+	})
 })
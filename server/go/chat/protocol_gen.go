@@ -0,0 +1,1204 @@
+// Code generated by protocolgen from protocol/schema.json. DO NOT EDIT.
+
+package chat
+
+import (
+	"bufio"
+	"io"
+)
+
+// command keys, see Header::command
+const (
+	CommandRegisterKey        uint16 = 0x0A
+	CommandLoginKey           uint16 = 0x01
+	CommandMessageKey         uint16 = 0x02
+	MessageSentResponseKey    uint16 = 0x0C
+	CommandMessageAckKey      uint16 = 0x0B
+	CommandMessageReadKey     uint16 = 0x0E
+	CommandMessageStatusKey   uint16 = 0x0D
+	CommandLogoutKey          uint16 = 0x04
+	CommandMultiMessageKey    uint16 = 0x05
+	MultiMessageResponseKey   uint16 = 0x06
+	CommandListUsersKey       uint16 = 0x07
+	UserListResponseKey       uint16 = 0x08
+	CommandServerGoingAwayKey uint16 = 0x17
+	CommandPingKey            uint16 = 0x18
+	CommandPongKey            uint16 = 0x19
+	CommandCorrelationIdTest  uint16 = 0x09
+	CommandCreateRoomKey      uint16 = 0x0F
+	CommandJoinRoomKey        uint16 = 0x10
+	CommandLeaveRoomKey       uint16 = 0x11
+	CommandListRoomMembersKey uint16 = 0x12
+	RoomMembersResponseKey    uint16 = 0x13
+	CommandRoomMessageKey     uint16 = 0x14
+	CommandHistoryKey         uint16 = 0x15
+	HistoryResponseKey        uint16 = 0x16
+	GenericResponseKey        uint16 = 0x03
+)
+
+// response codes
+const (
+	ResponseCodeOk                      uint16 = 0x01
+	ResponseCodeErrorUserNotFound       uint16 = 0x03
+	ResponseCodeErrorUserAlreadyLogged  uint16 = 0x04
+	ResponseCodeErrorUserNotLogged      uint16 = 0x05
+	ResponseCodeErrorUserAlreadyExists  uint16 = 0x06
+	ResponseCodeErrorBadCredentials     uint16 = 0x07
+	ResponseCodeErrorRoomNotFound       uint16 = 0x08
+	ResponseCodeErrorNotRoomMember      uint16 = 0x09
+	ResponseCodeErrorRoomAlreadyExists  uint16 = 0x0A
+	ResponseCodeErrorUnsupportedVersion uint16 = 0x0B
+	ResponseCodeErrorUnknownCommand     uint16 = 0x0C
+	ResponseCodeErrorFrameTooLarge      uint16 = 0x0D
+	ResponseCodeErrorMalformedFrame     uint16 = 0x0E
+	ResponseCodeErrorMailboxFull        uint16 = 0x0F
+)
+
+// message status, see CommandMessageStatus
+const (
+	MessageStatusDelivered byte = 0x01
+	MessageStatusRead      byte = 0x02
+)
+
+// latest versions of the commands with more than one version, see Header::version
+const (
+	CommandLoginVersion   byte = 2
+	CommandMessageVersion byte = 2
+)
+
+// LatestVersion returns the latest version of the command with the key,
+// Version1 for the commands with one version and for the unknown keys.
+func LatestVersion(key uint16) byte {
+	switch key {
+	case CommandLoginKey:
+		return CommandLoginVersion
+	case CommandMessageKey:
+		return CommandMessageVersion
+	}
+	return Version1
+}
+
+// CommandRegister creates a new account on the chat server.
+// The server stores only a salted hash of the password.
+type CommandRegister struct {
+	correlationId uint32
+	username      string
+	password      string
+}
+
+func (c *CommandRegister) Key() uint16 {
+	return CommandRegisterKey
+}
+
+func (c *CommandRegister) Version() byte {
+	return Version1
+}
+
+func (c *CommandRegister) fields() []any {
+	return []any{&c.correlationId, &c.username, &c.password}
+}
+
+func (c *CommandRegister) SizeNeeded() int {
+	return sizeOfFields(c)
+}
+
+func (c *CommandRegister) Write(writer *bufio.Writer) (int, error) {
+	return writeFields(writer, c)
+}
+
+func (c *CommandRegister) Read(reader *bufio.Reader) error {
+	return readFields(reader, c)
+}
+
+func (c *CommandRegister) CorrelationId() uint32 {
+	return c.correlationId
+}
+
+func (c *CommandRegister) SetCorrelationId(id uint32) {
+	c.correlationId = id
+}
+
+// CommandLogin is a command to login into the chat server.
+// The user must be registered with CommandRegister.
+// The version 1 has no password: the server accepts it only with a client certificate.
+type CommandLogin struct {
+	version       byte // 0 for CommandLoginVersion, see SetVersion
+	correlationId uint32
+	username      string
+	password      string
+}
+
+func (c *CommandLogin) Key() uint16 {
+	return CommandLoginKey
+}
+
+// Version is the version of the frame, CommandLoginVersion when it is not set.
+func (c *CommandLogin) Version() byte {
+	if c.version == 0 {
+		return CommandLoginVersion
+	}
+	return c.version
+}
+
+// SetVersion sets the version of the frame to write or to read:
+// the fields added by a later version are not encoded.
+func (c *CommandLogin) SetVersion(version byte) {
+	c.version = version
+}
+
+func (c *CommandLogin) fields() []any {
+	fields := []any{&c.correlationId, &c.username}
+	if c.Version() >= 2 {
+		fields = append(fields, &c.password)
+	}
+	return fields
+}
+
+func (c *CommandLogin) SizeNeeded() int {
+	return sizeOfFields(c)
+}
+
+func (c *CommandLogin) Write(writer *bufio.Writer) (int, error) {
+	return writeFields(writer, c)
+}
+
+func (c *CommandLogin) Read(reader *bufio.Reader) error {
+	return readFields(reader, c)
+}
+
+func (c *CommandLogin) CorrelationId() uint32 {
+	return c.correlationId
+}
+
+func (c *CommandLogin) SetCorrelationId(id uint32) {
+	c.correlationId = id
+}
+
+// CommandMessage sends a message to a user.
+// The server answers with a MessageSentResponse and sends the message to the recipient
+// with the Id assigned. The version 1 has no Id and no Room.
+type CommandMessage struct {
+	version       byte // 0 for CommandMessageVersion, see SetVersion
+	correlationId uint32
+	Message       string
+	From          string
+	To            string
+	Time          uint64
+	Id            uint64 // assigned by the server, 0 when sent by the client
+	Room          string // set by the server for the room messages, empty otherwise
+}
+
+func (c *CommandMessage) Key() uint16 {
+	return CommandMessageKey
+}
+
+// Version is the version of the frame, CommandMessageVersion when it is not set.
+func (c *CommandMessage) Version() byte {
+	if c.version == 0 {
+		return CommandMessageVersion
+	}
+	return c.version
+}
+
+// SetVersion sets the version of the frame to write or to read:
+// the fields added by a later version are not encoded.
+func (c *CommandMessage) SetVersion(version byte) {
+	c.version = version
+}
+
+func (c *CommandMessage) fields() []any {
+	fields := []any{&c.correlationId, &c.Message, &c.From, &c.To, &c.Time}
+	if c.Version() >= 2 {
+		fields = append(fields, &c.Id, &c.Room)
+	}
+	return fields
+}
+
+func (c *CommandMessage) SizeNeeded() int {
+	return sizeOfFields(c)
+}
+
+func (c *CommandMessage) Write(writer *bufio.Writer) (int, error) {
+	return writeFields(writer, c)
+}
+
+func (c *CommandMessage) Read(reader *bufio.Reader) error {
+	return readFields(reader, c)
+}
+
+func (c *CommandMessage) CorrelationId() uint32 {
+	return c.correlationId
+}
+
+func (c *CommandMessage) SetCorrelationId(id uint32) {
+	c.correlationId = id
+}
+
+// MessageSentResponse is the response to CommandMessage.
+// Id is the id assigned by the server to the message, it is used
+// in the CommandMessageStatus notifications.
+type MessageSentResponse struct {
+	correlationId uint32
+	responseCode  uint16 // `ResponseCodes`
+	Id            uint64 // `CommandMessage::Id`, 0 on error
+}
+
+func (c *MessageSentResponse) Key() uint16 {
+	return MessageSentResponseKey
+}
+
+func (c *MessageSentResponse) Version() byte {
+	return Version1
+}
+
+func (c *MessageSentResponse) fields() []any {
+	return []any{&c.correlationId, &c.responseCode, &c.Id}
+}
+
+func (c *MessageSentResponse) SizeNeeded() int {
+	return sizeOfFields(c)
+}
+
+func (c *MessageSentResponse) Write(writer *bufio.Writer) (int, error) {
+	return writeFields(writer, c)
+}
+
+func (c *MessageSentResponse) Read(reader *bufio.Reader) error {
+	return readFields(reader, c)
+}
+
+func (c *MessageSentResponse) CorrelationId() uint32 {
+	return c.correlationId
+}
+
+func (c *MessageSentResponse) SetCorrelationId(id uint32) {
+	c.correlationId = id
+}
+
+func (c *MessageSentResponse) ResponseCode() uint16 {
+	return c.responseCode
+}
+
+// CommandMessageAck is sent by the client when a CommandMessage is received.
+// The server removes the message from the mailbox only when it is acknowledged,
+// the messages not acknowledged are sent again at the next login.
+// The server doesn't send a response.
+type CommandMessageAck struct {
+	correlationId uint32
+	Id            uint64 // `CommandMessage::Id`
+}
+
+func (c *CommandMessageAck) Key() uint16 {
+	return CommandMessageAckKey
+}
+
+func (c *CommandMessageAck) Version() byte {
+	return Version1
+}
+
+func (c *CommandMessageAck) fields() []any {
+	return []any{&c.correlationId, &c.Id}
+}
+
+func (c *CommandMessageAck) SizeNeeded() int {
+	return sizeOfFields(c)
+}
+
+func (c *CommandMessageAck) Write(writer *bufio.Writer) (int, error) {
+	return writeFields(writer, c)
+}
+
+func (c *CommandMessageAck) Read(reader *bufio.Reader) error {
+	return readFields(reader, c)
+}
+
+func (c *CommandMessageAck) CorrelationId() uint32 {
+	return c.correlationId
+}
+
+func (c *CommandMessageAck) SetCorrelationId(id uint32) {
+	c.correlationId = id
+}
+
+// CommandMessageRead is sent by the client when the user reads a message.
+// The server notifies the sender with a CommandMessageStatus.
+// The server doesn't send a response.
+type CommandMessageRead struct {
+	correlationId uint32
+	Id            uint64 // `CommandMessage::Id`
+}
+
+func (c *CommandMessageRead) Key() uint16 {
+	return CommandMessageReadKey
+}
+
+func (c *CommandMessageRead) Version() byte {
+	return Version1
+}
+
+func (c *CommandMessageRead) fields() []any {
+	return []any{&c.correlationId, &c.Id}
+}
+
+func (c *CommandMessageRead) SizeNeeded() int {
+	return sizeOfFields(c)
+}
+
+func (c *CommandMessageRead) Write(writer *bufio.Writer) (int, error) {
+	return writeFields(writer, c)
+}
+
+func (c *CommandMessageRead) Read(reader *bufio.Reader) error {
+	return readFields(reader, c)
+}
+
+func (c *CommandMessageRead) CorrelationId() uint32 {
+	return c.correlationId
+}
+
+func (c *CommandMessageRead) SetCorrelationId(id uint32) {
+	c.correlationId = id
+}
+
+// CommandMessageStatus is sent by the server to the sender of a message
+// when the message is delivered to the recipient's client, and when it is read.
+// To is the recipient of the message, Time is when the status changed.
+type CommandMessageStatus struct {
+	correlationId uint32 // always 0
+	Id            uint64 // `CommandMessage::Id`
+	To            string // the recipient
+	Status        byte   // `MessageStatus`
+	Time          uint64
+}
+
+func (c *CommandMessageStatus) Key() uint16 {
+	return CommandMessageStatusKey
+}
+
+func (c *CommandMessageStatus) Version() byte {
+	return Version1
+}
+
+func (c *CommandMessageStatus) fields() []any {
+	return []any{&c.correlationId, &c.Id, &c.To, &c.Status, &c.Time}
+}
+
+func (c *CommandMessageStatus) SizeNeeded() int {
+	return sizeOfFields(c)
+}
+
+func (c *CommandMessageStatus) Write(writer *bufio.Writer) (int, error) {
+	return writeFields(writer, c)
+}
+
+func (c *CommandMessageStatus) Read(reader *bufio.Reader) error {
+	return readFields(reader, c)
+}
+
+func (c *CommandMessageStatus) CorrelationId() uint32 {
+	return c.correlationId
+}
+
+func (c *CommandMessageStatus) SetCorrelationId(id uint32) {
+	c.correlationId = id
+}
+
+// CommandLogout is a command to logout from the chat server.
+// The user is the one logged in on the connection, so only the correlationId is sent.
+// The connection stays open and can be used for a new login.
+type CommandLogout struct {
+	correlationId uint32
+}
+
+func (c *CommandLogout) Key() uint16 {
+	return CommandLogoutKey
+}
+
+func (c *CommandLogout) Version() byte {
+	return Version1
+}
+
+func (c *CommandLogout) fields() []any {
+	return []any{&c.correlationId}
+}
+
+func (c *CommandLogout) SizeNeeded() int {
+	return sizeOfFields(c)
+}
+
+func (c *CommandLogout) Write(writer *bufio.Writer) (int, error) {
+	return writeFields(writer, c)
+}
+
+func (c *CommandLogout) Read(reader *bufio.Reader) error {
+	return readFields(reader, c)
+}
+
+func (c *CommandLogout) CorrelationId() uint32 {
+	return c.correlationId
+}
+
+func (c *CommandLogout) SetCorrelationId(id uint32) {
+	c.correlationId = id
+}
+
+// CommandMultiMessage sends the same message to a list of users.
+// When Broadcast is true the To list is ignored and the message is sent
+// to all the users known by the server, except the sender.
+type CommandMultiMessage struct {
+	correlationId uint32
+	Message       string
+	From          string
+	To            []string
+	Broadcast     bool
+	Time          uint64
+}
+
+func (c *CommandMultiMessage) Key() uint16 {
+	return CommandMultiMessageKey
+}
+
+func (c *CommandMultiMessage) Version() byte {
+	return Version1
+}
+
+func (c *CommandMultiMessage) fields() []any {
+	return []any{&c.correlationId, &c.Message, &c.From, &c.To, &c.Broadcast, &c.Time}
+}
+
+func (c *CommandMultiMessage) SizeNeeded() int {
+	return sizeOfFields(c)
+}
+
+func (c *CommandMultiMessage) Write(writer *bufio.Writer) (int, error) {
+	return writeFields(writer, c)
+}
+
+func (c *CommandMultiMessage) Read(reader *bufio.Reader) error {
+	return readFields(reader, c)
+}
+
+func (c *CommandMultiMessage) CorrelationId() uint32 {
+	return c.correlationId
+}
+
+func (c *CommandMultiMessage) SetCorrelationId(id uint32) {
+	c.correlationId = id
+}
+
+// MultiMessageResponse is the response to CommandMultiMessage.
+// It reports the delivery status for each recipient:
+// Delivered: the user is online and the message is sent immediately
+// Queued: the user is offline and the message is stored until the next login
+// NotFound: the user does not exist
+// MailboxFull: the mailbox of the user is full and the message is not sent
+type MultiMessageResponse struct {
+	correlationId uint32
+	responseCode  uint16   // `ResponseCodes`
+	Delivered     []string // users online, message sent
+	Queued        []string // users offline, message stored
+	NotFound      []string // users not found
+	MailboxFull   []string // users with a full mailbox, message not sent
+}
+
+func (c *MultiMessageResponse) Key() uint16 {
+	return MultiMessageResponseKey
+}
+
+func (c *MultiMessageResponse) Version() byte {
+	return Version1
+}
+
+func (c *MultiMessageResponse) fields() []any {
+	return []any{&c.correlationId, &c.responseCode, &c.Delivered, &c.Queued, &c.NotFound, &c.MailboxFull}
+}
+
+func (c *MultiMessageResponse) SizeNeeded() int {
+	return sizeOfFields(c)
+}
+
+func (c *MultiMessageResponse) Write(writer *bufio.Writer) (int, error) {
+	return writeFields(writer, c)
+}
+
+func (c *MultiMessageResponse) Read(reader *bufio.Reader) error {
+	return readFields(reader, c)
+}
+
+func (c *MultiMessageResponse) CorrelationId() uint32 {
+	return c.correlationId
+}
+
+func (c *MultiMessageResponse) SetCorrelationId(id uint32) {
+	c.correlationId = id
+}
+
+func (c *MultiMessageResponse) ResponseCode() uint16 {
+	return c.responseCode
+}
+
+// CommandListUsers asks the server the list of the users.
+// The response is a UserListResponse.
+type CommandListUsers struct {
+	correlationId uint32
+}
+
+func (c *CommandListUsers) Key() uint16 {
+	return CommandListUsersKey
+}
+
+func (c *CommandListUsers) Version() byte {
+	return Version1
+}
+
+func (c *CommandListUsers) fields() []any {
+	return []any{&c.correlationId}
+}
+
+func (c *CommandListUsers) SizeNeeded() int {
+	return sizeOfFields(c)
+}
+
+func (c *CommandListUsers) Write(writer *bufio.Writer) (int, error) {
+	return writeFields(writer, c)
+}
+
+func (c *CommandListUsers) Read(reader *bufio.Reader) error {
+	return readFields(reader, c)
+}
+
+func (c *CommandListUsers) CorrelationId() uint32 {
+	return c.correlationId
+}
+
+func (c *CommandListUsers) SetCorrelationId(id uint32) {
+	c.correlationId = id
+}
+
+// UserListResponse is the response to CommandListUsers.
+// Online and Offline contain the usernames.
+// LastLogin maps each username to the last login time, formatted as time.RFC3339.
+type UserListResponse struct {
+	correlationId uint32
+	responseCode  uint16            // `ResponseCodes`
+	Online        []string          // online users
+	Offline       []string          // offline users
+	LastLogin     map[string]string // username => last login (`RFC3339`)
+}
+
+func (c *UserListResponse) Key() uint16 {
+	return UserListResponseKey
+}
+
+func (c *UserListResponse) Version() byte {
+	return Version1
+}
+
+func (c *UserListResponse) fields() []any {
+	return []any{&c.correlationId, &c.responseCode, &c.Online, &c.Offline, &c.LastLogin}
+}
+
+func (c *UserListResponse) SizeNeeded() int {
+	return sizeOfFields(c)
+}
+
+func (c *UserListResponse) Write(writer *bufio.Writer) (int, error) {
+	return writeFields(writer, c)
+}
+
+func (c *UserListResponse) Read(reader *bufio.Reader) error {
+	return readFields(reader, c)
+}
+
+func (c *UserListResponse) CorrelationId() uint32 {
+	return c.correlationId
+}
+
+func (c *UserListResponse) SetCorrelationId(id uint32) {
+	c.correlationId = id
+}
+
+func (c *UserListResponse) ResponseCode() uint16 {
+	return c.responseCode
+}
+
+// CommandServerGoingAway is sent by the server to the connected clients before the shutdown.
+// The server closes the connection after the queued frames are written.
+// The client doesn't send a response.
+type CommandServerGoingAway struct {
+	correlationId uint32 // always 0
+	Reason        string
+}
+
+func (c *CommandServerGoingAway) Key() uint16 {
+	return CommandServerGoingAwayKey
+}
+
+func (c *CommandServerGoingAway) Version() byte {
+	return Version1
+}
+
+func (c *CommandServerGoingAway) fields() []any {
+	return []any{&c.correlationId, &c.Reason}
+}
+
+func (c *CommandServerGoingAway) SizeNeeded() int {
+	return sizeOfFields(c)
+}
+
+func (c *CommandServerGoingAway) Write(writer *bufio.Writer) (int, error) {
+	return writeFields(writer, c)
+}
+
+func (c *CommandServerGoingAway) Read(reader *bufio.Reader) error {
+	return readFields(reader, c)
+}
+
+func (c *CommandServerGoingAway) CorrelationId() uint32 {
+	return c.correlationId
+}
+
+func (c *CommandServerGoingAway) SetCorrelationId(id uint32) {
+	c.correlationId = id
+}
+
+// CommandPing is the heartbeat, sent by the client and by the server
+// when the connection is idle. The other side answers with CommandPong.
+type CommandPing struct {
+	correlationId uint32
+}
+
+func (c *CommandPing) Key() uint16 {
+	return CommandPingKey
+}
+
+func (c *CommandPing) Version() byte {
+	return Version1
+}
+
+func (c *CommandPing) fields() []any {
+	return []any{&c.correlationId}
+}
+
+func (c *CommandPing) SizeNeeded() int {
+	return sizeOfFields(c)
+}
+
+func (c *CommandPing) Write(writer *bufio.Writer) (int, error) {
+	return writeFields(writer, c)
+}
+
+func (c *CommandPing) Read(reader *bufio.Reader) error {
+	return readFields(reader, c)
+}
+
+func (c *CommandPing) CorrelationId() uint32 {
+	return c.correlationId
+}
+
+func (c *CommandPing) SetCorrelationId(id uint32) {
+	c.correlationId = id
+}
+
+// CommandPong is the answer to CommandPing, with the same correlationId.
+type CommandPong struct {
+	correlationId uint32
+}
+
+func (c *CommandPong) Key() uint16 {
+	return CommandPongKey
+}
+
+func (c *CommandPong) Version() byte {
+	return Version1
+}
+
+func (c *CommandPong) fields() []any {
+	return []any{&c.correlationId}
+}
+
+func (c *CommandPong) SizeNeeded() int {
+	return sizeOfFields(c)
+}
+
+func (c *CommandPong) Write(writer *bufio.Writer) (int, error) {
+	return writeFields(writer, c)
+}
+
+func (c *CommandPong) Read(reader *bufio.Reader) error {
+	return readFields(reader, c)
+}
+
+func (c *CommandPong) CorrelationId() uint32 {
+	return c.correlationId
+}
+
+func (c *CommandPong) SetCorrelationId(id uint32) {
+	c.correlationId = id
+}
+
+// CorrelationIdTest is used by the client to test the correlation id:
+// the server answers with a GenericResponse after a random delay.
+type CorrelationIdTest struct {
+	correlationId uint32
+}
+
+func (c *CorrelationIdTest) Key() uint16 {
+	return CommandCorrelationIdTest
+}
+
+func (c *CorrelationIdTest) Version() byte {
+	return Version1
+}
+
+func (c *CorrelationIdTest) fields() []any {
+	return []any{&c.correlationId}
+}
+
+func (c *CorrelationIdTest) SizeNeeded() int {
+	return sizeOfFields(c)
+}
+
+func (c *CorrelationIdTest) Write(writer *bufio.Writer) (int, error) {
+	return writeFields(writer, c)
+}
+
+func (c *CorrelationIdTest) Read(reader *bufio.Reader) error {
+	return readFields(reader, c)
+}
+
+func (c *CorrelationIdTest) CorrelationId() uint32 {
+	return c.correlationId
+}
+
+func (c *CorrelationIdTest) SetCorrelationId(id uint32) {
+	c.correlationId = id
+}
+
+// CommandCreateRoom creates a room. The user who creates the room is the first member.
+// The response is a GenericResponse.
+type CommandCreateRoom struct {
+	correlationId uint32
+	Room          string
+}
+
+func (c *CommandCreateRoom) Key() uint16 {
+	return CommandCreateRoomKey
+}
+
+func (c *CommandCreateRoom) Version() byte {
+	return Version1
+}
+
+func (c *CommandCreateRoom) fields() []any {
+	return []any{&c.correlationId, &c.Room}
+}
+
+func (c *CommandCreateRoom) SizeNeeded() int {
+	return sizeOfFields(c)
+}
+
+func (c *CommandCreateRoom) Write(writer *bufio.Writer) (int, error) {
+	return writeFields(writer, c)
+}
+
+func (c *CommandCreateRoom) Read(reader *bufio.Reader) error {
+	return readFields(reader, c)
+}
+
+func (c *CommandCreateRoom) CorrelationId() uint32 {
+	return c.correlationId
+}
+
+func (c *CommandCreateRoom) SetCorrelationId(id uint32) {
+	c.correlationId = id
+}
+
+// CommandJoinRoom adds the logged user to the members of the room.
+// The response is a GenericResponse.
+type CommandJoinRoom struct {
+	correlationId uint32
+	Room          string
+}
+
+func (c *CommandJoinRoom) Key() uint16 {
+	return CommandJoinRoomKey
+}
+
+func (c *CommandJoinRoom) Version() byte {
+	return Version1
+}
+
+func (c *CommandJoinRoom) fields() []any {
+	return []any{&c.correlationId, &c.Room}
+}
+
+func (c *CommandJoinRoom) SizeNeeded() int {
+	return sizeOfFields(c)
+}
+
+func (c *CommandJoinRoom) Write(writer *bufio.Writer) (int, error) {
+	return writeFields(writer, c)
+}
+
+func (c *CommandJoinRoom) Read(reader *bufio.Reader) error {
+	return readFields(reader, c)
+}
+
+func (c *CommandJoinRoom) CorrelationId() uint32 {
+	return c.correlationId
+}
+
+func (c *CommandJoinRoom) SetCorrelationId(id uint32) {
+	c.correlationId = id
+}
+
+// CommandLeaveRoom removes the logged user from the members of the room.
+// The room is deleted when the last member leaves.
+// The response is a GenericResponse.
+type CommandLeaveRoom struct {
+	correlationId uint32
+	Room          string
+}
+
+func (c *CommandLeaveRoom) Key() uint16 {
+	return CommandLeaveRoomKey
+}
+
+func (c *CommandLeaveRoom) Version() byte {
+	return Version1
+}
+
+func (c *CommandLeaveRoom) fields() []any {
+	return []any{&c.correlationId, &c.Room}
+}
+
+func (c *CommandLeaveRoom) SizeNeeded() int {
+	return sizeOfFields(c)
+}
+
+func (c *CommandLeaveRoom) Write(writer *bufio.Writer) (int, error) {
+	return writeFields(writer, c)
+}
+
+func (c *CommandLeaveRoom) Read(reader *bufio.Reader) error {
+	return readFields(reader, c)
+}
+
+func (c *CommandLeaveRoom) CorrelationId() uint32 {
+	return c.correlationId
+}
+
+func (c *CommandLeaveRoom) SetCorrelationId(id uint32) {
+	c.correlationId = id
+}
+
+// CommandListRoomMembers asks the members of the room.
+// The response is a RoomMembersResponse.
+type CommandListRoomMembers struct {
+	correlationId uint32
+	Room          string
+}
+
+func (c *CommandListRoomMembers) Key() uint16 {
+	return CommandListRoomMembersKey
+}
+
+func (c *CommandListRoomMembers) Version() byte {
+	return Version1
+}
+
+func (c *CommandListRoomMembers) fields() []any {
+	return []any{&c.correlationId, &c.Room}
+}
+
+func (c *CommandListRoomMembers) SizeNeeded() int {
+	return sizeOfFields(c)
+}
+
+func (c *CommandListRoomMembers) Write(writer *bufio.Writer) (int, error) {
+	return writeFields(writer, c)
+}
+
+func (c *CommandListRoomMembers) Read(reader *bufio.Reader) error {
+	return readFields(reader, c)
+}
+
+func (c *CommandListRoomMembers) CorrelationId() uint32 {
+	return c.correlationId
+}
+
+func (c *CommandListRoomMembers) SetCorrelationId(id uint32) {
+	c.correlationId = id
+}
+
+// RoomMembersResponse is the response to CommandListRoomMembers.
+// Members contains the usernames sorted by name.
+type RoomMembersResponse struct {
+	correlationId uint32
+	responseCode  uint16 // `ResponseCodes`
+	Room          string
+	Members       []string // sorted by name
+}
+
+func (c *RoomMembersResponse) Key() uint16 {
+	return RoomMembersResponseKey
+}
+
+func (c *RoomMembersResponse) Version() byte {
+	return Version1
+}
+
+func (c *RoomMembersResponse) fields() []any {
+	return []any{&c.correlationId, &c.responseCode, &c.Room, &c.Members}
+}
+
+func (c *RoomMembersResponse) SizeNeeded() int {
+	return sizeOfFields(c)
+}
+
+func (c *RoomMembersResponse) Write(writer *bufio.Writer) (int, error) {
+	return writeFields(writer, c)
+}
+
+func (c *RoomMembersResponse) Read(reader *bufio.Reader) error {
+	return readFields(reader, c)
+}
+
+func (c *RoomMembersResponse) CorrelationId() uint32 {
+	return c.correlationId
+}
+
+func (c *RoomMembersResponse) SetCorrelationId(id uint32) {
+	c.correlationId = id
+}
+
+func (c *RoomMembersResponse) ResponseCode() uint16 {
+	return c.responseCode
+}
+
+// CommandRoomMessage sends the message to all the members of the room, except the sender.
+// The sender must be a member of the room. The members receive a CommandMessage
+// with the Room field set. The response is a MultiMessageResponse.
+type CommandRoomMessage struct {
+	correlationId uint32
+	Room          string
+	Message       string
+	From          string
+	Time          uint64
+}
+
+func (c *CommandRoomMessage) Key() uint16 {
+	return CommandRoomMessageKey
+}
+
+func (c *CommandRoomMessage) Version() byte {
+	return Version1
+}
+
+func (c *CommandRoomMessage) fields() []any {
+	return []any{&c.correlationId, &c.Room, &c.Message, &c.From, &c.Time}
+}
+
+func (c *CommandRoomMessage) SizeNeeded() int {
+	return sizeOfFields(c)
+}
+
+func (c *CommandRoomMessage) Write(writer *bufio.Writer) (int, error) {
+	return writeFields(writer, c)
+}
+
+func (c *CommandRoomMessage) Read(reader *bufio.Reader) error {
+	return readFields(reader, c)
+}
+
+func (c *CommandRoomMessage) CorrelationId() uint32 {
+	return c.correlationId
+}
+
+func (c *CommandRoomMessage) SetCorrelationId(id uint32) {
+	c.correlationId = id
+}
+
+// CommandHistory asks a page of the conversation between the logged user and Peer.
+// BeforeId and AfterId are cursors, 0 when not set: the CommandMessage.Id of a message
+// of a previous page. The ids are opaque, assigned by the server in the order it routes
+// the messages, and are not related to CommandMessage.Time.
+// With AfterId the page contains the oldest messages after AfterId,
+// otherwise the newest messages before BeforeId.
+// Limit is the max number of messages, 0 for the server default.
+// The response is a HistoryResponse.
+type CommandHistory struct {
+	correlationId uint32
+	Peer          string
+	BeforeId      uint64 // `CommandMessage::Id` cursor, 0 not set
+	AfterId       uint64 // `CommandMessage::Id` cursor, 0 not set
+	Limit         uint16 // 0 for the default (50), max 500
+}
+
+func (c *CommandHistory) Key() uint16 {
+	return CommandHistoryKey
+}
+
+func (c *CommandHistory) Version() byte {
+	return Version1
+}
+
+func (c *CommandHistory) fields() []any {
+	return []any{&c.correlationId, &c.Peer, &c.BeforeId, &c.AfterId, &c.Limit}
+}
+
+func (c *CommandHistory) SizeNeeded() int {
+	return sizeOfFields(c)
+}
+
+func (c *CommandHistory) Write(writer *bufio.Writer) (int, error) {
+	return writeFields(writer, c)
+}
+
+func (c *CommandHistory) Read(reader *bufio.Reader) error {
+	return readFields(reader, c)
+}
+
+func (c *CommandHistory) CorrelationId() uint32 {
+	return c.correlationId
+}
+
+func (c *CommandHistory) SetCorrelationId(id uint32) {
+	c.correlationId = id
+}
+
+// HistoryResponse is the response to CommandHistory.
+// Messages are sorted by id, each message is encoded as a CommandMessage
+// of the latest version with the correlationId set to 0.
+// More is true when there are other messages beyond the page.
+// The page is shorter than the limit when the messages don't fit in the max frame size,
+// but it has at least one message when More is true.
+type HistoryResponse struct {
+	correlationId uint32
+	responseCode  uint16 // `ResponseCodes`
+	More          bool   // other messages beyond the page
+	Messages      []*CommandMessage
+}
+
+func (c *HistoryResponse) Key() uint16 {
+	return HistoryResponseKey
+}
+
+func (c *HistoryResponse) Version() byte {
+	return Version1
+}
+
+func (c *HistoryResponse) fields() []any {
+	return []any{&c.correlationId, &c.responseCode, &c.More, (*commandMessageList)(&c.Messages)}
+}
+
+func (c *HistoryResponse) SizeNeeded() int {
+	return sizeOfFields(c)
+}
+
+func (c *HistoryResponse) Write(writer *bufio.Writer) (int, error) {
+	return writeFields(writer, c)
+}
+
+func (c *HistoryResponse) Read(reader *bufio.Reader) error {
+	return readFields(reader, c)
+}
+
+func (c *HistoryResponse) CorrelationId() uint32 {
+	return c.correlationId
+}
+
+func (c *HistoryResponse) SetCorrelationId(id uint32) {
+	c.correlationId = id
+}
+
+func (c *HistoryResponse) ResponseCode() uint16 {
+	return c.responseCode
+}
+
+// GenericResponse is the response of the commands without a specific response.
+type GenericResponse struct {
+	correlationId uint32
+	responseCode  uint16 // `ResponseCodes`
+}
+
+func (c *GenericResponse) Key() uint16 {
+	return GenericResponseKey
+}
+
+func (c *GenericResponse) Version() byte {
+	return Version1
+}
+
+func (c *GenericResponse) fields() []any {
+	return []any{&c.correlationId, &c.responseCode}
+}
+
+func (c *GenericResponse) SizeNeeded() int {
+	return sizeOfFields(c)
+}
+
+func (c *GenericResponse) Write(writer *bufio.Writer) (int, error) {
+	return writeFields(writer, c)
+}
+
+func (c *GenericResponse) Read(reader *bufio.Reader) error {
+	return readFields(reader, c)
+}
+
+func (c *GenericResponse) CorrelationId() uint32 {
+	return c.correlationId
+}
+
+func (c *GenericResponse) SetCorrelationId(id uint32) {
+	c.correlationId = id
+}
+
+func (c *GenericResponse) ResponseCode() uint16 {
+	return c.responseCode
+}
+
+// commandMessageList encodes a list of CommandMessage:
+// the number of entries (uint32) and then each entry.
+type commandMessageList []*CommandMessage
+
+func (l *commandMessageList) sizeNeeded() int {
+	size := chatProtocolUint32
+	for _, entry := range *l {
+		size += sizeOfFields(entry)
+	}
+	return size
+}
+
+func (l *commandMessageList) write(writer io.Writer) (int, error) {
+	written, err := writeMany(writer, len(*l))
+	if err != nil {
+		return written, err
+	}
+	for _, entry := range *l {
+		n, err := writeFields(writer, entry)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func (l *commandMessageList) read(reader io.Reader) error {
+	var count int
+	if err := readAny(reader, &count); err != nil {
+		return err
+	}
+	entries := make([]*CommandMessage, 0)
+	for i := 0; i < count; i++ {
+		entry := &CommandMessage{}
+		if err := readFields(reader, entry); err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+	}
+	*l = entries
+	return nil
+}
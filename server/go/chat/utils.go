@@ -3,31 +3,108 @@ package chat
 import (
 	"bufio"
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 	"time"
 )
 
+var (
+	// ErrFrameTooLarge is returned when the length of the frame is over the max frame size
+	ErrFrameTooLarge = errors.New("frame too large")
+	// ErrFrameTooShort is returned when the frame can't contain the header
+	ErrFrameTooShort = errors.New("frame too short")
+	// ErrStringTooLong is returned when a string or a []byte field is longer than MaxStringLength
+	ErrStringTooLong = errors.New("string too long")
+)
+
+// FormResponseCodeToString returns the name of the response code, Unknown(0x..) when the code is not defined.
 func FormResponseCodeToString(responseCode uint16) string {
 
-	fromCodeToString := "Success"
+	fromCodeToString := fmt.Sprintf("Unknown(0x%02X)", responseCode)
 	switch responseCode {
+	case ResponseCodeOk:
+		fromCodeToString = "Success"
 	case ResponseCodeErrorUserAlreadyLogged:
 		fromCodeToString = "ErrorUserAlreadyLogged"
 	case ResponseCodeErrorUserNotFound:
 		fromCodeToString = "ErrorUserNotFound"
+	case ResponseCodeErrorUserNotLogged:
+		fromCodeToString = "ErrorUserNotLogged"
+	case ResponseCodeErrorUserAlreadyExists:
+		fromCodeToString = "ErrorUserAlreadyExists"
+	case ResponseCodeErrorBadCredentials:
+		fromCodeToString = "ErrorBadCredentials"
+	case ResponseCodeErrorRoomNotFound:
+		fromCodeToString = "ErrorRoomNotFound"
+	case ResponseCodeErrorNotRoomMember:
+		fromCodeToString = "ErrorNotRoomMember"
+	case ResponseCodeErrorRoomAlreadyExists:
+		fromCodeToString = "ErrorRoomAlreadyExists"
+	case ResponseCodeErrorUnsupportedVersion:
+		fromCodeToString = "ErrorUnsupportedVersion"
+	case ResponseCodeErrorUnknownCommand:
+		fromCodeToString = "ErrorUnknownCommand"
+	case ResponseCodeErrorFrameTooLarge:
+		fromCodeToString = "ErrorFrameTooLarge"
+	case ResponseCodeErrorMalformedFrame:
+		fromCodeToString = "ErrorMalformedFrame"
+	case ResponseCodeErrorMailboxFull:
+		fromCodeToString = "ErrorMailboxFull"
 	}
 	return fromCodeToString
 }
 
-// TODO: Explain the REST problem and how this function solves it
+func FormMessageStatusToString(status byte) string {
+	switch status {
+	case MessageStatusDelivered:
+		return "Delivered"
+	case MessageStatusRead:
+		return "Read"
+	}
+	return "Unknown"
+}
+
+// PeekCorrelationId returns the correlationId of the command without consuming it:
+// all the commands start with the correlationId, so it can be read also when
+// the command can't be decoded, for example with an unknown key or version.
+func PeekCorrelationId(reader *bufio.Reader) (uint32, error) {
+	data, err := reader.Peek(chatProtocolCorrelationIdSizeBytes)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(data), nil
+}
 
+// ReadFullBufferFromSource reads a whole frame with the DefaultMaxFrameSize.
+// See ReadFullBufferFromSourceWithLimit.
 func ReadFullBufferFromSource(sourceStream io.Reader) (*bufio.Reader, error) {
-	dataLength, _ := readUInt(sourceStream)
+	return ReadFullBufferFromSourceWithLimit(sourceStream, DefaultMaxFrameSize)
+}
+
+// ReadFullBufferFromSourceWithLimit reads the length and then exactly length bytes,
+// so a command is never decoded from a partial read and the rest of the stream
+// stays aligned to the next frame. The frame is returned as a reader.
+// The length is checked before the allocation: a frame larger than maxFrameSize
+// returns ErrFrameTooLarge, a frame without room for the header ErrFrameTooShort.
+func ReadFullBufferFromSourceWithLimit(sourceStream io.Reader, maxFrameSize uint32) (*bufio.Reader, error) {
+	dataLength, err := readUInt(sourceStream)
+	if err != nil {
+		return nil, err
+	}
+	if dataLength > maxFrameSize {
+		return nil, fmt.Errorf("%w: %d bytes, max %d", ErrFrameTooLarge, dataLength, maxFrameSize)
+	}
+	if dataLength < chatProtocolHeaderSizeBytes {
+		return nil, fmt.Errorf("%w: %d bytes", ErrFrameTooShort, dataLength)
+	}
 	var bytesBuffer = make([]byte, int(dataLength))
-	_, err := io.ReadFull(sourceStream, bytesBuffer)
-	bufferReader := bytes.NewReader(bytesBuffer)
-	dataReader := bufio.NewReader(bufferReader)
-	return dataReader, err
+	_, err = io.ReadFull(sourceStream, bytesBuffer)
+	if err != nil {
+		return nil, err
+	}
+	return bufio.NewReader(bytes.NewReader(bytesBuffer)), nil
 }
 
 func ConvertTimeToUint64(t time.Time) uint64 {
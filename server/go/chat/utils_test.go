@@ -0,0 +1,36 @@
+package chat
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"gsantomaggio/chat/server/protocolgen"
+	"strconv"
+)
+
+var _ = Describe("Utils", func() {
+	It("names every response code of the schema with a distinct string", func() {
+		schema, err := protocolgen.LoadSchema("../../../protocol/schema.json")
+		Expect(err).To(BeNil())
+		var codes []*protocolgen.EnumValue
+		for _, enum := range schema.Enums {
+			if enum.Name == "ResponseCodes" {
+				codes = enum.Values
+			}
+		}
+		Expect(codes).NotTo(BeEmpty())
+
+		names := make(map[string]string)
+		for _, code := range codes {
+			value, err := strconv.ParseUint(code.Value, 0, 16)
+			Expect(err).To(BeNil())
+			name := FormResponseCodeToString(uint16(value))
+			Expect(name).NotTo(HavePrefix("Unknown"), code.Const)
+			Expect(names).NotTo(HaveKey(name), code.Const)
+			names[name] = code.Const
+			if code.Const != "ResponseCodeOk" {
+				Expect(name).To(Equal(code.Name))
+			}
+		}
+		Expect(FormResponseCodeToString(0xFFFF)).To(Equal("Unknown(0xFFFF)"))
+	})
+})
@@ -2,9 +2,14 @@ package chat
 
 import (
 	"encoding/binary"
+	"fmt"
 	"io"
 )
 
+// maxPreallocatedEntries limits the memory allocated from the number of entries
+// read from the wire, before the entries are read.
+const maxPreallocatedEntries = 1024
+
 func readUShort(readerStream io.Reader) (uint16, error) {
 	var res uint16
 	err := binary.Read(readerStream, binary.BigEndian, &res)
@@ -23,12 +28,17 @@ func readInt64(readerStream io.Reader) (int64, error) {
 	return res, err
 }
 
-func readString(readerStream io.Reader) string {
-	// FIXME: handle the potential error from readUShort
-	lenString, _ := readUShort(readerStream)
+func readString(readerStream io.Reader) (string, error) {
+	lenString, err := readUShort(readerStream)
+	if err != nil {
+		return "", err
+	}
 	buff := make([]byte, lenString)
-	_ = binary.Read(readerStream, binary.BigEndian, &buff)
-	return string(buff)
+	_, err = io.ReadFull(readerStream, buff)
+	if err != nil {
+		return "", err
+	}
+	return string(buff), nil
 }
 
 func readByteSlice(readerStream io.Reader) (data []byte, err error) {
@@ -72,16 +82,25 @@ func readAny(readerStream io.Reader, arg any) error {
 		}
 		*arg = int(uInt)
 	case *string:
-		*arg = readString(readerStream)
+		v, err := readString(readerStream)
+		if err != nil {
+			return err
+		}
+		*arg = v
 	case *[]string:
 		sliceLen, err := readUInt(readerStream)
 		if err != nil {
 			return err
 		}
-		mySlice := make([]string, sliceLen)
+		// the number of entries is not trusted for the allocation, the read fails
+		// at the end of the frame
+		mySlice := make([]string, 0, min(sliceLen, maxPreallocatedEntries))
 		for i := uint32(0); i < sliceLen; i++ {
-			v := readString(readerStream)
-			mySlice[i] = v
+			v, err := readString(readerStream)
+			if err != nil {
+				return err
+			}
+			mySlice = append(mySlice, v)
 		}
 		*arg = mySlice
 	case *[]byte:
@@ -95,10 +114,16 @@ func readAny(readerStream io.Reader, arg any) error {
 		if err != nil {
 			return err
 		}
-		myMap := make(map[string]string, mapLen)
+		myMap := make(map[string]string, min(mapLen, maxPreallocatedEntries))
 		for i := uint32(0); i < mapLen; i++ {
-			k := readString(readerStream)
-			v := readString(readerStream)
+			k, err := readString(readerStream)
+			if err != nil {
+				return err
+			}
+			v, err := readString(readerStream)
+			if err != nil {
+				return err
+			}
 			myMap[k] = v
 		}
 		*arg = myMap
@@ -145,6 +170,20 @@ func writeMany(writer io.Writer, args ...any) (int, error) {
 					return n, err
 				}
 			}
+		case []byte:
+			if len(arg) > MaxStringLength {
+				return written, fmt.Errorf("%w: %d bytes, max %d", ErrStringTooLong, len(arg), MaxStringLength)
+			}
+			n, err := writeMany(writer, uint16(len(arg)))
+			if err != nil {
+				return n, err
+			}
+			written += n
+			n, err = writer.Write(arg)
+			written += n
+			if err != nil {
+				return written, err
+			}
 		case map[string]string:
 			n, err := writeMany(writer, len(arg))
 			if err != nil {
@@ -175,7 +214,32 @@ func writeMany(writer io.Writer, args ...any) (int, error) {
 	return written, nil
 }
 
+// sizeOfStringSlice returns the bytes needed to encode a []string:
+// 4 bytes for the number of entries + 2 bytes for the length of each entry + the entries
+func sizeOfStringSlice(values []string) int {
+	size := chatProtocolUint32
+	for _, v := range values {
+		size += chatProtocolStringLenSizeBytes + len(v)
+	}
+	return size
+}
+
+// sizeOfStringMap returns the bytes needed to encode a map[string]string:
+// 4 bytes for the number of entries + key and value encoded as string
+func sizeOfStringMap(values map[string]string) int {
+	size := chatProtocolUint32
+	for k, v := range values {
+		size += chatProtocolStringLenSizeBytes + len(k) + chatProtocolStringLenSizeBytes + len(v)
+	}
+	return size
+}
+
+// writeString writes the length of the string in 2 bytes and the string.
+// It returns ErrStringTooLong, without writing, when the length doesn't fit.
 func writeString(writer io.Writer, value string) (nn int, err error) {
+	if len(value) > MaxStringLength {
+		return 0, fmt.Errorf("%w: %d bytes, max %d", ErrStringTooLong, len(value), MaxStringLength)
+	}
 	shortLen, err := writeMany(writer, uint16(len(value)))
 	if err != nil {
 		return 0, err
@@ -2,8 +2,8 @@ package chat
 
 import (
 	"bufio"
+	"bytes"
 	"gsantomaggio/chat/server/internal"
-	"sync"
 )
 
 // WriteCommand sends the Commands to the server.
@@ -12,11 +12,8 @@ import (
 // 2. Flush
 // The flush is required to make sure that the commands are sent to the server.
 // WriteCommand doesn't care about the response.
-var mutex = &sync.Mutex{} // it is needed because the bufio.Writer is not thread safe
+// The writer must not be shared between goroutines, see ConnectionWriter.
 func WriteCommand[T internal.CommandWrite](request T, writer *bufio.Writer) error {
-	mutex.Lock()
-	defer mutex.Unlock()
-
 	bWritten, err := request.Write(writer)
 	if err != nil {
 		return err
@@ -27,13 +24,42 @@ func WriteCommand[T internal.CommandWrite](request T, writer *bufio.Writer) erro
 	return writer.Flush()
 }
 
+// WriteCommandWithHeader writes the frame: the length, the header and the command.
+// The frame is encoded before the write, so nothing is written when the command
+// can't be encoded.
+// The writer must not be shared between goroutines, see ConnectionWriter.
 func WriteCommandWithHeader[T internal.CommandWrite](request T, writer *bufio.Writer) error {
-	mutex.Lock()
-	defer mutex.Unlock()
+	frame, err := EncodeFrame(request)
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(frame); err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+// EncodeFrame returns the frame of the command, as written by WriteCommandWithHeader.
+func EncodeFrame(request internal.CommandWrite) ([]byte, error) {
+	buffer := &bytes.Buffer{}
+	writer := bufio.NewWriter(buffer)
+	if err := writeFrame(request, writer); err != nil {
+		return nil, err
+	}
+	if err := writer.Flush(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func writeFrame(request internal.CommandWrite, writer *bufio.Writer) error {
 	hr := NewChatHeaderFromCommand(request)
 	// as first write how long is the whole message
 	// so header + command
-	writtenLength, _ := writeMany(writer, request.SizeNeeded()+hr.SizeNeeded())
+	writtenLength, err := writeMany(writer, request.SizeNeeded()+hr.SizeNeeded())
+	if err != nil {
+		return err
+	}
 
 	hWritten, err := hr.Write(writer)
 	if err != nil {
@@ -49,5 +75,5 @@ func WriteCommandWithHeader[T internal.CommandWrite](request T, writer *bufio.Wr
 	if (bWritten + hWritten + writtenLength) != (request.SizeNeeded() + hr.SizeNeeded() + 4) {
 		panic("WriteTo Command: Not all bytes written")
 	}
-	return writer.Flush()
+	return nil
 }
@@ -0,0 +1,327 @@
+// Package config loads the configuration of the server from a YAML file,
+// the environment variables and the flags. Each setting has a flag, like
+// -tls-cert, and an environment variable with the CHAT_ prefix, like CHAT_TLS_CERT:
+// the environment variables override the file and the flags override both.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"gsantomaggio/chat/server/chat"
+	"gsantomaggio/chat/server/tcp_server"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+// EnvPrefix is the prefix of the environment variables, CHAT_TLS_CERT for -tls-cert
+const EnvPrefix = "CHAT_"
+
+// The storage backends
+const (
+	StorageMemory = "memory"
+	StorageFile   = "file"
+)
+
+// The formats of the events, see Log
+const (
+	LogColor = "color"
+	LogText  = "text"
+	LogJSON  = "json"
+)
+
+// Config is the configuration of run/server. The YAML keys are the names in
+// the tags, for example:
+//
+//	address: localhost:5555
+//	tls:
+//	  cert: server.crt
+//	  key: server.key
+//	limits:
+//	  max_connections: 1000
+//	heartbeat:
+//	  interval: 10s
+type Config struct {
+	Address   string    `yaml:"address"`
+	TLS       TLS       `yaml:"tls"`
+	Limits    Limits    `yaml:"limits"`
+	Storage   Storage   `yaml:"storage"`
+	Heartbeat Heartbeat `yaml:"heartbeat"`
+	Log       Log       `yaml:"log"`
+	Metrics   Metrics   `yaml:"metrics"`
+	Admin     Admin     `yaml:"admin"`
+	// ShutdownTimeout is the max time to wait for the clients at the shutdown
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// Interactive stops the server also on enter, otherwise it runs until SIGINT or SIGTERM
+	Interactive bool `yaml:"interactive"`
+}
+
+// TLS enables TLS when Cert and Key are set, ClientCA enables mutual TLS
+type TLS struct {
+	Cert     string `yaml:"cert"`
+	Key      string `yaml:"key"`
+	ClientCA string `yaml:"client_ca"`
+}
+
+// Limits are the limits of the server, 0 for no limit but MaxFrameSize.
+// See tcp_server.ServerOptions.
+type Limits struct {
+	MaxFrameSize   uint `yaml:"max_frame_size"`
+	MaxMailboxSize int  `yaml:"max_mailbox_size"`
+	MaxConnections int  `yaml:"max_connections"`
+	WriteQueueSize int  `yaml:"write_queue_size"`
+}
+
+// Storage is the persistence backend: memory, or file with the Path.
+// An empty Backend is file when the Path is set, memory otherwise.
+type Storage struct {
+	Backend string `yaml:"backend"`
+	Path    string `yaml:"path"`
+}
+
+// Heartbeat detects the dead connections, an Interval of 0 disables it
+type Heartbeat struct {
+	Interval  time.Duration `yaml:"interval"`
+	MaxMissed int           `yaml:"max_missed"`
+}
+
+// Log is the output of the events: color, text or json, from the Level
+// (debug, info, warn or error). EventsBuffer is the number of events queued,
+// the events are dropped when the queue is full.
+type Log struct {
+	Format       string `yaml:"format"`
+	Level        string `yaml:"level"`
+	EventsBuffer int    `yaml:"events_buffer"`
+}
+
+// Metrics exposes /metrics at the Address, disabled when empty
+type Metrics struct {
+	Address string `yaml:"address"`
+}
+
+// Admin starts the admin API at the Address, disabled when empty
+type Admin struct {
+	Address string `yaml:"address"`
+	Token   string `yaml:"token"`
+}
+
+// Default returns the configuration used when nothing is set. The address is empty.
+func Default() *Config {
+	return &Config{
+		Limits: Limits{
+			MaxFrameSize:   uint(chat.DefaultMaxFrameSize),
+			WriteQueueSize: chat.DefaultWriteQueueSize,
+		},
+		Heartbeat: Heartbeat{
+			Interval:  chat.DefaultHeartbeatInterval,
+			MaxMissed: chat.DefaultHeartbeatMaxMissed,
+		},
+		Log: Log{
+			Format:       LogColor,
+			Level:        "info",
+			EventsBuffer: 1024,
+		},
+		ShutdownTimeout: 10 * time.Second,
+		Interactive:     true,
+	}
+}
+
+// newFlagSet binds the flags to the configuration, -config to path.
+func newFlagSet(c *Config, path *string, output io.Writer) *flag.FlagSet {
+	flags := flag.NewFlagSet("server", flag.ContinueOnError)
+	flags.SetOutput(output)
+	flags.StringVar(path, "config", "", "YAML configuration file")
+	flags.StringVar(&c.Address, "address", c.Address, "address of the server, like localhost:5555, it can be the argument")
+	flags.StringVar(&c.TLS.Cert, "tls-cert", c.TLS.Cert, "server certificate file (PEM), enables TLS")
+	flags.StringVar(&c.TLS.Key, "tls-key", c.TLS.Key, "server key file (PEM)")
+	flags.StringVar(&c.TLS.ClientCA, "tls-client-ca", c.TLS.ClientCA, "CA file (PEM) to verify the client certificates (mutual TLS)")
+	flags.UintVar(&c.Limits.MaxFrameSize, "max-frame-size", c.Limits.MaxFrameSize, "max length in bytes of a frame, the connections sending a larger frame are closed")
+	flags.IntVar(&c.Limits.MaxMailboxSize, "max-mailbox-size", c.Limits.MaxMailboxSize, "max messages waiting for the ack of a user, 0 for no limit")
+	flags.IntVar(&c.Limits.MaxConnections, "max-connections", c.Limits.MaxConnections, "max open connections, 0 for no limit")
+	flags.IntVar(&c.Limits.WriteQueueSize, "write-queue-size", c.Limits.WriteQueueSize, "frames queued on each connection")
+	flags.StringVar(&c.Storage.Backend, "storage-backend", c.Storage.Backend, "memory or file, file when -storage is set")
+	flags.StringVar(&c.Storage.Path, "storage", c.Storage.Path, "file used to persist users and offline messages")
+	flags.DurationVar(&c.Heartbeat.Interval, "heartbeat-interval", c.Heartbeat.Interval, "the server pings the idle connections after this time, 0 disables the heartbeat")
+	flags.IntVar(&c.Heartbeat.MaxMissed, "heartbeat-missed", c.Heartbeat.MaxMissed, "pings without an answer before the connection is closed and the user set offline")
+	flags.StringVar(&c.Log.Format, "log-format", c.Log.Format, "format of the events: color, text or json")
+	flags.StringVar(&c.Log.Level, "log-level", c.Log.Level, "min level of the events: debug, info, warn or error")
+	flags.IntVar(&c.Log.EventsBuffer, "events-buffer", c.Log.EventsBuffer, "events queued for the output, the events are dropped when the queue is full")
+	flags.StringVar(&c.Metrics.Address, "metrics-address", c.Metrics.Address, "address of the HTTP server exposing /metrics in the Prometheus format, disabled when empty")
+	flags.StringVar(&c.Admin.Address, "admin-address", c.Admin.Address, "address of the HTTP admin API, disabled when empty")
+	flags.StringVar(&c.Admin.Token, "admin-token", c.Admin.Token, "token of the admin API, sent as \"Authorization: Bearer <token>\"")
+	flags.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "max time to wait for the clients at the shutdown")
+	flags.BoolVar(&c.Interactive, "interactive", c.Interactive, "stop also on enter, false runs until SIGINT or SIGTERM")
+	flags.Usage = func() {
+		fmt.Fprintf(output, "usage: server [flags] [address]\n\n")
+		fmt.Fprintf(output, "Each flag can be set with an environment variable: %sTLS_CERT for -tls-cert.\n", EnvPrefix)
+		fmt.Fprintf(output, "The flags override the environment variables, that override the -config file.\n\n")
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// EnvName returns the environment variable of the flag, CHAT_TLS_CERT for tls-cert.
+func EnvName(flagName string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// Load returns the configuration of the arguments, without the program name.
+// The defaults are overridden by the file of -config (or CHAT_CONFIG), then by the
+// environment variables read with getenv, then by the flags. The only argument
+// allowed is the address. It returns flag.ErrHelp when the arguments have -h.
+func Load(args []string, getenv func(string) string, output io.Writer) (*Config, error) {
+	var path string
+	parsed := newFlagSet(Default(), &path, output)
+	if err := parsed.Parse(args); err != nil {
+		return nil, err
+	}
+	if parsed.NArg() > 1 {
+		return nil, fmt.Errorf("unexpected arguments %v, only the address is allowed", parsed.Args()[1:])
+	}
+	if path == "" {
+		path = getenv(EnvName("config"))
+	}
+
+	c := Default()
+	if path != "" {
+		if err := c.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	var ignored string
+	flags := newFlagSet(c, &ignored, output)
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		if value := getenv(EnvName(f.Name)); value != "" && f.Name != "config" && err == nil {
+			if setErr := flags.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("invalid %s: %w", EnvName(f.Name), setErr)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	parsed.Visit(func(f *flag.Flag) {
+		// the values of the parsed flags are valid
+		_ = flags.Set(f.Name, f.Value.String())
+	})
+	if parsed.NArg() == 1 {
+		c.Address = parsed.Arg(0)
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// loadFile reads the YAML file over the configuration, the unknown keys are an error.
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading the configuration: %w", err)
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("error reading the configuration %s: %w", path, err)
+	}
+	return nil
+}
+
+// Validate checks the values, it returns the first error.
+func (c *Config) Validate() error {
+	switch {
+	case c.Address == "":
+		return errors.New("the address is not set")
+	case (c.TLS.Cert == "") != (c.TLS.Key == ""):
+		return errors.New("the TLS certificate and key must be set together")
+	case c.TLS.ClientCA != "" && c.TLS.Cert == "":
+		return errors.New("the TLS client CA needs the TLS certificate")
+	case c.Limits.MaxFrameSize == 0 || c.Limits.MaxFrameSize > math.MaxUint32:
+		return fmt.Errorf("the max frame size must be between 1 and %d", uint64(math.MaxUint32))
+	case c.Limits.MaxMailboxSize < 0, c.Limits.MaxConnections < 0, c.Limits.WriteQueueSize < 0:
+		return errors.New("the limits can't be negative")
+	case c.Heartbeat.Interval < 0 || c.Heartbeat.MaxMissed <= 0:
+		return errors.New("the heartbeat interval can't be negative and the missed heartbeats must be more than 0")
+	case c.ShutdownTimeout <= 0:
+		return errors.New("the shutdown timeout must be more than 0")
+	case c.Log.EventsBuffer < 0:
+		return errors.New("the events buffer can't be negative")
+	case c.Admin.Address != "" && c.Admin.Token == "":
+		return fmt.Errorf("the admin API needs a token, set -admin-token or %s", EnvName("admin-token"))
+	}
+	switch c.StorageBackend() {
+	case StorageMemory:
+	case StorageFile:
+		if c.Storage.Path == "" {
+			return errors.New("the file storage needs the path")
+		}
+	default:
+		return fmt.Errorf("unknown storage backend %s", c.Storage.Backend)
+	}
+	switch c.Log.Format {
+	case LogColor, LogText, LogJSON:
+	default:
+		return fmt.Errorf("unknown log format %s", c.Log.Format)
+	}
+	if _, err := c.LogLevel(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// StorageBackend returns the backend, file when it is not set and the path is set.
+func (c *Config) StorageBackend() string {
+	if c.Storage.Backend == "" {
+		if c.Storage.Path != "" {
+			return StorageFile
+		}
+		return StorageMemory
+	}
+	return c.Storage.Backend
+}
+
+// LogLevel returns the min level of the events.
+func (c *Config) LogLevel() (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Log.Level)); err != nil {
+		return level, fmt.Errorf("unknown log level %s", c.Log.Level)
+	}
+	return level, nil
+}
+
+// OpenStorage opens the storage of the backend, the caller closes it.
+func (c *Config) OpenStorage() (tcp_server.Storage, error) {
+	if c.StorageBackend() == StorageFile {
+		return tcp_server.NewFileStorage(c.Storage.Path)
+	}
+	return tcp_server.NewMemoryStorage(), nil
+}
+
+// ServerOptions returns the options of the server with the storage,
+// the TLS files are loaded when TLS is enabled.
+func (c *Config) ServerOptions(storage tcp_server.Storage) (tcp_server.ServerOptions, error) {
+	options := tcp_server.DefaultServerOptions(c.Address)
+	options.Storage = storage
+	options.MaxFrameSize = uint32(c.Limits.MaxFrameSize)
+	options.MaxMailboxSize = c.Limits.MaxMailboxSize
+	options.MaxConnections = c.Limits.MaxConnections
+	options.WriteQueueSize = c.Limits.WriteQueueSize
+	// 0 disables the heartbeat, like in the options
+	options.HeartbeatInterval = c.Heartbeat.Interval
+	options.HeartbeatMaxMissed = c.Heartbeat.MaxMissed
+	if c.TLS.Cert != "" {
+		tlsConfig, err := tcp_server.NewServerTLSConfig(c.TLS.Cert, c.TLS.Key, c.TLS.ClientCA)
+		if err != nil {
+			return options, fmt.Errorf("error loading TLS configuration: %w", err)
+		}
+		options.TLSConfig = tlsConfig
+	}
+	return options, nil
+}
@@ -0,0 +1,111 @@
+package config_test
+
+import (
+	"errors"
+	"flag"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"gsantomaggio/chat/server/chat"
+	"gsantomaggio/chat/server/config"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var _ = Describe("Config", func() {
+	var env map[string]string
+	getenv := func(key string) string { return env[key] }
+	writeFile := func(content string) string {
+		path := filepath.Join(GinkgoT().TempDir(), "server.yaml")
+		Expect(os.WriteFile(path, []byte(content), 0o600)).To(Succeed())
+		return path
+	}
+	BeforeEach(func() {
+		env = map[string]string{}
+	})
+
+	It("Uses the defaults with the address argument", func() {
+		c, err := config.Load([]string{"localhost:5555"}, getenv, io.Discard)
+		Expect(err).To(BeNil())
+		Expect(c.Address).To(Equal("localhost:5555"))
+		Expect(c.Limits.MaxFrameSize).To(Equal(uint(chat.DefaultMaxFrameSize)))
+		Expect(c.Heartbeat.Interval).To(Equal(chat.DefaultHeartbeatInterval))
+		Expect(c.StorageBackend()).To(Equal(config.StorageMemory))
+		Expect(c.Interactive).To(BeTrue())
+
+		options, err := c.ServerOptions(nil)
+		Expect(err).To(BeNil())
+		Expect(options.Address).To(Equal("localhost:5555"))
+		Expect(options.TLSConfig).To(BeNil())
+	})
+
+	It("Overrides the file with the environment and the flags", func() {
+		path := writeFile(`
+address: localhost:5555
+limits:
+  max_connections: 10
+  max_mailbox_size: 100
+storage:
+  path: /tmp/chat.json
+heartbeat:
+  interval: 30s
+log:
+  format: json
+interactive: false
+`)
+		env["CHAT_CONFIG"] = path
+		env["CHAT_MAX_CONNECTIONS"] = "20"
+		env["CHAT_LOG_FORMAT"] = "text"
+		c, err := config.Load([]string{"-max-connections", "30", "-heartbeat-interval", "0"}, getenv, io.Discard)
+		Expect(err).To(BeNil())
+		Expect(c.Address).To(Equal("localhost:5555"))
+		Expect(c.Limits.MaxConnections).To(Equal(30))
+		Expect(c.Limits.MaxMailboxSize).To(Equal(100))
+		Expect(c.Log.Format).To(Equal(config.LogText))
+		Expect(c.StorageBackend()).To(Equal(config.StorageFile))
+		Expect(c.Interactive).To(BeFalse())
+		Expect(c.Heartbeat.Interval).To(Equal(time.Duration(0)))
+
+		options, err := c.ServerOptions(nil)
+		Expect(err).To(BeNil())
+		Expect(options.MaxConnections).To(Equal(30))
+		// 0 disables the heartbeat
+		Expect(options.HeartbeatInterval).To(BeZero())
+
+		c, err = config.Load([]string{"-config", path, "localhost:6000"}, func(string) string { return "" }, io.Discard)
+		Expect(err).To(BeNil())
+		Expect(c.Address).To(Equal("localhost:6000"))
+		Expect(c.Limits.MaxConnections).To(Equal(10))
+		Expect(c.Log.Format).To(Equal(config.LogJSON))
+	})
+
+	It("Refuses the invalid configurations", func() {
+		invalid := [][]string{
+			{},
+			{"-tls-cert", "server.crt", "localhost:5555"},
+			{"-max-frame-size", "0", "localhost:5555"},
+			{"-max-connections", "-1", "localhost:5555"},
+			{"-storage-backend", "file", "localhost:5555"},
+			{"-storage-backend", "redis", "localhost:5555"},
+			{"-log-format", "xml", "localhost:5555"},
+			{"-log-level", "verbose", "localhost:5555"},
+			{"-admin-address", "localhost:8080", "localhost:5555"},
+			{"localhost:5555", "localhost:6000"},
+		}
+		for _, args := range invalid {
+			_, err := config.Load(args, getenv, io.Discard)
+			Expect(err).NotTo(BeNil(), "%v", args)
+		}
+
+		env["CHAT_MAX_CONNECTIONS"] = "many"
+		_, err := config.Load([]string{"localhost:5555"}, getenv, io.Discard)
+		Expect(err).To(MatchError(ContainSubstring("CHAT_MAX_CONNECTIONS")))
+
+		_, err = config.Load([]string{"-config", writeFile("limits:\n  max_conections: 10\n"), "localhost:5555"}, func(string) string { return "" }, io.Discard)
+		Expect(err).To(MatchError(ContainSubstring("max_conections")))
+
+		_, err = config.Load([]string{"-h"}, getenv, io.Discard)
+		Expect(errors.Is(err, flag.ErrHelp)).To(BeTrue())
+	})
+})
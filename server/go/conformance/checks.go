@@ -0,0 +1,409 @@
+package conformance
+
+import (
+	"errors"
+	"fmt"
+	"gsantomaggio/chat/server/chat"
+	"gsantomaggio/chat/server/tcp_client"
+	"time"
+)
+
+const (
+	// concurrentRequests is the number of requests in flight in the correlation id check
+	concurrentRequests = 10
+	// badVersion and unknownKey are not defined by the protocol
+	badVersion = byte(0xFF)
+	unknownKey = uint16(0x7FFF)
+)
+
+var checks = []check{
+	{"login", checkLogin, false},
+	{"duplicate login", checkDuplicateLogin, false},
+	{"login unknown user", checkLoginUnknownUser, true},
+	{"message to unknown user", checkMessageUnknownUser, false},
+	{"offline queuing", checkOfflineQueuing, true},
+	{"correlation id under concurrency", checkCorrelationId, false},
+	{"truncated length prefix", checkTruncatedLength, false},
+	{"oversized frame", checkOversizedFrame, false},
+	{"unknown command key", checkUnknownKey, false},
+	{"bad version", checkBadVersion, false},
+	{"heartbeat", checkHeartbeat, false},
+}
+
+func expectCode(operation string, got, expected uint16) error {
+	if got != expected {
+		return fmt.Errorf("%s: expected %s, got %s (0x%02X)", operation,
+			chat.FormResponseCodeToString(expected), chat.FormResponseCodeToString(got), got)
+	}
+	return nil
+}
+
+// register creates the user on a new connection.
+// The servers without CommandRegister create the user at the first login.
+func (r *Runner) register(username string) error {
+	if !r.registration {
+		return nil
+	}
+	client, err := r.newClient(make(chan *chat.CommandMessage, 1))
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	response, err := client.Register(username, password)
+	if err != nil {
+		return fmt.Errorf("register %s: %w", username, err)
+	}
+	return expectCode("register "+username, response.ResponseCode(), chat.ResponseCodeOk)
+}
+
+// login connects and logs in the user. The caller closes the client.
+func (r *Runner) login(username string, receiver chan *chat.CommandMessage) (*tcp_client.ChatClient, error) {
+	client, err := r.newClient(receiver)
+	if err != nil {
+		return nil, err
+	}
+	response, err := client.Login(username, password)
+	if err == nil {
+		err = expectCode("login "+username, response.ResponseCode(), chat.ResponseCodeOk)
+	}
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// registerAndLogin creates a new user and logs in.
+func (r *Runner) registerAndLogin(name string, receiver chan *chat.CommandMessage) (*tcp_client.ChatClient, string, error) {
+	username := r.username(name)
+	if err := r.register(username); err != nil {
+		return nil, "", err
+	}
+	client, err := r.login(username, receiver)
+	return client, username, err
+}
+
+func checkLogin(r *Runner) error {
+	client, _, err := r.registerAndLogin("login", make(chan *chat.CommandMessage, 1))
+	if err != nil {
+		return err
+	}
+	return client.Close()
+}
+
+func checkDuplicateLogin(r *Runner) error {
+	first, username, err := r.registerAndLogin("duplicate", make(chan *chat.CommandMessage, 1))
+	if err != nil {
+		return err
+	}
+	defer first.Close()
+	second, err := r.newClient(make(chan *chat.CommandMessage, 1))
+	if err != nil {
+		return err
+	}
+	defer second.Close()
+	response, err := second.Login(username, password)
+	if err != nil {
+		return fmt.Errorf("second login: %w", err)
+	}
+	return expectCode("second login", response.ResponseCode(), chat.ResponseCodeErrorUserAlreadyLogged)
+}
+
+func checkLoginUnknownUser(r *Runner) error {
+	client, err := r.newClient(make(chan *chat.CommandMessage, 1))
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	response, err := client.Login(r.username("not-registered"), password)
+	if err != nil {
+		return fmt.Errorf("login: %w", err)
+	}
+	return expectCode("login", response.ResponseCode(), chat.ResponseCodeErrorUserNotFound)
+}
+
+func checkMessageUnknownUser(r *Runner) error {
+	client, _, err := r.registerAndLogin("sender-unknown", make(chan *chat.CommandMessage, 1))
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	response, err := client.SendMessage("hello", r.username("not-registered"))
+	if err != nil {
+		return fmt.Errorf("send message: %w", err)
+	}
+	if err := expectCode("send message", response.ResponseCode(), chat.ResponseCodeErrorUserNotFound); err != nil {
+		return err
+	}
+	if response.Id != 0 {
+		return fmt.Errorf("send message: expected the id 0 on error, got %d", response.Id)
+	}
+	return nil
+}
+
+// checkOfflineQueuing sends a message to a user never logged in,
+// the message must be delivered when the user logs in.
+func checkOfflineQueuing(r *Runner) error {
+	sender, senderName, err := r.registerAndLogin("offline-sender", make(chan *chat.CommandMessage, 1))
+	if err != nil {
+		return err
+	}
+	defer sender.Close()
+	recipientName := r.username("offline-recipient")
+	if err := r.register(recipientName); err != nil {
+		return err
+	}
+	text := fmt.Sprintf("queued message %d", time.Now().UnixNano())
+	response, err := sender.SendMessage(text, recipientName)
+	if err != nil {
+		return fmt.Errorf("send message: %w", err)
+	}
+	if err := expectCode("send message", response.ResponseCode(), chat.ResponseCodeOk); err != nil {
+		return err
+	}
+
+	receiver := make(chan *chat.CommandMessage, 1)
+	recipient, err := r.login(recipientName, receiver)
+	if err != nil {
+		return err
+	}
+	defer recipient.Close()
+	select {
+	case message := <-receiver:
+		if message.Message != text || message.From != senderName || message.To != recipientName {
+			return fmt.Errorf("unexpected message from %s to %s: %q", message.From, message.To, message.Message)
+		}
+		if message.Id != response.Id {
+			return fmt.Errorf("expected the message id %d, got %d", response.Id, message.Id)
+		}
+		return nil
+	case <-time.After(r.config.Timeout):
+		return fmt.Errorf("the queued message was not delivered in %s after the login", r.config.Timeout)
+	}
+}
+
+// checkCorrelationId sends many CorrelationIdTest commands without waiting,
+// the server answers after a random delay: every response must have
+// the correlationId of a request, once.
+func checkCorrelationId(r *Runner) error {
+	conn, err := r.newRawConn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	pending := make(map[uint32]bool)
+	for i := uint32(1); i <= concurrentRequests; i++ {
+		correlationId := 1000 + i
+		if err := conn.WriteCommand(chat.NewCorrelationIdCommand(), correlationId); err != nil {
+			return fmt.Errorf("write request %d: %w", correlationId, err)
+		}
+		pending[correlationId] = true
+	}
+	for len(pending) > 0 {
+		header, reader, err := conn.ReadFrame()
+		if err != nil {
+			return fmt.Errorf("%d responses missing: %w", len(pending), err)
+		}
+		if header.Key() != chat.GenericResponseKey {
+			return fmt.Errorf("expected a GenericResponse, got the key 0x%02X", header.Key())
+		}
+		response := &chat.GenericResponse{}
+		if err := response.Read(reader); err != nil {
+			return fmt.Errorf("error reading the response: %w", err)
+		}
+		if !pending[response.CorrelationId()] {
+			return fmt.Errorf("unexpected correlationId %d", response.CorrelationId())
+		}
+		delete(pending, response.CorrelationId())
+		if err := expectCode(fmt.Sprintf("correlationId %d", response.CorrelationId()), response.ResponseCode(), chat.ResponseCodeOk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkTruncatedLength sends half of the length prefix and closes the write side:
+// the server must close the connection and accept new connections.
+func checkTruncatedLength(r *Runner) error {
+	conn, err := r.newRawConn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.WriteRaw([]byte{0x00, 0x00}); err != nil {
+		return err
+	}
+	if err := conn.CloseWrite(); err != nil {
+		return err
+	}
+	if err := conn.ExpectClosed(); err != nil {
+		return err
+	}
+	return r.expectAlive()
+}
+
+// checkOversizedFrame sends a length of 4 GiB: the server must answer
+// with ErrorFrameTooLarge without reading the frame, and close the connection.
+func checkOversizedFrame(r *Runner) error {
+	conn, err := r.newRawConn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.WriteRaw([]byte{0xFF, 0xFF, 0xFF, 0xFF}); err != nil {
+		return err
+	}
+	header, reader, err := conn.ReadFrame()
+	if err != nil {
+		return fmt.Errorf("the oversized frame was not answered: %w", err)
+	}
+	if header.Key() != chat.GenericResponseKey {
+		return fmt.Errorf("expected a GenericResponse, got the key 0x%02X", header.Key())
+	}
+	response := &chat.GenericResponse{}
+	if err := response.Read(reader); err != nil {
+		return fmt.Errorf("error reading the response: %w", err)
+	}
+	if err := expectCode("oversized frame", response.ResponseCode(), chat.ResponseCodeErrorFrameTooLarge); err != nil {
+		return err
+	}
+	if err := conn.ExpectClosed(); err != nil {
+		return err
+	}
+	return r.expectAlive()
+}
+
+// checkUnknownKey sends a frame with a key not defined by the protocol, then a valid command.
+func checkUnknownKey(r *Runner) error {
+	return r.expectRejected(chat.ResponseCodeErrorUnknownCommand, func(conn *RawConn, correlationId uint32) error {
+		command := chat.NewCorrelationIdCommand()
+		command.SetCorrelationId(correlationId)
+		payload, err := EncodeCommand(command)
+		if err != nil {
+			return err
+		}
+		return conn.WriteFrame(chat.Version1, unknownKey, payload)
+	})
+}
+
+// checkBadVersion sends a valid command with a version not supported, then a valid command.
+func checkBadVersion(r *Runner) error {
+	return r.expectRejected(chat.ResponseCodeErrorUnsupportedVersion, func(conn *RawConn, correlationId uint32) error {
+		command := chat.NewCommandListUsers()
+		command.SetCorrelationId(correlationId)
+		payload, err := EncodeCommand(command)
+		if err != nil {
+			return err
+		}
+		return conn.WriteFrame(badVersion, command.Key(), payload)
+	})
+}
+
+// checkHeartbeat sends a CommandPing, the server must answer with a CommandPong
+// with the same correlationId. The pings of the server are skipped.
+func checkHeartbeat(r *Runner) error {
+	const correlationId = uint32(7)
+	conn, err := r.newRawConn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.WriteCommand(chat.NewCommandPing(), correlationId); err != nil {
+		return fmt.Errorf("write ping: %w", err)
+	}
+	for {
+		header, reader, err := conn.ReadFrame()
+		if err != nil {
+			return fmt.Errorf("the ping was not answered: %w", err)
+		}
+		switch header.Key() {
+		case chat.CommandPingKey:
+			continue
+		case chat.CommandPongKey:
+			pong := &chat.CommandPong{}
+			if err := pong.Read(reader); err != nil {
+				return fmt.Errorf("error reading the pong: %w", err)
+			}
+			if pong.CorrelationId() != correlationId {
+				return fmt.Errorf("pong with correlationId %d, expected %d", pong.CorrelationId(), correlationId)
+			}
+			return nil
+		default:
+			return fmt.Errorf("unexpected response key 0x%02X", header.Key())
+		}
+	}
+}
+
+// expectRejected writes the invalid frame and a CommandListUsers.
+// The server must answer to the invalid frame with a GenericResponse with the code
+// and the same correlationId, without executing it.
+// The connection must stay usable, so the CommandListUsers must be answered.
+func (r *Runner) expectRejected(code uint16, writeInvalid func(conn *RawConn, correlationId uint32) error) error {
+	const invalidId, validId = uint32(1), uint32(2)
+	conn, err := r.newRawConn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := writeInvalid(conn, invalidId); err != nil {
+		return fmt.Errorf("write invalid frame: %w", err)
+	}
+	if err := conn.WriteCommand(chat.NewCommandListUsers(), validId); err != nil {
+		return fmt.Errorf("write valid frame: %w", err)
+	}
+	rejected := false
+	for {
+		header, reader, err := conn.ReadFrame()
+		if err != nil {
+			if !rejected {
+				return fmt.Errorf("the invalid frame was not answered: %w", err)
+			}
+			return fmt.Errorf("the valid command after the invalid frame was not answered: %w", err)
+		}
+		switch header.Key() {
+		case chat.GenericResponseKey:
+			response := &chat.GenericResponse{}
+			if err := response.Read(reader); err != nil {
+				return fmt.Errorf("error reading the response: %w", err)
+			}
+			if response.CorrelationId() != invalidId {
+				return fmt.Errorf("unexpected GenericResponse with correlationId %d", response.CorrelationId())
+			}
+			if err := expectCode("invalid frame", response.ResponseCode(), code); err != nil {
+				return err
+			}
+			rejected = true
+		case chat.UserListResponseKey:
+			response := &chat.UserListResponse{}
+			if err := response.Read(reader); err != nil {
+				return fmt.Errorf("error reading the response: %w", err)
+			}
+			if response.CorrelationId() == invalidId {
+				return errors.New("the invalid frame was executed")
+			}
+			if response.CorrelationId() != validId {
+				return fmt.Errorf("unexpected UserListResponse with correlationId %d", response.CorrelationId())
+			}
+			if !rejected {
+				return errors.New("the invalid frame was not answered")
+			}
+			return nil
+		default:
+			return fmt.Errorf("unexpected response key 0x%02X", header.Key())
+		}
+	}
+}
+
+// expectAlive checks that the server accepts a new connection and answers.
+// The login is in the base protocol, any response code is fine.
+func (r *Runner) expectAlive() error {
+	client, err := r.newClient(make(chan *chat.CommandMessage, 1))
+	if err != nil {
+		return fmt.Errorf("the server is not reachable: %w", err)
+	}
+	defer client.Close()
+	if _, err := client.Login(r.username("alive"), password); err != nil {
+		return fmt.Errorf("the server doesn't answer: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+// Package conformance checks that a chat server implements the protocol
+// described in the README, whatever the language of the server.
+// The checks use tcp_client.ChatClient for the valid commands and RawConn
+// for the malformed frames. See run/conformance.
+package conformance
+
+import (
+	"crypto/tls"
+	"fmt"
+	"gsantomaggio/chat/server/chat"
+	"gsantomaggio/chat/server/tcp_client"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	defaultTimeout = 5 * time.Second
+	password       = "conformance"
+)
+
+type Config struct {
+	// Address of the server, host:port
+	Address string
+	// TLSConfig enables TLS when it is not nil
+	TLSConfig *tls.Config
+	// Timeout is the max wait for a response, 5 seconds when zero
+	Timeout time.Duration
+}
+
+// Result is the outcome of a check. Error is set when the check failed,
+// SkipReason when the check was not run.
+type Result struct {
+	Name       string
+	Error      error
+	SkipReason string
+	Duration   time.Duration
+}
+
+func (r *Result) Passed() bool {
+	return r.Error == nil && r.SkipReason == ""
+}
+
+func (r *Result) Skipped() bool {
+	return r.SkipReason != ""
+}
+
+type check struct {
+	name string
+	run  func(r *Runner) error
+	// registration is true when the check needs a user that exists before its first login:
+	// the servers without CommandRegister create the user at the login.
+	// The other checks run on all the servers and fail on a wrong answer.
+	registration bool
+}
+
+// skipRegistration is the SkipReason of the checks that need CommandRegister
+const skipRegistration = "the server doesn't implement CommandRegister, the check needs a user registered before the login"
+
+// Runner runs the checks against a server.
+// The users are registered with a prefix unique for each run, so the checks
+// can run many times against the same server, also with a persistent storage.
+// The servers without CommandRegister create the user at the first login:
+// the checks that need a registered user are skipped.
+type Runner struct {
+	config Config
+	prefix string
+	// registration is true when the server implements CommandRegister, see probeRegistration
+	registration bool
+}
+
+func NewRunner(config Config) *Runner {
+	if config.Timeout <= 0 {
+		config.Timeout = defaultTimeout
+	}
+	return &Runner{
+		config: config,
+		prefix: fmt.Sprintf("conformance-%d", time.Now().UnixNano()),
+	}
+}
+
+// Run executes all the checks in order. A failed check doesn't stop the others.
+func (r *Runner) Run() []*Result {
+	r.registration = r.probeRegistration()
+	results := make([]*Result, 0, len(checks))
+	for _, c := range checks {
+		if c.registration && !r.registration {
+			results = append(results, &Result{Name: c.name, SkipReason: skipRegistration})
+			continue
+		}
+		start := time.Now()
+		err := c.run(r)
+		results = append(results, &Result{Name: c.name, Error: err, Duration: time.Since(start)})
+	}
+	return results
+}
+
+// probeRegistration registers a user to know if the server implements CommandRegister.
+// The servers of the base protocol answer with ErrorUnknownCommand or close the connection.
+// It returns true when the server can't be reached, so the checks fail instead of being skipped.
+func (r *Runner) probeRegistration() bool {
+	conn, err := r.newRawConn()
+	if err != nil {
+		return true
+	}
+	defer conn.Close()
+	if err := conn.WriteCommand(chat.NewCommandRegister(r.username("probe"), password), 1); err != nil {
+		return false
+	}
+	header, reader, err := conn.ReadFrame()
+	if err != nil || header.Key() != chat.GenericResponseKey {
+		return false
+	}
+	response := &chat.GenericResponse{}
+	if err := response.Read(reader); err != nil {
+		return false
+	}
+	return response.ResponseCode() == chat.ResponseCodeOk || response.ResponseCode() == chat.ResponseCodeErrorUserAlreadyExists
+}
+
+// username returns a username unique for this run.
+func (r *Runner) username(name string) string {
+	return r.prefix + "-" + name
+}
+
+func (r *Runner) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: r.config.Timeout}
+	if r.config.TLSConfig != nil {
+		return tls.DialWithDialer(dialer, "tcp", r.config.Address, r.config.TLSConfig)
+	}
+	return dialer.Dial("tcp", r.config.Address)
+}
+
+func (r *Runner) newRawConn() (*RawConn, error) {
+	conn, err := r.dial()
+	if err != nil {
+		return nil, err
+	}
+	return NewRawConn(conn, r.config.Timeout), nil
+}
+
+// newClient connects a client. The servers without CommandRegister implement the base
+// protocol, so the client sends the version 1 of the commands.
+func (r *Runner) newClient(receiver chan *chat.CommandMessage) (*tcp_client.ChatClient, error) {
+	options := tcp_client.DefaultClientOptions()
+	if !r.registration {
+		options.ProtocolVersion = chat.Version1
+	}
+	client := tcp_client.NewChatClientWithOptions(receiver, options)
+	var err error
+	if r.config.TLSConfig != nil {
+		err = client.ConnectTLS(r.config.Address, r.config.TLSConfig)
+	} else {
+		err = client.Connect(r.config.Address)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to %s: %w", r.config.Address, err)
+	}
+	return client, nil
+}
+
+// PrintReport writes one line for each check and the summary.
+// It returns the number of failed checks, the skipped checks are not failed.
+func PrintReport(writer io.Writer, results []*Result) int {
+	failed, skipped := 0, 0
+	for _, result := range results {
+		switch {
+		case result.Skipped():
+			skipped++
+			fmt.Fprintf(writer, "SKIP  %s: %s\n", result.Name, result.SkipReason)
+		case result.Passed():
+			fmt.Fprintf(writer, "PASS  %s (%s)\n", result.Name, result.Duration.Round(time.Millisecond))
+		default:
+			failed++
+			fmt.Fprintf(writer, "FAIL  %s (%s): %v\n", result.Name, result.Duration.Round(time.Millisecond), result.Error)
+		}
+	}
+	fmt.Fprintf(writer, "\n%d checks, %d passed, %d failed, %d skipped\n", len(results), len(results)-failed-skipped, failed, skipped)
+	return failed
+}
@@ -0,0 +1,125 @@
+package conformance_test
+
+import (
+	"bufio"
+	"bytes"
+	"gsantomaggio/chat/server/chat"
+	"gsantomaggio/chat/server/conformance"
+	"gsantomaggio/chat/server/tcp_server"
+	"net"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+const address = "localhost:6669"
+
+// serveBaseProtocol is a server of the base protocol, like the servers of the other
+// languages: the login creates the user, the other commands close the connection.
+func serveBaseProtocol(listener net.Listener) {
+	var mutex sync.Mutex
+	online := make(map[string]bool)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			reader := bufio.NewReader(conn)
+			username := ""
+			defer func() {
+				mutex.Lock()
+				delete(online, username)
+				mutex.Unlock()
+			}()
+			for {
+				frame, err := chat.ReadFullBufferFromSource(reader)
+				if err != nil {
+					return
+				}
+				header := &chat.ChatHeader{}
+				// the base protocol knows only the version 1 of the login, without password
+				login := &chat.CommandLogin{}
+				login.SetVersion(chat.Version1)
+				if header.Read(frame) != nil || header.Key() != chat.CommandLoginKey || login.Read(frame) != nil {
+					return
+				}
+				code := chat.ResponseCodeErrorUserAlreadyLogged
+				mutex.Lock()
+				if !online[login.Username()] {
+					online[login.Username()] = true
+					username = login.Username()
+					code = chat.ResponseCodeOk
+				}
+				mutex.Unlock()
+				response := chat.NewGenericResponse(code)
+				response.SetCorrelationId(login.CorrelationId())
+				if chat.WriteCommandWithHeader(response, bufio.NewWriter(conn)) != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+var _ = Describe("Conformance", func() {
+	var tcpServer *tcp_server.TcpServer
+	BeforeEach(func() {
+		tcpServer = tcp_server.NewTcpServer(address, nil)
+		Expect(tcpServer.StartInAThread()).To(Succeed())
+		time.Sleep(200 * time.Millisecond)
+	})
+	AfterEach(func() {
+		tcpServer.Stop()
+	})
+
+	It("The server passes the checks", func() {
+		results := conformance.NewRunner(conformance.Config{Address: address}).Run()
+		Expect(results).NotTo(BeEmpty())
+		for _, result := range results {
+			Expect(result.Error).NotTo(HaveOccurred(), result.Name)
+			Expect(result.Skipped()).To(BeFalse(), result.Name)
+		}
+	})
+
+	It("Skips only the checks that need CommandRegister on a server of the base protocol", func() {
+		listener, err := net.Listen("tcp", "localhost:6680")
+		Expect(err).To(BeNil())
+		defer listener.Close()
+		go serveBaseProtocol(listener)
+
+		results := conformance.NewRunner(conformance.Config{Address: "localhost:6680", Timeout: time.Second}).Run()
+		passed, failed, skipped := make([]string, 0), make([]string, 0), make([]string, 0)
+		for _, result := range results {
+			switch {
+			case result.Skipped():
+				skipped = append(skipped, result.Name)
+			case result.Passed():
+				passed = append(passed, result.Name)
+			default:
+				failed = append(failed, result.Name)
+			}
+		}
+		Expect(passed).To(Equal([]string{"login", "duplicate login", "truncated length prefix"}))
+		Expect(skipped).To(Equal([]string{"login unknown user", "offline queuing"}))
+		// the server closes the connection on the commands it doesn't know, instead of answering
+		Expect(failed).To(Equal([]string{"message to unknown user", "correlation id under concurrency",
+			"oversized frame", "unknown command key", "bad version", "heartbeat"}))
+		report := &bytes.Buffer{}
+		Expect(conformance.PrintReport(report, results)).To(Equal(6))
+		Expect(report.String()).To(ContainSubstring("FAIL  bad version"))
+		Expect(report.String()).To(ContainSubstring("SKIP  offline queuing: "))
+		Expect(report.String()).To(ContainSubstring("3 passed, 6 failed, 2 skipped"))
+	})
+
+	It("The report counts the failed checks", func() {
+		results := conformance.NewRunner(conformance.Config{Address: "localhost:1", Timeout: time.Second}).Run()
+		report := &bytes.Buffer{}
+		Expect(conformance.PrintReport(report, results)).To(Equal(len(results)))
+		Expect(report.String()).To(ContainSubstring("FAIL  login"))
+		Expect(report.String()).To(ContainSubstring("0 passed"))
+	})
+})
@@ -0,0 +1,113 @@
+package conformance
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"gsantomaggio/chat/server/chat"
+	"gsantomaggio/chat/server/internal"
+	"io"
+	"net"
+	"time"
+)
+
+// RawConn writes and reads the frames without the client, so it can send
+// the frames the client never produces: a truncated length, a bad version, an unknown key.
+type RawConn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+}
+
+func NewRawConn(conn net.Conn, timeout time.Duration) *RawConn {
+	return &RawConn{conn: conn, reader: bufio.NewReader(conn), timeout: timeout}
+}
+
+// EncodeCommand returns the fields of the command, without the length and the header.
+func EncodeCommand(command internal.CommandWrite) ([]byte, error) {
+	buffer := &bytes.Buffer{}
+	writer := bufio.NewWriter(buffer)
+	if _, err := command.Write(writer); err != nil {
+		return nil, err
+	}
+	if err := writer.Flush(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// WriteFrame writes the length, the header with the version and the key, and the payload.
+func (c *RawConn) WriteFrame(version byte, key uint16, payload []byte) error {
+	frame := make([]byte, 0, 7+len(payload))
+	frame = binary.BigEndian.AppendUint32(frame, uint32(3+len(payload)))
+	frame = append(frame, version)
+	frame = binary.BigEndian.AppendUint16(frame, key)
+	frame = append(frame, payload...)
+	return c.WriteRaw(frame)
+}
+
+// WriteCommand writes the command with the correlationId and a valid header.
+func (c *RawConn) WriteCommand(command internal.SyncCommandWrite, correlationId uint32) error {
+	command.SetCorrelationId(correlationId)
+	payload, err := EncodeCommand(command)
+	if err != nil {
+		return err
+	}
+	return c.WriteFrame(command.Version(), command.Key(), payload)
+}
+
+// WriteRaw writes the bytes as they are.
+func (c *RawConn) WriteRaw(data []byte) error {
+	_ = c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	_, err := c.conn.Write(data)
+	return err
+}
+
+// CloseWrite closes the write side of the connection, the server reads EOF.
+func (c *RawConn) CloseWrite() error {
+	if closer, ok := c.conn.(interface{ CloseWrite() error }); ok {
+		return closer.CloseWrite()
+	}
+	return fmt.Errorf("the connection %T can't close the write side", c.conn)
+}
+
+// ReadFrame waits for the next frame and returns the header and the reader of the fields.
+func (c *RawConn) ReadFrame() (*chat.ChatHeader, *bufio.Reader, error) {
+	_ = c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+	var length uint32
+	if err := binary.Read(c.reader, binary.BigEndian, &length); err != nil {
+		return nil, nil, err
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, data); err != nil {
+		return nil, nil, err
+	}
+	reader := bufio.NewReader(bytes.NewReader(data))
+	header := &chat.ChatHeader{}
+	if err := header.Read(reader); err != nil {
+		return nil, nil, fmt.Errorf("error reading header: %w", err)
+	}
+	return header, reader, nil
+}
+
+// ExpectClosed waits until the server closes the connection.
+// It fails when the server sends a frame or keeps the connection open.
+func (c *RawConn) ExpectClosed() error {
+	_ = c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+	data := make([]byte, 1)
+	n, err := c.reader.Read(data)
+	if n > 0 {
+		return errors.New("the server sent data instead of closing the connection")
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("the server didn't close the connection in %s", c.timeout)
+	}
+	return nil
+}
+
+func (c *RawConn) Close() error {
+	return c.conn.Close()
+}
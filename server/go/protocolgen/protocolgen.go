@@ -0,0 +1,497 @@
+// Package protocolgen generates the Go command types and the README protocol
+// tables from the protocol schema (protocol/schema.json), so the specification
+// and the code can't disagree.
+package protocolgen
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/format"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	readmeBegin = "<!-- BEGIN PROTOCOL TABLES: generated from protocol/schema.json by server/go/run/protocolgen, do not edit -->"
+	readmeEnd   = "<!-- END PROTOCOL TABLES -->"
+)
+
+// Schema is the declarative definition of the protocol.
+type Schema struct {
+	Version  byte       `json:"version"`
+	Sections []*Section `json:"sections"`
+	Enums    []*Enum    `json:"enums"`
+}
+
+// Section groups the commands in the README. The first section has no title.
+type Section struct {
+	Title    string     `json:"title"`
+	Readme   string     `json:"readme"`
+	Commands []*Command `json:"commands"`
+}
+
+// Command is a frame of the protocol. Key is the value of Header::command,
+// KeyConst is the name of the Go constant, Name + "Key" when empty.
+// Doc is the Go doc comment, Readme the description in the README.
+// Version is the latest version of the command, the schema version when 0:
+// a new version adds fields at the end, see Field.Since.
+type Command struct {
+	Name     string   `json:"name"`
+	Key      string   `json:"key"`
+	KeyConst string   `json:"keyConst,omitempty"`
+	Doc      string   `json:"doc"`
+	Readme   string   `json:"readme,omitempty"`
+	Version  byte     `json:"version,omitempty"`
+	Fields   []*Field `json:"fields"`
+}
+
+// Field is encoded in the declaration order. Name is the Go field name.
+// Since is the version of the command that added the field, the schema version when 0.
+type Field struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Doc   string `json:"doc,omitempty"`
+	Since byte   `json:"since,omitempty"`
+}
+
+// Enum is a list of constants, for example the response codes.
+type Enum struct {
+	Name   string       `json:"name"`
+	Type   string       `json:"type"`
+	Doc    string       `json:"doc"`
+	Values []*EnumValue `json:"values"`
+}
+
+type EnumValue struct {
+	Name  string `json:"name"`
+	Const string `json:"const"`
+	Value string `json:"value"`
+}
+
+// goTypes maps the schema types to the Go types.
+// A list of commands is declared as "[]CommandName".
+var goTypes = map[string]string{
+	"bool":              "bool",
+	"byte":              "byte",
+	"uint16":            "uint16",
+	"uint32":            "uint32",
+	"uint64":            "uint64",
+	"string":            "string",
+	"[]byte":            "[]byte",
+	"[]string":          "[]string",
+	"map[string]string": "map[string]string",
+}
+
+// LoadSchema reads and validates the schema.
+func LoadSchema(path string) (*Schema, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading schema %s: %w", path, err)
+	}
+	schema := &Schema{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(schema); err != nil {
+		return nil, fmt.Errorf("error decoding schema %s: %w", path, err)
+	}
+	if err := schema.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid schema %s: %w", path, err)
+	}
+	return schema, nil
+}
+
+// Commands returns all the commands in the schema order.
+func (s *Schema) Commands() []*Command {
+	commands := make([]*Command, 0)
+	for _, section := range s.Sections {
+		commands = append(commands, section.Commands...)
+	}
+	return commands
+}
+
+func (s *Schema) command(name string) *Command {
+	for _, command := range s.Commands() {
+		if command.Name == name {
+			return command
+		}
+	}
+	return nil
+}
+
+// Validate checks the keys are unique and the field types are supported.
+// Every command starts with the correlationId. The fields added by a version
+// follow the fields of the previous versions, so the older frames are a prefix.
+func (s *Schema) Validate() error {
+	keys := make(map[uint64]string)
+	names := make(map[string]bool)
+	for _, command := range s.Commands() {
+		if names[command.Name] {
+			return fmt.Errorf("command %s declared twice", command.Name)
+		}
+		names[command.Name] = true
+		key, err := strconv.ParseUint(command.Key, 0, 16)
+		if err != nil {
+			return fmt.Errorf("command %s: invalid key %q", command.Name, command.Key)
+		}
+		if other, ok := keys[key]; ok {
+			return fmt.Errorf("command %s: key %s already used by %s", command.Name, command.Key, other)
+		}
+		keys[key] = command.Name
+		if len(command.Fields) == 0 || command.Fields[0].Name != "correlationId" || command.Fields[0].Type != "uint32" {
+			return fmt.Errorf("command %s: the first field must be correlationId uint32", command.Name)
+		}
+		if command.Version != 0 && command.Version < s.Version {
+			return fmt.Errorf("command %s: version %d lower than the schema version %d", command.Name, command.Version, s.Version)
+		}
+		fields := make(map[string]bool)
+		previous := s.Version
+		for _, field := range command.Fields {
+			if fields[field.Name] {
+				return fmt.Errorf("command %s: field %s declared twice", command.Name, field.Name)
+			}
+			fields[field.Name] = true
+			since := s.fieldSince(field)
+			if since > s.latestVersion(command) {
+				return fmt.Errorf("command %s field %s: version %d after the latest version of the command", command.Name, field.Name, since)
+			}
+			if since < previous {
+				return fmt.Errorf("command %s field %s: version %d declared after the fields of version %d", command.Name, field.Name, since, previous)
+			}
+			previous = since
+			if _, err := s.goType(field.Type); err != nil {
+				return fmt.Errorf("command %s field %s: %w", command.Name, field.Name, err)
+			}
+		}
+	}
+	for _, enum := range s.Enums {
+		if _, ok := goTypes[enum.Type]; !ok {
+			return fmt.Errorf("enum %s: unsupported type %s", enum.Name, enum.Type)
+		}
+		for _, value := range enum.Values {
+			if _, err := strconv.ParseUint(value.Value, 0, 64); err != nil {
+				return fmt.Errorf("enum %s: invalid value %q for %s", enum.Name, value.Value, value.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// listItem returns the command name of a "[]CommandName" type.
+func listItem(schemaType string) (string, bool) {
+	if !strings.HasPrefix(schemaType, "[]") {
+		return "", false
+	}
+	item := strings.TrimPrefix(schemaType, "[]")
+	if _, ok := goTypes[item]; ok {
+		return "", false
+	}
+	return item, true
+}
+
+func (s *Schema) goType(schemaType string) (string, error) {
+	if goType, ok := goTypes[schemaType]; ok {
+		return goType, nil
+	}
+	if item, ok := listItem(schemaType); ok && s.command(item) != nil {
+		return "[]*" + item, nil
+	}
+	return "", fmt.Errorf("unsupported type %s", schemaType)
+}
+
+// listCodec is the name of the fieldCodec type for a list of commands,
+// for example commandMessageList for []CommandMessage.
+func listCodec(item string) string {
+	return strings.ToLower(item[:1]) + item[1:] + "List"
+}
+
+// latestVersion is the latest version of the command.
+func (s *Schema) latestVersion(command *Command) byte {
+	if command.Version == 0 {
+		return s.Version
+	}
+	return command.Version
+}
+
+// versioned is true when the command has more than one version.
+func (s *Schema) versioned(command *Command) bool {
+	return s.latestVersion(command) > s.Version
+}
+
+// fieldSince is the version of the command that added the field.
+func (s *Schema) fieldSince(field *Field) byte {
+	return max(field.Since, s.Version)
+}
+
+// versionConst is the name of the Go constant of the latest version of the command.
+func (c *Command) versionConst() string {
+	return c.Name + "Version"
+}
+
+func (c *Command) keyConst() string {
+	if c.KeyConst != "" {
+		return c.KeyConst
+	}
+	return c.Name + "Key"
+}
+
+func (c *Command) hasField(name string) bool {
+	for _, field := range c.Fields {
+		if field.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func writeComment(buffer *bytes.Buffer, indent, comment string) {
+	for _, line := range strings.Split(comment, "\n") {
+		if line == "" {
+			fmt.Fprintf(buffer, "%s//\n", indent)
+			continue
+		}
+		fmt.Fprintf(buffer, "%s// %s\n", indent, line)
+	}
+}
+
+// GenerateGo returns the Go source of the command types, formatted by gofmt.
+func GenerateGo(schema *Schema, packageName string) ([]byte, error) {
+	buffer := &bytes.Buffer{}
+	fmt.Fprintf(buffer, "// Code generated by protocolgen from protocol/schema.json. DO NOT EDIT.\n\n")
+	fmt.Fprintf(buffer, "package %s\n\nimport (\n\t\"bufio\"\n\t\"io\"\n)\n\n", packageName)
+
+	fmt.Fprintf(buffer, "// command keys, see Header::command\nconst (\n")
+	for _, command := range schema.Commands() {
+		fmt.Fprintf(buffer, "\t%s uint16 = %s\n", command.keyConst(), command.Key)
+	}
+	fmt.Fprintf(buffer, ")\n\n")
+
+	for _, enum := range schema.Enums {
+		writeComment(buffer, "", enum.Doc)
+		fmt.Fprintf(buffer, "const (\n")
+		for _, value := range enum.Values {
+			fmt.Fprintf(buffer, "\t%s %s = %s\n", value.Const, goTypes[enum.Type], value.Value)
+		}
+		fmt.Fprintf(buffer, ")\n\n")
+	}
+
+	versioned := make([]*Command, 0)
+	for _, command := range schema.Commands() {
+		if schema.versioned(command) {
+			versioned = append(versioned, command)
+		}
+	}
+	fmt.Fprintf(buffer, "// latest versions of the commands with more than one version, see Header::version\nconst (\n")
+	for _, command := range versioned {
+		fmt.Fprintf(buffer, "\t%s byte = %d\n", command.versionConst(), schema.latestVersion(command))
+	}
+	fmt.Fprintf(buffer, ")\n\n")
+	fmt.Fprintf(buffer, "// LatestVersion returns the latest version of the command with the key,\n")
+	fmt.Fprintf(buffer, "// Version1 for the commands with one version and for the unknown keys.\n")
+	fmt.Fprintf(buffer, "func LatestVersion(key uint16) byte {\n\tswitch key {\n")
+	for _, command := range versioned {
+		fmt.Fprintf(buffer, "\tcase %s:\n\t\treturn %s\n", command.keyConst(), command.versionConst())
+	}
+	fmt.Fprintf(buffer, "\t}\n\treturn Version1\n}\n\n")
+
+	lists := make([]string, 0)
+	for _, command := range schema.Commands() {
+		writeComment(buffer, "", command.Doc)
+		fmt.Fprintf(buffer, "type %s struct {\n", command.Name)
+		if schema.versioned(command) {
+			fmt.Fprintf(buffer, "\tversion byte // 0 for %s, see SetVersion\n", command.versionConst())
+		}
+		// fieldRefs groups the fields by the version that added them
+		fieldRefs := make(map[byte][]string)
+		for _, field := range command.Fields {
+			goType, _ := schema.goType(field.Type)
+			if field.Doc != "" {
+				fmt.Fprintf(buffer, "\t%s %s // %s\n", field.Name, goType, strings.ReplaceAll(field.Doc, "\n", " "))
+			} else {
+				fmt.Fprintf(buffer, "\t%s %s\n", field.Name, goType)
+			}
+			since := schema.fieldSince(field)
+			if item, ok := listItem(field.Type); ok {
+				fieldRefs[since] = append(fieldRefs[since], fmt.Sprintf("(*%s)(&c.%s)", listCodec(item), field.Name))
+				if !contains(lists, item) {
+					lists = append(lists, item)
+				}
+			} else {
+				fieldRefs[since] = append(fieldRefs[since], "&c."+field.Name)
+			}
+		}
+		fmt.Fprintf(buffer, "}\n\n")
+
+		name := command.Name
+		fmt.Fprintf(buffer, "func (c *%s) Key() uint16 {\n\treturn %s\n}\n\n", name, command.keyConst())
+		if !schema.versioned(command) {
+			fmt.Fprintf(buffer, "func (c *%s) Version() byte {\n\treturn Version1\n}\n\n", name)
+			fmt.Fprintf(buffer, "func (c *%s) fields() []any {\n\treturn []any{%s}\n}\n\n", name, strings.Join(fieldRefs[schema.Version], ", "))
+		} else {
+			fmt.Fprintf(buffer, "// Version is the version of the frame, %s when it is not set.\n", command.versionConst())
+			fmt.Fprintf(buffer, "func (c *%s) Version() byte {\n\tif c.version == 0 {\n\t\treturn %s\n\t}\n\treturn c.version\n}\n\n", name, command.versionConst())
+			fmt.Fprintf(buffer, "// SetVersion sets the version of the frame to write or to read:\n// the fields added by a later version are not encoded.\n")
+			fmt.Fprintf(buffer, "func (c *%s) SetVersion(version byte) {\n\tc.version = version\n}\n\n", name)
+			fmt.Fprintf(buffer, "func (c *%s) fields() []any {\n\tfields := []any{%s}\n", name, strings.Join(fieldRefs[schema.Version], ", "))
+			for version := schema.Version + 1; version <= schema.latestVersion(command); version++ {
+				if len(fieldRefs[version]) > 0 {
+					fmt.Fprintf(buffer, "\tif c.Version() >= %d {\n\t\tfields = append(fields, %s)\n\t}\n", version, strings.Join(fieldRefs[version], ", "))
+				}
+			}
+			fmt.Fprintf(buffer, "\treturn fields\n}\n\n")
+		}
+		fmt.Fprintf(buffer, "func (c *%s) SizeNeeded() int {\n\treturn sizeOfFields(c)\n}\n\n", name)
+		fmt.Fprintf(buffer, "func (c *%s) Write(writer *bufio.Writer) (int, error) {\n\treturn writeFields(writer, c)\n}\n\n", name)
+		fmt.Fprintf(buffer, "func (c *%s) Read(reader *bufio.Reader) error {\n\treturn readFields(reader, c)\n}\n\n", name)
+		fmt.Fprintf(buffer, "func (c *%s) CorrelationId() uint32 {\n\treturn c.correlationId\n}\n\n", name)
+		fmt.Fprintf(buffer, "func (c *%s) SetCorrelationId(id uint32) {\n\tc.correlationId = id\n}\n\n", name)
+		if command.hasField("responseCode") {
+			fmt.Fprintf(buffer, "func (c *%s) ResponseCode() uint16 {\n\treturn c.responseCode\n}\n\n", name)
+		}
+	}
+
+	for _, item := range lists {
+		list := listCodec(item)
+		fmt.Fprintf(buffer, "// %s encodes a list of %s:\n// the number of entries (uint32) and then each entry.\n", list, item)
+		fmt.Fprintf(buffer, "type %s []*%s\n\n", list, item)
+		fmt.Fprintf(buffer, `func (l *%[1]s) sizeNeeded() int {
+	size := chatProtocolUint32
+	for _, entry := range *l {
+		size += sizeOfFields(entry)
+	}
+	return size
+}
+
+func (l *%[1]s) write(writer io.Writer) (int, error) {
+	written, err := writeMany(writer, len(*l))
+	if err != nil {
+		return written, err
+	}
+	for _, entry := range *l {
+		n, err := writeFields(writer, entry)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func (l *%[1]s) read(reader io.Reader) error {
+	var count int
+	if err := readAny(reader, &count); err != nil {
+		return err
+	}
+	entries := make([]*%[2]s, 0)
+	for i := 0; i < count; i++ {
+		entry := &%[2]s{}
+		if err := readFields(reader, entry); err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+	}
+	*l = entries
+	return nil
+}
+
+`, list, item)
+	}
+
+	source, err := format.Source(buffer.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("error formatting the generated code: %w", err)
+	}
+	return source, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// GenerateReadme returns the Markdown tables of the commands and the enums.
+func GenerateReadme(schema *Schema) string {
+	buffer := &bytes.Buffer{}
+	for _, section := range schema.Sections {
+		if section.Title != "" {
+			fmt.Fprintf(buffer, "## %s\n\n", section.Title)
+		}
+		if section.Readme != "" {
+			fmt.Fprintf(buffer, "%s\n\n", section.Readme)
+		}
+		for _, command := range section.Commands {
+			fmt.Fprintf(buffer, "### %s\n\n", command.Name)
+			if command.Readme != "" {
+				fmt.Fprintf(buffer, "%s\n\n", command.Readme)
+			}
+			versions := make([]string, 0)
+			for version := schema.Version; version <= schema.latestVersion(command); version++ {
+				versions = append(versions, fmt.Sprintf("0x%02X", version))
+			}
+			rows := [][]string{
+				{"`version`", "`byte`", strings.Join(versions, ", "), "`Header::version`"},
+				{"`key`", "`uint16`", command.Key, "`Header::command`"},
+			}
+			for _, field := range command.Fields {
+				reference := field.Doc
+				if since := schema.fieldSince(field); since > schema.Version {
+					reference = strings.TrimSuffix(fmt.Sprintf("since version 0x%02X, %s", since, field.Doc), ", ")
+				}
+				rows = append(rows, []string{"`" + field.Name + "`", "`" + field.Type + "`", "", reference})
+			}
+			writeTable(buffer, []string{"Name", "Type", "value(s)", "reference"}, rows)
+		}
+	}
+	for _, enum := range schema.Enums {
+		fmt.Fprintf(buffer, "### %s\n\n", enum.Name)
+		rows := make([][]string, 0, len(enum.Values))
+		for _, value := range enum.Values {
+			rows = append(rows, []string{"`" + value.Name + "`", value.Value})
+		}
+		writeTable(buffer, []string{"Name", "value(s)"}, rows)
+	}
+	return strings.TrimRight(buffer.String(), "\n")
+}
+
+func writeTable(buffer *bytes.Buffer, header []string, rows [][]string) {
+	widths := make([]int, len(header))
+	for i, h := range header {
+		widths[i] = len(h)
+	}
+	for _, row := range rows {
+		for i, cell := range row {
+			widths[i] = max(widths[i], len(cell))
+		}
+	}
+	writeRow := func(cells []string) {
+		for i, cell := range cells {
+			fmt.Fprintf(buffer, "| %-*s ", widths[i], cell)
+		}
+		fmt.Fprintf(buffer, "|\n")
+	}
+	writeRow(header)
+	separators := make([]string, len(header))
+	for i := range header {
+		separators[i] = strings.Repeat("-", widths[i])
+	}
+	writeRow(separators)
+	for _, row := range rows {
+		writeRow(row)
+	}
+	fmt.Fprintf(buffer, "\n")
+}
+
+// ReplaceReadme replaces the text between the README markers with the tables.
+func ReplaceReadme(readme string, tables string) (string, error) {
+	begin := strings.Index(readme, readmeBegin)
+	end := strings.Index(readme, readmeEnd)
+	if begin < 0 || end < begin {
+		return "", fmt.Errorf("the README must contain the markers %q and %q", readmeBegin, readmeEnd)
+	}
+	return readme[:begin+len(readmeBegin)] + "\n\n" + tables + "\n\n" + readme[end:], nil
+}
@@ -0,0 +1,13 @@
+package protocolgen_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestProtocolgen(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Protocolgen Suite")
+}
@@ -0,0 +1,89 @@
+package protocolgen_test
+
+import (
+	"gsantomaggio/chat/server/protocolgen"
+	"os"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Protocolgen", func() {
+	const schemaPath = "../../../protocol/schema.json"
+
+	It("The generated Go file is up to date", func() {
+		schema, err := protocolgen.LoadSchema(schemaPath)
+		Expect(err).NotTo(HaveOccurred())
+		source, err := protocolgen.GenerateGo(schema, "chat")
+		Expect(err).NotTo(HaveOccurred())
+		current, err := os.ReadFile("../chat/protocol_gen.go")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(source)).To(Equal(string(current)), "run `go generate ./chat` from server/go")
+	})
+
+	It("The README tables are up to date", func() {
+		schema, err := protocolgen.LoadSchema(schemaPath)
+		Expect(err).NotTo(HaveOccurred())
+		readme, err := os.ReadFile("../../../README.md")
+		Expect(err).NotTo(HaveOccurred())
+		updated, err := protocolgen.ReplaceReadme(string(readme), protocolgen.GenerateReadme(schema))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(updated).To(Equal(string(readme)), "run `go generate ./chat` from server/go")
+	})
+
+	It("ReplaceReadme needs the markers", func() {
+		_, err := protocolgen.ReplaceReadme("# README\n", "tables")
+		Expect(err).To(HaveOccurred())
+	})
+
+	Context("Validate", func() {
+		command := func(name, key string, fields ...*protocolgen.Field) *protocolgen.Command {
+			fields = append([]*protocolgen.Field{{Name: "correlationId", Type: "uint32"}}, fields...)
+			return &protocolgen.Command{Name: name, Key: key, Fields: fields}
+		}
+		schemaWith := func(commands ...*protocolgen.Command) *protocolgen.Schema {
+			return &protocolgen.Schema{Version: 1, Sections: []*protocolgen.Section{{Commands: commands}}}
+		}
+
+		It("Valid schema", func() {
+			Expect(schemaWith(command("A", "0x01"), command("B", "0x02",
+				&protocolgen.Field{Name: "List", Type: "[]A"})).Validate()).To(Succeed())
+		})
+
+		It("Duplicated key", func() {
+			Expect(schemaWith(command("A", "0x01"), command("B", "0x01")).Validate()).
+				To(MatchError(ContainSubstring("already used by A")))
+		})
+
+		It("Duplicated name", func() {
+			Expect(schemaWith(command("A", "0x01"), command("A", "0x02")).Validate()).
+				To(MatchError(ContainSubstring("declared twice")))
+		})
+
+		It("Missing correlationId", func() {
+			Expect(schemaWith(&protocolgen.Command{Name: "A", Key: "0x01"}).Validate()).
+				To(MatchError(ContainSubstring("correlationId")))
+		})
+
+		It("Versions of the fields", func() {
+			versioned := command("A", "0x01", &protocolgen.Field{Name: "F", Type: "string", Since: 2})
+			versioned.Version = 2
+			Expect(schemaWith(versioned).Validate()).To(Succeed())
+			// the field is after the latest version of the command
+			Expect(schemaWith(command("A", "0x01", &protocolgen.Field{Name: "F", Type: "string", Since: 2})).Validate()).
+				To(MatchError(ContainSubstring("after the latest version")))
+			// a new version adds the fields at the end
+			versioned = command("A", "0x01", &protocolgen.Field{Name: "F", Type: "string", Since: 2},
+				&protocolgen.Field{Name: "G", Type: "string"})
+			versioned.Version = 2
+			Expect(schemaWith(versioned).Validate()).To(MatchError(ContainSubstring("declared after the fields of version 2")))
+		})
+
+		It("Unsupported type", func() {
+			Expect(schemaWith(command("A", "0x01", &protocolgen.Field{Name: "F", Type: "float64"})).Validate()).
+				To(HaveOccurred())
+			Expect(schemaWith(command("A", "0x01", &protocolgen.Field{Name: "F", Type: "[]Unknown"})).Validate()).
+				To(HaveOccurred())
+		})
+	})
+})
@@ -2,23 +2,69 @@ package main
 
 import (
 	"bufio"
+	"flag"
 	"fmt"
 	"github.com/fatih/color"
 	"gsantomaggio/chat/server/chat"
 	"gsantomaggio/chat/server/tcp_client"
 	"os"
+	"strings"
 	"sync"
 	"time"
 )
 
 func main() {
-	args := os.Args
-	if len(args) < 2 {
-		fmt.Fprintf(os.Stderr, "usage: %s <server_address>\n", os.Args[0])
+	useTLS := flag.Bool("tls", false, "connect with TLS")
+	tlsCA := flag.String("tls-ca", "", "CA file (PEM) to verify the server certificate (system CAs when empty)")
+	tlsServerName := flag.String("tls-server-name", "", "name in the server certificate (host of the address when empty)")
+	tlsCert := flag.String("tls-cert", "", "client certificate file (PEM) for mutual TLS, the CN is the username")
+	tlsKey := flag.String("tls-key", "", "client key file (PEM) for mutual TLS")
+	heartbeatInterval := flag.Duration("heartbeat-interval", 0, "time between the pings to the server, 0 disables the heartbeat (only the Go server answers to the pings)")
+	reconnect := flag.Bool("reconnect", false, "reconnect and log in again when the connection is lost")
+	heartbeatMissed := flag.Int("heartbeat-missed", chat.DefaultHeartbeatMaxMissed, "pings without an answer before the server is considered dead")
+	baseProtocol := flag.Bool("base-protocol", false, "send the version 1 of the commands, the base protocol of the servers of the other languages (login without password)")
+	flag.Parse()
+	if flag.NArg() < 1 {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] <server_address>\n", os.Args[0])
+		flag.PrintDefaults()
 		return
 	}
+	serverAddr := flag.Arg(0)
 	in := bufio.NewReader(os.Stdin)
 	chMessages := make(chan *chat.CommandMessage)
+	chMessageStatus := make(chan *chat.CommandMessageStatus)
+	options := tcp_client.DefaultClientOptions()
+	if *baseProtocol {
+		options.ProtocolVersion = chat.Version1
+	}
+	client := tcp_client.NewChatClientWithOptions(chMessages, options)
+	client.NotifyMessageStatus(chMessageStatus)
+	chGoingAway := make(chan *chat.CommandServerGoingAway, 1)
+	client.NotifyServerGoingAway(chGoingAway)
+	go func() {
+		for goingAway := range chGoingAway {
+			color.Red("The server is going away: %s\n", goingAway.Reason)
+		}
+	}()
+	client.SetHeartbeat(*heartbeatInterval, *heartbeatMissed)
+	if *reconnect {
+		client.SetReconnectPolicy(tcp_client.DefaultReconnectPolicy())
+		client.OnStateChange(func(state tcp_client.ConnectionState, err error) {
+			switch state {
+			case tcp_client.StateReconnecting:
+				color.Yellow("Reconnecting... (%v)\n", err)
+			case tcp_client.StateConnected:
+				color.Green("Connected again\n")
+			}
+		})
+	}
+	chDisconnected := make(chan error, 1)
+	client.NotifyDisconnected(chDisconnected)
+	go func() {
+		err := <-chDisconnected
+		color.Red("Disconnected from the server: %v\n", err)
+		os.Exit(1)
+	}()
 
 	go func() {
 		totalReceived := 0
@@ -26,14 +72,53 @@ func main() {
 			msg := <-chMessages
 			totalReceived++
 			color.Green("****** New message received ******\n")
-			color.Green("%s -From : %s Text: %s - total: %d \n", chat.ConvertUint64ToTimeFormatted(msg.Time),
-				msg.From, msg.Message, totalReceived)
+			if msg.Room != "" {
+				color.Green("%s -Room: %s From : %s Text: %s - total: %d \n", chat.ConvertUint64ToTimeFormatted(msg.Time),
+					msg.Room, msg.From, msg.Message, totalReceived)
+			} else {
+				color.Green("%s -From : %s Text: %s - total: %d \n", chat.ConvertUint64ToTimeFormatted(msg.Time),
+					msg.From, msg.Message, totalReceived)
+			}
 			color.Green("****** End message received ******\n")
+			// the message is printed, so it is read
+			if msg.Id != 0 {
+				if err := client.MarkRead(msg.Id); err != nil {
+					fmt.Fprintf(os.Stderr, "error marking the message as read: %v\n", err)
+				}
+			}
+		}
+	}()
+
+	// the text of the messages sent, to show the status next to the message
+	sentMessages := make(map[uint64]string)
+	sentMutex := sync.Mutex{}
+	go func() {
+		for status := range chMessageStatus {
+			sentMutex.Lock()
+			text, ok := sentMessages[status.Id]
+			if status.Status == chat.MessageStatusRead {
+				delete(sentMessages, status.Id)
+			}
+			sentMutex.Unlock()
+			if !ok {
+				text = fmt.Sprintf("message %d", status.Id)
+			}
+			color.Yellow("%s - To: %s Text: %s [%s]\n", chat.ConvertUint64ToTimeFormatted(status.Time),
+				status.To, text, chat.FormMessageStatusToString(status.Status))
 		}
 	}()
 
-	client := tcp_client.NewChatClient(chMessages)
-	err := client.Connect(args[1])
+	var err error
+	if *useTLS {
+		tlsConfig, errTLS := tcp_client.NewClientTLSConfig(*tlsCA, *tlsServerName, *tlsCert, *tlsKey)
+		if errTLS != nil {
+			fmt.Printf("Error loading TLS configuration: %v\n", errTLS)
+			return
+		}
+		err = client.ConnectTLS(serverAddr, tlsConfig)
+	} else {
+		err = client.Connect(serverAddr)
+	}
 	if err != nil {
 		fmt.Printf("Error connecting to server: %v\n", err)
 		return
@@ -42,12 +127,35 @@ func main() {
 	fmt.Printf("Enter your user name:\n")
 	username, _ := in.ReadString('\n')
 	username = username[:len(username)-1]
+	fmt.Printf("Enter your password:\n")
+	password, _ := in.ReadString('\n')
+	password = password[:len(password)-1]
 
-	res, err := client.Login(username)
+	res, err := client.Login(username, password)
 	if err != nil {
 		return
 	}
 
+	if res.ResponseCode() == chat.ResponseCodeErrorUserNotFound {
+		fmt.Printf("User %s not found, register it? (y/n)\n", username)
+		answer, _ := in.ReadString('\n')
+		if strings.TrimSpace(answer) != "y" {
+			return
+		}
+		res, err = client.Register(username, password)
+		if err != nil {
+			return
+		}
+		if res.ResponseCode() != chat.ResponseCodeOk {
+			fmt.Printf("Register error: %s\n", chat.FormResponseCodeToString(res.ResponseCode()))
+			return
+		}
+		res, err = client.Login(username, password)
+		if err != nil {
+			return
+		}
+	}
+
 	if res.ResponseCode() != chat.ResponseCodeOk {
 		fmt.Printf("Login error: %s\n", chat.FormResponseCodeToString(res.ResponseCode()))
 		return
@@ -59,13 +167,24 @@ func main() {
 		time.Sleep(500 * time.Millisecond)
 		fmt.Printf("****Menu****\n")
 		fmt.Printf("1. Send a message\n")
-		fmt.Printf("2. Test correlation id\n")
-		fmt.Printf("3. Exit\n")
+		fmt.Printf("2. Send a message to many users\n")
+		fmt.Printf("3. List users\n")
+		fmt.Printf("4. Test correlation id\n")
+		fmt.Printf("5. Rooms\n")
+		fmt.Printf("6. History\n")
+		fmt.Printf("7. Exit\n")
 		fmt.Printf("************\n")
 
 		option, _ := in.ReadString('\n')
 		option = option[:len(option)-1]
-		if option == "3" {
+		if option == "7" {
+			res, err = client.Logout()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error during logout: %v\n", err)
+			} else {
+				fmt.Printf("Logout %s\n", chat.FormResponseCodeToString(res.ResponseCode()))
+			}
+			_ = client.Close()
 			break
 		}
 
@@ -76,20 +195,133 @@ func main() {
 			fmt.Printf("Message text:\n")
 			message, _ := in.ReadString('\n')
 			message = message[:len(message)-1]
-			res, err = client.SendMessage(message, userTo)
+			sent, err := client.SendMessage(message, userTo)
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "error sending message: %v\n", err)
 				return
 			}
-			if res.ResponseCode() != chat.ResponseCodeOk {
-				fmt.Fprintf(os.Stderr, "error sending message: %s\n", chat.FormResponseCodeToString(res.ResponseCode()))
+			if sent.ResponseCode() != chat.ResponseCodeOk {
+				fmt.Fprintf(os.Stderr, "error sending message: %s\n", chat.FormResponseCodeToString(sent.ResponseCode()))
 			} else {
-
-				fmt.Printf("Message sent. Response code: %s\n", chat.FormResponseCodeToString(res.ResponseCode()))
+				sentMutex.Lock()
+				sentMessages[sent.Id] = message
+				sentMutex.Unlock()
+				fmt.Printf("Message sent. Response code: %s [Sent]\n", chat.FormResponseCodeToString(sent.ResponseCode()))
 			}
 		}
 
 		if option == "2" {
+			fmt.Printf("Write the users separated by comma (empty to send to all):\n")
+			usersTo, _ := in.ReadString('\n')
+			usersTo = strings.TrimSpace(usersTo)
+			fmt.Printf("Message text:\n")
+			message, _ := in.ReadString('\n')
+			message = message[:len(message)-1]
+			var multiRes *chat.MultiMessageResponse
+			if usersTo == "" {
+				multiRes, err = client.Broadcast(message)
+			} else {
+				multiRes, err = client.SendMessageToMany(message, strings.Split(usersTo, ","))
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error sending message: %v\n", err)
+				return
+			}
+			fmt.Printf("Message sent. Response code: %s\n", chat.FormResponseCodeToString(multiRes.ResponseCode()))
+			fmt.Printf("Delivered: %v, Queued: %v, Not found: %v, Mailbox full: %v\n", multiRes.Delivered, multiRes.Queued, multiRes.NotFound, multiRes.MailboxFull)
+		}
+
+		if option == "3" {
+			users, err := client.ListUsers()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error listing users: %v\n", err)
+				return
+			}
+			for _, user := range users.Online {
+				color.Cyan("%s is online, last login: %s\n", user, users.LastLogin[user])
+			}
+			for _, user := range users.Offline {
+				color.White("%s is offline, last login: %s\n", user, users.LastLogin[user])
+			}
+		}
+
+		if option == "5" {
+			fmt.Printf("a. Create  b. Join  c. Leave  d. Members  e. Send a message\n")
+			roomOption, _ := in.ReadString('\n')
+			roomOption = strings.TrimSpace(roomOption)
+			fmt.Printf("Room name:\n")
+			room, _ := in.ReadString('\n')
+			room = strings.TrimSpace(room)
+			switch roomOption {
+			case "a", "b", "c":
+				var roomRes *chat.GenericResponse
+				if roomOption == "a" {
+					roomRes, err = client.CreateRoom(room)
+				} else if roomOption == "b" {
+					roomRes, err = client.JoinRoom(room)
+				} else {
+					roomRes, err = client.LeaveRoom(room)
+				}
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "error on room %s: %v\n", room, err)
+					return
+				}
+				fmt.Printf("Room %s. Response code: %s\n", room, chat.FormResponseCodeToString(roomRes.ResponseCode()))
+			case "d":
+				members, err := client.RoomMembers(room)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "error listing the room members: %v\n", err)
+					return
+				}
+				fmt.Printf("Room %s. Response code: %s, members: %v\n", room,
+					chat.FormResponseCodeToString(members.ResponseCode()), members.Members)
+			case "e":
+				fmt.Printf("Message text:\n")
+				message, _ := in.ReadString('\n')
+				message = message[:len(message)-1]
+				multiRes, err := client.SendRoomMessage(room, message)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "error sending message: %v\n", err)
+					return
+				}
+				fmt.Printf("Message sent. Response code: %s\n", chat.FormResponseCodeToString(multiRes.ResponseCode()))
+				fmt.Printf("Delivered: %v, Queued: %v\n", multiRes.Delivered, multiRes.Queued)
+			}
+		}
+
+		if option == "6" {
+			fmt.Printf("History with the user:\n")
+			peer, _ := in.ReadString('\n')
+			peer = strings.TrimSpace(peer)
+			var beforeId uint64
+			for {
+				history, err := client.History(peer, beforeId, 0, 10)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "error reading the history: %v\n", err)
+					return
+				}
+				if history.ResponseCode() != chat.ResponseCodeOk {
+					fmt.Fprintf(os.Stderr, "error reading the history: %s\n", chat.FormResponseCodeToString(history.ResponseCode()))
+					break
+				}
+				for _, msg := range history.Messages {
+					color.White("%s - From: %s To: %s Text: %s\n", chat.ConvertUint64ToTimeFormatted(msg.Time),
+						msg.From, msg.To, msg.Message)
+				}
+				// an empty page has no cursor for the next one
+				if !history.More || len(history.Messages) == 0 {
+					break
+				}
+				fmt.Printf("Older messages? (y/n)\n")
+				answer, _ := in.ReadString('\n')
+				if strings.TrimSpace(answer) != "y" {
+					break
+				}
+				beforeId = history.Messages[0].Id
+			}
+		}
+
+		if option == "4" {
 			waitGroup := sync.WaitGroup{}
 			for i := 0; i < 20; i++ {
 				waitGroup.Add(1)
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"gsantomaggio/chat/server/conformance"
+	"gsantomaggio/chat/server/tcp_client"
+	"os"
+	"time"
+)
+
+// conformance checks that a chat server, in any language, implements the protocol.
+func main() {
+	timeout := flag.Duration("timeout", 5*time.Second, "max wait for each response")
+	useTLS := flag.Bool("tls", false, "connect with TLS")
+	tlsCA := flag.String("tls-ca", "", "CA file (PEM) to verify the server certificate (system CAs when empty)")
+	tlsServerName := flag.String("tls-server-name", "", "name in the server certificate (host of the address when empty)")
+	flag.Parse()
+	if flag.NArg() < 1 {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] <server_address>\n", os.Args[0])
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+
+	var tlsConfig *tls.Config
+	if *useTLS {
+		var err error
+		tlsConfig, err = tcp_client.NewClientTLSConfig(*tlsCA, *tlsServerName, "", "")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error loading TLS configuration: %v\n", err)
+			os.Exit(2)
+		}
+	}
+
+	runner := conformance.NewRunner(conformance.Config{
+		Address:   flag.Arg(0),
+		TLSConfig: tlsConfig,
+		Timeout:   *timeout,
+	})
+	fmt.Printf("Running the conformance checks against %s\n\n", flag.Arg(0))
+	if conformance.PrintReport(os.Stdout, runner.Run()) > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"gsantomaggio/chat/server/protocolgen"
+	"os"
+)
+
+// protocolgen generates the Go command types and the README protocol tables
+// from the protocol schema. Run it with `go generate ./chat` from server/go.
+func main() {
+	schemaPath := flag.String("schema", "", "protocol schema file (JSON)")
+	goOut := flag.String("go", "", "Go file to generate with the command types")
+	goPackage := flag.String("package", "chat", "package of the generated Go file")
+	readmePath := flag.String("readme", "", "README file where the protocol tables are replaced")
+	flag.Parse()
+
+	if *schemaPath == "" || (*goOut == "" && *readmePath == "") {
+		fmt.Fprintf(os.Stderr, "usage: %s -schema <schema.json> [-go <file.go>] [-readme <README.md>]\n", os.Args[0])
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+
+	schema, err := protocolgen.LoadSchema(*schemaPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	if *goOut != "" {
+		source, err := protocolgen.GenerateGo(schema, *goPackage)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		if err := os.WriteFile(*goOut, source, 0o644); err != nil {
+			fmt.Fprintf(os.Stderr, "error writing %s: %v\n", *goOut, err)
+			os.Exit(1)
+		}
+	}
+
+	if *readmePath != "" {
+		readme, err := os.ReadFile(*readmePath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error reading %s: %v\n", *readmePath, err)
+			os.Exit(1)
+		}
+		updated, err := protocolgen.ReplaceReadme(string(readme), protocolgen.GenerateReadme(schema))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", *readmePath, err)
+			os.Exit(1)
+		}
+		if err := os.WriteFile(*readmePath, []byte(updated), 0o644); err != nil {
+			fmt.Fprintf(os.Stderr, "error writing %s: %v\n", *readmePath, err)
+			os.Exit(1)
+		}
+	}
+}
@@ -1,54 +1,167 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"github.com/fatih/color"
+	"gsantomaggio/chat/server/config"
 	"gsantomaggio/chat/server/tcp_server"
+	"log/slog"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
 func printColoredMessage(event *tcp_server.Event) {
-	switch event.Level() {
-	case 1:
-		color.Cyan("%s: %s\n", event.Time().Format("2006-01-02 15:04:05"), event.Message())
-	case 2:
-		color.Green("%s: %s\n", event.Time().Format("2006-01-02 15:04:05"), event.Message())
-	case 3:
-		color.Red("%s: %s\n", event.Time().Format("2006-01-02 15:04:05"), event.Message())
-	case 4:
-		color.Yellow("%s: %s\n", event.Time().Format("2006-01-02 15:04:05"), event.Message())
+	line := fmt.Sprintf("%s: %s", event.Time().Format("2006-01-02 15:04:05"), event.Message())
+	for _, attr := range event.Attrs() {
+		line += fmt.Sprintf(" %s=%v", attr.Key, attr.Value)
+	}
+	switch {
+	case event.Level() >= slog.LevelError:
+		color.Red("%s\n", line)
+	case event.Level() >= slog.LevelWarn:
+		color.Yellow("%s\n", line)
+	case event.Level() >= slog.LevelInfo:
+		color.Green("%s\n", line)
 	default:
-		color.White("%s: %s\n", event.Time().Format("2006-01-02 15:04:05"), event.Message())
+		color.Cyan("%s\n", line)
 	}
-
 }
 
-func main() {
-
-	args := os.Args
-	if len(args) < 2 {
-		fmt.Fprintf(os.Stderr, "usage: %s <server_address>\n", os.Args[0])
+// logEvents writes the events with the level or a higher one, in the format:
+// color for the terminal, text or json for the slog handlers.
+func logEvents(events <-chan *tcp_server.Event, format string, level slog.Level) {
+	var handler slog.Handler
+	options := &slog.HandlerOptions{Level: level}
+	switch format {
+	case "json":
+		handler = slog.NewJSONHandler(os.Stdout, options)
+	case "text":
+		handler = slog.NewTextHandler(os.Stdout, options)
+	default:
+		for event := range events {
+			if event.Level() >= level {
+				printColoredMessage(event)
+			}
+		}
 		return
 	}
-	serverAddr := args[1]
+	tcp_server.LogEvents(events, slog.New(handler))
+}
 
-	events := make(chan *tcp_server.Event)
+// serveHTTP listens on the address and serves the handler in a goroutine, the caller shuts it down.
+// The error of the listen is returned, the errors of the server are sent to failed.
+func serveHTTP(address string, handler http.Handler, failed chan<- error) (*http.Server, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("error starting the HTTP server at %s: %w", address, err)
+	}
+	server := &http.Server{Handler: handler}
 	go func() {
-		for event := range events {
-			printColoredMessage(event)
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			failed <- fmt.Errorf("error in the HTTP server at %s: %w", address, err)
 		}
 	}()
+	return server, nil
+}
 
-	tcpServer := tcp_server.NewTcpServer(serverAddr, events)
-	err := tcpServer.StartInAThread()
+func main() {
+	os.Exit(run())
+}
 
+// run starts the server and waits for the stop, it returns the exit code:
+// 2 for an invalid configuration, 1 when the server fails.
+func run() int {
+	cfg, err := config.Load(os.Args[1:], os.Getenv, os.Stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	}
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "error starting TCP server: %v\n", err)
-		return
+		fmt.Fprintf(os.Stderr, "error in the configuration: %v\n", err)
+		return 2
+	}
+	level, _ := cfg.LogLevel()
+
+	storage, err := cfg.OpenStorage()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error opening the storage: %v\n", err)
+		return 1
+	}
+	defer storage.Close()
+	options, err := cfg.ServerOptions(storage)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+
+	events := make(chan *tcp_server.Event, cfg.Log.EventsBuffer)
+	go logEvents(events, cfg.Log.Format, level)
+
+	tcpServer := tcp_server.NewTcpServerWithOptions(options, events)
+	err = tcpServer.StartInAThread()
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+
+	exitCode := 0
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	// failed receives the errors of the HTTP servers, they stop the process
+	failed := make(chan error, 2)
+	var httpServers []*http.Server
+	startHTTP := func(address string, handler http.Handler, url string) {
+		httpServer, err := serveHTTP(address, handler, failed)
+		if err != nil {
+			failed <- err
+			return
+		}
+		httpServers = append(httpServers, httpServer)
+		fmt.Printf("%s\n", url)
+	}
+	if cfg.Metrics.Address != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", tcpServer.MetricsHandler())
+		startHTTP(cfg.Metrics.Address, mux, fmt.Sprintf("metrics at http://%s/metrics", cfg.Metrics.Address))
+	}
+	if cfg.Admin.Address != "" {
+		startHTTP(cfg.Admin.Address, tcpServer.AdminHandler(cfg.Admin.Token), fmt.Sprintf("admin API at http://%s/admin/", cfg.Admin.Address))
 	}
 
-	fmt.Printf("press enter to stop the server\n")
-	fmt.Scanln()
-	tcpServer.Stop()
+	if cfg.Interactive {
+		go func() {
+			// stdin closed, like in a service, is not a stop
+			if _, err := bufio.NewReader(os.Stdin).ReadString('\n'); err == nil {
+				stop <- os.Interrupt
+			}
+		}()
+		fmt.Printf("press enter or ctrl-c to stop the server\n")
+	}
+	select {
+	case <-stop:
+	case err := <-failed:
+		fmt.Fprintf(os.Stderr, "%v, stopping the server\n", err)
+		exitCode = 1
+	}
 
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := tcpServer.Shutdown(ctx); err != nil {
+		fmt.Fprintf(os.Stderr, "error during the shutdown: %v\n", err)
+		exitCode = 1
+	}
+	for _, httpServer := range httpServers {
+		_ = httpServer.Shutdown(ctx)
+	}
+	if dropped := tcpServer.DroppedEvents(); dropped > 0 {
+		fmt.Fprintf(os.Stderr, "%d events dropped, the output was too slow\n", dropped)
+	}
+	return exitCode
 }
@@ -2,6 +2,8 @@ package tcp_client
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"gsantomaggio/chat/server/chat"
@@ -17,39 +19,263 @@ type Response struct {
 	responseCode  int
 	data          chan any
 	correlationId uint32
+	// err is the reason why data is closed without a response
+	err error
 }
 
+// NewResponse creates the pending response of a command. The channel is buffered:
+// the reader of the connection doesn't wait for the caller.
 func NewResponse(correlationId uint32) *Response {
 	return &Response{
 		correlationId: correlationId,
-		data:          make(chan any),
+		data:          make(chan any, 1),
 	}
 }
 
+// ClientOptions are the default timeouts of the client. The methods with
+// a context use the deadline of the context when it is set.
+type ClientOptions struct {
+	// RequestTimeout is the max time to wait for the response of a command
+	RequestTimeout time.Duration
+	// ConnectTimeout is the max time to connect to the server, TLS handshake included
+	ConnectTimeout time.Duration
+	// HeartbeatInterval and HeartbeatMaxMissed, see SetHeartbeat.
+	// The heartbeat is disabled when HeartbeatInterval is 0.
+	HeartbeatInterval  time.Duration
+	HeartbeatMaxMissed int
+	// ProtocolVersion is the version of the commands with more than one version, the latest
+	// when 0. chat.Version1 is the base protocol of the servers of the other languages:
+	// the login has no password and the messages have no id.
+	ProtocolVersion byte
+}
+
+// DefaultClientOptions waits 5 seconds for the responses and 10 seconds for the connection.
+// The heartbeat is disabled: only the Go server answers to CommandPing.
+func DefaultClientOptions() ClientOptions {
+	return ClientOptions{
+		RequestTimeout:     5 * time.Second,
+		ConnectTimeout:     10 * time.Second,
+		HeartbeatMaxMissed: chat.DefaultHeartbeatMaxMissed,
+	}
+}
+
+var (
+	// ErrServerNotResponding is sent to the NotifyDisconnected channel when
+	// the server doesn't answer to the heartbeats
+	ErrServerNotResponding = errors.New("the server doesn't answer to the heartbeats")
+	// ErrConnectionLost is sent to the NotifyDisconnected channel when the
+	// connection is closed by the server or by the network
+	ErrConnectionLost = errors.New("connection lost")
+	// ErrNotConnected is returned by the commands sent while the client is reconnecting
+	ErrNotConnected = errors.New("the client is not connected")
+	// errClientClosed is the reason of the connection closed by Close
+	errClientClosed = errors.New("the client is closed")
+)
+
+// clientConnection is a connection to the server. The client replaces it when it reconnects.
+type clientConnection struct {
+	conn   net.Conn
+	writer *chat.ConnectionWriter
+	// lost is closed when the connection is closed, reason is the first error
+	lost     chan struct{}
+	lostOnce sync.Once
+	reason   error
+	mutex    sync.Mutex
+	isLost   bool
+	// established is false while the client logs in again after a reconnection,
+	// see ChatClient.establish
+	established bool
+}
+
+func newClientConnection(conn net.Conn, established bool) *clientConnection {
+	return &clientConnection{
+		conn:        conn,
+		writer:      chat.NewConnectionWriter(conn, 0, 0),
+		lost:        make(chan struct{}),
+		established: established,
+	}
+}
+
+// close closes the connection. The reason of the first call is kept.
+func (c *clientConnection) close(reason error) {
+	c.lostOnce.Do(func() {
+		c.reason = reason
+		close(c.lost)
+		_ = c.conn.Close()
+		_ = c.writer.Close()
+	})
+}
+
+// maxSeenMessages is the number of message ids remembered to discard the duplicates
+const maxSeenMessages = 10_000
+
 type ChatClient struct {
-	tcpConn           *net.TCPConn
-	chMessages        chan *chat.CommandMessage
+	// connMutex protects current, currentUser and password
+	connMutex sync.Mutex
+	current   *clientConnection
+	// dial opens a new connection, with the address and the TLS configuration of Connect
+	dial            func() (net.Conn, error)
+	reconnectPolicy *ReconnectPolicy
+	onStateChange   func(state ConnectionState, err error)
+	options         ClientOptions
+	chMessages      chan *chat.CommandMessage
+	chMessageStatus chan *chat.CommandMessageStatus
+	chGoingAway     chan *chat.CommandServerGoingAway
+	chDisconnected  chan error
+	// heartbeatInterval and heartbeatMaxMissed detect the dead server, see SetHeartbeat
+	heartbeatInterval  time.Duration
+	heartbeatMaxMissed int
+	// closing is closed by Close, closed is set so the disconnection isn't notified
+	closing           chan struct{}
+	closed            atomic.Bool
 	nextCorrelationId uint32
 	respMutex         sync.Mutex
 	responses         map[uint32]*Response
 	currentUser       string
+	// password is used to log in again after a reconnection
+	password string
+	// the ids of the last messages received, the server can send
+	// a message again when the ack is lost
+	seenMessages      map[uint64]struct{}
+	seenMessagesOrder []uint64
 }
 
 func NewChatClient(receiver chan *chat.CommandMessage) *ChatClient {
+	return NewChatClientWithOptions(receiver, DefaultClientOptions())
+}
+
+// NewChatClientWithOptions creates a client with the timeouts of the options.
+// The zero values use the defaults of DefaultClientOptions.
+func NewChatClientWithOptions(receiver chan *chat.CommandMessage, options ClientOptions) *ChatClient {
+	defaults := DefaultClientOptions()
+	if options.RequestTimeout <= 0 {
+		options.RequestTimeout = defaults.RequestTimeout
+	}
+	if options.ConnectTimeout <= 0 {
+		options.ConnectTimeout = defaults.ConnectTimeout
+	}
+	if options.HeartbeatMaxMissed <= 0 {
+		options.HeartbeatMaxMissed = defaults.HeartbeatMaxMissed
+	}
 	fc := &ChatClient{
-		chMessages: receiver,
-		responses:  make(map[uint32]*Response),
+		options:            options,
+		chMessages:         receiver,
+		responses:          make(map[uint32]*Response),
+		seenMessages:       make(map[uint64]struct{}),
+		closing:            make(chan struct{}),
+		heartbeatInterval:  options.HeartbeatInterval,
+		heartbeatMaxMissed: options.HeartbeatMaxMissed,
 	}
 	return fc
 }
+
+// NotifyMessageStatus sets the channel where the client sends the status
+// (delivered, read) of the messages sent by the current user.
+// The status notifications are discarded when the channel is not set.
+func (f *ChatClient) NotifyMessageStatus(receiver chan *chat.CommandMessageStatus) {
+	f.chMessageStatus = receiver
+}
+
+// NotifyServerGoingAway sets the channel where the client sends the
+// notification of the server shutdown. The server closes the connection after it.
+// The notification is discarded when the channel is not set.
+func (f *ChatClient) NotifyServerGoingAway(receiver chan *chat.CommandServerGoingAway) {
+	f.chGoingAway = receiver
+}
+
+// NotifyDisconnected sets the channel where the client sends the error when the
+// connection is lost: ErrServerNotResponding when the server doesn't answer
+// to the heartbeats, ErrConnectionLost when the connection is closed.
+// With a reconnect policy the error is sent when the client stops reconnecting,
+// wrapped in ErrReconnectFailed. The error is not sent when the client is closed with Close.
+func (f *ChatClient) NotifyDisconnected(receiver chan error) {
+	f.chDisconnected = receiver
+}
+
+// SetHeartbeat sets the interval of the pings sent to the server and the number of
+// pings without an answer before the server is considered dead: the connection is
+// closed and ErrServerNotResponding is sent to the NotifyDisconnected channel.
+// An interval of 0 disables the heartbeat, the default: the servers of the other
+// languages in this repo don't answer to CommandPing. It must be called before Connect.
+func (f *ChatClient) SetHeartbeat(interval time.Duration, maxMissed int) {
+	f.heartbeatInterval = interval
+	f.heartbeatMaxMissed = maxMissed
+}
+
+// markMessageSeen returns false when the message id was already received.
+func (f *ChatClient) markMessageSeen(id uint64) bool {
+	if _, ok := f.seenMessages[id]; ok {
+		return false
+	}
+	f.seenMessages[id] = struct{}{}
+	f.seenMessagesOrder = append(f.seenMessagesOrder, id)
+	if len(f.seenMessagesOrder) > maxSeenMessages {
+		delete(f.seenMessages, f.seenMessagesOrder[0])
+		f.seenMessagesOrder = f.seenMessagesOrder[1:]
+	}
+	return true
+}
+
+// ackMessage tells the server that the message is received,
+// so the server removes it from the mailbox.
+func (f *ChatClient) ackMessage(id uint64) error {
+	return f.send(chat.NewCommandMessageAck(id))
+}
+
+// connection returns the current connection, nil before Connect.
+func (f *ChatClient) connection() *clientConnection {
+	f.connMutex.Lock()
+	defer f.connMutex.Unlock()
+	return f.current
+}
+
+// send writes the command on the current connection.
+// It returns ErrNotConnected when the connection is lost.
+func (f *ChatClient) send(command internal.CommandWrite) error {
+	c := f.connection()
+	if c == nil {
+		return ErrNotConnected
+	}
+	select {
+	case <-c.lost:
+		return ErrNotConnected
+	default:
+	}
+	return c.writer.Send(command)
+}
+
+// session returns the user logged in and the password, used to log in again.
+func (f *ChatClient) session() (string, string) {
+	f.connMutex.Lock()
+	defer f.connMutex.Unlock()
+	return f.currentUser, f.password
+}
+
+func (f *ChatClient) setSession(user, password string) {
+	f.connMutex.Lock()
+	defer f.connMutex.Unlock()
+	f.currentUser = user
+	f.password = password
+}
+
+// username returns the user logged in, empty when no user is logged.
+func (f *ChatClient) username() string {
+	user, _ := f.session()
+	return user
+}
 func (f *ChatClient) atomicIncrementCorrelationId() uint32 {
 	return atomic.AddUint32(&f.nextCorrelationId, 1)
 }
 
-func (f *ChatClient) AddResponse(correlationId uint32) {
+// AddResponse registers the pending response for the correlationId and returns it.
+// The caller waits on the returned response: the entry is removed from the pending
+// responses as soon as the response arrives or the connection is lost.
+func (f *ChatClient) AddResponse(correlationId uint32) *Response {
 	f.respMutex.Lock()
 	defer f.respMutex.Unlock()
-	f.responses[correlationId] = NewResponse(correlationId)
+	resp := NewResponse(correlationId)
+	f.responses[correlationId] = resp
+	return resp
 }
 
 func (f *ChatClient) GetResponse(correlationId uint32) *Response {
@@ -58,18 +284,63 @@ func (f *ChatClient) GetResponse(correlationId uint32) *Response {
 	return f.responses[correlationId]
 }
 
+// WaitResponse waits for the response with the default timeout, see ClientOptions.
 func (f *ChatClient) WaitResponse(correlationId uint32) (any, error) {
+	return f.WaitResponseContext(context.Background(), correlationId)
+}
+
+// WaitResponseContext waits for the response until the context is done.
+// Without a deadline in the context the default timeout is used.
+// The pending response is removed when the wait ends.
+func (f *ChatClient) WaitResponseContext(ctx context.Context, correlationId uint32) (any, error) {
 	resp := f.GetResponse(correlationId)
 	if resp == nil {
-		return nil, fmt.Errorf("Response not found for correlationId %d\n", correlationId)
+		return nil, fmt.Errorf("response not found for correlationId %d", correlationId)
 	}
+	return f.waitResponse(ctx, resp)
+}
+
+// waitResponse waits on the response returned by AddResponse until the context is done.
+// The pending response is removed when the wait ends.
+func (f *ChatClient) waitResponse(ctx context.Context, resp *Response) (any, error) {
+	correlationId := resp.correlationId
+	defer f.deleteResponse(correlationId)
+	ctx, cancel := f.withDefaultTimeout(ctx)
+	defer cancel()
 	select {
-	case data := <-resp.data:
+	case data, ok := <-resp.data:
+		if !ok {
+			if resp.err != nil {
+				return nil, resp.err
+			}
+			return nil, fmt.Errorf("response removed for correlationId %d", correlationId)
+		}
 		return data, nil
-	case <-time.After(time.Duration(5) * time.Second):
-		return nil, fmt.Errorf("Timeout waiting for response with correlationId %d\n", correlationId)
+	case <-ctx.Done():
+		return nil, fmt.Errorf("waiting for the response with correlationId %d: %w", correlationId, ctx.Err())
 	}
+}
+
+// withDefaultTimeout adds the RequestTimeout of the options to a context without deadline.
+func (f *ChatClient) withDefaultTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, f.options.RequestTimeout)
+}
 
+// deliverResponse sends the response to the caller waiting for it and removes it.
+// The responses received after the caller stopped waiting are discarded.
+func (f *ChatClient) deliverResponse(correlationId uint32, data any) {
+	f.respMutex.Lock()
+	defer f.respMutex.Unlock()
+	resp, ok := f.responses[correlationId]
+	if !ok {
+		return
+	}
+	delete(f.responses, correlationId)
+	// buffered and delivered once, it doesn't block
+	resp.data <- data
 }
 
 func (f *ChatClient) RemoveResponse(correlationId uint32) {
@@ -83,66 +354,398 @@ func (f *ChatClient) RemoveResponse(correlationId uint32) {
 	delete(f.responses, correlationId)
 }
 
+// deleteResponse removes the response without closing it: the command was not sent
+// or the caller doesn't wait anymore.
+func (f *ChatClient) deleteResponse(correlationId uint32) {
+	f.respMutex.Lock()
+	defer f.respMutex.Unlock()
+	delete(f.responses, correlationId)
+}
+
+// failResponses ends the wait of all the pending responses with the error.
+// It is called when the connection is lost.
+func (f *ChatClient) failResponses(err error) {
+	f.respMutex.Lock()
+	defer f.respMutex.Unlock()
+	for correlationId, resp := range f.responses {
+		resp.err = err
+		close(resp.data)
+		delete(f.responses, correlationId)
+	}
+}
+
 func (f *ChatClient) Connect(servAddr string) error {
 	tcpAddr, err := net.ResolveTCPAddr("tcp", servAddr)
 	if err != nil {
 		return err
 	}
-	conn, err := net.DialTCP("tcp", nil, tcpAddr)
+	f.dial = func() (net.Conn, error) {
+		dialer := &net.Dialer{Timeout: f.options.ConnectTimeout}
+		return dialer.Dial("tcp", tcpAddr.String())
+	}
+	conn, err := f.dial()
 	if err != nil {
 		return err
 	}
-	f.tcpConn = conn
+	_, err = f.start(conn, true)
+	return err
+}
 
-	go func() {
-		f.WaitMessages()
-	}()
+// ConnectTLS connects to the server with TLS. See NewClientTLSConfig.
+func (f *ChatClient) ConnectTLS(servAddr string, config *tls.Config) error {
+	f.dial = func() (net.Conn, error) {
+		dialer := &net.Dialer{Timeout: f.options.ConnectTimeout}
+		return tls.DialWithDialer(dialer, "tcp", servAddr, config)
+	}
+	conn, err := f.dial()
+	if err != nil {
+		return err
+	}
+	_, err = f.start(conn, true)
+	return err
+}
+
+// start makes conn the current connection, reads its frames and sends the heartbeats.
+func (f *ChatClient) start(conn net.Conn, established bool) (*clientConnection, error) {
+	c := newClientConnection(conn, established)
+	f.connMutex.Lock()
+	if f.closed.Load() {
+		f.connMutex.Unlock()
+		c.close(errClientClosed)
+		return nil, errClientClosed
+	}
+	f.current = c
+	f.connMutex.Unlock()
 
-	return nil
+	go f.waitMessages(c)
+	f.sendHeartbeats(c)
+	return c, nil
 }
 
+// Close writes the commands queued and closes the connection.
+// The client doesn't reconnect anymore.
 func (f *ChatClient) Close() error {
-	return f.tcpConn.Close()
+	f.connMutex.Lock()
+	if f.closed.CompareAndSwap(false, true) {
+		close(f.closing)
+	}
+	c := f.current
+	f.connMutex.Unlock()
+	if c == nil {
+		return nil
+	}
+	_ = c.writer.Close()
+	err := c.conn.Close()
+	c.close(errClientClosed)
+	return err
+}
+
+// Ping sends a heartbeat and waits for the answer of the server.
+// It returns an error when the server doesn't answer in the request timeout.
+func (f *ChatClient) Ping() error {
+	return f.PingContext(context.Background())
+}
+
+// PingContext is Ping with a context.
+func (f *ChatClient) PingContext(ctx context.Context) error {
+	// any answer proves that the server is alive, also the ErrorUnknownCommand
+	// of a server without the heartbeat
+	_, err := f.sendRPC(ctx, chat.NewCommandPing())
+	return err
 }
 
-func (f *ChatClient) sendRPCCommand(command internal.SyncCommandWrite) (*chat.GenericResponse, error) {
+// sendHeartbeats pings the server every heartbeat interval, until the connection is lost.
+// After heartbeatMaxMissed pings without an answer the connection is closed
+// with ErrServerNotResponding.
+func (f *ChatClient) sendHeartbeats(c *clientConnection) {
+	if f.heartbeatInterval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(f.heartbeatInterval)
+		defer ticker.Stop()
+		missed := 0
+		for {
+			select {
+			case <-c.lost:
+				return
+			case <-ticker.C:
+				ctx, cancel := context.WithTimeout(context.Background(), f.heartbeatInterval)
+				err := f.PingContext(ctx)
+				cancel()
+				if err != nil {
+					missed++
+					if missed >= f.heartbeatMaxMissed {
+						c.close(ErrServerNotResponding)
+						return
+					}
+					continue
+				}
+				missed = 0
+			}
+		}
+	}()
+}
+
+// notifyDisconnected sends the error to the NotifyDisconnected channel,
+// unless the client is closed by Close.
+func (f *ChatClient) notifyDisconnected(err error) {
+	if f.closed.Load() {
+		return
+	}
+	if f.chDisconnected != nil {
+		f.chDisconnected <- err
+	}
+}
+
+// sendRPC sends the command and waits for the response with the same correlationId.
+// The caller converts the response to the type expected by the command.
+func (f *ChatClient) sendRPC(ctx context.Context, command internal.SyncCommandWrite) (any, error) {
 	command.SetCorrelationId(f.atomicIncrementCorrelationId())
-	f.AddResponse(command.CorrelationId())
-	err := chat.WriteCommandWithHeader(command, bufio.NewWriter(f.tcpConn))
+	resp := f.AddResponse(command.CorrelationId())
+	err := f.send(command)
 	if err != nil {
+		f.deleteResponse(command.CorrelationId())
 		return nil, err
 	}
-	resp, err := f.WaitResponse(command.CorrelationId())
+	return f.waitResponse(ctx, resp)
+}
+
+func (f *ChatClient) sendRPCCommand(ctx context.Context, command internal.SyncCommandWrite) (*chat.GenericResponse, error) {
+	return typedResponse[*chat.GenericResponse](f.sendRPC(ctx, command))
+}
+
+// typedResponse converts the response to the type expected by the command.
+// The server answers with a GenericResponse to the commands it can't decode,
+// for example ErrorUnknownCommand from a server that doesn't know the command.
+func typedResponse[T any](resp any, err error) (T, error) {
+	var zero T
+	if err != nil {
+		return zero, err
+	}
+	if typed, ok := resp.(T); ok {
+		return typed, nil
+	}
+	if generic, ok := resp.(*chat.GenericResponse); ok {
+		return zero, fmt.Errorf("the server refused the command: %s", chat.FormResponseCodeToString(generic.ResponseCode()))
+	}
+	return zero, fmt.Errorf("unexpected response %T", resp)
+}
+
+// Register creates a new account. The user must log in with Login.
+func (f *ChatClient) Register(user, password string) (*chat.GenericResponse, error) {
+	return f.RegisterContext(context.Background(), user, password)
+}
+
+// RegisterContext is Register with a context.
+func (f *ChatClient) RegisterContext(ctx context.Context, user, password string) (*chat.GenericResponse, error) {
+	return f.sendRPCCommand(ctx, chat.NewCommandRegister(user, password))
+}
+
+// Login logs in the user. The user and the password are kept to log in again
+// when the client reconnects, see SetReconnectPolicy.
+func (f *ChatClient) Login(user, password string) (*chat.GenericResponse, error) {
+	return f.LoginContext(context.Background(), user, password)
+}
+
+// LoginContext is Login with a context. The session is kept only when the login succeeds:
+// the client doesn't log in again with credentials refused by the server.
+func (f *ChatClient) LoginContext(ctx context.Context, user, password string) (*chat.GenericResponse, error) {
+	res, err := f.sendRPCCommand(ctx, f.newCommandLogin(user, password))
 	if err != nil {
 		return nil, err
 	}
-	return resp.(*chat.GenericResponse), nil
+	if res.ResponseCode() == chat.ResponseCodeOk {
+		f.setSession(user, password)
+	}
+	return res, nil
 }
 
-func (f *ChatClient) Login(user string) (*chat.GenericResponse, error) {
-	commandLogin := chat.NewCommandLogin(user)
-	f.currentUser = user
-	return f.sendRPCCommand(commandLogin)
+// commandVersion is the version of a command with the latest version given:
+// ClientOptions.ProtocolVersion when it is set and the command has it.
+func (f *ChatClient) commandVersion(latest byte) byte {
+	if f.options.ProtocolVersion != 0 {
+		return min(f.options.ProtocolVersion, latest)
+	}
+	return latest
+}
+
+// newCommandLogin returns the login in the version of ClientOptions.ProtocolVersion.
+func (f *ChatClient) newCommandLogin(user, password string) *chat.CommandLogin {
+	login := chat.NewCommandLogin(user, password)
+	login.SetVersion(f.commandVersion(chat.CommandLoginVersion))
+	return login
+}
+
+func (f *ChatClient) Logout() (*chat.GenericResponse, error) {
+	return f.LogoutContext(context.Background())
+}
+
+// LogoutContext is Logout with a context.
+func (f *ChatClient) LogoutContext(ctx context.Context) (*chat.GenericResponse, error) {
+	res, err := f.sendRPCCommand(ctx, chat.NewCommandLogout())
+	if err != nil {
+		return nil, err
+	}
+	if res.ResponseCode() == chat.ResponseCodeOk {
+		f.setSession("", "")
+	}
+	return res, nil
 }
 
 func (f *ChatClient) CorrelationIdTest() (*chat.GenericResponse, error) {
-	commandLogin := chat.NewCorrelationIdCommand()
-	return f.sendRPCCommand(commandLogin)
+	return f.CorrelationIdTestContext(context.Background())
+}
+
+// CorrelationIdTestContext is CorrelationIdTest with a context.
+func (f *ChatClient) CorrelationIdTestContext(ctx context.Context) (*chat.GenericResponse, error) {
+	return f.sendRPCCommand(ctx, chat.NewCorrelationIdCommand())
+}
+
+// SendMessage sends the message to the user.
+// The response contains the id of the message, used by the status notifications.
+func (f *ChatClient) SendMessage(message string, to string) (*chat.MessageSentResponse, error) {
+	return f.SendMessageContext(context.Background(), message, to)
+}
+
+// SendMessageContext is SendMessage with a context. When the context is done
+// before the response the message can be delivered anyway.
+func (f *ChatClient) SendMessageContext(ctx context.Context, message string, to string) (*chat.MessageSentResponse, error) {
+	commandMessage := chat.NewCommandMessage(message, f.username(), to, chat.ConvertTimeToUint64(time.Now()))
+	commandMessage.SetVersion(f.commandVersion(chat.CommandMessageVersion))
+	return typedResponse[*chat.MessageSentResponse](f.sendRPC(ctx, commandMessage))
+}
+
+// MarkRead tells the server that the user read the message.
+// The server notifies the sender.
+func (f *ChatClient) MarkRead(id uint64) error {
+	return f.send(chat.NewCommandMessageRead(id))
+}
+
+// SendMessageToMany sends the same message to a list of users.
+// The response contains the delivery status for each user.
+func (f *ChatClient) SendMessageToMany(message string, to []string) (*chat.MultiMessageResponse, error) {
+	return f.SendMessageToManyContext(context.Background(), message, to)
+}
+
+// SendMessageToManyContext is SendMessageToMany with a context.
+func (f *ChatClient) SendMessageToManyContext(ctx context.Context, message string, to []string) (*chat.MultiMessageResponse, error) {
+	commandMessage := chat.NewCommandMultiMessage(message, f.username(), to, chat.ConvertTimeToUint64(time.Now()))
+	return typedResponse[*chat.MultiMessageResponse](f.sendRPC(ctx, commandMessage))
+}
+
+// Broadcast sends the message to all the users known by the server.
+func (f *ChatClient) Broadcast(message string) (*chat.MultiMessageResponse, error) {
+	return f.BroadcastContext(context.Background(), message)
+}
+
+// BroadcastContext is Broadcast with a context.
+func (f *ChatClient) BroadcastContext(ctx context.Context, message string) (*chat.MultiMessageResponse, error) {
+	commandMessage := chat.NewCommandBroadcastMessage(message, f.username(), chat.ConvertTimeToUint64(time.Now()))
+	return typedResponse[*chat.MultiMessageResponse](f.sendRPC(ctx, commandMessage))
+}
+
+// ListUsers returns the users known by the server with their status and last login.
+func (f *ChatClient) ListUsers() (*chat.UserListResponse, error) {
+	return f.ListUsersContext(context.Background())
+}
+
+// ListUsersContext is ListUsers with a context.
+func (f *ChatClient) ListUsersContext(ctx context.Context) (*chat.UserListResponse, error) {
+	return typedResponse[*chat.UserListResponse](f.sendRPC(ctx, chat.NewCommandListUsers()))
+}
+
+// CreateRoom creates the room, the current user is the first member.
+func (f *ChatClient) CreateRoom(room string) (*chat.GenericResponse, error) {
+	return f.CreateRoomContext(context.Background(), room)
+}
+
+// CreateRoomContext is CreateRoom with a context.
+func (f *ChatClient) CreateRoomContext(ctx context.Context, room string) (*chat.GenericResponse, error) {
+	return f.sendRPCCommand(ctx, chat.NewCommandCreateRoom(room))
+}
+
+// JoinRoom adds the current user to the members of the room.
+func (f *ChatClient) JoinRoom(room string) (*chat.GenericResponse, error) {
+	return f.JoinRoomContext(context.Background(), room)
+}
+
+// JoinRoomContext is JoinRoom with a context.
+func (f *ChatClient) JoinRoomContext(ctx context.Context, room string) (*chat.GenericResponse, error) {
+	return f.sendRPCCommand(ctx, chat.NewCommandJoinRoom(room))
+}
+
+// LeaveRoom removes the current user from the members of the room.
+func (f *ChatClient) LeaveRoom(room string) (*chat.GenericResponse, error) {
+	return f.LeaveRoomContext(context.Background(), room)
+}
+
+// LeaveRoomContext is LeaveRoom with a context.
+func (f *ChatClient) LeaveRoomContext(ctx context.Context, room string) (*chat.GenericResponse, error) {
+	return f.sendRPCCommand(ctx, chat.NewCommandLeaveRoom(room))
+}
+
+// RoomMembers returns the members of the room.
+func (f *ChatClient) RoomMembers(room string) (*chat.RoomMembersResponse, error) {
+	return f.RoomMembersContext(context.Background(), room)
+}
+
+// RoomMembersContext is RoomMembers with a context.
+func (f *ChatClient) RoomMembersContext(ctx context.Context, room string) (*chat.RoomMembersResponse, error) {
+	return typedResponse[*chat.RoomMembersResponse](f.sendRPC(ctx, chat.NewCommandListRoomMembers(room)))
+}
+
+// SendRoomMessage sends the message to the members of the room.
+// The response contains the delivery status for each member.
+func (f *ChatClient) SendRoomMessage(room, message string) (*chat.MultiMessageResponse, error) {
+	return f.SendRoomMessageContext(context.Background(), room, message)
+}
+
+// SendRoomMessageContext is SendRoomMessage with a context.
+func (f *ChatClient) SendRoomMessageContext(ctx context.Context, room, message string) (*chat.MultiMessageResponse, error) {
+	commandMessage := chat.NewCommandRoomMessage(room, message, f.username(), chat.ConvertTimeToUint64(time.Now()))
+	return typedResponse[*chat.MultiMessageResponse](f.sendRPC(ctx, commandMessage))
 }
 
-func (f *ChatClient) SendMessage(message string, to string) (*chat.GenericResponse, error) {
-	commandMessage := chat.NewCommandMessage(message, f.currentUser, to, chat.ConvertTimeToUint64(time.Now()))
-	return f.sendRPCCommand(commandMessage)
+// History returns a page of the conversation between the current user and the peer.
+// beforeId and afterId are cursors, 0 when not set: the Id of the first (or last)
+// message of a previous page. The ids are opaque, they are not times.
+// With afterId the page contains the oldest messages after it, otherwise the newest
+// messages before beforeId. limit 0 uses the server default.
+func (f *ChatClient) History(peer string, beforeId, afterId uint64, limit uint16) (*chat.HistoryResponse, error) {
+	return f.HistoryContext(context.Background(), peer, beforeId, afterId, limit)
 }
 
+// HistoryContext is History with a context.
+func (f *ChatClient) HistoryContext(ctx context.Context, peer string, beforeId, afterId uint64, limit uint16) (*chat.HistoryResponse, error) {
+	return typedResponse[*chat.HistoryResponse](f.sendRPC(ctx, chat.NewCommandHistory(peer, beforeId, afterId, limit)))
+}
+
+// ReadMessage reads a CommandMessage of the latest version.
 func (f *ChatClient) ReadMessage(reader *bufio.Reader) (*chat.CommandMessage, error) {
+	return f.readMessage(reader, chat.CommandMessageVersion)
+}
+
+// readMessage reads a CommandMessage of the version of the header:
+// the servers of the base protocol send the version 1, without Id.
+func (f *ChatClient) readMessage(reader *bufio.Reader, version byte) (*chat.CommandMessage, error) {
 	msg := &chat.CommandMessage{}
+	msg.SetVersion(version)
 	err := msg.Read(reader)
 	return msg, err
 }
 
+// WaitMessages reads the frames of the current connection until it is lost.
 func (f *ChatClient) WaitMessages() {
-	reader := bufio.NewReader(f.tcpConn)
+	f.waitMessages(f.connection())
+}
+
+// waitMessages reads the frames of c until it is lost.
+// c is the connection the reader was started for: the current connection can
+// already be a newer one after a reconnection.
+func (f *ChatClient) waitMessages(c *clientConnection) {
+	defer f.connectionLost(c)
+	reader := bufio.NewReader(c.conn)
 	for {
 		dataReader, err := chat.ReadFullBufferFromSource(reader)
 		if err != nil {
@@ -166,13 +769,22 @@ func (f *ChatClient) WaitMessages() {
 		switch header.Key() {
 		case chat.CommandMessageKey:
 			{
-				msg, err := f.ReadMessage(dataReader)
+				msg, err := f.readMessage(dataReader, header.Version())
 				if err != nil {
 					fmt.Printf("Error reading message: %v\n", err)
 					return
 				}
 
-				f.chMessages <- msg
+				if msg.Id == 0 || f.markMessageSeen(msg.Id) {
+					f.chMessages <- msg
+				}
+				if msg.Id != 0 {
+					err = f.ackMessage(msg.Id)
+					if err != nil {
+						fmt.Printf("Error sending message ack: %v\n", err)
+						return
+					}
+				}
 
 			}
 		case chat.GenericResponseKey:
@@ -183,8 +795,105 @@ func (f *ChatClient) WaitMessages() {
 					fmt.Printf("Error reading generic response: %v\n", err)
 					return
 				}
-				res := f.GetResponse(generic.CorrelationId())
-				res.data <- generic
+				f.deliverResponse(generic.CorrelationId(), generic)
+			}
+		case chat.MessageSentResponseKey:
+			{
+				sent := &chat.MessageSentResponse{}
+				err := sent.Read(dataReader)
+				if err != nil {
+					fmt.Printf("Error reading message sent response: %v\n", err)
+					return
+				}
+				f.deliverResponse(sent.CorrelationId(), sent)
+			}
+		case chat.CommandMessageStatusKey:
+			{
+				status := &chat.CommandMessageStatus{}
+				err := status.Read(dataReader)
+				if err != nil {
+					fmt.Printf("Error reading message status: %v\n", err)
+					return
+				}
+				if f.chMessageStatus != nil {
+					f.chMessageStatus <- status
+				}
+			}
+		case chat.CommandPingKey:
+			{
+				ping := &chat.CommandPing{}
+				err := ping.Read(dataReader)
+				if err != nil {
+					fmt.Printf("Error reading ping: %v\n", err)
+					return
+				}
+				err = c.writer.Send(chat.NewCommandPong(ping.CorrelationId()))
+				if err != nil {
+					fmt.Printf("Error sending pong: %v\n", err)
+					return
+				}
+			}
+		case chat.CommandPongKey:
+			{
+				pong := &chat.CommandPong{}
+				err := pong.Read(dataReader)
+				if err != nil {
+					fmt.Printf("Error reading pong: %v\n", err)
+					return
+				}
+				f.deliverResponse(pong.CorrelationId(), pong)
+			}
+		case chat.CommandServerGoingAwayKey:
+			{
+				goingAway := &chat.CommandServerGoingAway{}
+				err := goingAway.Read(dataReader)
+				if err != nil {
+					fmt.Printf("Error reading server going away: %v\n", err)
+					return
+				}
+				if f.chGoingAway != nil {
+					f.chGoingAway <- goingAway
+				}
+			}
+		case chat.MultiMessageResponseKey:
+			{
+				multi := &chat.MultiMessageResponse{}
+				err := multi.Read(dataReader)
+				if err != nil {
+					fmt.Printf("Error reading multi message response: %v\n", err)
+					return
+				}
+				f.deliverResponse(multi.CorrelationId(), multi)
+			}
+		case chat.UserListResponseKey:
+			{
+				userList := &chat.UserListResponse{}
+				err := userList.Read(dataReader)
+				if err != nil {
+					fmt.Printf("Error reading user list response: %v\n", err)
+					return
+				}
+				f.deliverResponse(userList.CorrelationId(), userList)
+			}
+		case chat.HistoryResponseKey:
+			{
+				history := &chat.HistoryResponse{}
+				err := history.Read(dataReader)
+				if err != nil {
+					fmt.Printf("Error reading history response: %v\n", err)
+					return
+				}
+				f.deliverResponse(history.CorrelationId(), history)
+			}
+		case chat.RoomMembersResponseKey:
+			{
+				members := &chat.RoomMembersResponse{}
+				err := members.Read(dataReader)
+				if err != nil {
+					fmt.Printf("Error reading room members response: %v\n", err)
+					return
+				}
+				f.deliverResponse(members.CorrelationId(), members)
 			}
 
 		}
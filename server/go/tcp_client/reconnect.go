@@ -0,0 +1,191 @@
+package tcp_client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gsantomaggio/chat/server/chat"
+	"math/rand/v2"
+	"time"
+)
+
+// ErrReconnectFailed is sent to the NotifyDisconnected channel when the client
+// stops reconnecting: the attempts are over or the login is refused.
+var ErrReconnectFailed = errors.New("reconnection failed")
+
+// ConnectionState is the state of the connection reported to OnStateChange.
+type ConnectionState int
+
+const (
+	// StateConnected: the client is connected again, and logged in when a user was logged
+	StateConnected ConnectionState = iota
+	// StateReconnecting: the connection is lost and the client is trying to reconnect
+	StateReconnecting
+	// StateDisconnected: the connection is lost and the client doesn't reconnect
+	StateDisconnected
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case StateConnected:
+		return "connected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateDisconnected:
+		return "disconnected"
+	}
+	return fmt.Sprintf("ConnectionState(%d)", int(s))
+}
+
+// ReconnectPolicy sets how the client reconnects when the connection is lost.
+// The delay before the attempt n is InitialDelay * Multiplier^(n-1), at most MaxDelay,
+// changed randomly by up to Jitter (a fraction of the delay) so the clients
+// disconnected together don't reconnect together.
+type ReconnectPolicy struct {
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	Multiplier   float64
+	Jitter       float64
+	// MaxAttempts is the number of attempts before the client gives up, 0 for no limit
+	MaxAttempts int
+}
+
+// DefaultReconnectPolicy retries forever: the first attempt after 100ms,
+// then the delay doubles up to 30 seconds, with 20% of jitter.
+func DefaultReconnectPolicy() *ReconnectPolicy {
+	return &ReconnectPolicy{
+		InitialDelay: 100 * time.Millisecond,
+		MaxDelay:     30 * time.Second,
+		Multiplier:   2,
+		Jitter:       0.2,
+	}
+}
+
+// delay returns the time to wait before the attempt, starting from 1.
+func (p *ReconnectPolicy) delay(attempt int) time.Duration {
+	delay := float64(p.InitialDelay)
+	for i := 1; i < attempt && delay < float64(p.MaxDelay); i++ {
+		delay *= p.Multiplier
+	}
+	if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+	if p.Jitter > 0 {
+		delay += delay * p.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(delay)
+}
+
+// SetReconnectPolicy enables the automatic reconnection, nil disables it (the default).
+// When the connection is lost the client dials the server again and logs in the user
+// of Login. The commands waiting for a response fail with ErrConnectionLost and
+// the commands sent while the client is reconnecting fail with ErrNotConnected:
+// they are not sent again, the caller decides. It must be called before Connect.
+func (f *ChatClient) SetReconnectPolicy(policy *ReconnectPolicy) {
+	f.reconnectPolicy = policy
+}
+
+// OnStateChange sets the function called when the connection is lost (StateReconnecting
+// or StateDisconnected, with the reason) and when the client is connected again.
+// The function is not called when the client is closed with Close.
+// It must be called before Connect.
+func (f *ChatClient) OnStateChange(callback func(state ConnectionState, err error)) {
+	f.onStateChange = callback
+}
+
+func (f *ChatClient) setState(state ConnectionState, err error) {
+	if f.onStateChange != nil && !f.closed.Load() {
+		f.onStateChange(state, err)
+	}
+}
+
+// connectionLost is called by WaitMessages when the connection is closed.
+// The pending responses fail, then the client reconnects when the policy is set.
+// A connection not established yet is handled by reconnect.
+func (f *ChatClient) connectionLost(c *clientConnection) {
+	c.close(ErrConnectionLost)
+	f.failResponses(ErrConnectionLost)
+	c.mutex.Lock()
+	c.isLost = true
+	established := c.established
+	c.mutex.Unlock()
+	if !established || f.closed.Load() {
+		return
+	}
+	if f.reconnectPolicy == nil {
+		f.setState(StateDisconnected, c.reason)
+		f.notifyDisconnected(c.reason)
+		return
+	}
+	f.setState(StateReconnecting, c.reason)
+	f.reconnect()
+}
+
+// reconnect dials the server until the client is connected and logged in,
+// waiting the delay of the policy before each attempt.
+func (f *ChatClient) reconnect() {
+	policy := f.reconnectPolicy
+	var lastErr error
+	for attempt := 1; policy.MaxAttempts == 0 || attempt <= policy.MaxAttempts; attempt++ {
+		select {
+		case <-f.closing:
+			return
+		case <-time.After(policy.delay(attempt)):
+		}
+		retry, err := f.establish()
+		if err == nil {
+			f.setState(StateConnected, nil)
+			return
+		}
+		lastErr = err
+		if f.closed.Load() {
+			return
+		}
+		if !retry || attempt == policy.MaxAttempts {
+			break
+		}
+		f.setState(StateReconnecting, err)
+	}
+	err := fmt.Errorf("%w: %w", ErrReconnectFailed, lastErr)
+	f.setState(StateDisconnected, err)
+	f.notifyDisconnected(err)
+}
+
+// establish dials a new connection and logs in the user of the session.
+// retry is false when the attempt can't succeed, for example with a bad password.
+func (f *ChatClient) establish() (retry bool, err error) {
+	conn, err := f.dial()
+	if err != nil {
+		return true, err
+	}
+	user, password := f.session()
+	c, err := f.start(conn, user == "")
+	if err != nil {
+		return false, err
+	}
+	if user == "" {
+		return true, nil
+	}
+	res, err := f.sendRPCCommand(context.Background(), f.newCommandLogin(user, password))
+	if err == nil && res.ResponseCode() != chat.ResponseCodeOk {
+		err = fmt.Errorf("login of %s refused: %s", user, chat.FormResponseCodeToString(res.ResponseCode()))
+		// the server can still see the user online on the lost connection,
+		// until its heartbeat closes it
+		retry = res.ResponseCode() == chat.ResponseCodeErrorUserAlreadyLogged
+	} else {
+		retry = true
+	}
+	if err != nil {
+		c.close(err)
+		return retry, err
+	}
+	c.mutex.Lock()
+	c.established = true
+	lost := c.isLost
+	c.mutex.Unlock()
+	if lost {
+		// the connection was lost during the login, WaitMessages left it to reconnect
+		return true, c.reason
+	}
+	return true, nil
+}
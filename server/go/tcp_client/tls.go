@@ -0,0 +1,39 @@
+package tcp_client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// NewClientTLSConfig creates the TLS configuration to connect to the server.
+// caFile is the CA used to verify the server certificate, the system CAs are used when empty.
+// serverName must match the server certificate, the host of the address is used when empty.
+// certFile and keyFile are the client certificate for mutual TLS, they are optional:
+// the certificate CN is the username.
+func NewClientTLSConfig(caFile, serverName, certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if caFile != "" {
+		data, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA file %s: %w", caFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificate found in CA file %s", caFile)
+		}
+		config.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	return config, nil
+}
@@ -0,0 +1,269 @@
+package tcp_server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gsantomaggio/chat/server/chat"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SystemUsername is the sender of the messages posted with SendSystemMessage.
+// The username is reserved: it can't be registered, used to log in or to send messages.
+const SystemUsername = "system"
+
+// kickReason is sent to the kicked clients with CommandServerGoingAway
+const kickReason = "disconnected by the administrator"
+
+var (
+	// ErrUserNotFound is returned by the admin operations when the user is not registered
+	ErrUserNotFound = errors.New("user not found")
+	// ErrUserOffline is returned by KickUser when the user is not connected
+	ErrUserOffline = errors.New("user offline")
+)
+
+// reservedUsername returns true for the usernames the clients can't use, see SystemUsername.
+func reservedUsername(username string) bool {
+	return username == SystemUsername
+}
+
+// KickUser closes the connection of the user, after CommandServerGoingAway.
+// The user is set offline and the messages not acknowledged are kept in the mailbox.
+func (t *TcpServer) KickUser(username string) error {
+	user := t.User(username)
+	if user == nil {
+		return ErrUserNotFound
+	}
+	if !t.kick(user) {
+		return ErrUserOffline
+	}
+	t.DispatchEvent(EventAdmin, slog.LevelWarn, "User kicked", slog.String(AttrUser, username))
+	return nil
+}
+
+// kick closes the connection of the user, it returns false when the user is offline.
+// The read of handleConnection fails and the user is set offline.
+func (t *TcpServer) kick(user *User) bool {
+	writer := user.currentWriter()
+	if writer == nil {
+		return false
+	}
+	var conn net.Conn
+	t.mutexConnections.Lock()
+	for c, w := range t.connections {
+		if w == writer {
+			conn = c
+			break
+		}
+	}
+	t.mutexConnections.Unlock()
+	if conn == nil {
+		// the connection is already closing
+		return false
+	}
+	_ = writer.Send(chat.NewCommandServerGoingAway(kickReason))
+	_ = writer.Close()
+	_ = conn.Close()
+	return true
+}
+
+// DeleteUser disconnects the user, removes it from the rooms and deletes it with the
+// mailbox from the storage. The receipts of its messages are dropped, so the statuses are not sent.
+// The messages sent to the user are refused from now on,
+// the history of the conversations is kept. The username can be registered again.
+func (t *TcpServer) DeleteUser(username string) error {
+	user := t.users.remove(username)
+	if user == nil {
+		return ErrUserNotFound
+	}
+	t.kick(user)
+	t.rooms.leaveAll(username)
+	t.receipts.removeUser(username)
+	user.remove()
+	err := t.storage.DeleteUser(username)
+	t.DispatchEvent(EventAdmin, slog.LevelWarn, "User deleted", slog.String(AttrUser, username))
+	return err
+}
+
+// SendSystemMessage sends the message from SystemUsername to the user, or to all
+// the users when to is empty. The message is queued for the offline users, and
+// refused for the users with a full mailbox.
+// A message longer than chat.MaxStringLength returns chat.ErrStringTooLong:
+// it can't be encoded in a CommandMessage.
+func (t *TcpServer) SendSystemMessage(to, message string) (delivered, queued, refused []string, err error) {
+	if len(message) > chat.MaxStringLength {
+		return nil, nil, nil, fmt.Errorf("%w: %d bytes, max %d", chat.ErrStringTooLong, len(message), chat.MaxStringLength)
+	}
+	recipients := []string{to}
+	if to == "" {
+		recipients = sortedKeys(t.Users())
+	} else if t.User(to) == nil {
+		return nil, nil, nil, ErrUserNotFound
+	}
+	delivered = make([]string, 0)
+	queued = make([]string, 0)
+	refused = make([]string, 0)
+	sent := chat.ConvertTimeToUint64(time.Now())
+	for _, username := range recipients {
+		if recipient := t.User(username); recipient == nil || t.mailboxFull(recipient, SystemUsername) {
+			refused = append(refused, username)
+		} else if t.routeMessage(t.nextMessageId(), "", SystemUsername, username, message, sent) {
+			delivered = append(delivered, username)
+		} else {
+			queued = append(queued, username)
+		}
+	}
+	t.DispatchEvent(EventAdmin, slog.LevelInfo, "System message sent",
+		slog.String(AttrPeer, to), slog.Int(AttrCount, len(recipients)), slog.Int(AttrBytes, len(message)))
+	return delivered, queued, refused, nil
+}
+
+// AdminUser is a user returned by the admin API
+type AdminUser struct {
+	Username  string    `json:"username"`
+	Online    bool      `json:"online"`
+	LastLogin time.Time `json:"last_login"`
+	Mailbox   int       `json:"mailbox"`
+	Rooms     []string  `json:"rooms"`
+}
+
+// AdminMessage is the body of POST /admin/messages, To empty sends the message to all the users
+type AdminMessage struct {
+	To      string `json:"to"`
+	Message string `json:"message"`
+}
+
+// AdminMessageResult is the response of POST /admin/messages
+type AdminMessageResult struct {
+	Delivered []string `json:"delivered"`
+	Queued    []string `json:"queued"`
+	// Refused are the users with a full mailbox, or deleted while the message was sent
+	Refused []string `json:"refused"`
+}
+
+type adminError struct {
+	Error string `json:"error"`
+}
+
+// AdminHandler serves the admin API, the requests must have the header
+// "Authorization: Bearer <token>". An empty token refuses all the requests.
+//
+//	GET    /admin/users                  the users with the status and the mailbox size
+//	GET    /admin/users/{username}       one user
+//	POST   /admin/users/{username}/kick  closes the connection of the user
+//	DELETE /admin/users/{username}       deletes the user
+//	POST   /admin/messages               sends an AdminMessage from SystemUsername
+func (t *TcpServer) AdminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/users", t.adminListUsers)
+	mux.HandleFunc("GET /admin/users/{username}", t.adminGetUser)
+	mux.HandleFunc("POST /admin/users/{username}/kick", t.adminKickUser)
+	mux.HandleFunc("DELETE /admin/users/{username}", t.adminDeleteUser)
+	mux.HandleFunc("POST /admin/messages", t.adminPostMessage)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || !ok || subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+			writeJSON(w, http.StatusUnauthorized, &adminError{Error: "invalid admin token"})
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (t *TcpServer) adminUser(user *User, membership map[string][]string) *AdminUser {
+	online, lastLogin := user.Status()
+	rooms := membership[user.Username]
+	if rooms == nil {
+		rooms = make([]string, 0)
+	}
+	return &AdminUser{
+		Username:  user.Username,
+		Online:    online,
+		LastLogin: lastLogin,
+		Mailbox:   user.MailboxSize(),
+		Rooms:     rooms,
+	}
+}
+
+func (t *TcpServer) adminListUsers(w http.ResponseWriter, _ *http.Request) {
+	membership := t.rooms.membership()
+	users := t.Users()
+	result := make([]*AdminUser, 0, len(users))
+	for _, user := range users {
+		result = append(result, t.adminUser(user, membership))
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Username < result[j].Username })
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (t *TcpServer) adminGetUser(w http.ResponseWriter, r *http.Request) {
+	user := t.User(r.PathValue("username"))
+	if user == nil {
+		writeAdminError(w, ErrUserNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, t.adminUser(user, t.rooms.membership()))
+}
+
+func (t *TcpServer) adminKickUser(w http.ResponseWriter, r *http.Request) {
+	if err := t.KickUser(r.PathValue("username")); err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (t *TcpServer) adminDeleteUser(w http.ResponseWriter, r *http.Request) {
+	if err := t.DeleteUser(r.PathValue("username")); err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (t *TcpServer) adminPostMessage(w http.ResponseWriter, r *http.Request) {
+	message := &AdminMessage{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, int64(t.maxFrameSize))).Decode(message); err != nil {
+		writeJSON(w, http.StatusBadRequest, &adminError{Error: "invalid message: " + err.Error()})
+		return
+	}
+	if message.Message == "" {
+		writeJSON(w, http.StatusBadRequest, &adminError{Error: "the message is empty"})
+		return
+	}
+	if len(message.Message) > chat.MaxStringLength {
+		writeJSON(w, http.StatusBadRequest, &adminError{Error: fmt.Sprintf("the message is too long: %d bytes, max %d", len(message.Message), chat.MaxStringLength)})
+		return
+	}
+	delivered, queued, refused, err := t.SendSystemMessage(message.To, message.Message)
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, &AdminMessageResult{Delivered: delivered, Queued: queued, Refused: refused})
+}
+
+func writeAdminError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrUserNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrUserOffline):
+		status = http.StatusConflict
+	case errors.Is(err, chat.ErrStringTooLong):
+		status = http.StatusBadRequest
+	}
+	writeJSON(w, status, &adminError{Error: err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(value)
+}
@@ -0,0 +1,183 @@
+package tcp_server
+
+import (
+	"encoding/json"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"gsantomaggio/chat/server/chat"
+	"gsantomaggio/chat/server/tcp_client"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+)
+
+var _ = Describe("Admin API", func() {
+	const adminAddress = "localhost:6678"
+	const token = "secret"
+	var tcpServer *TcpServer
+	var httpServer *httptest.Server
+	BeforeEach(func() {
+		tcpServer = NewTcpServer(adminAddress, nil)
+		Expect(tcpServer.StartInAThread()).To(Succeed())
+		time.Sleep(200 * time.Millisecond)
+		registerUsers(adminAddress, "user1", "user2")
+		httpServer = httptest.NewServer(tcpServer.AdminHandler(token))
+	})
+	AfterEach(func() {
+		httpServer.Close()
+		tcpServer.Stop()
+	})
+
+	request := func(method, path, body string, result any) int {
+		req, err := http.NewRequest(method, httpServer.URL+path, strings.NewReader(body))
+		Expect(err).To(BeNil())
+		req.Header.Set("Authorization", "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		Expect(err).To(BeNil())
+		defer res.Body.Close()
+		if result != nil {
+			Expect(json.NewDecoder(res.Body).Decode(result)).To(Succeed())
+		}
+		return res.StatusCode
+	}
+
+	login := func(username string, messages chan *chat.CommandMessage) *tcp_client.ChatClient {
+		client := tcp_client.NewChatClient(messages)
+		Expect(client.Connect(adminAddress)).To(Succeed())
+		r, e := client.Login(username, password)
+		Expect(e).To(BeNil())
+		Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+		return client
+	}
+
+	It("Refuses the requests without the token", func() {
+		res, err := http.Get(httpServer.URL + "/admin/users")
+		Expect(err).To(BeNil())
+		Expect(res.StatusCode).To(Equal(http.StatusUnauthorized))
+		_ = res.Body.Close()
+
+		req, _ := http.NewRequest("GET", httpServer.URL+"/admin/users", nil)
+		req.Header.Set("Authorization", "Bearer wrong")
+		res, err = http.DefaultClient.Do(req)
+		Expect(err).To(BeNil())
+		Expect(res.StatusCode).To(Equal(http.StatusUnauthorized))
+		_ = res.Body.Close()
+
+		withoutToken := httptest.NewServer(tcpServer.AdminHandler(""))
+		defer withoutToken.Close()
+		res, err = http.Get(withoutToken.URL + "/admin/users")
+		Expect(err).To(BeNil())
+		Expect(res.StatusCode).To(Equal(http.StatusUnauthorized))
+		_ = res.Body.Close()
+	})
+
+	It("Lists the users and sends a system message to everyone", func() {
+		messages := make(chan *chat.CommandMessage, 1)
+		client := login("user1", messages)
+		defer client.Close()
+
+		result := &AdminMessageResult{}
+		Expect(request("POST", "/admin/messages", `{"message":"maintenance at 10"}`, result)).To(Equal(http.StatusOK))
+		Expect(result.Delivered).To(Equal([]string{"user1"}))
+		Expect(result.Queued).To(Equal([]string{"user2"}))
+		var message *chat.CommandMessage
+		Eventually(messages).Should(Receive(&message))
+		Expect(message.From).To(Equal(SystemUsername))
+		Expect(message.Message).To(Equal("maintenance at 10"))
+
+		var users []*AdminUser
+		Expect(request("GET", "/admin/users", "", &users)).To(Equal(http.StatusOK))
+		Expect(users).To(HaveLen(2))
+		Expect(users[0].Username).To(Equal("user1"))
+		Expect(users[0].Online).To(BeTrue())
+		Expect(users[1].Username).To(Equal("user2"))
+		Expect(users[1].Online).To(BeFalse())
+		Expect(users[1].Mailbox).To(Equal(1))
+
+		Expect(request("POST", "/admin/messages", `{"to":"nobody","message":"hi"}`, nil)).To(Equal(http.StatusNotFound))
+		Expect(request("POST", "/admin/messages", `{"to":"user2"}`, nil)).To(Equal(http.StatusBadRequest))
+
+		r, e := client.Register(SystemUsername, password)
+		Expect(e).To(BeNil())
+		Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeErrorUserAlreadyExists))
+	})
+
+	It("Refuses the login of a system user saved before the name was reserved", func() {
+		credentials, err := NewCredentials(password)
+		Expect(err).To(BeNil())
+		tcpServer.users.getOrCreate(SystemUsername, func() *User {
+			return NewUser(SystemUsername, credentials, nil, tcpServer.storage)
+		})
+		client := tcp_client.NewChatClient(make(chan *chat.CommandMessage))
+		Expect(client.Connect(adminAddress)).To(Succeed())
+		defer client.Close()
+		r, e := client.Login(SystemUsername, password)
+		Expect(e).To(BeNil())
+		Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeErrorBadCredentials))
+		sent, e := client.SendMessage("forged", "user1")
+		Expect(e).To(BeNil())
+		Expect(sent.ResponseCode()).To(Equal(chat.ResponseCodeErrorUserNotLogged))
+		Expect(tcpServer.User("user1").MailboxSize()).To(BeZero())
+	})
+
+	It("Refuses the system messages longer than the max string length", func() {
+		messages := make(chan *chat.CommandMessage, 1)
+		client := login("user1", messages)
+		defer client.Close()
+
+		tooLong := strings.Repeat("a", chat.MaxStringLength+1)
+		Expect(request("POST", "/admin/messages", `{"to":"user1","message":"`+tooLong+`"}`, nil)).To(Equal(http.StatusBadRequest))
+		_, _, _, err := tcpServer.SendSystemMessage("user1", tooLong)
+		Expect(err).To(MatchError(chat.ErrStringTooLong))
+		Expect(tcpServer.User("user1").MailboxSize()).To(BeZero())
+
+		// the connection is still usable and gets the next message
+		Expect(client.Ping()).To(Succeed())
+		result := &AdminMessageResult{}
+		Expect(request("POST", "/admin/messages", `{"to":"user1","message":"hi"}`, result)).To(Equal(http.StatusOK))
+		Expect(result.Delivered).To(Equal([]string{"user1"}))
+		var message *chat.CommandMessage
+		Eventually(messages).Should(Receive(&message))
+		Expect(message.Message).To(Equal("hi"))
+	})
+
+	It("Kicks a user", func() {
+		client := login("user1", make(chan *chat.CommandMessage, 1))
+		defer client.Close()
+		goingAway := make(chan *chat.CommandServerGoingAway, 1)
+		client.NotifyServerGoingAway(goingAway)
+
+		Expect(request("POST", "/admin/users/user1/kick", "", nil)).To(Equal(http.StatusNoContent))
+		Eventually(goingAway).Should(Receive())
+		Eventually(func() bool {
+			return tcpServer.User("user1").IsOnLine()
+		}).Should(BeFalse())
+		Expect(request("POST", "/admin/users/user1/kick", "", nil)).To(Equal(http.StatusConflict))
+		Expect(request("POST", "/admin/users/nobody/kick", "", nil)).To(Equal(http.StatusNotFound))
+	})
+
+	It("Deletes a user", func() {
+		client := login("user2", make(chan *chat.CommandMessage, 1))
+		defer client.Close()
+		_, _, _, err := tcpServer.SendSystemMessage("user2", "not read")
+		Expect(err).To(BeNil())
+		Expect(tcpServer.receipts.size()).To(Equal(1))
+		Expect(request("DELETE", "/admin/users/user2", "", nil)).To(Equal(http.StatusNoContent))
+		// the message is never read, the receipt is dropped with the user
+		Expect(tcpServer.receipts.size()).To(BeZero())
+		Expect(request("GET", "/admin/users/user2", "", nil)).To(Equal(http.StatusNotFound))
+		Expect(request("DELETE", "/admin/users/user2", "", nil)).To(Equal(http.StatusNotFound))
+
+		other := tcp_client.NewChatClient(make(chan *chat.CommandMessage))
+		Expect(other.Connect(adminAddress)).To(Succeed())
+		defer other.Close()
+		r, e := other.Login("user2", password)
+		Expect(e).To(BeNil())
+		Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeErrorUserNotFound))
+		// the username can be registered again
+		r, e = other.Register("user2", password)
+		Expect(e).To(BeNil())
+		Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+	})
+})
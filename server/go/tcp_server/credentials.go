@@ -0,0 +1,54 @@
+package tcp_server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	// passwordAlgorithmPBKDF2SHA256 is PBKDF2 with HMAC-SHA256, the key is as long as the SHA256 digest.
+	// The credentials saved without the algorithm use it.
+	passwordAlgorithmPBKDF2SHA256 = "pbkdf2-sha256"
+	passwordSaltSize              = 16
+	passwordIterations            = 100_000
+)
+
+// Credentials is the salted hash of the user password.
+// The password is never stored. Algorithm and Iterations are saved with the hash,
+// so the parameters of the new passwords can change and the old ones are still verified.
+type Credentials struct {
+	Algorithm  string `json:",omitempty"`
+	Salt       []byte
+	Hash       []byte
+	Iterations int
+}
+
+func NewCredentials(password string) (*Credentials, error) {
+	salt := make([]byte, passwordSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return &Credentials{
+		Algorithm:  passwordAlgorithmPBKDF2SHA256,
+		Salt:       salt,
+		Hash:       pbkdf2SHA256([]byte(password), salt, passwordIterations),
+		Iterations: passwordIterations,
+	}, nil
+}
+
+// Verify checks the password against the hash in constant time.
+// The credentials with an unknown algorithm never match.
+func (c *Credentials) Verify(password string) bool {
+	switch c.Algorithm {
+	case "", passwordAlgorithmPBKDF2SHA256:
+		hash := pbkdf2SHA256([]byte(password), c.Salt, c.Iterations)
+		return subtle.ConstantTimeCompare(hash, c.Hash) == 1
+	}
+	return false
+}
+
+func pbkdf2SHA256(password, salt []byte, iterations int) []byte {
+	return pbkdf2.Key(password, salt, iterations, sha256.Size, sha256.New)
+}
@@ -1,20 +1,82 @@
 package tcp_server
 
-import "time"
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// EventKind is the type of an event of the server.
+type EventKind string
+
+const (
+	EventServerStarted    EventKind = "server_started"
+	EventServerStopped    EventKind = "server_stopped"
+	EventStorage          EventKind = "storage"
+	EventConnectionClosed EventKind = "connection_closed"
+	EventLogin            EventKind = "login"
+	EventLoginFailed      EventKind = "login_failed"
+	EventLogout           EventKind = "logout"
+	EventRegister         EventKind = "register"
+	EventRegisterFailed   EventKind = "register_failed"
+	// EventMessageRouted: a message is added to the mailbox of the recipient
+	EventMessageRouted EventKind = "message_routed"
+	// EventMessageQueued: the recipient is offline, the message waits for the next login
+	EventMessageQueued EventKind = "message_queued"
+	// EventMessageSent: the message is written to the connection of the recipient
+	EventMessageSent EventKind = "message_sent"
+	// EventMessageDelivered: the recipient sent the ack
+	EventMessageDelivered EventKind = "message_delivered"
+	EventMessageRead      EventKind = "message_read"
+	EventDeliveryFailed   EventKind = "delivery_failed"
+	EventRoom             EventKind = "room"
+	EventHistory          EventKind = "history"
+	// EventCommand: a command is answered
+	EventCommand       EventKind = "command"
+	EventProtocolError EventKind = "protocol_error"
+	EventHeartbeat     EventKind = "heartbeat"
+	EventUsersStatus   EventKind = "users_status"
+	// EventAdmin: an operation of the admin API, like kick and delete
+	EventAdmin EventKind = "admin"
+)
+
+// The keys of the attributes of the events
+const (
+	AttrUser          = "user"
+	AttrPeer          = "peer"
+	AttrRoom          = "room"
+	AttrCorrelationId = "correlation_id"
+	AttrMessageId     = "message_id"
+	AttrBytes         = "bytes"
+	AttrCount         = "count"
+	AttrRemote        = "remote"
+	AttrCode          = "code"
+	AttrError         = "error"
+	AttrAddress       = "address"
+	AttrTLS           = "tls"
+	AttrOnline        = "online"
+	AttrLastLogin     = "last_login"
+	AttrRooms         = "rooms"
+	// AttrEvent is the key of the kind when the event is logged with slog
+	AttrEvent = "event"
+)
 
 type Event struct {
-	time      time.Time
-	message   string
-	level     int
-	isAnError bool
+	time    time.Time
+	kind    EventKind
+	level   slog.Level
+	message string
+	attrs   []slog.Attr
 }
 
-func NewEvent(message string, isAnError bool, level int) *Event {
+func NewEvent(kind EventKind, level slog.Level, message string, attrs ...slog.Attr) *Event {
 	return &Event{
-		time:      time.Now(),
-		message:   message,
-		isAnError: isAnError,
-		level:     level,
+		time:    time.Now(),
+		kind:    kind,
+		level:   level,
+		message: message,
+		attrs:   attrs,
 	}
 }
 
@@ -22,14 +84,88 @@ func (e *Event) Time() time.Time {
 	return e.time
 }
 
+func (e *Event) Kind() EventKind {
+	return e.kind
+}
+
 func (e *Event) Message() string {
 	return e.message
 }
 
+func (e *Event) Level() slog.Level {
+	return e.level
+}
+
 func (e *Event) IsAnError() bool {
-	return e.isAnError
+	return e.level >= slog.LevelError
 }
 
-func (e *Event) Level() int {
-	return e.level
+// Attrs returns the attributes of the event, like the user and the correlationId.
+func (e *Event) Attrs() []slog.Attr {
+	return e.attrs
+}
+
+// Attr returns the value of the attribute with the key, false when the event doesn't have it.
+func (e *Event) Attr(key string) (slog.Value, bool) {
+	for _, attr := range e.attrs {
+		if attr.Key == key {
+			return attr.Value, true
+		}
+	}
+	return slog.Value{}, false
+}
+
+// Log writes the event with the logger, the kind is the attribute AttrEvent.
+func (e *Event) Log(logger *slog.Logger) {
+	if !logger.Enabled(context.Background(), e.level) {
+		return
+	}
+	record := slog.NewRecord(e.time, e.level, e.message, 0)
+	record.AddAttrs(slog.String(AttrEvent, string(e.kind)))
+	record.AddAttrs(e.attrs...)
+	_ = logger.Handler().Handle(context.Background(), record)
+}
+
+// LogEvents writes the events received with the logger until the channel is closed.
+// For example, to log JSON lines from the info level:
+//
+//	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelInfo}))
+//	go tcp_server.LogEvents(events, logger)
+func LogEvents(events <-chan *Event, logger *slog.Logger) {
+	for event := range events {
+		event.Log(logger)
+	}
+}
+
+// EventDispatcher sends the events to a channel without blocking:
+// when the channel is full the event is dropped and counted, so a slow
+// consumer doesn't slow down the server. Use a buffered channel.
+// A nil dispatcher or a dispatcher without channel discards the events.
+type EventDispatcher struct {
+	events  chan<- *Event
+	dropped atomic.Uint64
+}
+
+func NewEventDispatcher(events chan<- *Event) *EventDispatcher {
+	return &EventDispatcher{events: events}
+}
+
+// Dispatch creates the event and sends it to the channel.
+func (d *EventDispatcher) Dispatch(kind EventKind, level slog.Level, message string, attrs ...slog.Attr) {
+	if d == nil || d.events == nil {
+		return
+	}
+	select {
+	case d.events <- NewEvent(kind, level, message, attrs...):
+	default:
+		d.dropped.Add(1)
+	}
+}
+
+// Dropped returns the number of events dropped because the channel was full.
+func (d *EventDispatcher) Dropped() uint64 {
+	if d == nil {
+		return 0
+	}
+	return d.dropped.Load()
 }
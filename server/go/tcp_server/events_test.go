@@ -0,0 +1,90 @@
+package tcp_server
+
+import (
+	"bytes"
+	"encoding/json"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"gsantomaggio/chat/server/chat"
+	"gsantomaggio/chat/server/tcp_client"
+	"log/slog"
+	"time"
+)
+
+var _ = Describe("Events", func() {
+
+	It("Drops the events when the channel is full without blocking", func() {
+		events := make(chan *Event, 1)
+		dispatcher := NewEventDispatcher(events)
+		dispatcher.Dispatch(EventLogin, slog.LevelInfo, "first")
+		dispatcher.Dispatch(EventLogin, slog.LevelInfo, "second")
+		dispatcher.Dispatch(EventLogin, slog.LevelInfo, "third")
+		Expect(dispatcher.Dropped()).To(Equal(uint64(2)))
+		Expect((<-events).Message()).To(Equal("first"))
+
+		var discard *EventDispatcher
+		discard.Dispatch(EventLogin, slog.LevelInfo, "discarded")
+		Expect(discard.Dropped()).To(BeZero())
+	})
+
+	It("Logs the kind, the level and the attributes as JSON", func() {
+		output := &bytes.Buffer{}
+		logger := slog.New(slog.NewJSONHandler(output, &slog.HandlerOptions{Level: slog.LevelInfo}))
+		NewEvent(EventMessageRouted, slog.LevelDebug, "filtered").Log(logger)
+		NewEvent(EventMessageRouted, slog.LevelInfo, "Message routed",
+			slog.String(AttrUser, "user1"), slog.String(AttrPeer, "user2"), slog.Int(AttrBytes, 5)).Log(logger)
+
+		line := map[string]any{}
+		Expect(json.Unmarshal(output.Bytes(), &line)).To(Succeed())
+		Expect(line).To(HaveKeyWithValue("level", "INFO"))
+		Expect(line).To(HaveKeyWithValue("msg", "Message routed"))
+		Expect(line).To(HaveKeyWithValue(AttrEvent, string(EventMessageRouted)))
+		Expect(line).To(HaveKeyWithValue(AttrUser, "user1"))
+		Expect(line).To(HaveKeyWithValue(AttrPeer, "user2"))
+		Expect(line).To(HaveKeyWithValue(AttrBytes, 5.0))
+	})
+
+	It("Dispatches the login and the routed message with the attributes", func() {
+		const eventsAddress = "localhost:6676"
+		events := make(chan *Event, 1024)
+		tcpServer := NewTcpServer(eventsAddress, events)
+		Expect(tcpServer.StartInAThread()).To(Succeed())
+		defer tcpServer.Stop()
+		time.Sleep(200 * time.Millisecond)
+		registerUsers(eventsAddress, "user1", "user2")
+
+		client := tcp_client.NewChatClient(make(chan *chat.CommandMessage, 1))
+		Expect(client.Connect(eventsAddress)).To(Succeed())
+		defer client.Close()
+		r, e := client.Login("user1", password)
+		Expect(e).To(BeNil())
+		Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+		_, e = client.SendMessage("hello", "user2")
+		Expect(e).To(BeNil())
+
+		received := map[EventKind]*Event{}
+		Eventually(func() bool {
+			for {
+				select {
+				case event := <-events:
+					received[event.Kind()] = event
+				default:
+					return received[EventLogin] != nil && received[EventMessageRouted] != nil
+				}
+			}
+		}).Should(BeTrue())
+
+		user, ok := received[EventLogin].Attr(AttrUser)
+		Expect(ok).To(BeTrue())
+		Expect(user.String()).To(Equal("user1"))
+		_, ok = received[EventLogin].Attr(AttrCorrelationId)
+		Expect(ok).To(BeTrue())
+
+		routed := received[EventMessageRouted]
+		peer, _ := routed.Attr(AttrPeer)
+		Expect(peer.String()).To(Equal("user2"))
+		size, _ := routed.Attr(AttrBytes)
+		Expect(size.Int64()).To(Equal(int64(len("hello"))))
+		Expect(tcpServer.DroppedEvents()).To(BeZero())
+	})
+})
@@ -0,0 +1,104 @@
+package tcp_server
+
+import (
+	"bufio"
+	"gsantomaggio/chat/server/chat"
+	"gsantomaggio/chat/server/tcp_client"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const benchmarkAddress = "localhost:6671"
+
+func benchmarkClient(b *testing.B, username string, receiver chan *chat.CommandMessage) *tcp_client.ChatClient {
+	client := tcp_client.NewChatClient(receiver)
+	if err := client.Connect(benchmarkAddress); err != nil {
+		b.Fatalf("error connecting %s: %v", username, err)
+	}
+	response, err := client.Register(username, password)
+	if err != nil || response.ResponseCode() != chat.ResponseCodeOk {
+		b.Fatalf("error registering %s: %v", username, err)
+	}
+	response, err = client.Login(username, password)
+	if err != nil || response.ResponseCode() != chat.ResponseCodeOk {
+		b.Fatalf("error logging in %s: %v", username, err)
+	}
+	return client
+}
+
+// BenchmarkFanOutWithStalledReceiver sends each message to the receivers and to
+// a user that never reads from the socket. The writes to the stalled user fill
+// its connection queue, the other receivers must not slow down.
+func BenchmarkFanOutWithStalledReceiver(b *testing.B) {
+	const receivers = 8
+	tcpServer := NewTcpServer(benchmarkAddress, nil)
+	if err := tcpServer.StartInAThread(); err != nil {
+		b.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	defer tcpServer.Stop()
+
+	recipients := make([]string, 0, receivers+1)
+	received := make([]atomic.Int64, receivers)
+	for i := 0; i < receivers; i++ {
+		username := "receiver" + string(rune('a'+i))
+		recipients = append(recipients, username)
+		messages := make(chan *chat.CommandMessage, 64)
+		go func(count *atomic.Int64) {
+			for range messages {
+				count.Add(1)
+			}
+		}(&received[i])
+		client := benchmarkClient(b, username, messages)
+		defer client.Close()
+	}
+
+	// the stalled user logs in and never reads
+	registration := tcp_client.NewChatClient(make(chan *chat.CommandMessage))
+	if err := registration.Connect(benchmarkAddress); err != nil {
+		b.Fatal(err)
+	}
+	if _, err := registration.Register("stalled", password); err != nil {
+		b.Fatal(err)
+	}
+	_ = registration.Close()
+	conn, err := net.Dial("tcp", benchmarkAddress)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.(*net.TCPConn).SetReadBuffer(1024)
+	if err := chat.WriteCommandWithHeader(chat.NewCommandLogin("stalled", password), bufio.NewWriter(conn)); err != nil {
+		b.Fatal(err)
+	}
+	recipients = append(recipients, "stalled")
+
+	sender := benchmarkClient(b, "sender", make(chan *chat.CommandMessage))
+	defer sender.Close()
+	message := strings.Repeat("x", 1024)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		response, err := sender.SendMessageToMany(message, recipients)
+		if err != nil {
+			b.Fatalf("error sending message %d: %v", i, err)
+		}
+		if len(response.Delivered) != len(recipients) {
+			b.Fatalf("message %d delivered to %v", i, response.Delivered)
+		}
+	}
+	deadline := time.Now().Add(30 * time.Second)
+	for i := range received {
+		for received[i].Load() < int64(b.N) {
+			if time.Now().After(deadline) {
+				b.Fatalf("%s received %d messages of %d", recipients[i], received[i].Load(), b.N)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(b.N*receivers)/b.Elapsed().Seconds(), "deliveries/s")
+}
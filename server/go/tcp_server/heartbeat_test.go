@@ -0,0 +1,117 @@
+package tcp_server
+
+import (
+	"bufio"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"gsantomaggio/chat/server/chat"
+	"gsantomaggio/chat/server/tcp_client"
+	"io"
+	"net"
+	"time"
+)
+
+var _ = Describe("Heartbeat", func() {
+	const heartbeatAddress = "localhost:6672"
+	var tcpServer *TcpServer
+	BeforeEach(func() {
+		tcpServer = NewTcpServer(heartbeatAddress, nil)
+		tcpServer.SetHeartbeat(100*time.Millisecond, 2)
+		Expect(tcpServer.StartInAThread()).To(Succeed())
+		time.Sleep(200 * time.Millisecond)
+		registerUsers(heartbeatAddress, "user1")
+	})
+	AfterEach(func() {
+		tcpServer.Stop()
+	})
+
+	It("Closes the connection and sets the user offline when the client doesn't answer", func() {
+		conn, err := net.Dial("tcp", heartbeatAddress)
+		Expect(err).To(BeNil())
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		login := chat.NewCommandLoginWithCorrelation("user1", password, 1)
+		Expect(chat.WriteCommandWithHeader(login, bufio.NewWriter(conn))).To(Succeed())
+
+		// the pings are not answered, the server closes the connection.
+		// The login is slow (password hash), a ping can arrive before the response.
+		pings := 0
+		logged := false
+		for {
+			frame, err := chat.ReadFullBufferFromSource(reader)
+			if err != nil {
+				Expect(err).To(MatchError(io.EOF))
+				break
+			}
+			header := &chat.ChatHeader{}
+			Expect(header.Read(frame)).To(Succeed())
+			if header.Key() == chat.GenericResponseKey {
+				response := &chat.GenericResponse{}
+				Expect(response.Read(frame)).To(Succeed())
+				Expect(response.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+				logged = true
+				continue
+			}
+			Expect(header.Key()).To(Equal(chat.CommandPingKey))
+			pings++
+		}
+		Expect(logged).To(BeTrue())
+		Expect(pings).To(Equal(2))
+		Eventually(func() bool {
+			return tcpServer.User("user1").IsOnLine()
+		}).Should(BeFalse())
+	})
+
+	It("Keeps the connection of a client sending the heartbeats", func() {
+		client := tcp_client.NewChatClient(make(chan *chat.CommandMessage))
+		// the server reads the pings on the goroutine of the connection: the interval
+		// must be longer than the login (password hash), slow with -race
+		client.SetHeartbeat(500*time.Millisecond, 2)
+		disconnected := make(chan error, 1)
+		client.NotifyDisconnected(disconnected)
+		Expect(client.Connect(heartbeatAddress)).To(Succeed())
+		r, e := client.Login("user1", password)
+		Expect(e).To(BeNil())
+		Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+
+		Consistently(disconnected, 1500*time.Millisecond).ShouldNot(Receive())
+		Expect(tcpServer.User("user1").IsOnLine()).To(BeTrue())
+		Expect(client.Ping()).To(Succeed())
+		Expect(client.Close()).To(Succeed())
+		Consistently(disconnected, 200*time.Millisecond).ShouldNot(Receive())
+	})
+
+	It("Disables the heartbeat with an interval of 0 in the options", func() {
+		options := DefaultServerOptions("localhost:6681")
+		Expect(options.HeartbeatInterval).To(Equal(chat.DefaultHeartbeatInterval))
+		options.HeartbeatInterval = 0
+		server := NewTcpServerWithOptions(options, nil)
+		defer server.Stop()
+		Expect(server.heartbeatInterval).To(BeZero())
+		Expect(server.heartbeatMaxMissed).To(Equal(chat.DefaultHeartbeatMaxMissed))
+	})
+
+	It("Notifies the client when the server doesn't answer", func() {
+		// the server accepts the connection and never answers
+		listener, err := net.Listen("tcp", "localhost:6673")
+		Expect(err).To(BeNil())
+		defer listener.Close()
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			_, _ = io.Copy(io.Discard, conn)
+		}()
+
+		client := tcp_client.NewChatClient(make(chan *chat.CommandMessage))
+		client.SetHeartbeat(50*time.Millisecond, 2)
+		disconnected := make(chan error, 1)
+		client.NotifyDisconnected(disconnected)
+		Expect(client.Connect("localhost:6673")).To(Succeed())
+		var reason error
+		Eventually(disconnected, 2*time.Second).Should(Receive(&reason))
+		Expect(reason).To(MatchError(tcp_client.ErrServerNotResponding))
+	})
+})
@@ -0,0 +1,114 @@
+package tcp_server
+
+import (
+	"gsantomaggio/chat/server/chat"
+	"sync"
+)
+
+const (
+	// defaultHistoryLimit is the page size when the client doesn't set the limit
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 500
+)
+
+// messageHistory keeps the direct messages of each conversation sorted by id,
+// the order the server routed them. The id is the cursor of the pages: it is
+// unique, unlike the time set by the client.
+// A conversation is identified by the two users, in any order.
+type messageHistory struct {
+	mutex         sync.Mutex
+	conversations map[string][]*UserMessage
+}
+
+func newMessageHistory() *messageHistory {
+	return &messageHistory{
+		conversations: make(map[string][]*UserMessage),
+	}
+}
+
+func conversationKey(user, peer string) string {
+	if user > peer {
+		user, peer = peer, user
+	}
+	return user + "\x00" + peer
+}
+
+// add inserts the message in the conversation keeping the order by id.
+// The messages usually arrive in order, so the position is searched from the end.
+func (h *messageHistory) add(message *UserMessage) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	key := conversationKey(message.From, message.To)
+	messages := h.conversations[key]
+	i := len(messages)
+	for i > 0 && messages[i-1].Id > message.Id {
+		i--
+	}
+	messages = append(messages, nil)
+	copy(messages[i+1:], messages[i:])
+	messages[i] = message
+	h.conversations[key] = messages
+}
+
+// page returns the messages between user and peer with the id in (afterId, beforeId),
+// a zero value means not set. With afterId the page contains the oldest messages,
+// otherwise the newest ones. more is true when other messages match.
+func (h *messageHistory) page(user, peer string, beforeId, afterId uint64, limit int) (page []*UserMessage, more bool) {
+	if limit <= 0 {
+		limit = defaultHistoryLimit
+	}
+	if limit > maxHistoryLimit {
+		limit = maxHistoryLimit
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	matching := make([]*UserMessage, 0)
+	for _, message := range h.conversations[conversationKey(user, peer)] {
+		if afterId > 0 && message.Id <= afterId {
+			continue
+		}
+		if beforeId > 0 && message.Id >= beforeId {
+			continue
+		}
+		matching = append(matching, message)
+	}
+	if len(matching) <= limit {
+		return copyUserMessages(matching), false
+	}
+	if afterId > 0 {
+		return copyUserMessages(matching[:limit]), true
+	}
+	return copyUserMessages(matching[len(matching)-limit:]), true
+}
+
+// fitHistoryFrame keeps the messages of the page that fit in a HistoryResponse frame
+// of maxFrameSize bytes. The kept messages are the nearest to the cursor: the oldest
+// ones when oldest is true (paging with afterId), otherwise the newest ones.
+// It returns true when messages are dropped.
+// The nearest message is always kept, also when it is larger than maxFrameSize: a page
+// without messages can't move the cursor. A message is smaller than
+// chat.DefaultMaxFrameSize (the strings are at most chat.MaxStringLength bytes), so the
+// clients can read it.
+func fitHistoryFrame(messages []*chat.CommandMessage, maxFrameSize int, oldest bool) ([]*chat.CommandMessage, bool) {
+	empty := chat.NewHistoryResponse(chat.ResponseCodeOk, false, nil)
+	size := chat.NewChatHeaderFromCommand(empty).SizeNeeded() + empty.SizeNeeded()
+	fit := 0
+	for fit < len(messages) {
+		message := messages[fit]
+		if !oldest {
+			message = messages[len(messages)-1-fit]
+		}
+		size += message.SizeNeeded()
+		if size > maxFrameSize && fit > 0 {
+			break
+		}
+		fit++
+	}
+	if fit == len(messages) {
+		return messages, false
+	}
+	if oldest {
+		return messages[:fit], true
+	}
+	return messages[len(messages)-fit:], true
+}
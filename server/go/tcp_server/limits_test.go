@@ -0,0 +1,176 @@
+package tcp_server
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"gsantomaggio/chat/server/chat"
+	"gsantomaggio/chat/server/tcp_client"
+	"strings"
+	"time"
+)
+
+var _ = Describe("Limits", func() {
+	const limitsAddress = "localhost:6679"
+	var tcpServer *TcpServer
+	BeforeEach(func() {
+		options := DefaultServerOptions(limitsAddress)
+		options.MaxConnections = 1
+		options.MaxMailboxSize = 1
+		tcpServer = NewTcpServerWithOptions(options, nil)
+		Expect(tcpServer.StartInAThread()).To(Succeed())
+		time.Sleep(200 * time.Millisecond)
+		registerUsers(limitsAddress, "user1", "user2", "user3")
+	})
+	AfterEach(func() {
+		tcpServer.Stop()
+	})
+
+	login := func() *tcp_client.ChatClient {
+		client := tcp_client.NewChatClient(make(chan *chat.CommandMessage, 1))
+		// the connection of registerUsers is closed asynchronously
+		Eventually(func() int {
+			tcpServer.mutexConnections.Lock()
+			defer tcpServer.mutexConnections.Unlock()
+			return len(tcpServer.connections)
+		}).Should(BeZero())
+		Expect(client.Connect(limitsAddress)).To(Succeed())
+		r, e := client.Login("user1", password)
+		Expect(e).To(BeNil())
+		Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+		return client
+	}
+
+	It("Refuses the connections over the max connections", func() {
+		client := login()
+		defer client.Close()
+
+		other := tcp_client.NewChatClient(make(chan *chat.CommandMessage))
+		goingAway := make(chan *chat.CommandServerGoingAway, 1)
+		other.NotifyServerGoingAway(goingAway)
+		Expect(other.Connect(limitsAddress)).To(Succeed())
+		defer other.Close()
+		var command *chat.CommandServerGoingAway
+		Eventually(goingAway).Should(Receive(&command))
+		Expect(command.Reason).To(Equal(tooManyConnectionsReason))
+	})
+
+	It("Refuses the messages to a full mailbox", func() {
+		client := login()
+		defer client.Close()
+
+		r, e := client.SendMessage("first", "user2")
+		Expect(e).To(BeNil())
+		Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+		r, e = client.SendMessage("second", "user2")
+		Expect(e).To(BeNil())
+		Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeErrorMailboxFull))
+		Expect(tcpServer.User("user2").MailboxSize()).To(Equal(1))
+
+		multi, e := client.SendMessageToMany("third", []string{"user2", "user3"})
+		Expect(e).To(BeNil())
+		Expect(multi.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+		Expect(multi.Queued).To(Equal([]string{"user3"}))
+		Expect(multi.NotFound).To(BeEmpty())
+		Expect(multi.MailboxFull).To(Equal([]string{"user2"}))
+		multi, e = client.SendMessageToMany("fourth", []string{"user2", "user3", "unknown"})
+		Expect(e).To(BeNil())
+		Expect(multi.ResponseCode()).To(Equal(chat.ResponseCodeErrorMailboxFull))
+		Expect(multi.NotFound).To(Equal([]string{"unknown"}))
+		Expect(multi.MailboxFull).To(Equal([]string{"user2", "user3"}))
+	})
+
+	It("Reports the members of a room with a full mailbox", func() {
+		client := login()
+		defer client.Close()
+		r, e := client.CreateRoom("limits")
+		Expect(e).To(BeNil())
+		Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+		// user2 can't connect over the max connections
+		Expect(tcpServer.rooms.join("limits", "user2")).To(Equal(chat.ResponseCodeOk))
+
+		multi, e := client.SendRoomMessage("limits", "first")
+		Expect(e).To(BeNil())
+		Expect(multi.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+		Expect(multi.Queued).To(Equal([]string{"user2"}))
+		multi, e = client.SendRoomMessage("limits", "second")
+		Expect(e).To(BeNil())
+		Expect(multi.ResponseCode()).To(Equal(chat.ResponseCodeErrorMailboxFull))
+		Expect(multi.NotFound).To(BeEmpty())
+		Expect(multi.MailboxFull).To(Equal([]string{"user2"}))
+	})
+
+	It("Refuses the messages longer than the max string length before sending them", func() {
+		client := login()
+		defer client.Close()
+		r, e := client.CreateRoom("long")
+		Expect(e).To(BeNil())
+		Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+
+		tooLong := strings.Repeat("a", chat.MaxStringLength+1)
+		_, e = client.SendMessage(tooLong, "user2")
+		Expect(e).To(MatchError(chat.ErrStringTooLong))
+		_, e = client.SendMessageToMany(tooLong, []string{"user2", "user3"})
+		Expect(e).To(MatchError(chat.ErrStringTooLong))
+		_, e = client.Broadcast(tooLong)
+		Expect(e).To(MatchError(chat.ErrStringTooLong))
+		_, e = client.SendRoomMessage("long", tooLong)
+		Expect(e).To(MatchError(chat.ErrStringTooLong))
+
+		// nothing was sent, the connection is still usable
+		Expect(client.Ping()).To(Succeed())
+		sent, e := client.SendMessage("short", "user2")
+		Expect(e).To(BeNil())
+		Expect(sent.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+	})
+})
+
+var _ = Describe("History frame limit", func() {
+	const historyAddress = "localhost:6684"
+	var tcpServer *TcpServer
+	BeforeEach(func() {
+		options := DefaultServerOptions(historyAddress)
+		options.MaxFrameSize = 1024
+		tcpServer = NewTcpServerWithOptions(options, nil)
+		Expect(tcpServer.StartInAThread()).To(Succeed())
+		time.Sleep(200 * time.Millisecond)
+		registerUsers(historyAddress, "user1", "user2")
+	})
+	AfterEach(func() {
+		tcpServer.Stop()
+	})
+
+	It("Sends the messages larger than the max frame size one per page", func() {
+		large := strings.Repeat("a", 2000)
+		for i := 0; i < 3; i++ {
+			tcpServer.history.add(&UserMessage{Id: uint64(1 + i), From: "user2", To: "user1", Message: large, Sent: uint64(1000 + i)})
+		}
+		client := tcp_client.NewChatClient(make(chan *chat.CommandMessage, 1))
+		Expect(client.Connect(historyAddress)).To(Succeed())
+		defer client.Close()
+		r, e := client.Login("user1", password)
+		Expect(e).To(BeNil())
+		Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+
+		// every page has the nearest message, the pages reach the end of the conversation
+		ids := make([]uint64, 0)
+		var before uint64
+		for {
+			history, e := client.History("user2", before, 0, 3)
+			Expect(e).To(BeNil())
+			Expect(history.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+			Expect(history.Messages).To(HaveLen(1))
+			ids = append(ids, history.Messages[0].Id)
+			if !history.More {
+				break
+			}
+			before = history.Messages[0].Id
+		}
+		Expect(ids).To(Equal([]uint64{3, 2, 1}))
+
+		history, e := client.History("user2", 0, 1, 3)
+		Expect(e).To(BeNil())
+		Expect(history.Messages).To(HaveLen(1))
+		Expect(history.Messages[0].Id).To(BeNumerically("==", 2))
+		Expect(history.More).To(BeTrue())
+	})
+})
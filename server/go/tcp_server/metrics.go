@@ -0,0 +1,215 @@
+package tcp_server
+
+import (
+	"bufio"
+	"fmt"
+	"gsantomaggio/chat/server/chat"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rpcDurationBuckets are the upper bounds, in seconds, of the buckets of the RPC latency
+var rpcDurationBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// unknownCommandLabel is the label of the commands with an unknown key,
+// so a client can't create a time series for each key
+const unknownCommandLabel = "unknown"
+
+type histogram struct {
+	// counts has one counter for each bucket plus +Inf, not cumulative
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) observe(value float64) {
+	i := sort.SearchFloat64s(rpcDurationBuckets, value)
+	h.counts[i]++
+	h.count++
+	h.sum += value
+}
+
+// serverMetrics are the counters updated by the connections. The gauges, like the
+// open connections and the mailboxes, are read from the server by WriteMetrics.
+type serverMetrics struct {
+	bytesIn        atomic.Uint64
+	bytesOut       atomic.Uint64
+	logins         atomic.Uint64
+	messagesRouted atomic.Uint64
+	messagesQueued atomic.Uint64
+	// mutex protects the counters with labels
+	mutex         sync.Mutex
+	loginFailures map[string]uint64
+	rpcDurations  map[string]*histogram
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{
+		loginFailures: make(map[string]uint64),
+		rpcDurations:  make(map[string]*histogram),
+	}
+}
+
+// login counts the login with the response code sent to the client.
+func (m *serverMetrics) login(code uint16) {
+	if code == chat.ResponseCodeOk {
+		m.logins.Add(1)
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.loginFailures[chat.FormResponseCodeToString(code)]++
+}
+
+// observeRPC records the time to handle a command and to queue the response.
+func (m *serverMetrics) observeRPC(command string, duration time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	h, ok := m.rpcDurations[command]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(rpcDurationBuckets)+1)}
+		m.rpcDurations[command] = h
+	}
+	h.observe(duration.Seconds())
+}
+
+func commandLabel(key uint16) string {
+	return fmt.Sprintf("0x%02X", key)
+}
+
+// countingReader counts the bytes read from the connection
+type countingReader struct {
+	reader io.Reader
+	count  *atomic.Uint64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.count.Add(uint64(n))
+	return n, err
+}
+
+// countingWriter counts the bytes written to the connection
+type countingWriter struct {
+	writer io.Writer
+	count  *atomic.Uint64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.writer.Write(p)
+	c.count.Add(uint64(n))
+	return n, err
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricsWriter writes the Prometheus text format, the first error is kept
+type metricsWriter struct {
+	writer *bufio.Writer
+	err    error
+}
+
+func (w *metricsWriter) printf(format string, args ...any) {
+	if w.err == nil {
+		_, w.err = fmt.Fprintf(w.writer, format, args...)
+	}
+}
+
+func (w *metricsWriter) header(name, kind, help string) {
+	w.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (w *metricsWriter) value(name string, value any) {
+	w.printf("%s %v\n", name, value)
+}
+
+func (w *metricsWriter) labeled(name, label, labelValue string, value any) {
+	w.printf("%s{%s=\"%s\"} %v\n", name, label, labelEscaper.Replace(labelValue), value)
+}
+
+// WriteMetrics writes the counters and the gauges of the server in the Prometheus text format.
+func (t *TcpServer) WriteMetrics(writer io.Writer) error {
+	w := &metricsWriter{writer: bufio.NewWriter(writer)}
+
+	t.mutexConnections.Lock()
+	connections := len(t.connections)
+	t.mutexConnections.Unlock()
+	w.header("chat_connections_open", "gauge", "Open connections.")
+	w.value("chat_connections_open", connections)
+
+	users := t.Users()
+	usernames := make([]string, 0, len(users))
+	online := 0
+	for username, user := range users {
+		usernames = append(usernames, username)
+		if user.IsOnLine() {
+			online++
+		}
+	}
+	sort.Strings(usernames)
+	w.header("chat_users_registered", "gauge", "Registered users.")
+	w.value("chat_users_registered", len(users))
+	w.header("chat_users_online", "gauge", "Users online.")
+	w.value("chat_users_online", online)
+	w.header("chat_mailbox_messages", "gauge", "Messages in the mailbox of the user, waiting for the ack.")
+	for _, username := range usernames {
+		w.labeled("chat_mailbox_messages", "user", username, users[username].MailboxSize())
+	}
+
+	m := t.metrics
+	w.header("chat_logins_total", "counter", "Successful logins.")
+	w.value("chat_logins_total", m.logins.Load())
+	w.header("chat_messages_routed_total", "counter", "Messages added to the mailbox of the recipients.")
+	w.value("chat_messages_routed_total", m.messagesRouted.Load())
+	w.header("chat_messages_queued_total", "counter", "Messages routed to an offline recipient.")
+	w.value("chat_messages_queued_total", m.messagesQueued.Load())
+	w.header("chat_received_bytes_total", "counter", "Bytes read from the connections.")
+	w.value("chat_received_bytes_total", m.bytesIn.Load())
+	w.header("chat_sent_bytes_total", "counter", "Bytes written to the connections.")
+	w.value("chat_sent_bytes_total", m.bytesOut.Load())
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	w.header("chat_login_failures_total", "counter", "Refused logins by response code.")
+	for _, code := range sortedKeys(m.loginFailures) {
+		w.labeled("chat_login_failures_total", "code", code, m.loginFailures[code])
+	}
+	w.header("chat_rpc_duration_seconds", "histogram", "Time to handle a command and queue the response, by command key.")
+	for _, command := range sortedKeys(m.rpcDurations) {
+		h := m.rpcDurations[command]
+		cumulative := uint64(0)
+		for i, bound := range rpcDurationBuckets {
+			cumulative += h.counts[i]
+			w.printf("chat_rpc_duration_seconds_bucket{command=\"%s\",le=\"%g\"} %d\n", command, bound, cumulative)
+		}
+		w.printf("chat_rpc_duration_seconds_bucket{command=\"%s\",le=\"+Inf\"} %d\n", command, h.count)
+		w.printf("chat_rpc_duration_seconds_sum{command=\"%s\"} %g\n", command, h.sum)
+		w.printf("chat_rpc_duration_seconds_count{command=\"%s\"} %d\n", command, h.count)
+	}
+	if w.err != nil {
+		return w.err
+	}
+	return w.writer.Flush()
+}
+
+// MetricsHandler serves WriteMetrics, for example on /metrics.
+func (t *TcpServer) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = t.WriteMetrics(w)
+	})
+}
+
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,64 @@
+package tcp_server
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"gsantomaggio/chat/server/chat"
+	"gsantomaggio/chat/server/tcp_client"
+	"io"
+	"net/http/httptest"
+	"time"
+)
+
+var _ = Describe("Metrics", func() {
+	const metricsAddress = "localhost:6677"
+	var tcpServer *TcpServer
+	BeforeEach(func() {
+		tcpServer = NewTcpServer(metricsAddress, nil)
+		Expect(tcpServer.StartInAThread()).To(Succeed())
+		time.Sleep(200 * time.Millisecond)
+		registerUsers(metricsAddress, "user1", "user2")
+	})
+	AfterEach(func() {
+		tcpServer.Stop()
+	})
+
+	scrape := func() string {
+		recorder := httptest.NewRecorder()
+		tcpServer.MetricsHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+		Expect(recorder.Header().Get("Content-Type")).To(HavePrefix("text/plain"))
+		body, err := io.ReadAll(recorder.Body)
+		Expect(err).To(BeNil())
+		return string(body)
+	}
+
+	It("Counts the logins, the messages and the connections", func() {
+		client := tcp_client.NewChatClient(make(chan *chat.CommandMessage, 1))
+		Expect(client.Connect(metricsAddress)).To(Succeed())
+		defer client.Close()
+		r, e := client.Login("user1", "wrong")
+		Expect(e).To(BeNil())
+		Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeErrorBadCredentials))
+		r, e = client.Login("user1", password)
+		Expect(e).To(BeNil())
+		Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+		// user2 is offline, the message is queued
+		_, e = client.SendMessage("hello", "user2")
+		Expect(e).To(BeNil())
+
+		// the connection of registerUsers is closed asynchronously
+		Eventually(scrape).Should(ContainSubstring("# TYPE chat_connections_open gauge\nchat_connections_open 1\n"))
+		metrics := scrape()
+		Expect(metrics).To(ContainSubstring("chat_users_registered 2\n"))
+		Expect(metrics).To(ContainSubstring("chat_users_online 1\n"))
+		Expect(metrics).To(ContainSubstring("chat_mailbox_messages{user=\"user2\"} 1\n"))
+		Expect(metrics).To(ContainSubstring("chat_logins_total 1\n"))
+		Expect(metrics).To(ContainSubstring("chat_login_failures_total{code=\"ErrorBadCredentials\"} 1\n"))
+		Expect(metrics).To(ContainSubstring("chat_messages_routed_total 1\n"))
+		Expect(metrics).To(ContainSubstring("chat_messages_queued_total 1\n"))
+		Expect(metrics).To(ContainSubstring("chat_rpc_duration_seconds_count{command=\"0x01\"} 2\n"))
+		Expect(metrics).To(ContainSubstring("chat_rpc_duration_seconds_bucket{command=\"0x02\",le=\"+Inf\"} 1\n"))
+		Expect(metrics).To(MatchRegexp(`chat_received_bytes_total [1-9]\d*\n`))
+		Expect(metrics).To(MatchRegexp(`chat_sent_bytes_total [1-9]\d*\n`))
+	})
+})
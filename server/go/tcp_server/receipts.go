@@ -0,0 +1,93 @@
+package tcp_server
+
+import (
+	"container/list"
+	"sync"
+)
+
+// maxMessageReceipts is the number of receipts kept: the clients may never send the read status,
+// so when the limit is reached the oldest receipt is removed and its read status is not notified.
+const maxMessageReceipts = 100000
+
+// messageReceipt remembers the sender and the recipient of a message,
+// so the sender can be notified when the message is delivered and read.
+type messageReceipt struct {
+	id   uint64
+	from string
+	to   string
+}
+
+// messageReceipts keeps the receipts of the messages not read yet, at most max.
+// The receipts are kept in memory: after a restart they are rebuilt from the mailboxes,
+// so the messages already delivered but not read don't notify the read status.
+type messageReceipts struct {
+	mutex sync.Mutex
+	max   int
+	// order has the receipts from the oldest, entries points to its elements
+	order   *list.List
+	entries map[uint64]*list.Element
+}
+
+func newMessageReceipts(max int) *messageReceipts {
+	return &messageReceipts{
+		max:     max,
+		order:   list.New(),
+		entries: make(map[uint64]*list.Element),
+	}
+}
+
+// add keeps the receipt of the message, the oldest receipt is removed over the max.
+func (r *messageReceipts) add(id uint64, from, to string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if element, ok := r.entries[id]; ok {
+		r.order.Remove(element)
+	}
+	r.entries[id] = r.order.PushBack(&messageReceipt{id: id, from: from, to: to})
+	for r.order.Len() > r.max {
+		oldest := r.order.Remove(r.order.Front()).(*messageReceipt)
+		delete(r.entries, oldest.id)
+	}
+}
+
+// get returns the receipt of the message when the recipient is the user.
+func (r *messageReceipts) get(id uint64, to string) *messageReceipt {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	element := r.entries[id]
+	if element == nil || element.Value.(*messageReceipt).to != to {
+		return nil
+	}
+	return element.Value.(*messageReceipt)
+}
+
+func (r *messageReceipts) remove(id uint64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if element, ok := r.entries[id]; ok {
+		r.order.Remove(element)
+		delete(r.entries, id)
+	}
+}
+
+// removeUser removes the receipts of the messages sent or received by the user:
+// the read status of a deleted user is never sent or received.
+func (r *messageReceipts) removeUser(username string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for element := r.order.Front(); element != nil; {
+		next := element.Next()
+		if receipt := element.Value.(*messageReceipt); receipt.from == username || receipt.to == username {
+			r.order.Remove(element)
+			delete(r.entries, receipt.id)
+		}
+		element = next
+	}
+}
+
+// size returns the number of receipts kept.
+func (r *messageReceipts) size() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.order.Len()
+}
@@ -0,0 +1,34 @@
+package tcp_server
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Message receipts", func() {
+	It("Removes the oldest receipts over the max", func() {
+		receipts := newMessageReceipts(2)
+		receipts.add(1, "user1", "user2")
+		receipts.add(2, "user1", "user2")
+		receipts.add(3, "user1", "user3")
+		Expect(receipts.size()).To(Equal(2))
+		Expect(receipts.get(1, "user2")).To(BeNil())
+		Expect(receipts.get(2, "user2")).NotTo(BeNil())
+		Expect(receipts.get(3, "user3").from).To(Equal("user1"))
+
+		receipts.remove(2)
+		receipts.add(4, "user2", "user3")
+		Expect(receipts.size()).To(Equal(2))
+		Expect(receipts.get(3, "user3")).NotTo(BeNil())
+	})
+
+	It("Removes the receipts of the messages sent or received by a user", func() {
+		receipts := newMessageReceipts(10)
+		receipts.add(1, "user1", "user2")
+		receipts.add(2, "user2", "user3")
+		receipts.add(3, "user1", "user3")
+		receipts.removeUser("user2")
+		Expect(receipts.size()).To(Equal(1))
+		Expect(receipts.get(3, "user3")).NotTo(BeNil())
+	})
+})
@@ -0,0 +1,166 @@
+package tcp_server
+
+import (
+	"bufio"
+	"context"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"gsantomaggio/chat/server/chat"
+	"gsantomaggio/chat/server/tcp_client"
+	"net"
+	"time"
+)
+
+type stateChange struct {
+	state tcp_client.ConnectionState
+	err   error
+}
+
+// newReconnectingClient creates a client that reconnects quickly and reports the state changes.
+func newReconnectingClient(maxAttempts int) (*tcp_client.ChatClient, chan stateChange) {
+	client := tcp_client.NewChatClient(make(chan *chat.CommandMessage, 16))
+	client.SetReconnectPolicy(&tcp_client.ReconnectPolicy{
+		InitialDelay: 20 * time.Millisecond,
+		MaxDelay:     200 * time.Millisecond,
+		Multiplier:   2,
+		Jitter:       0.2,
+		MaxAttempts:  maxAttempts,
+	})
+	states := make(chan stateChange, 64)
+	client.OnStateChange(func(state tcp_client.ConnectionState, err error) {
+		states <- stateChange{state, err}
+	})
+	return client, states
+}
+
+var _ = Describe("Reconnect", func() {
+	const reconnectAddress = "localhost:6674"
+
+	It("Reconnects and logs in again when the server restarts", func() {
+		storage := NewMemoryStorage()
+		server := NewTcpServerWithStorage(reconnectAddress, nil, storage)
+		Expect(server.StartInAThread()).To(Succeed())
+		time.Sleep(200 * time.Millisecond)
+		registerUsers(reconnectAddress, "user1", "user2")
+
+		client, states := newReconnectingClient(0)
+		Expect(client.Connect(reconnectAddress)).To(Succeed())
+		r, e := client.Login("user1", password)
+		Expect(e).To(BeNil())
+		Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		Expect(server.Shutdown(ctx)).To(Succeed())
+		var change stateChange
+		Eventually(states).Should(Receive(&change))
+		Expect(change.state).To(Equal(tcp_client.StateReconnecting))
+		Expect(change.err).To(MatchError(tcp_client.ErrConnectionLost))
+		// the server is down, the commands fail immediately
+		_, e = client.ListUsers()
+		Expect(e).To(MatchError(tcp_client.ErrNotConnected))
+
+		server = NewTcpServerWithStorage(reconnectAddress, nil, storage)
+		Expect(server.StartInAThread()).To(Succeed())
+		defer server.Stop()
+		Eventually(states, 5*time.Second).Should(Receive(&change, WithTransform(func(c stateChange) tcp_client.ConnectionState {
+			return c.state
+		}, Equal(tcp_client.StateConnected))))
+		Expect(server.User("user1").IsOnLine()).To(BeTrue())
+		sent, e := client.SendMessage("Hello", "user2")
+		Expect(e).To(BeNil())
+		Expect(sent.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+		Expect(client.Close()).To(Succeed())
+	})
+
+	It("Logs in again with the last login accepted by the server", func() {
+		storage := NewMemoryStorage()
+		server := NewTcpServerWithStorage(reconnectAddress, nil, storage)
+		Expect(server.StartInAThread()).To(Succeed())
+		time.Sleep(200 * time.Millisecond)
+		registerUsers(reconnectAddress, "user1", "user2")
+
+		client, states := newReconnectingClient(0)
+		Expect(client.Connect(reconnectAddress)).To(Succeed())
+		r, e := client.Login("user1", "wrong")
+		Expect(e).To(BeNil())
+		Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeErrorBadCredentials))
+		r, e = client.Login("user1", password)
+		Expect(e).To(BeNil())
+		Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+		r, e = client.Login("user2", password)
+		Expect(e).To(BeNil())
+		Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeErrorUserAlreadyLogged))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		Expect(server.Shutdown(ctx)).To(Succeed())
+		server = NewTcpServerWithStorage(reconnectAddress, nil, storage)
+		Expect(server.StartInAThread()).To(Succeed())
+		defer server.Stop()
+		var change stateChange
+		Eventually(states, 5*time.Second).Should(Receive(&change, WithTransform(func(c stateChange) tcp_client.ConnectionState {
+			return c.state
+		}, Equal(tcp_client.StateConnected))))
+		Expect(server.User("user1").IsOnLine()).To(BeTrue())
+		Expect(server.User("user2").IsOnLine()).To(BeFalse())
+		Expect(client.Close()).To(Succeed())
+	})
+
+	It("Fails the pending commands when the connection is lost", func() {
+		// the server reads the first frame and closes the connection without answering
+		listener, err := net.Listen("tcp", reconnectAddress)
+		Expect(err).To(BeNil())
+		defer listener.Close()
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = chat.ReadFullBufferFromSource(bufio.NewReader(conn))
+			_ = conn.Close()
+		}()
+
+		client := tcp_client.NewChatClient(make(chan *chat.CommandMessage))
+		disconnected := make(chan error, 1)
+		client.NotifyDisconnected(disconnected)
+		Expect(client.Connect(reconnectAddress)).To(Succeed())
+		start := time.Now()
+		_, e := client.ListUsers()
+		Expect(e).To(MatchError(tcp_client.ErrConnectionLost))
+		Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+		Eventually(disconnected).Should(Receive(MatchError(tcp_client.ErrConnectionLost)))
+		_, e = client.ListUsers()
+		Expect(e).To(MatchError(tcp_client.ErrNotConnected))
+	})
+
+	It("Stops reconnecting after the max attempts", func() {
+		listener, err := net.Listen("tcp", reconnectAddress)
+		Expect(err).To(BeNil())
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}()
+
+		client, states := newReconnectingClient(2)
+		disconnected := make(chan error, 1)
+		client.NotifyDisconnected(disconnected)
+		Expect(client.Connect(reconnectAddress)).To(Succeed())
+		// the server is gone, the new connections are refused
+		Expect(listener.Close()).To(Succeed())
+
+		var reason error
+		Eventually(disconnected, 2*time.Second).Should(Receive(&reason))
+		Expect(reason).To(MatchError(tcp_client.ErrReconnectFailed))
+		received := make([]tcp_client.ConnectionState, 0)
+		for len(states) > 0 {
+			received = append(received, (<-states).state)
+		}
+		Expect(received).To(Equal([]tcp_client.ConnectionState{
+			tcp_client.StateReconnecting, tcp_client.StateReconnecting, tcp_client.StateDisconnected,
+		}))
+	})
+})
@@ -0,0 +1,60 @@
+package tcp_server
+
+import "sync"
+
+// userRegistry keeps the registered users. A user is never replaced,
+// so the *User returned stays valid while the registry changes.
+// A removed user registered again is a new *User.
+type userRegistry struct {
+	mutex sync.RWMutex
+	users map[string]*User
+}
+
+func newUserRegistry() *userRegistry {
+	return &userRegistry{
+		users: make(map[string]*User),
+	}
+}
+
+// get returns the user, nil when the user is not registered.
+func (r *userRegistry) get(username string) *User {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.users[username]
+}
+
+// getOrCreate returns the user registered with the username or the user
+// returned by create, that is added to the registry. created is true when
+// create was called. create runs with the lock held: the concurrent calls
+// with the same username create one user only.
+func (r *userRegistry) getOrCreate(username string, create func() *User) (user *User, created bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if user, ok := r.users[username]; ok {
+		return user, false
+	}
+	user = create()
+	r.users[username] = user
+	return user, true
+}
+
+// remove deletes the user from the registry and returns it, nil when the user is not registered.
+func (r *userRegistry) remove(username string) *User {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	user := r.users[username]
+	delete(r.users, username)
+	return user
+}
+
+// snapshot returns a copy of the registry, the users can be read
+// while the other users register.
+func (r *userRegistry) snapshot() map[string]*User {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	users := make(map[string]*User, len(r.users))
+	for username, user := range r.users {
+		users[username] = user
+	}
+	return users
+}
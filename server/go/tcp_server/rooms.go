@@ -0,0 +1,126 @@
+package tcp_server
+
+import (
+	"gsantomaggio/chat/server/chat"
+	"sort"
+	"sync"
+)
+
+// Room is a named group of users. The messages posted to the room
+// are sent to all the members.
+type Room struct {
+	Name    string
+	members map[string]struct{}
+}
+
+// chatRooms keeps the rooms in memory: the rooms are lost when the server stops,
+// the room messages not delivered yet are kept in the users' mailboxes.
+type chatRooms struct {
+	mutex sync.Mutex
+	rooms map[string]*Room
+}
+
+func newChatRooms() *chatRooms {
+	return &chatRooms{
+		rooms: make(map[string]*Room),
+	}
+}
+
+// create creates the room with the owner as the first member.
+func (c *chatRooms) create(name, owner string) uint16 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, ok := c.rooms[name]; ok {
+		return chat.ResponseCodeErrorRoomAlreadyExists
+	}
+	c.rooms[name] = &Room{
+		Name:    name,
+		members: map[string]struct{}{owner: {}},
+	}
+	return chat.ResponseCodeOk
+}
+
+func (c *chatRooms) join(name, username string) uint16 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	room := c.rooms[name]
+	if room == nil {
+		return chat.ResponseCodeErrorRoomNotFound
+	}
+	room.members[username] = struct{}{}
+	return chat.ResponseCodeOk
+}
+
+// leave removes the user from the room. The room is deleted when it is empty.
+func (c *chatRooms) leave(name, username string) uint16 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	room := c.rooms[name]
+	if room == nil {
+		return chat.ResponseCodeErrorRoomNotFound
+	}
+	if _, ok := room.members[username]; !ok {
+		return chat.ResponseCodeErrorNotRoomMember
+	}
+	delete(room.members, username)
+	if len(room.members) == 0 {
+		delete(c.rooms, name)
+	}
+	return chat.ResponseCodeOk
+}
+
+// leaveAll removes the user from all the rooms, the empty rooms are deleted.
+func (c *chatRooms) leaveAll(username string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for name, room := range c.rooms {
+		delete(room.members, username)
+		if len(room.members) == 0 {
+			delete(c.rooms, name)
+		}
+	}
+}
+
+// members returns the members of the room sorted by name.
+func (c *chatRooms) members(name string) ([]string, uint16) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	room := c.rooms[name]
+	if room == nil {
+		return nil, chat.ResponseCodeErrorRoomNotFound
+	}
+	members := make([]string, 0, len(room.members))
+	for username := range room.members {
+		members = append(members, username)
+	}
+	sort.Strings(members)
+	return members, chat.ResponseCodeOk
+}
+
+// isMember returns true when the user is a member of the room.
+func (c *chatRooms) isMember(name, username string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	room := c.rooms[name]
+	if room == nil {
+		return false
+	}
+	_, ok := room.members[username]
+	return ok
+}
+
+// membership returns the rooms of each user, the rooms are sorted by name.
+func (c *chatRooms) membership() map[string][]string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	result := make(map[string][]string)
+	for name, room := range c.rooms {
+		for username := range room.members {
+			result[username] = append(result[username], name)
+		}
+	}
+	for _, rooms := range result {
+		sort.Strings(rooms)
+	}
+	return result
+}
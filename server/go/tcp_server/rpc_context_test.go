@@ -0,0 +1,137 @@
+package tcp_server
+
+import (
+	"bufio"
+	"context"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"gsantomaggio/chat/server/chat"
+	"gsantomaggio/chat/server/tcp_client"
+	"net"
+	"sync"
+	"time"
+)
+
+var _ = Describe("Client requests with context", func() {
+	const rpcAddress = "localhost:6675"
+	var listener net.Listener
+	// received gets the correlationId of each frame, answer releases the response of the oldest one
+	var received chan uint32
+	var answer chan struct{}
+	BeforeEach(func() {
+		var err error
+		listener, err = net.Listen("tcp", rpcAddress)
+		Expect(err).To(BeNil())
+		received = make(chan uint32, 16)
+		answer = make(chan struct{})
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			reader := bufio.NewReader(conn)
+			pending := make(chan uint32, 16)
+			go func() {
+				for correlationId := range pending {
+					<-answer
+					response := chat.NewGenericResponse(chat.ResponseCodeOk)
+					response.SetCorrelationId(correlationId)
+					if chat.WriteCommandWithHeader(response, bufio.NewWriter(conn)) != nil {
+						return
+					}
+				}
+			}()
+			defer close(pending)
+			for {
+				frame, err := chat.ReadFullBufferFromSource(reader)
+				if err != nil {
+					return
+				}
+				header := &chat.ChatHeader{}
+				if header.Read(frame) != nil {
+					return
+				}
+				correlationId, _ := chat.PeekCorrelationId(frame)
+				received <- correlationId
+				pending <- correlationId
+			}
+		}()
+	})
+	AfterEach(func() {
+		Expect(listener.Close()).To(Succeed())
+	})
+
+	It("Removes the pending response on timeout and cancel and discards the late responses", func() {
+		client := tcp_client.NewChatClientWithOptions(make(chan *chat.CommandMessage), tcp_client.ClientOptions{
+			RequestTimeout: 100 * time.Millisecond,
+		})
+		client.SetHeartbeat(0, 0)
+		Expect(client.Connect(rpcAddress)).To(Succeed())
+
+		start := time.Now()
+		_, err := client.CorrelationIdTest()
+		Expect(err).To(MatchError(context.DeadlineExceeded))
+		Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+		var timedOut uint32
+		Eventually(received).Should(Receive(&timedOut))
+		Expect(client.GetResponse(timedOut)).To(BeNil())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+		_, err = client.CorrelationIdTestContext(ctx)
+		Expect(err).To(MatchError(context.Canceled))
+		var cancelled uint32
+		Eventually(received).Should(Receive(&cancelled))
+		Expect(client.GetResponse(cancelled)).To(BeNil())
+
+		// the late responses are discarded, the client keeps working
+		answer <- struct{}{}
+		answer <- struct{}{}
+		go func() {
+			answer <- struct{}{}
+		}()
+		r, err := client.CorrelationIdTestContext(context.Background())
+		Expect(err).To(BeNil())
+		Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+		Expect(client.Close()).To(Succeed())
+	})
+})
+
+var _ = Describe("Concurrent client requests", func() {
+	const concurrentAddress = "localhost:6683"
+	var tcpServer *TcpServer
+	BeforeEach(func() {
+		tcpServer = NewTcpServer(concurrentAddress, nil)
+		Expect(tcpServer.StartInAThread()).To(Succeed())
+		time.Sleep(200 * time.Millisecond)
+	})
+	AfterEach(func() {
+		tcpServer.Stop()
+	})
+
+	It("Gets the responses of the concurrent requests also when they arrive before the wait", func() {
+		client := tcp_client.NewChatClient(make(chan *chat.CommandMessage))
+		Expect(client.Connect(concurrentAddress)).To(Succeed())
+		defer client.Close()
+		const goroutines = 32
+		const requests = 300
+		errs := make(chan error, goroutines*requests)
+		var wg sync.WaitGroup
+		for i := 0; i < goroutines; i++ {
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				for j := 0; j < requests; j++ {
+					if err := client.Ping(); err != nil {
+						errs <- err
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		Expect(errs).To(BeEmpty())
+	})
+})
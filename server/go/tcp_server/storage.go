@@ -0,0 +1,103 @@
+package tcp_server
+
+import (
+	"sync"
+	"time"
+)
+
+// UserRecord is the state of a user saved by a Storage:
+// the user registry entry plus the offline mailbox.
+type UserRecord struct {
+	Username    string
+	LastLogin   time.Time
+	Credentials *Credentials
+	Messages    []*UserMessage
+}
+
+// Storage persists the users, their offline messages and the message history.
+// SaveUser replaces the whole record of the user, so the implementations
+// don't need to know how the mailbox changed.
+// SaveHistory appends a message to the history, LoadHistory returns
+// the messages in the order they were saved.
+type Storage interface {
+	LoadUsers() ([]*UserRecord, error)
+	SaveUser(record *UserRecord) error
+	DeleteUser(username string) error
+	LoadHistory() ([]*UserMessage, error)
+	SaveHistory(message *UserMessage) error
+	Close() error
+}
+
+// MemoryStorage keeps the records in memory.
+// The records are lost when the process stops.
+type MemoryStorage struct {
+	mutex   sync.Mutex
+	records map[string]*UserRecord
+	history []*UserMessage
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		records: make(map[string]*UserRecord),
+	}
+}
+
+func (m *MemoryStorage) LoadUsers() ([]*UserRecord, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	records := make([]*UserRecord, 0, len(m.records))
+	for _, record := range m.records {
+		records = append(records, copyUserRecord(record))
+	}
+	return records, nil
+}
+
+func (m *MemoryStorage) SaveUser(record *UserRecord) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.records[record.Username] = copyUserRecord(record)
+	return nil
+}
+
+func (m *MemoryStorage) DeleteUser(username string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.records, username)
+	return nil
+}
+
+func (m *MemoryStorage) LoadHistory() ([]*UserMessage, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return copyUserMessages(m.history), nil
+}
+
+func (m *MemoryStorage) SaveHistory(message *UserMessage) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	saved := *message
+	m.history = append(m.history, &saved)
+	return nil
+}
+
+func (m *MemoryStorage) Close() error {
+	return nil
+}
+
+func copyUserRecord(record *UserRecord) *UserRecord {
+	return &UserRecord{
+		Username:    record.Username,
+		LastLogin:   record.LastLogin,
+		Credentials: record.Credentials,
+		Messages:    copyUserMessages(record.Messages),
+	}
+}
+
+func copyUserMessages(messages []*UserMessage) []*UserMessage {
+	result := make([]*UserMessage, len(messages))
+	for i, message := range messages {
+		m := *message
+		result[i] = &m
+	}
+	return result
+}
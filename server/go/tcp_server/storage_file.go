@@ -0,0 +1,324 @@
+package tcp_server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+const (
+	fileStorageOpSave    = "save"
+	fileStorageOpDelete  = "delete"
+	fileStorageOpHistory = "history"
+	// fileStorageOpAdd and fileStorageOpAck change the mailbox of the last saved record
+	fileStorageOpAdd = "add"
+	fileStorageOpAck = "ack"
+
+	// fileStorageMinCompactSize is the size of the log under which
+	// the log is not compacted while the file is open
+	fileStorageMinCompactSize = 1024 * 1024
+)
+
+// fileStorageEntry is one line of the log.
+type fileStorageEntry struct {
+	Op       string       `json:"op"`
+	Username string       `json:"username"`
+	Record   *UserRecord  `json:"record,omitempty"`
+	Message  *UserMessage `json:"message,omitempty"`
+	// Id is the message removed by fileStorageOpAck
+	Id uint64 `json:"id,omitempty"`
+}
+
+// FileStorage is an append-only log of JSON lines.
+// SaveUser appends the messages added to and removed from the mailbox since the
+// last save of the user, one line each. When the other fields of the user changed
+// it appends the whole record, the last record of a user wins.
+// DeleteUser appends one line, every SaveHistory appends one line with the message.
+// When the file is opened the log is replayed and compacted, so the file contains
+// only one line for each user, plus the history. The log is compacted again when
+// it grows to twice the size of the last compaction, see fileStorageMinCompactSize.
+type FileStorage struct {
+	mutex   sync.Mutex
+	path    string
+	file    *os.File
+	records map[string]*UserRecord
+	history []*UserMessage
+	// size is the size of the log, compactedSize the size after the last compaction
+	size          int64
+	compactedSize int64
+	// failed are the users with a SaveUser failed: some lines can be in the log,
+	// the next save writes the whole record
+	failed map[string]bool
+}
+
+func NewFileStorage(path string) (*FileStorage, error) {
+	f := &FileStorage{
+		path:    path,
+		records: make(map[string]*UserRecord),
+		failed:  make(map[string]bool),
+	}
+	if err := f.replay(); err != nil {
+		return nil, err
+	}
+	if err := f.compact(); err != nil {
+		return nil, err
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *FileStorage) open() error {
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("error opening storage file %s: %w", f.path, err)
+	}
+	f.file = file
+	return nil
+}
+
+func (f *FileStorage) replay() error {
+	file, err := os.Open(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error opening storage file %s: %w", f.path, err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			// a line without the final new line is a write interrupted by a crash
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading storage file %s: %w", f.path, err)
+		}
+		entry := &fileStorageEntry{}
+		if err := json.Unmarshal(line, entry); err != nil {
+			return fmt.Errorf("error decoding storage file %s at line %d: %w", f.path, lineNumber, err)
+		}
+		f.apply(entry)
+	}
+}
+
+func (f *FileStorage) apply(entry *fileStorageEntry) {
+	switch entry.Op {
+	case fileStorageOpSave:
+		if entry.Record != nil {
+			f.records[entry.Username] = entry.Record
+		}
+	case fileStorageOpDelete:
+		delete(f.records, entry.Username)
+	case fileStorageOpAdd:
+		if record := f.records[entry.Username]; record != nil && entry.Message != nil {
+			record.Messages = append(record.Messages, entry.Message)
+		}
+	case fileStorageOpAck:
+		if record := f.records[entry.Username]; record != nil {
+			for i, message := range record.Messages {
+				if message.Id == entry.Id {
+					record.Messages = append(record.Messages[:i], record.Messages[i+1:]...)
+					break
+				}
+			}
+		}
+	case fileStorageOpHistory:
+		if entry.Message != nil {
+			f.history = append(f.history, entry.Message)
+		}
+	}
+}
+
+// compact rewrites the log with the current records.
+// The new file is written aside and renamed, so a crash leaves the old log intact.
+func (f *FileStorage) compact() error {
+	tmpPath := f.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_TRUNC|os.O_WRONLY|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("error compacting storage file %s: %w", f.path, err)
+	}
+	writer := bufio.NewWriter(tmp)
+	var size int64
+	for username, record := range f.records {
+		n, err := writeFileStorageEntry(writer, &fileStorageEntry{Op: fileStorageOpSave, Username: username, Record: record})
+		if err != nil {
+			_ = tmp.Close()
+			return err
+		}
+		size += int64(n)
+	}
+	for _, message := range f.history {
+		n, err := writeFileStorageEntry(writer, &fileStorageEntry{Op: fileStorageOpHistory, Message: message})
+		if err != nil {
+			_ = tmp.Close()
+			return err
+		}
+		size += int64(n)
+	}
+	if err := writer.Flush(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, f.path); err != nil {
+		return err
+	}
+	f.size = size
+	f.compactedSize = size
+	return nil
+}
+
+// compactIfNeeded compacts the open log when it is twice the size of the last compaction,
+// so the lines replaced by the newer ones don't grow the log without bound.
+func (f *FileStorage) compactIfNeeded() error {
+	if f.size < fileStorageMinCompactSize || f.size < 2*f.compactedSize {
+		return nil
+	}
+	if err := f.file.Close(); err != nil {
+		return fmt.Errorf("error closing storage file %s: %w", f.path, err)
+	}
+	// the log is opened again also when the compaction fails, the old log is intact
+	err := f.compact()
+	if openErr := f.open(); openErr != nil {
+		return openErr
+	}
+	return err
+}
+
+// append writes the entries at the end of the log.
+func (f *FileStorage) append(entries ...*fileStorageEntry) error {
+	for _, entry := range entries {
+		n, err := writeFileStorageEntry(f.file, entry)
+		f.size += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeFileStorageEntry(writer io.Writer, entry *fileStorageEntry) (int, error) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return 0, err
+	}
+	return writer.Write(append(data, '\n'))
+}
+
+// mailboxChanges returns the entries that change the mailbox of the saved record into
+// the mailbox of record: an ack for each message removed and an add for each message
+// appended. It returns nil when the whole record must be saved: the user is new,
+// the other fields changed or the new mailbox is not the saved one with messages
+// removed and appended.
+func mailboxChanges(saved, record *UserRecord) []*fileStorageEntry {
+	if saved == nil || !saved.LastLogin.Equal(record.LastLogin) || saved.Credentials != record.Credentials {
+		return nil
+	}
+	current := make(map[uint64]bool, len(record.Messages))
+	for _, message := range record.Messages {
+		// the messages saved before the ids were introduced have the id 0
+		if message.Id == 0 || current[message.Id] {
+			return nil
+		}
+		current[message.Id] = true
+	}
+	entries := make([]*fileStorageEntry, 0)
+	kept := 0
+	for _, message := range saved.Messages {
+		if !current[message.Id] {
+			entries = append(entries, &fileStorageEntry{Op: fileStorageOpAck, Username: record.Username, Id: message.Id})
+			continue
+		}
+		if record.Messages[kept].Id != message.Id {
+			return nil
+		}
+		kept++
+	}
+	for _, message := range record.Messages[kept:] {
+		entries = append(entries, &fileStorageEntry{Op: fileStorageOpAdd, Username: record.Username, Message: message})
+	}
+	return entries
+}
+
+func (f *FileStorage) LoadUsers() ([]*UserRecord, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	records := make([]*UserRecord, 0, len(f.records))
+	for _, record := range f.records {
+		records = append(records, copyUserRecord(record))
+	}
+	return records, nil
+}
+
+func (f *FileStorage) SaveUser(record *UserRecord) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	record = copyUserRecord(record)
+	var entries []*fileStorageEntry
+	if !f.failed[record.Username] {
+		entries = mailboxChanges(f.records[record.Username], record)
+	}
+	if entries == nil {
+		entries = []*fileStorageEntry{{Op: fileStorageOpSave, Username: record.Username, Record: record}}
+	}
+	if err := f.append(entries...); err != nil {
+		f.failed[record.Username] = true
+		return err
+	}
+	delete(f.failed, record.Username)
+	f.records[record.Username] = record
+	return f.compactIfNeeded()
+}
+
+func (f *FileStorage) DeleteUser(username string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.append(&fileStorageEntry{Op: fileStorageOpDelete, Username: username}); err != nil {
+		return err
+	}
+	delete(f.records, username)
+	delete(f.failed, username)
+	return f.compactIfNeeded()
+}
+
+func (f *FileStorage) LoadHistory() ([]*UserMessage, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return copyUserMessages(f.history), nil
+}
+
+func (f *FileStorage) SaveHistory(message *UserMessage) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	saved := *message
+	if err := f.append(&fileStorageEntry{Op: fileStorageOpHistory, Message: &saved}); err != nil {
+		return err
+	}
+	f.history = append(f.history, &saved)
+	return f.compactIfNeeded()
+}
+
+func (f *FileStorage) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.file.Sync(); err != nil {
+		_ = f.file.Close()
+		return err
+	}
+	return f.file.Close()
+}
@@ -0,0 +1,293 @@
+package tcp_server
+
+import (
+	"encoding/hex"
+	"fmt"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"gsantomaggio/chat/server/chat"
+	"gsantomaggio/chat/server/tcp_client"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var _ = Describe("Storage", func() {
+	var storagePath string
+	BeforeEach(func() {
+		storagePath = filepath.Join(GinkgoT().TempDir(), "chat.log")
+	})
+
+	Context("MemoryStorage", func() {
+		It("saves, loads and deletes the users", func() {
+			storage := NewMemoryStorage()
+			Expect(storage.SaveUser(&UserRecord{Username: "user1", Messages: []*UserMessage{{From: "user2", To: "user1", Message: "Hello"}}})).To(Succeed())
+			Expect(storage.SaveUser(&UserRecord{Username: "user2"})).To(Succeed())
+			records, err := storage.LoadUsers()
+			Expect(err).To(BeNil())
+			Expect(records).To(HaveLen(2))
+			Expect(storage.DeleteUser("user2")).To(Succeed())
+			records, err = storage.LoadUsers()
+			Expect(err).To(BeNil())
+			Expect(records).To(HaveLen(1))
+			Expect(records[0].Messages[0].Message).To(Equal("Hello"))
+		})
+	})
+
+	Context("FileStorage", func() {
+		It("restores the users after a reopen", func() {
+			storage, err := NewFileStorage(storagePath)
+			Expect(err).To(BeNil())
+			lastLogin := time.Now().Truncate(time.Second)
+			Expect(storage.SaveUser(&UserRecord{Username: "user1", LastLogin: lastLogin})).To(Succeed())
+			Expect(storage.SaveUser(&UserRecord{Username: "user1", LastLogin: lastLogin,
+				Messages: []*UserMessage{{From: "user2", To: "user1", Message: "Hello", Sent: 10}}})).To(Succeed())
+			Expect(storage.SaveUser(&UserRecord{Username: "user2"})).To(Succeed())
+			Expect(storage.DeleteUser("user2")).To(Succeed())
+			Expect(storage.Close()).To(Succeed())
+
+			storage, err = NewFileStorage(storagePath)
+			Expect(err).To(BeNil())
+			records, err := storage.LoadUsers()
+			Expect(err).To(BeNil())
+			Expect(records).To(HaveLen(1))
+			Expect(records[0].Username).To(Equal("user1"))
+			Expect(records[0].LastLogin.Equal(lastLogin)).To(BeTrue())
+			Expect(records[0].Messages).To(HaveLen(1))
+			Expect(records[0].Messages[0].Message).To(Equal("Hello"))
+			Expect(records[0].Messages[0].Sent).To(BeNumerically("==", 10))
+			Expect(storage.Close()).To(Succeed())
+		})
+
+		It("compacts the log when it is opened", func() {
+			storage, err := NewFileStorage(storagePath)
+			Expect(err).To(BeNil())
+			for i := 0; i < 10; i++ {
+				Expect(storage.SaveUser(&UserRecord{Username: "user1"})).To(Succeed())
+			}
+			Expect(storage.Close()).To(Succeed())
+
+			storage, err = NewFileStorage(storagePath)
+			Expect(err).To(BeNil())
+			Expect(storage.Close()).To(Succeed())
+			data, err := os.ReadFile(storagePath)
+			Expect(err).To(BeNil())
+			Expect(string(data)).To(HaveLen(len(`{"op":"save","username":"user1","record":{"Username":"user1","LastLogin":"0001-01-01T00:00:00Z","Credentials":null,"Messages":[]}}`) + 1))
+		})
+
+		It("keeps the history after the compaction", func() {
+			storage, err := NewFileStorage(storagePath)
+			Expect(err).To(BeNil())
+			Expect(storage.SaveHistory(&UserMessage{Id: 1, From: "user1", To: "user2", Message: "Hello", Sent: 10})).To(Succeed())
+			Expect(storage.SaveHistory(&UserMessage{Id: 2, From: "user2", To: "user1", Message: "Hi", Sent: 11})).To(Succeed())
+			Expect(storage.Close()).To(Succeed())
+
+			for i := 0; i < 2; i++ {
+				storage, err = NewFileStorage(storagePath)
+				Expect(err).To(BeNil())
+				history, err := storage.LoadHistory()
+				Expect(err).To(BeNil())
+				Expect(history).To(HaveLen(2))
+				Expect(history[0].Message).To(Equal("Hello"))
+				Expect(history[1].Message).To(Equal("Hi"))
+				Expect(storage.Close()).To(Succeed())
+			}
+		})
+
+		It("appends the mailbox changes instead of the whole record", func() {
+			storage, err := NewFileStorage(storagePath)
+			Expect(err).To(BeNil())
+			const messages = 1000
+			record := &UserRecord{Username: "user1", LastLogin: time.Now()}
+			Expect(storage.SaveUser(record)).To(Succeed())
+			for i := 1; i <= messages; i++ {
+				record.Messages = append(record.Messages, &UserMessage{Id: uint64(i), From: "user2", To: "user1", Message: fmt.Sprintf("Hello %d", i), Sent: 10})
+				Expect(storage.SaveUser(record)).To(Succeed())
+			}
+			// the acks of the even messages
+			for i := messages - 1; i >= 0; i-- {
+				if record.Messages[i].Id%2 == 0 {
+					record.Messages = append(record.Messages[:i], record.Messages[i+1:]...)
+					Expect(storage.SaveUser(record)).To(Succeed())
+				}
+			}
+			// the whole record saved each time would be about 40 MB
+			info, err := os.Stat(storagePath)
+			Expect(err).To(BeNil())
+			Expect(info.Size()).To(BeNumerically("<", 200*messages))
+			Expect(storage.Close()).To(Succeed())
+
+			storage, err = NewFileStorage(storagePath)
+			Expect(err).To(BeNil())
+			records, err := storage.LoadUsers()
+			Expect(err).To(BeNil())
+			Expect(records).To(HaveLen(1))
+			Expect(records[0].Messages).To(HaveLen(messages / 2))
+			for i, message := range records[0].Messages {
+				Expect(message.Id).To(BeNumerically("==", 2*i+1))
+				Expect(message.Message).To(Equal(fmt.Sprintf("Hello %d", 2*i+1)))
+			}
+			Expect(storage.Close()).To(Succeed())
+		})
+
+		It("compacts the open log when it grows", func() {
+			storage, err := NewFileStorage(storagePath)
+			Expect(err).To(BeNil())
+			record := &UserRecord{Username: "user1"}
+			Expect(storage.SaveUser(record)).To(Succeed())
+			// about 3 times fileStorageMinCompactSize of adds and acks
+			for i := 1; i <= 20_000; i++ {
+				record.Messages = []*UserMessage{{Id: uint64(i), From: "user2", To: "user1", Message: "Hello", Sent: 10}}
+				Expect(storage.SaveUser(record)).To(Succeed())
+				record.Messages = nil
+				Expect(storage.SaveUser(record)).To(Succeed())
+			}
+			info, err := os.Stat(storagePath)
+			Expect(err).To(BeNil())
+			Expect(info.Size()).To(BeNumerically("<", fileStorageMinCompactSize))
+			record.Messages = []*UserMessage{{Id: 20_001, From: "user2", To: "user1", Message: "Last", Sent: 10}}
+			Expect(storage.SaveUser(record)).To(Succeed())
+			Expect(storage.Close()).To(Succeed())
+
+			storage, err = NewFileStorage(storagePath)
+			Expect(err).To(BeNil())
+			records, err := storage.LoadUsers()
+			Expect(err).To(BeNil())
+			Expect(records).To(HaveLen(1))
+			Expect(records[0].Messages).To(HaveLen(1))
+			Expect(records[0].Messages[0].Message).To(Equal("Last"))
+			Expect(storage.Close()).To(Succeed())
+		})
+
+		It("ignores a last line interrupted by a crash", func() {
+			storage, err := NewFileStorage(storagePath)
+			Expect(err).To(BeNil())
+			Expect(storage.SaveUser(&UserRecord{Username: "user1"})).To(Succeed())
+			Expect(storage.Close()).To(Succeed())
+			file, err := os.OpenFile(storagePath, os.O_APPEND|os.O_WRONLY, 0o600)
+			Expect(err).To(BeNil())
+			_, err = file.WriteString(`{"op":"save","usern`)
+			Expect(err).To(BeNil())
+			Expect(file.Close()).To(Succeed())
+
+			storage, err = NewFileStorage(storagePath)
+			Expect(err).To(BeNil())
+			records, err := storage.LoadUsers()
+			Expect(err).To(BeNil())
+			Expect(records).To(HaveLen(1))
+			Expect(storage.Close()).To(Succeed())
+		})
+	})
+
+	Context("TcpServer", func() {
+		It("keeps the offline messages after a restart", func() {
+			const restartAddress = "localhost:6667"
+			storage, err := NewFileStorage(storagePath)
+			Expect(err).To(BeNil())
+			server := NewTcpServerWithStorage(restartAddress, nil, storage)
+			Expect(server.StartInAThread()).To(Succeed())
+			time.Sleep(200 * time.Millisecond)
+			registerUsers(restartAddress, "user1", "user2")
+
+			client1 := tcp_client.NewChatClient(make(chan *chat.CommandMessage))
+			Expect(client1.Connect(restartAddress)).To(Succeed())
+			r, e := client1.Login("user1", password)
+			Expect(e).To(BeNil())
+			Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+			r, e = client1.Logout()
+			Expect(e).To(BeNil())
+			Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+
+			client2 := tcp_client.NewChatClient(make(chan *chat.CommandMessage))
+			Expect(client2.Connect(restartAddress)).To(Succeed())
+			r, e = client2.Login("user2", password)
+			Expect(e).To(BeNil())
+			Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+			sent, e := client2.SendMessage("Hello", "user1")
+			Expect(e).To(BeNil())
+			Expect(sent.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+			Expect(client1.Close()).To(Succeed())
+			Expect(client2.Close()).To(Succeed())
+			Expect(server.Stop()).To(Succeed())
+			Expect(storage.Close()).To(Succeed())
+
+			storage, err = NewFileStorage(storagePath)
+			Expect(err).To(BeNil())
+			server = NewTcpServerWithStorage(restartAddress, nil, storage)
+			Expect(server.StartInAThread()).To(Succeed())
+			time.Sleep(200 * time.Millisecond)
+			Expect(server.Users()).To(HaveKey("user2"))
+			Expect(server.Users()["user2"].IsOnLine()).To(BeFalse())
+			Expect(server.Users()["user2"].VerifyPassword(password)).To(BeTrue())
+			Expect(server.Users()["user2"].VerifyPassword("wrong")).To(BeFalse())
+
+			receiver := make(chan *chat.CommandMessage, 1)
+			client1 = tcp_client.NewChatClient(receiver)
+			Expect(client1.Connect(restartAddress)).To(Succeed())
+			r, e = client1.Login("user1", password)
+			Expect(e).To(BeNil())
+			Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+			var msg *chat.CommandMessage
+			Eventually(receiver).Should(Receive(&msg))
+			Expect(msg.From).To(Equal("user2"))
+			Expect(msg.Message).To(Equal("Hello"))
+
+			history, e := client1.History("user2", 0, 0, 0)
+			Expect(e).To(BeNil())
+			Expect(history.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+			Expect(history.Messages).To(HaveLen(1))
+			Expect(history.Messages[0].Id).To(Equal(msg.Id))
+
+			Expect(client1.Close()).To(Succeed())
+			Expect(server.Stop()).To(Succeed())
+			Expect(storage.Close()).To(Succeed())
+		})
+	})
+})
+
+var _ = Describe("Credentials", func() {
+	Context("Credentials", func() {
+		It("derives the key as PBKDF2-HMAC-SHA256", func() {
+			// test vectors from RFC 7914, section 11
+			Expect(hex.EncodeToString(pbkdf2SHA256([]byte("passwd"), []byte("salt"), 1))).
+				To(Equal("55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc"))
+		})
+
+		It("verifies only the right password", func() {
+			credentials, err := NewCredentials("secret")
+			Expect(err).To(BeNil())
+			Expect(credentials.Verify("secret")).To(BeTrue())
+			Expect(credentials.Verify("Secret")).To(BeFalse())
+			other, err := NewCredentials("secret")
+			Expect(err).To(BeNil())
+			Expect(other.Salt).NotTo(Equal(credentials.Salt))
+		})
+
+		It("verifies the credentials saved without the algorithm and refuses an unknown algorithm", func() {
+			credentials, err := NewCredentials("secret")
+			Expect(err).To(BeNil())
+			Expect(credentials.Algorithm).To(Equal(passwordAlgorithmPBKDF2SHA256))
+			// the credentials saved before the algorithm was stored
+			saved := &Credentials{Salt: credentials.Salt, Hash: credentials.Hash, Iterations: credentials.Iterations}
+			Expect(saved.Verify("secret")).To(BeTrue())
+			saved.Algorithm = "argon2id"
+			Expect(saved.Verify("secret")).To(BeFalse())
+		})
+
+		It("refuses the login of a user saved without credentials until the password is set", func() {
+			storage := NewMemoryStorage()
+			user := restoreUser(&UserRecord{Username: "user1"}, nil, storage)
+			defer user.shutdown()
+			Expect(user.VerifyPassword("secret")).To(BeFalse())
+			Expect(user.VerifyPassword("secret")).To(BeFalse())
+
+			Expect(user.SetPassword("secret")).To(Succeed())
+			Expect(user.VerifyPassword("secret")).To(BeTrue())
+			Expect(user.VerifyPassword("other")).To(BeFalse())
+			records, err := storage.LoadUsers()
+			Expect(err).To(BeNil())
+			Expect(records).To(HaveLen(1))
+			Expect(records[0].Credentials).NotTo(BeNil())
+		})
+	})
+})
@@ -2,13 +2,18 @@ package tcp_server
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"gsantomaggio/chat/server/chat"
 	"io"
+	"log/slog"
 	"math/rand/v2"
 	"net"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,205 +22,1224 @@ type TcpServerer interface {
 
 type TcpServer struct {
 	address     string
-	users       map[string]*User
-	mutexMap    sync.Mutex
+	users       *userRegistry
 	listener    net.Listener
-	chEvents    chan *Event
+	events      *EventDispatcher
 	done        chan bool
 	tickerUsers *time.Ticker
+	storage     Storage
+	tlsConfig   *tls.Config
+	// lastMessageId is the id of the last message routed, see nextMessageId
+	lastMessageId uint64
+	mutexId       sync.Mutex
+	receipts      *messageReceipts
+	rooms         *chatRooms
+	history       *messageHistory
+	// maxFrameSize is the max length of the frames read, see SetMaxFrameSize
+	maxFrameSize uint32
+	// writeQueueSize is the number of frames queued on each connection, see SetWriteQueueSize
+	writeQueueSize int
+	// handshakeTimeout closes the connections that don't complete the TLS handshake
+	handshakeTimeout time.Duration
+	// heartbeatInterval and heartbeatMaxMissed detect the dead connections, see SetHeartbeat
+	heartbeatInterval  time.Duration
+	heartbeatMaxMissed int
+	// maxConnections and maxMailboxSize are the limits of ServerOptions, 0 for no limit
+	maxConnections int
+	maxMailboxSize int
+	// connections are the open connections with their writer, closed by Shutdown.
+	// mutexConnections protects also listener and shuttingDown.
+	mutexConnections sync.Mutex
+	connections      map[net.Conn]*chat.ConnectionWriter
+	shuttingDown     bool
+	// connectionsWg waits for the handleConnection goroutines,
+	// backgroundWg for the other goroutines of the server
+	connectionsWg sync.WaitGroup
+	backgroundWg  sync.WaitGroup
+	// acceptDone is closed when the accept loop of Start exits
+	acceptDone   chan struct{}
+	shutdownOnce sync.Once
+	shutdownErr  error
+	// metrics are the counters written by WriteMetrics
+	metrics *serverMetrics
 }
 
+// shutdownReason is sent to the clients with CommandServerGoingAway
+const shutdownReason = "server shutdown"
+
+// tlsHandshakeTimeout is the time the clients have to complete the TLS handshake
+const tlsHandshakeTimeout = 10 * time.Second
+
+// tooManyConnectionsReason is sent with CommandServerGoingAway to the connections over ServerOptions.MaxConnections
+const tooManyConnectionsReason = "too many connections"
+
+// ServerOptions configure the server created by NewTcpServerWithOptions.
+type ServerOptions struct {
+	// Address is the address of the listener, like localhost:5555
+	Address string
+	// Storage persists the users and the messages, a MemoryStorage when nil.
+	// The storage is not closed by the server.
+	Storage Storage
+	// TLSConfig enables TLS when it is set, see NewServerTLSConfig
+	TLSConfig *tls.Config
+	// MaxFrameSize, see SetMaxFrameSize
+	MaxFrameSize uint32
+	// WriteQueueSize, see SetWriteQueueSize
+	WriteQueueSize int
+	// HeartbeatInterval and HeartbeatMaxMissed, see SetHeartbeat.
+	// An interval of 0 disables the heartbeat, DefaultServerOptions enables it.
+	HeartbeatInterval  time.Duration
+	HeartbeatMaxMissed int
+	// MaxConnections is the max number of open connections, 0 for no limit.
+	// The connections over the limit receive CommandServerGoingAway and are closed.
+	MaxConnections int
+	// MaxMailboxSize is the max number of messages waiting for the ack of a user, 0 for no limit.
+	// The messages to a full mailbox are refused with ErrorMailboxFull.
+	MaxMailboxSize int
+}
+
+// DefaultServerOptions returns the options of a server listening on the address,
+// in memory, without TLS and without limits on the connections and the mailboxes.
+func DefaultServerOptions(address string) ServerOptions {
+	return ServerOptions{
+		Address:            address,
+		MaxFrameSize:       chat.DefaultMaxFrameSize,
+		WriteQueueSize:     chat.DefaultWriteQueueSize,
+		HeartbeatInterval:  chat.DefaultHeartbeatInterval,
+		HeartbeatMaxMissed: chat.DefaultHeartbeatMaxMissed,
+	}
+}
+
+// NewTcpServer creates a server that keeps the users and the messages in memory.
+// The events are sent to the channel without blocking, see EventDispatcher:
+// use a buffered channel, or nil to discard them.
 func NewTcpServer(address string, events chan *Event) *TcpServer {
+	return NewTcpServerWithOptions(DefaultServerOptions(address), events)
+}
+
+// NewTcpServerWithStorage creates a server that persists the users and the
+// offline messages in the storage. The users are loaded from the storage when
+// the server starts. The storage is not closed by the server.
+func NewTcpServerWithStorage(address string, events chan *Event, storage Storage) *TcpServer {
+	options := DefaultServerOptions(address)
+	options.Storage = storage
+	return NewTcpServerWithOptions(options, events)
+}
+
+// NewTcpServerWithOptions creates a server with the options, see ServerOptions.
+// The zero values use the defaults of DefaultServerOptions, except HeartbeatInterval:
+// 0 disables the heartbeat.
+func NewTcpServerWithOptions(options ServerOptions, events chan *Event) *TcpServer {
+	defaults := DefaultServerOptions(options.Address)
+	if options.Storage == nil {
+		options.Storage = NewMemoryStorage()
+	}
+	if options.MaxFrameSize == 0 {
+		options.MaxFrameSize = defaults.MaxFrameSize
+	}
+	if options.HeartbeatMaxMissed <= 0 {
+		options.HeartbeatMaxMissed = defaults.HeartbeatMaxMissed
+	}
 	return &TcpServer{
-		address:     address,
-		users:       make(map[string]*User),
-		mutexMap:    sync.Mutex{},
-		chEvents:    events,
-		tickerUsers: time.NewTicker(5 * time.Second),
-		done:        make(chan bool),
+		address:            options.Address,
+		users:              newUserRegistry(),
+		events:             NewEventDispatcher(events),
+		tickerUsers:        time.NewTicker(5 * time.Second),
+		done:               make(chan bool),
+		storage:            options.Storage,
+		tlsConfig:          options.TLSConfig,
+		handshakeTimeout:   tlsHandshakeTimeout,
+		receipts:           newMessageReceipts(maxMessageReceipts),
+		rooms:              newChatRooms(),
+		history:            newMessageHistory(),
+		maxFrameSize:       options.MaxFrameSize,
+		writeQueueSize:     options.WriteQueueSize,
+		heartbeatInterval:  options.HeartbeatInterval,
+		heartbeatMaxMissed: options.HeartbeatMaxMissed,
+		maxConnections:     options.MaxConnections,
+		maxMailboxSize:     options.MaxMailboxSize,
+		connections:        make(map[net.Conn]*chat.ConnectionWriter),
+		acceptDone:         make(chan struct{}),
+		metrics:            newServerMetrics(),
 	}
 }
 
-func (t *TcpServer) DispatchEvent(message string, isAnError bool, level int) {
-	if t.chEvents != nil {
-		t.chEvents <- NewEvent(message, isAnError, level)
+// nextMessageId returns a unique id for a message.
+// The id is the current time in nanoseconds, or the last id + 1 when two messages
+// are routed in the same nanosecond, so the ids are unique across server restarts.
+func (t *TcpServer) nextMessageId() uint64 {
+	t.mutexId.Lock()
+	defer t.mutexId.Unlock()
+	id := chat.ConvertTimeToUint64(time.Now())
+	if id <= t.lastMessageId {
+		id = t.lastMessageId + 1
 	}
+	t.lastMessageId = id
+	return id
 }
 
-func (t *TcpServer) dispatchUserStatus() {
+// SetTLSConfig enables TLS for the connections. It must be called before Start.
+// See NewServerTLSConfig.
+func (t *TcpServer) SetTLSConfig(config *tls.Config) {
+	t.tlsConfig = config
+}
+
+// SetMaxFrameSize sets the max length of the frames accepted, chat.DefaultMaxFrameSize
+// when not set. The connections sending a larger frame are closed.
+// It must be called before Start.
+func (t *TcpServer) SetMaxFrameSize(size uint32) {
+	t.maxFrameSize = size
+}
+
+// SetWriteQueueSize sets the number of frames queued on each connection,
+// chat.DefaultWriteQueueSize when not set. See chat.ConnectionWriter.
+// It must be called before Start.
+func (t *TcpServer) SetWriteQueueSize(size int) {
+	t.writeQueueSize = size
+}
+
+// SetHeartbeat sets how the dead connections are detected: when the server doesn't
+// read any frame for interval it sends a CommandPing, after maxMissed pings without
+// frames from the client the connection is closed and the user is set offline.
+// An interval of 0, like in ServerOptions, disables the heartbeat. It must be called before Start.
+func (t *TcpServer) SetHeartbeat(interval time.Duration, maxMissed int) {
+	t.heartbeatInterval = interval
+	t.heartbeatMaxMissed = maxMissed
+}
+
+// loadHistory restores the message history saved in the storage.
+func (t *TcpServer) loadHistory() error {
+	messages, err := t.storage.LoadHistory()
+	if err != nil {
+		return err
+	}
+	for _, message := range messages {
+		if message.Id > t.lastMessageId {
+			t.lastMessageId = message.Id
+		}
+		t.history.add(message)
+	}
+	t.DispatchEvent(EventStorage, slog.LevelInfo, "History loaded from the storage", slog.Int(AttrCount, len(messages)))
+	return nil
+}
+
+// loadUsers restores the users saved in the storage. All the users are offline.
+func (t *TcpServer) loadUsers() error {
+	records, err := t.storage.LoadUsers()
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		for _, message := range record.Messages {
+			if message.Id > t.lastMessageId {
+				t.lastMessageId = message.Id
+			}
+		}
+	}
+	for _, record := range records {
+		for _, message := range record.Messages {
+			// messages saved before the ids were introduced
+			if message.Id == 0 {
+				message.Id = t.nextMessageId()
+			}
+			t.receipts.add(message.Id, message.From, message.To)
+		}
+		t.users.getOrCreate(record.Username, func() *User {
+			return restoreUser(record, t.events, t.storage)
+		})
+	}
+	t.DispatchEvent(EventStorage, slog.LevelInfo, "Users loaded from the storage", slog.Int(AttrCount, len(records)))
+	return nil
+}
+
+// DispatchEvent sends an event without blocking, see EventDispatcher.
+func (t *TcpServer) DispatchEvent(kind EventKind, level slog.Level, message string, attrs ...slog.Attr) {
+	t.events.Dispatch(kind, level, message, attrs...)
+}
+
+// DroppedEvents returns the number of events dropped because the channel of the events was full.
+func (t *TcpServer) DroppedEvents() uint64 {
+	return t.events.Dropped()
+}
 
+func (t *TcpServer) dispatchUserStatus() {
+	t.backgroundWg.Add(1)
 	go func() {
+		defer t.backgroundWg.Done()
 		for {
 			select {
 			case <-t.done:
 				return
 			case _ = <-t.tickerUsers.C:
-				var userStatus []string
+				membership := t.rooms.membership()
 				for _, user := range t.Users() {
-					if user.IsOnLine() {
-						userStatus = append(userStatus, fmt.Sprintf("\n %s is online, last Login: %s", user.Username, user.LastLogin.Format(time.RFC1123)))
-					} else {
-						userStatus = append(userStatus, fmt.Sprintf("\n %s is offline, last Login: %s", user.Username, user.LastLogin.Format(time.RFC1123)))
-					}
+					online, lastLogin := user.Status()
+					t.DispatchEvent(EventUsersStatus, slog.LevelDebug, "User status",
+						slog.String(AttrUser, user.Username), slog.Bool(AttrOnline, online),
+						slog.Time(AttrLastLogin, lastLogin), slog.Any(AttrRooms, membership[user.Username]))
 				}
-				t.DispatchEvent(fmt.Sprintf("Users status:%s \n", userStatus), false, 1)
 			}
 		}
 	}()
 }
 
+// StartInAThread loads the storage and listens, then accepts the connections in a goroutine.
+// The errors of the storage and of the listen are returned.
 func (t *TcpServer) StartInAThread() error {
-	go func() {
-		err := t.Start()
-		if err != nil {
-			t.DispatchEvent(fmt.Sprintf("Error starting server: %v", err), true, 1)
-		}
-	}()
+	listener, err := t.listen()
+	if err != nil {
+		return err
+	}
+	go t.serve(listener)
 	return nil
 }
+
+// Start loads the storage, listens and accepts the connections until the server is shut down.
 func (t *TcpServer) Start() error {
-	listener, err := net.Listen("tcp", t.address)
+	listener, err := t.listen()
 	if err != nil {
-		t.DispatchEvent(fmt.Sprintf("Error starting server: %v", err), true, 2)
-		return fmt.Errorf("error starting TCP server: %v", err)
+		return err
+	}
+	t.serve(listener)
+	return nil
+}
+
+// listen loads the history and the users from the storage and opens the listener.
+func (t *TcpServer) listen() (net.Listener, error) {
+	err := t.loadHistory()
+	if err != nil {
+		t.DispatchEvent(EventStorage, slog.LevelError, "Error loading history", slog.String(AttrError, err.Error()))
+		return nil, fmt.Errorf("error loading history: %v", err)
+	}
+	err = t.loadUsers()
+	if err != nil {
+		t.DispatchEvent(EventStorage, slog.LevelError, "Error loading users", slog.String(AttrError, err.Error()))
+		return nil, fmt.Errorf("error loading users: %v", err)
+	}
+	var listener net.Listener
+	if t.tlsConfig != nil {
+		listener, err = tls.Listen("tcp", t.address, t.tlsConfig)
+	} else {
+		listener, err = net.Listen("tcp", t.address)
+	}
+	if err != nil {
+		t.DispatchEvent(EventServerStopped, slog.LevelError, "Error starting server", slog.String(AttrError, err.Error()))
+		return nil, fmt.Errorf("error starting TCP server: %v", err)
+	}
+	t.mutexConnections.Lock()
+	defer t.mutexConnections.Unlock()
+	if t.shuttingDown {
+		_ = listener.Close()
+		return nil, errors.New("the server is shut down")
 	}
 	t.listener = listener
+	return listener, nil
+}
+
+// serve accepts the connections until the listener is closed.
+func (t *TcpServer) serve(listener net.Listener) {
+	defer close(t.acceptDone)
 
-	t.DispatchEvent(fmt.Sprintf("Server started at %s", t.address), false, 2)
+	t.DispatchEvent(EventServerStarted, slog.LevelInfo, "Server started",
+		slog.String(AttrAddress, t.address), slog.Bool(AttrTLS, t.tlsConfig != nil))
 	t.dispatchUserStatus()
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			t.DispatchEvent(fmt.Sprintf("Error accepting connection: %v", err), true, 3)
+			if !errors.Is(err, net.ErrClosed) {
+				t.DispatchEvent(EventProtocolError, slog.LevelError, "Error accepting connection", slog.String(AttrError, err.Error()))
+			}
 			break
 		}
+		t.connectionsWg.Add(1)
 		go t.handleConnection(conn)
 	}
 
-	t.DispatchEvent("Server stopped", false, 2)
-	return nil
+	t.DispatchEvent(EventServerStopped, slog.LevelInfo, "Server stopped")
 }
 
+// Stop is Shutdown without a deadline.
 func (t *TcpServer) Stop() error {
+	return t.Shutdown(context.Background())
+}
+
+// Shutdown stops the server gracefully:
+//   - stops accepting the connections
+//   - sends CommandServerGoingAway to the connected clients and writes the frames queued
+//   - closes the connections and waits for their goroutines
+//   - stops the goroutines of the users and saves the users in the storage
+//
+// When the context expires the connections are closed without waiting for the writes,
+// and Shutdown returns the context error without waiting for the goroutines.
+// The storage is not closed. Only the first call shuts down the server.
+func (t *TcpServer) Shutdown(ctx context.Context) error {
+	t.shutdownOnce.Do(func() {
+		t.shutdownErr = t.shutdown(ctx)
+	})
+	return t.shutdownErr
+}
 
-	t.done <- true
+func (t *TcpServer) shutdown(ctx context.Context) error {
+	t.DispatchEvent(EventServerStopped, slog.LevelInfo, "Shutting down the server")
+	close(t.done)
 	t.tickerUsers.Stop()
-	return t.listener.Close()
 
+	t.mutexConnections.Lock()
+	t.shuttingDown = true
+	listener := t.listener
+	connections := make(map[net.Conn]*chat.ConnectionWriter, len(t.connections))
+	for conn, writer := range t.connections {
+		connections[conn] = writer
+	}
+	t.mutexConnections.Unlock()
+	if listener != nil {
+		_ = listener.Close()
+		<-t.acceptDone
+	}
+
+	drained := sync.WaitGroup{}
+	for _, writer := range connections {
+		drained.Add(1)
+		go func(writer *chat.ConnectionWriter) {
+			defer drained.Done()
+			_ = writer.Send(chat.NewCommandServerGoingAway(shutdownReason))
+			_ = writer.Close()
+		}(writer)
+	}
+	err := waitContext(ctx, &drained)
+	for conn := range connections {
+		_ = conn.Close()
+	}
+	if err != nil {
+		return err
+	}
+	if err := waitContext(ctx, &t.connectionsWg); err != nil {
+		return err
+	}
+
+	users := sync.WaitGroup{}
+	for _, user := range t.Users() {
+		users.Add(1)
+		go func(user *User) {
+			defer users.Done()
+			user.shutdown()
+		}(user)
+	}
+	if err := waitContext(ctx, &users); err != nil {
+		return err
+	}
+	if err := waitContext(ctx, &t.backgroundWg); err != nil {
+		return err
+	}
+	t.DispatchEvent(EventServerStopped, slog.LevelInfo, "Server shut down", slog.Int(AttrCount, len(connections)))
+	return nil
+}
+
+// waitContext waits for the wait group or the context, what comes first.
+func waitContext(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// trackConnection adds the connection to the ones closed by Shutdown.
+// It returns the reason sent to the client when the connection is refused:
+// the server is shutting down or has maxConnections connections. Empty when accepted.
+func (t *TcpServer) trackConnection(conn net.Conn, writer *chat.ConnectionWriter) string {
+	t.mutexConnections.Lock()
+	defer t.mutexConnections.Unlock()
+	if t.shuttingDown {
+		return shutdownReason
+	}
+	if t.maxConnections > 0 && len(t.connections) >= t.maxConnections {
+		return tooManyConnectionsReason
+	}
+	t.connections[conn] = writer
+	return ""
+}
+
+func (t *TcpServer) untrackConnection(conn net.Conn) {
+	t.mutexConnections.Lock()
+	defer t.mutexConnections.Unlock()
+	delete(t.connections, conn)
 }
 
 func (t *TcpServer) handleConnection(conn net.Conn) {
+	defer t.connectionsWg.Done()
 	defer conn.Close()
-	reader := bufio.NewReader(conn)
-	writer := bufio.NewWriter(conn)
+	writer := chat.NewConnectionWriter(&countingWriter{writer: conn, count: &t.metrics.bytesOut}, t.writeQueueSize, 0)
+	defer writer.Close()
+	if reason := t.trackConnection(conn, writer); reason != "" {
+		if reason == tooManyConnectionsReason {
+			t.DispatchEvent(EventConnectionClosed, slog.LevelWarn, "Connection refused, too many connections",
+				slog.String(AttrRemote, conn.RemoteAddr().String()), slog.Int(AttrCount, t.maxConnections))
+		}
+		_ = writer.Send(chat.NewCommandServerGoingAway(reason))
+		return
+	}
+	defer t.untrackConnection(conn)
+	remote := slog.String(AttrRemote, conn.RemoteAddr().String())
+	// the username of the client certificate, when mutual TLS is used
+	var certUser string
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		// a client that connects and never sends the hello must not hold the connection
+		_ = tlsConn.SetDeadline(time.Now().Add(t.handshakeTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			t.DispatchEvent(EventProtocolError, slog.LevelError, "TLS handshake error", remote, slog.String(AttrError, err.Error()))
+			return
+		}
+		_ = tlsConn.SetDeadline(time.Time{})
+		state := tlsConn.ConnectionState()
+		certUser = certificateUsername(&state)
+	}
+	reader := bufio.NewReader(&countingReader{reader: conn, count: &t.metrics.bytesIn})
 	var user *User
+	// idleSince is the time the connection started waiting for the next frame, in nanoseconds,
+	// 0 while a command is handled: a slow command (the password hash) delays the read
+	// of the pongs, so the connection is not idle. See watchHeartbeat
+	idleSince := &atomic.Int64{}
+	heartbeatDone := make(chan struct{})
+	defer close(heartbeatDone)
+	t.watchHeartbeat(conn, writer, idleSince, heartbeatDone)
 	for {
+		idleSince.Store(time.Now().UnixNano())
 
-		readerFull, err := chat.ReadFullBufferFromSource(reader)
+		readerFull, err := chat.ReadFullBufferFromSourceWithLimit(reader, t.maxFrameSize)
 		if err != nil {
-			t.DispatchEvent(fmt.Sprintf("Error reading source: %v", err), true, 3)
-			return
+			if errors.Is(err, chat.ErrFrameTooLarge) || errors.Is(err, chat.ErrFrameTooShort) {
+				t.rejectFrame(err, 0, writer, remote)
+			} else if errors.Is(err, io.EOF) {
+				t.DispatchEvent(EventConnectionClosed, slog.LevelInfo, "Connection closed due of EOF", remote)
+			} else {
+				t.DispatchEvent(EventConnectionClosed, slog.LevelError, "Error reading source", remote, slog.String(AttrError, err.Error()))
+			}
+			break
 		}
+		start := time.Now()
+		idleSince.Store(0)
 
 		header := &chat.ChatHeader{}
 		err = header.Read(readerFull)
 		if err != nil {
 			if errors.Is(err, io.EOF) {
-				t.DispatchEvent("Connection closed due of EOF", false, 2)
+				t.DispatchEvent(EventConnectionClosed, slog.LevelInfo, "Connection closed due of EOF", remote)
 			} else {
-				t.DispatchEvent(fmt.Sprintf("Error reading header: %v", err), true, 3)
+				t.DispatchEvent(EventProtocolError, slog.LevelError, "Error reading header", remote, slog.String(AttrError, err.Error()))
 			}
 			break
 		}
+		// the correlationId of the frame, to answer also when the command can't be decoded
+		frameCorrelationId, _ := chat.PeekCorrelationId(readerFull)
+		if header.Version() < chat.Version1 || header.Version() > chat.LatestVersion(header.Key()) {
+			t.DispatchEvent(EventProtocolError, slog.LevelWarn, fmt.Sprintf("Command 0x%02X with unsupported version %d", header.Key(), header.Version()),
+				remote, slog.Any(AttrCorrelationId, frameCorrelationId))
+			if err := t.sendResponse(chat.ResponseCodeErrorUnsupportedVersion, frameCorrelationId, writer); err != nil {
+				t.DispatchEvent(EventConnectionClosed, slog.LevelError, "Error sending response", remote, slog.String(AttrError, err.Error()))
+				break
+			}
+			continue
+		}
 		var correlationId uint32
 		var lastSendError error
+		command := commandLabel(header.Key())
+		// readError is set when the command can't be decoded, the connection is closed
+		var readError error
 		switch header.Key() {
 		case chat.CommandLoginKey:
+			// the version 1 has no password, see authenticate
 			login := &chat.CommandLogin{}
+			login.SetVersion(header.Version())
 			err := login.Read(readerFull)
 			if err != nil {
-				t.DispatchEvent(fmt.Sprintf("Error reading login: %v", err), true, 3)
+				readError = fmt.Errorf("error reading login: %w", err)
 				break
 			}
 			correlationId = login.CorrelationId()
-			t.DispatchEvent(fmt.Sprintf("Login request for user %s", login.Username()), false, 1)
-			if t.Users()[login.Username()] != nil && t.Users()[login.Username()].IsOnLine() {
-				t.DispatchEvent(fmt.Sprintf("User %s already logged", login.Username()), false, 4)
-				lastSendError = t.sendResponse(chat.ResponseCodeErrorUserAlreadyLogged, correlationId, writer)
+			loginAttrs := []slog.Attr{slog.String(AttrUser, login.Username()), slog.Any(AttrCorrelationId, correlationId), remote}
+			t.DispatchEvent(EventCommand, slog.LevelDebug, "Login request", loginAttrs...)
+			loginUser := t.User(login.Username())
+			code := chat.ResponseCodeOk
+			if user != nil {
+				t.DispatchEvent(EventLoginFailed, slog.LevelWarn, "Connection already logged",
+					append(loginAttrs, slog.String(AttrPeer, user.Username))...)
+				code = chat.ResponseCodeErrorUserAlreadyLogged
+			} else if loginUser == nil {
+				t.DispatchEvent(EventLoginFailed, slog.LevelWarn, "User not registered", loginAttrs...)
+				code = chat.ResponseCodeErrorUserNotFound
+			} else if reservedUsername(loginUser.Username) {
+				t.DispatchEvent(EventLoginFailed, slog.LevelWarn, "Reserved username", loginAttrs...)
+				code = chat.ResponseCodeErrorBadCredentials
+			} else if !t.authenticate(loginUser, login.Password(), certUser) {
+				t.DispatchEvent(EventLoginFailed, slog.LevelWarn, "Bad credentials", loginAttrs...)
+				code = chat.ResponseCodeErrorBadCredentials
+			} else if !loginUser.AttachWriter(writer, messageVersion(login.Version())) {
+				t.DispatchEvent(EventLoginFailed, slog.LevelWarn, "User already logged", loginAttrs...)
+				code = chat.ResponseCodeErrorUserAlreadyLogged
 			} else {
-				if t.Users()[login.Username()] != nil {
-					t.DispatchEvent(fmt.Sprintf("User %s reconnected", login.Username()), false, 1)
-				} else {
-					t.DispatchEvent(fmt.Sprintf("New User %s logged in", login.Username()), false, 1)
-					t.Users()[login.Username()] = NewUser(login.Username(), t.chEvents)
-				}
-				user = t.Users()[login.Username()]
-				lastSendError = t.sendResponse(chat.ResponseCodeOk, correlationId, writer)
-				user.UpdateWriter(writer)
+				t.DispatchEvent(EventLogin, slog.LevelInfo, "User logged in", loginAttrs...)
+				user = loginUser
+			}
+			t.metrics.login(code)
+			lastSendError = t.sendResponse(code, correlationId, writer)
+			if code == chat.ResponseCodeOk {
+				// the mailbox is sent after the response of the login
+				user.notify()
+			}
+
+		case chat.CommandRegisterKey:
+			register := &chat.CommandRegister{}
+			err := register.Read(readerFull)
+			if err != nil {
+				readError = fmt.Errorf("error reading register: %w", err)
+				break
+			}
+			correlationId = register.CorrelationId()
+			lastSendError = t.sendResponse(t.registerUser(register.Username(), register.Password(), correlationId), correlationId, writer)
+
+		case chat.CommandLogoutKey:
+			logout := &chat.CommandLogout{}
+			err := logout.Read(readerFull)
+			if err != nil {
+				readError = fmt.Errorf("error reading logout: %w", err)
+				break
+			}
+			correlationId = logout.CorrelationId()
+			if user == nil {
+				t.DispatchEvent(EventCommand, slog.LevelWarn, "Logout request on a connection without user",
+					slog.Any(AttrCorrelationId, correlationId), remote)
+				lastSendError = t.sendResponse(chat.ResponseCodeErrorUserNotLogged, correlationId, writer)
+				break
 			}
+			user.DetachWriter(writer)
+			t.DispatchEvent(EventLogout, slog.LevelInfo, "User logged out",
+				slog.String(AttrUser, user.Username), slog.Any(AttrCorrelationId, correlationId), remote)
+			lastSendError = t.sendResponse(chat.ResponseCodeOk, correlationId, writer)
+			user = nil
 
 		case chat.CommandMessageKey:
+			// the Id and the Room of the version 2 are set by the server, the client can send both versions
 			message := &chat.CommandMessage{}
+			message.SetVersion(header.Version())
 			err := message.Read(readerFull)
 			if err != nil {
-				t.DispatchEvent(fmt.Sprintf("Error reading message: %v", err), true, 3)
+				readError = fmt.Errorf("error reading message: %w", err)
 				break
 			}
 			correlationId = message.CorrelationId()
-			if t.Users()[message.To] != nil {
-				t.DispatchEvent(fmt.Sprintf("Message from %s to %s: %s", message.From, message.To, message.Message), false, 2)
-				lastSendError = t.sendResponse(chat.ResponseCodeOk, correlationId, writer)
-				toUser := t.Users()[message.To]
-				toUser.AddMessage(message.From, message.To, message.Message, message.Time)
+			if user == nil || reservedUsername(user.Username) {
+				t.DispatchEvent(EventDeliveryFailed, slog.LevelWarn, "Message on a connection without user",
+					slog.String(AttrPeer, message.To), slog.Any(AttrCorrelationId, correlationId), remote)
+				lastSendError = t.sendMessageSentResponse(chat.ResponseCodeErrorUserNotLogged, 0, correlationId, writer)
+				break
+			}
+			// the sender is the logged user, the From of the frame is ignored
+			recipient := t.User(message.To)
+			if recipient == nil {
+				t.DispatchEvent(EventDeliveryFailed, slog.LevelWarn, "Recipient not found",
+					slog.String(AttrUser, user.Username), slog.String(AttrPeer, message.To), slog.Any(AttrCorrelationId, correlationId))
+				lastSendError = t.sendMessageSentResponse(chat.ResponseCodeErrorUserNotFound, 0, correlationId, writer)
+			} else if t.mailboxFull(recipient, user.Username) {
+				lastSendError = t.sendMessageSentResponse(chat.ResponseCodeErrorMailboxFull, 0, correlationId, writer)
 			} else {
-				t.DispatchEvent(fmt.Sprintf("User %s not found", message.To), true, 3)
-				lastSendError = t.sendResponse(chat.ResponseCodeErrorUserNotFound, correlationId, writer)
+				id := t.nextMessageId()
+				lastSendError = t.sendMessageSentResponse(chat.ResponseCodeOk, id, correlationId, writer)
+				t.routeMessage(id, "", user.Username, message.To, message.Message, message.Time)
+			}
+		case chat.CommandMessageAckKey:
+			ack := &chat.CommandMessageAck{}
+			err := ack.Read(readerFull)
+			if err != nil {
+				readError = fmt.Errorf("error reading message ack: %w", err)
+				break
+			}
+			if user == nil {
+				t.DispatchEvent(EventCommand, slog.LevelWarn, "Ack on a connection without user", slog.Uint64(AttrMessageId, ack.Id), remote)
+				continue
+			}
+			if user.AckMessage(ack.Id) {
+				t.DispatchEvent(EventMessageDelivered, slog.LevelDebug, "Message delivered",
+					slog.String(AttrUser, user.Username), slog.Uint64(AttrMessageId, ack.Id))
+				t.notifyMessageStatus(ack.Id, user.Username, chat.MessageStatusDelivered)
+			}
+			// the ack has no response
+			continue
+
+		case chat.CommandMessageReadKey:
+			read := &chat.CommandMessageRead{}
+			err := read.Read(readerFull)
+			if err != nil {
+				readError = fmt.Errorf("error reading message read: %w", err)
+				break
+			}
+			if user == nil {
+				t.DispatchEvent(EventCommand, slog.LevelWarn, "Read on a connection without user", slog.Uint64(AttrMessageId, read.Id), remote)
+				continue
+			}
+			t.DispatchEvent(EventMessageRead, slog.LevelDebug, "Message read",
+				slog.String(AttrUser, user.Username), slog.Uint64(AttrMessageId, read.Id))
+			t.notifyMessageStatus(read.Id, user.Username, chat.MessageStatusRead)
+			// the read has no response
+			continue
+
+		case chat.CommandMultiMessageKey:
+			message := &chat.CommandMultiMessage{}
+			err := message.Read(readerFull)
+			if err != nil {
+				readError = fmt.Errorf("error reading multi message: %w", err)
+				break
+			}
+			correlationId = message.CorrelationId()
+			lastSendError = t.handleMultiMessage(user, message, writer)
+
+		case chat.CommandListUsersKey:
+			listUsers := &chat.CommandListUsers{}
+			err := listUsers.Read(readerFull)
+			if err != nil {
+				readError = fmt.Errorf("error reading list users: %w", err)
+				break
+			}
+			correlationId = listUsers.CorrelationId()
+			lastSendError = t.handleListUsers(user, correlationId, writer)
+
+		case chat.CommandCreateRoomKey:
+			create := &chat.CommandCreateRoom{}
+			err := create.Read(readerFull)
+			if err != nil {
+				readError = fmt.Errorf("error reading create room: %w", err)
+				break
+			}
+			correlationId = create.CorrelationId()
+			lastSendError = t.sendResponse(t.handleRoomCommand(user, create.Room, "create", t.rooms.create), correlationId, writer)
+
+		case chat.CommandJoinRoomKey:
+			join := &chat.CommandJoinRoom{}
+			err := join.Read(readerFull)
+			if err != nil {
+				readError = fmt.Errorf("error reading join room: %w", err)
+				break
+			}
+			correlationId = join.CorrelationId()
+			lastSendError = t.sendResponse(t.handleRoomCommand(user, join.Room, "join", t.rooms.join), correlationId, writer)
+
+		case chat.CommandLeaveRoomKey:
+			leave := &chat.CommandLeaveRoom{}
+			err := leave.Read(readerFull)
+			if err != nil {
+				readError = fmt.Errorf("error reading leave room: %w", err)
+				break
+			}
+			correlationId = leave.CorrelationId()
+			lastSendError = t.sendResponse(t.handleRoomCommand(user, leave.Room, "leave", t.rooms.leave), correlationId, writer)
+
+		case chat.CommandListRoomMembersKey:
+			listMembers := &chat.CommandListRoomMembers{}
+			err := listMembers.Read(readerFull)
+			if err != nil {
+				readError = fmt.Errorf("error reading list room members: %w", err)
+				break
+			}
+			correlationId = listMembers.CorrelationId()
+			members, code := t.rooms.members(listMembers.Room)
+			if members == nil {
+				members = make([]string, 0)
 			}
+			response := chat.NewRoomMembersResponse(code, listMembers.Room, members)
+			response.SetCorrelationId(correlationId)
+			lastSendError = writer.Send(response)
+
+		case chat.CommandRoomMessageKey:
+			message := &chat.CommandRoomMessage{}
+			err := message.Read(readerFull)
+			if err != nil {
+				readError = fmt.Errorf("error reading room message: %w", err)
+				break
+			}
+			correlationId = message.CorrelationId()
+			lastSendError = t.handleRoomMessage(user, message, writer)
+
+		case chat.CommandHistoryKey:
+			history := &chat.CommandHistory{}
+			err := history.Read(readerFull)
+			if err != nil {
+				readError = fmt.Errorf("error reading history: %w", err)
+				break
+			}
+			correlationId = history.CorrelationId()
+			lastSendError = t.handleHistory(user, history, writer)
+
 		case chat.CommandCorrelationIdTest:
-			login := &chat.CommandLogin{}
-			err := login.Read(readerFull)
+			test := &chat.CorrelationIdTest{}
+			err := test.Read(readerFull)
 			if err != nil {
-				t.DispatchEvent(fmt.Sprintf("Error reading login: %v", err), true, 3)
+				readError = fmt.Errorf("error reading correlation id test: %w", err)
 				break
 			}
-			correlationId = login.CorrelationId()
-			t.DispatchEvent(fmt.Sprintf("Correlation id test: Login request for user %s", login.Username()), false, 1)
+			correlationId = test.CorrelationId()
+			t.DispatchEvent(EventCommand, slog.LevelDebug, "Correlation id test request", slog.Any(AttrCorrelationId, correlationId))
 			go func() {
 				ran := rand.IntN(4000)
 				randomSleep := time.Duration(ran * int(time.Millisecond))
 				time.Sleep(randomSleep)
-				lastSendError = t.sendResponse(chat.ResponseCodeOk, correlationId, writer)
-				t.DispatchEvent(fmt.Sprintf("Correlation id test: Response sent to user %s correlationId %d, in %d Millisecond",
-					login.Username(), correlationId, ran), false, 1)
+				err := t.sendResponse(chat.ResponseCodeOk, correlationId, writer)
+				if err != nil {
+					t.DispatchEvent(EventCommand, slog.LevelError, "Correlation id test: error sending response",
+						slog.Any(AttrCorrelationId, correlationId), slog.String(AttrError, err.Error()))
+					return
+				}
+				t.DispatchEvent(EventCommand, slog.LevelDebug, fmt.Sprintf("Correlation id test: response sent in %d Millisecond", ran),
+					slog.Any(AttrCorrelationId, correlationId))
 			}()
 
+		case chat.CommandPingKey:
+			ping := &chat.CommandPing{}
+			err := ping.Read(readerFull)
+			if err != nil {
+				readError = fmt.Errorf("error reading ping: %w", err)
+				break
+			}
+			correlationId = ping.CorrelationId()
+			lastSendError = writer.Send(chat.NewCommandPong(correlationId))
+
+		case chat.CommandPongKey:
+			pong := &chat.CommandPong{}
+			err := pong.Read(readerFull)
+			if err != nil {
+				readError = fmt.Errorf("error reading pong: %w", err)
+				break
+			}
+			// the pong resets the idle time, it has no response
+			continue
+
+		default:
+			command = unknownCommandLabel
+			t.DispatchEvent(EventProtocolError, slog.LevelWarn, fmt.Sprintf("Unknown command 0x%02X", header.Key()),
+				slog.Any(AttrCorrelationId, frameCorrelationId), remote)
+			correlationId = frameCorrelationId
+			lastSendError = t.sendResponse(chat.ResponseCodeErrorUnknownCommand, correlationId, writer)
+		}
+
+		if readError != nil {
+			t.rejectFrame(readError, frameCorrelationId, writer, remote)
+			break
 		}
 
 		if lastSendError != nil {
-			t.DispatchEvent(fmt.Sprintf("Error sending response: %v", lastSendError), true, 3)
+			t.DispatchEvent(EventConnectionClosed, slog.LevelError, "Error sending response",
+				slog.Any(AttrCorrelationId, correlationId), remote, slog.String(AttrError, lastSendError.Error()))
 			break
 		}
+		t.metrics.observeRPC(command, time.Since(start))
 
 		if user != nil {
-			t.DispatchEvent(fmt.Sprintf("Response sent to user %s correlationId %d", user.Username, correlationId), false, 1)
+			t.DispatchEvent(EventCommand, slog.LevelDebug, "Response sent",
+				slog.String(AttrUser, user.Username), slog.Any(AttrCorrelationId, correlationId))
+		}
+
+	}
+	if user != nil && user.DetachWriter(writer) {
+		t.DispatchEvent(EventLogout, slog.LevelInfo, "User logged out, connection closed", slog.String(AttrUser, user.Username), remote)
+	}
+
+}
+
+// watchHeartbeat pings the client when no frame is read for a heartbeat interval.
+// After heartbeatMaxMissed pings without frames the connection is closed:
+// the read of handleConnection fails and the user is set offline, so the new
+// messages are queued instead of being written to a dead connection.
+func (t *TcpServer) watchHeartbeat(conn net.Conn, writer *chat.ConnectionWriter, idleSince *atomic.Int64, done chan struct{}) {
+	if t.heartbeatInterval <= 0 {
+		return
+	}
+	t.connectionsWg.Add(1)
+	go func() {
+		defer t.connectionsWg.Done()
+		ticker := time.NewTicker(t.heartbeatInterval)
+		defer ticker.Stop()
+		missed := 0
+		var correlationId uint32
+		var lastIdleSince int64
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				// a frame read after the previous tick resets the missed pings: the pong
+				// arrives just after the ping, so it can be almost one interval old
+				if since := idleSince.Load(); since == 0 || since != lastIdleSince {
+					lastIdleSince = since
+					missed = 0
+					continue
+				}
+				if missed >= t.heartbeatMaxMissed {
+					t.DispatchEvent(EventHeartbeat, slog.LevelWarn, "Heartbeats missed, closing the connection",
+						slog.String(AttrRemote, conn.RemoteAddr().String()), slog.Int(AttrCount, missed))
+					_ = conn.Close()
+					return
+				}
+				missed++
+				correlationId++
+				ping := chat.NewCommandPing()
+				ping.SetCorrelationId(correlationId)
+				if err := writer.Send(ping); err != nil {
+					t.DispatchEvent(EventHeartbeat, slog.LevelError, "Error sending heartbeat",
+						slog.String(AttrRemote, conn.RemoteAddr().String()), slog.String(AttrError, err.Error()))
+				}
+			}
+		}
+	}()
+}
+
+// messageVersion is the version of the CommandMessage sent to a connection logged in with
+// the loginVersion of CommandLogin: the clients of the base protocol know only the version 1.
+func messageVersion(loginVersion byte) byte {
+	if loginVersion == chat.Version1 {
+		return chat.Version1
+	}
+	return chat.CommandMessageVersion
+}
+
+// authenticate checks the client certificate when the client sent it,
+// otherwise the password: a login of version 1, without password, needs the certificate.
+func (t *TcpServer) authenticate(user *User, password, certUser string) bool {
+	if certUser != "" {
+		return certUser == user.Username
+	}
+	return user.VerifyPassword(password)
+}
+
+// registerUser creates the user with the password credentials.
+// When the same username is registered at the same time only one registration succeeds.
+func (t *TcpServer) registerUser(username, password string, correlationId uint32) uint16 {
+	attrs := []slog.Attr{slog.String(AttrUser, username), slog.Any(AttrCorrelationId, correlationId)}
+	if reservedUsername(username) || t.User(username) != nil {
+		t.DispatchEvent(EventRegisterFailed, slog.LevelWarn, "User already exists", attrs...)
+		return chat.ResponseCodeErrorUserAlreadyExists
+	}
+	// the hash is slow, it is computed without the lock of the registry
+	credentials, err := NewCredentials(password)
+	if err != nil {
+		t.DispatchEvent(EventRegisterFailed, slog.LevelError, "Error creating credentials", append(attrs, slog.String(AttrError, err.Error()))...)
+		return chat.ResponseCodeErrorBadCredentials
+	}
+	_, created := t.users.getOrCreate(username, func() *User {
+		return NewUser(username, credentials, t.events, t.storage)
+	})
+	if !created {
+		t.DispatchEvent(EventRegisterFailed, slog.LevelWarn, "User already exists", attrs...)
+		return chat.ResponseCodeErrorUserAlreadyExists
+	}
+	t.DispatchEvent(EventRegister, slog.LevelInfo, "New user registered", attrs...)
+	return chat.ResponseCodeOk
+}
+
+// mailboxFull returns true when the mailbox of the recipient has maxMailboxSize messages.
+// The limit is checked before the message is routed, so the messages sent at the same
+// time to the recipient can exceed it.
+func (t *TcpServer) mailboxFull(recipient *User, from string) bool {
+	if t.maxMailboxSize <= 0 || recipient.MailboxSize() < t.maxMailboxSize {
+		return false
+	}
+	t.DispatchEvent(EventDeliveryFailed, slog.LevelWarn, "Mailbox full",
+		slog.String(AttrUser, from), slog.String(AttrPeer, recipient.Username), slog.Int(AttrCount, t.maxMailboxSize))
+	return true
+}
+
+// routeMessage stores the message in the recipient mailbox and keeps the receipt
+// to notify the sender. The direct messages are added to the history.
+// It returns true when the recipient is online.
+func (t *TcpServer) routeMessage(id uint64, room, from, to, message string, sent uint64) bool {
+	attrs := []slog.Attr{slog.String(AttrUser, from), slog.String(AttrPeer, to),
+		slog.Uint64(AttrMessageId, id), slog.Int(AttrBytes, len(message))}
+	if room != "" {
+		attrs = append(attrs, slog.String(AttrRoom, room))
+	}
+	recipient := t.User(to)
+	if recipient == nil {
+		// the user was deleted after the check of the caller
+		t.DispatchEvent(EventDeliveryFailed, slog.LevelWarn, "Recipient deleted", attrs...)
+		return false
+	}
+	t.receipts.add(id, from, to)
+	t.DispatchEvent(EventMessageRouted, slog.LevelInfo, "Message routed", attrs...)
+	if room == "" {
+		t.saveHistory(&UserMessage{Id: id, From: from, To: to, Message: message, Sent: sent})
+	}
+	t.metrics.messagesRouted.Add(1)
+	online := recipient.AddMessage(id, room, from, to, message, sent)
+	if !online {
+		t.metrics.messagesQueued.Add(1)
+	}
+	return online
+}
+
+func (t *TcpServer) saveHistory(message *UserMessage) {
+	t.history.add(message)
+	err := t.storage.SaveHistory(message)
+	if err != nil {
+		t.DispatchEvent(EventStorage, slog.LevelError, "Error saving the message in the history",
+			slog.Uint64(AttrMessageId, message.Id), slog.String(AttrError, err.Error()))
+	}
+}
+
+// notifyMessageStatus sends the status of the message to the sender, when the
+// sender is online. The status is not stored for the offline senders.
+// The receipt is removed when the message is read.
+func (t *TcpServer) notifyMessageStatus(id uint64, to string, status byte) {
+	receipt := t.receipts.get(id, to)
+	if receipt == nil {
+		return
+	}
+	if status == chat.MessageStatusRead {
+		t.receipts.remove(id)
+	}
+	sender := t.User(receipt.from)
+	if sender == nil {
+		return
+	}
+	err := sender.SendMessageStatus(chat.NewCommandMessageStatus(id, to, status, chat.ConvertTimeToUint64(time.Now())))
+	if err != nil {
+		t.DispatchEvent(EventDeliveryFailed, slog.LevelError, "Error sending the message status",
+			slog.String(AttrUser, receipt.from), slog.Uint64(AttrMessageId, id), slog.String(AttrError, err.Error()))
+	}
+}
+
+// handleMultiMessage dispatches the message of the logged user to each recipient
+// and answers with the delivery status of every recipient.
+// The sender is the logged user, the From of the frame is ignored.
+func (t *TcpServer) handleMultiMessage(user *User, message *chat.CommandMultiMessage, writer *chat.ConnectionWriter) error {
+	if user == nil || reservedUsername(user.Username) {
+		t.DispatchEvent(EventDeliveryFailed, slog.LevelWarn, "Message on a connection without user",
+			slog.Any(AttrCorrelationId, message.CorrelationId()))
+		response := chat.NewMultiMessageResponse(chat.ResponseCodeErrorUserNotLogged, make([]string, 0), make([]string, 0), make([]string, 0), make([]string, 0))
+		response.SetCorrelationId(message.CorrelationId())
+		return writer.Send(response)
+	}
+	from := user.Username
+	recipients := message.To
+	if message.Broadcast {
+		recipients = make([]string, 0)
+		for username := range t.Users() {
+			if username != from {
+				recipients = append(recipients, username)
+			}
+		}
+		t.DispatchEvent(EventCommand, slog.LevelInfo, "Broadcast message",
+			slog.String(AttrUser, from), slog.Int(AttrCount, len(recipients)), slog.Any(AttrCorrelationId, message.CorrelationId()))
+	}
+
+	delivered := make([]string, 0)
+	queued := make([]string, 0)
+	notFound := make([]string, 0)
+	mailboxFull := make([]string, 0)
+	for _, to := range recipients {
+		toUser := t.User(to)
+		if toUser == nil {
+			t.DispatchEvent(EventDeliveryFailed, slog.LevelWarn, "Recipient not found",
+				slog.String(AttrUser, from), slog.String(AttrPeer, to), slog.Any(AttrCorrelationId, message.CorrelationId()))
+			notFound = append(notFound, to)
+			continue
+		}
+		if t.mailboxFull(toUser, from) {
+			mailboxFull = append(mailboxFull, to)
+			continue
+		}
+		if t.routeMessage(t.nextMessageId(), "", from, to, message.Message, message.Time) {
+			delivered = append(delivered, to)
+		} else {
+			queued = append(queued, to)
+		}
+	}
+
+	response := chat.NewMultiMessageResponse(multiMessageCode(delivered, queued, notFound, mailboxFull), delivered, queued, notFound, mailboxFull)
+	response.SetCorrelationId(message.CorrelationId())
+	return writer.Send(response)
+}
+
+// handleRoomCommand runs the create, join or leave operation for the logged user.
+func (t *TcpServer) handleRoomCommand(user *User, room, operation string, apply func(room, username string) uint16) uint16 {
+	if user == nil {
+		t.DispatchEvent(EventRoom, slog.LevelWarn, fmt.Sprintf("Room %s request on a connection without user", operation), slog.String(AttrRoom, room))
+		return chat.ResponseCodeErrorUserNotLogged
+	}
+	code := apply(room, user.Username)
+	if code != chat.ResponseCodeOk {
+		t.DispatchEvent(EventRoom, slog.LevelWarn, fmt.Sprintf("User can't %s the room", operation),
+			slog.String(AttrUser, user.Username), slog.String(AttrRoom, room), slog.String(AttrCode, chat.FormResponseCodeToString(code)))
+		return code
+	}
+	t.DispatchEvent(EventRoom, slog.LevelInfo, fmt.Sprintf("Room %s", operation), slog.String(AttrUser, user.Username), slog.String(AttrRoom, room))
+	return code
+}
+
+// handleRoomMessage sends the message to the members of the room, except the sender,
+// and answers with the delivery status of every member.
+// The sender is the logged user and must be a member of the room.
+func (t *TcpServer) handleRoomMessage(user *User, message *chat.CommandRoomMessage, writer *chat.ConnectionWriter) error {
+	code := chat.ResponseCodeErrorUserNotLogged
+	var members []string
+	if user != nil && !reservedUsername(user.Username) {
+		members, code = t.rooms.members(message.Room)
+		if code == chat.ResponseCodeOk && !t.rooms.isMember(message.Room, user.Username) {
+			code = chat.ResponseCodeErrorNotRoomMember
 		}
+	}
 
+	delivered := make([]string, 0)
+	queued := make([]string, 0)
+	notFound := make([]string, 0)
+	mailboxFull := make([]string, 0)
+	if code != chat.ResponseCodeOk {
+		t.DispatchEvent(EventDeliveryFailed, slog.LevelWarn, "Message to room refused", slog.String(AttrRoom, message.Room),
+			slog.String(AttrCode, chat.FormResponseCodeToString(code)), slog.Any(AttrCorrelationId, message.CorrelationId()))
+	} else {
+		t.DispatchEvent(EventRoom, slog.LevelInfo, "Message to room", slog.String(AttrUser, user.Username), slog.String(AttrRoom, message.Room),
+			slog.Int(AttrBytes, len(message.Message)), slog.Any(AttrCorrelationId, message.CorrelationId()))
+		for _, to := range members {
+			if to == user.Username {
+				continue
+			}
+			recipient := t.User(to)
+			if recipient == nil {
+				notFound = append(notFound, to)
+				continue
+			}
+			if t.mailboxFull(recipient, user.Username) {
+				mailboxFull = append(mailboxFull, to)
+				continue
+			}
+			if t.routeMessage(t.nextMessageId(), message.Room, user.Username, to, message.Message, message.Time) {
+				delivered = append(delivered, to)
+			} else {
+				queued = append(queued, to)
+			}
+		}
 	}
-	if user != nil {
-		user.SetOnline(false)
-		t.DispatchEvent(fmt.Sprintf("User %s logged out", user.Username), false, 2)
+	if code == chat.ResponseCodeOk {
+		code = multiMessageCode(delivered, queued, notFound, mailboxFull)
 	}
+	response := chat.NewMultiMessageResponse(code, delivered, queued, notFound, mailboxFull)
+	response.SetCorrelationId(message.CorrelationId())
+	return writer.Send(response)
+}
 
+// multiMessageCode is the response code of a message to many users: Ok when at least one user
+// got the message, ErrorMailboxFull when a mailbox is full, ErrorUserNotFound when the users don't exist.
+func multiMessageCode(delivered, queued, notFound, mailboxFull []string) uint16 {
+	switch {
+	case len(delivered)+len(queued) > 0:
+		return chat.ResponseCodeOk
+	case len(mailboxFull) > 0:
+		return chat.ResponseCodeErrorMailboxFull
+	case len(notFound) > 0:
+		return chat.ResponseCodeErrorUserNotFound
+	}
+	return chat.ResponseCodeOk
 }
 
-func (t *TcpServer) sendResponse(code uint16, correlationId uint32, writer *bufio.Writer) error {
+// handleHistory answers with a page of the conversation between the logged user and the peer.
+func (t *TcpServer) handleHistory(user *User, history *chat.CommandHistory, writer *chat.ConnectionWriter) error {
+	code := chat.ResponseCodeOk
+	more := false
+	messages := make([]*chat.CommandMessage, 0)
+	if user == nil {
+		t.DispatchEvent(EventHistory, slog.LevelWarn, "History request on a connection without user", slog.Any(AttrCorrelationId, history.CorrelationId()))
+		code = chat.ResponseCodeErrorUserNotLogged
+	} else if t.User(history.Peer) == nil {
+		t.DispatchEvent(EventHistory, slog.LevelWarn, "History request for a user not found",
+			slog.String(AttrUser, user.Username), slog.String(AttrPeer, history.Peer), slog.Any(AttrCorrelationId, history.CorrelationId()))
+		code = chat.ResponseCodeErrorUserNotFound
+	} else {
+		var page []*UserMessage
+		page, more = t.history.page(user.Username, history.Peer, history.BeforeId, history.AfterId, int(history.Limit))
+		for _, message := range page {
+			commandMessage := chat.NewCommandMessage(message.Message, message.From, message.To, message.Sent)
+			commandMessage.Id = message.Id
+			messages = append(messages, commandMessage)
+		}
+		var truncated bool
+		messages, truncated = fitHistoryFrame(messages, t.historyFrameSize(), history.AfterId > 0)
+		more = more || truncated
+		t.DispatchEvent(EventHistory, slog.LevelDebug, "History sent", slog.String(AttrUser, user.Username), slog.String(AttrPeer, history.Peer),
+			slog.Int(AttrCount, len(messages)), slog.Any(AttrCorrelationId, history.CorrelationId()))
+	}
+	response := chat.NewHistoryResponse(code, more, messages)
+	response.SetCorrelationId(history.CorrelationId())
+	return writer.Send(response)
+}
+
+// historyFrameSize is the max length of a HistoryResponse frame: the clients read
+// the frames up to chat.DefaultMaxFrameSize.
+func (t *TcpServer) historyFrameSize() int {
+	return int(min(t.maxFrameSize, chat.DefaultMaxFrameSize))
+}
+
+// handleListUsers answers with the online and offline users and their last login.
+// The list is sent only to the logged users.
+func (t *TcpServer) handleListUsers(user *User, correlationId uint32, writer *chat.ConnectionWriter) error {
+	if user == nil {
+		t.DispatchEvent(EventCommand, slog.LevelWarn, "List of the users on a connection without user", slog.Any(AttrCorrelationId, correlationId))
+		response := chat.NewUserListResponse(chat.ResponseCodeErrorUserNotLogged, make([]string, 0), make([]string, 0), make(map[string]string))
+		response.SetCorrelationId(correlationId)
+		return writer.Send(response)
+	}
+	online := make([]string, 0)
+	offline := make([]string, 0)
+	lastLogin := make(map[string]string)
+	for username, registered := range t.Users() {
+		isOnline, userLastLogin := registered.Status()
+		if isOnline {
+			online = append(online, username)
+		} else {
+			offline = append(offline, username)
+		}
+		lastLogin[username] = userLastLogin.Format(time.RFC3339)
+	}
+	sort.Strings(online)
+	sort.Strings(offline)
+	response := chat.NewUserListResponse(chat.ResponseCodeOk, online, offline, lastLogin)
+	response.SetCorrelationId(correlationId)
+	return writer.Send(response)
+}
+
+func (t *TcpServer) sendMessageSentResponse(code uint16, id uint64, correlationId uint32, writer *chat.ConnectionWriter) error {
+	response := chat.NewMessageSentResponse(code, id)
+	response.SetCorrelationId(correlationId)
+	return writer.Send(response)
+}
+
+// rejectFrame answers to a frame too large or malformed before the connection is closed,
+// so the client knows why. The error of the response is ignored, the connection is closed anyway.
+func (t *TcpServer) rejectFrame(reason error, correlationId uint32, writer *chat.ConnectionWriter, remote slog.Attr) {
+	t.DispatchEvent(EventProtocolError, slog.LevelError, "Invalid frame, closing the connection",
+		remote, slog.Any(AttrCorrelationId, correlationId), slog.String(AttrError, reason.Error()))
+	code := chat.ResponseCodeErrorMalformedFrame
+	if errors.Is(reason, chat.ErrFrameTooLarge) {
+		code = chat.ResponseCodeErrorFrameTooLarge
+	}
+	_ = t.sendResponse(code, correlationId, writer)
+}
+
+func (t *TcpServer) sendResponse(code uint16, correlationId uint32, writer *chat.ConnectionWriter) error {
 	genericResponse := chat.NewGenericResponse(code)
 	genericResponse.SetCorrelationId(correlationId)
-	return chat.WriteCommandWithHeader(genericResponse, writer)
+	return writer.Send(genericResponse)
 }
 
+// Users returns a copy of the registered users by username.
+// Changes to the map don't change the users of the server.
 func (t *TcpServer) Users() map[string]*User {
-	t.mutexMap.Lock()
-	defer t.mutexMap.Unlock()
-	return t.users
+	return t.users.snapshot()
+}
+
+// User returns the registered user, nil when the user doesn't exist.
+func (t *TcpServer) User(username string) *User {
+	return t.users.get(username)
 }
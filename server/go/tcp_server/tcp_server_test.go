@@ -1,60 +1,385 @@
 package tcp_server
 
 import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	"gsantomaggio/chat/server/chat"
+	"gsantomaggio/chat/server/internal"
 	"gsantomaggio/chat/server/tcp_client"
+	"net"
+	"strings"
+	"sync"
 	"time"
 )
 
 const port = int(6666)
 const address = "localhost:6666"
+const password = "password"
+
+// registerUsers creates the accounts used by the tests
+func registerUsers(serverAddress string, usernames ...string) {
+	client := tcp_client.NewChatClient(make(chan *chat.CommandMessage))
+	Expect(client.Connect(serverAddress)).To(Succeed())
+	for _, username := range usernames {
+		r, e := client.Register(username, password)
+		Expect(e).To(BeNil())
+		Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+	}
+	Expect(client.Close()).To(Succeed())
+}
+
+// writeFrame writes the command with the header given, to send the frames the client never produces
+func writeFrame(conn net.Conn, header *chat.ChatHeader, command internal.CommandWrite) {
+	writer := bufio.NewWriter(conn)
+	Expect(binary.Write(writer, binary.BigEndian, uint32(header.SizeNeeded()+command.SizeNeeded()))).To(Succeed())
+	_, err := header.Write(writer)
+	Expect(err).To(BeNil())
+	_, err = command.Write(writer)
+	Expect(err).To(BeNil())
+	Expect(writer.Flush()).To(Succeed())
+}
+
+func readGenericResponse(reader *bufio.Reader) *chat.GenericResponse {
+	frame, err := chat.ReadFullBufferFromSource(reader)
+	Expect(err).To(BeNil())
+	header := &chat.ChatHeader{}
+	Expect(header.Read(frame)).To(Succeed())
+	Expect(header.Key()).To(Equal(chat.GenericResponseKey))
+	response := &chat.GenericResponse{}
+	Expect(response.Read(frame)).To(Succeed())
+	return response
+}
 
 var _ = Describe("Tcp Server", func() {
 	var tcpServer *TcpServer
 	BeforeEach(func() {
 
-		tcpServer = NewTcpServer("localhost", port, nil)
+		tcpServer = NewTcpServer(address, nil)
 		err := tcpServer.StartInAThread()
 		if err != nil {
 			return
 		}
 		time.Sleep(200 * time.Millisecond)
+		registerUsers(address, "user1", "user2", "user3")
 	})
 	AfterEach(func() {
 		tcpServer.Stop()
 	})
+	Context("Start", func() {
+		It("Returns the error when the address is in use", func() {
+			second := NewTcpServer(address, nil)
+			Expect(second.StartInAThread()).To(MatchError(ContainSubstring("address already in use")))
+			Expect(second.Stop()).To(Succeed())
+		})
+	})
+	Context("Shutdown", func() {
+		It("Notifies the clients, closes the connections and saves the mailboxes", func() {
+			receiver1 := make(chan *chat.CommandMessage, 1)
+			goingAway := make(chan *chat.CommandServerGoingAway, 1)
+			client1 := tcp_client.NewChatClient(receiver1)
+			client1.NotifyServerGoingAway(goingAway)
+			Expect(client1.Connect(address)).To(Succeed())
+			r, e := client1.Login("user1", password)
+			Expect(e).To(BeNil())
+			Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+			// user3 is offline, the message stays in the mailbox
+			sent, e := client1.SendMessage("Hello", "user3")
+			Expect(e).To(BeNil())
+			Expect(sent.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			Expect(tcpServer.Shutdown(ctx)).To(Succeed())
+			var notification *chat.CommandServerGoingAway
+			Eventually(goingAway).Should(Receive(&notification))
+			Expect(notification.Reason).To(Equal(shutdownReason))
+			Expect(tcpServer.Users()["user1"].IsOnLine()).To(BeFalse())
+
+			records, err := tcpServer.storage.LoadUsers()
+			Expect(err).To(BeNil())
+			var mailbox []*UserMessage
+			for _, record := range records {
+				if record.Username == "user3" {
+					mailbox = record.Messages
+				}
+			}
+			Expect(mailbox).To(HaveLen(1))
+			Expect(mailbox[0].Message).To(Equal("Hello"))
+
+			// the new connections are refused, a second shutdown does nothing
+			_, err = net.DialTimeout("tcp", address, time.Second)
+			Expect(err).NotTo(BeNil())
+			Expect(tcpServer.Stop()).To(Succeed())
+			_ = client1.Close()
+		})
+	})
+	Context("Concurrency", func() {
+		// run with -race: go test -race ./tcp_server
+		It("Accepts one login when many clients log in as the same user at once", func() {
+			const clients = 32
+			responses := make(chan uint16, clients)
+			connected := make([]*tcp_client.ChatClient, clients)
+			for i := range connected {
+				connected[i] = tcp_client.NewChatClient(make(chan *chat.CommandMessage, 16))
+				Expect(connected[i].Connect(address)).To(Succeed())
+			}
+			sender := tcp_client.NewChatClient(make(chan *chat.CommandMessage))
+			Expect(sender.Connect(address)).To(Succeed())
+			r, e := sender.Login("user2", password)
+			Expect(e).To(BeNil())
+			Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+
+			start := make(chan struct{})
+			wg := sync.WaitGroup{}
+			for _, client := range connected {
+				wg.Add(1)
+				go func(client *tcp_client.ChatClient) {
+					defer GinkgoRecover()
+					defer wg.Done()
+					<-start
+					// the logins wait for the password hashes of the others,
+					// slow with -race on a single CPU
+					ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+					defer cancel()
+					r, e := client.LoginContext(ctx, "user1", password)
+					Expect(e).To(BeNil())
+					responses <- r.ResponseCode()
+				}(client)
+			}
+			// the messages to user1 and the list of the users run with the logins
+			wg.Add(2)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				<-start
+				for i := 0; i < 20; i++ {
+					_, e := sender.SendMessage(fmt.Sprintf("Hello %d", i), "user1")
+					Expect(e).To(BeNil())
+				}
+			}()
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				<-start
+				for i := 0; i < 20; i++ {
+					_, e := sender.ListUsers()
+					Expect(e).To(BeNil())
+				}
+			}()
+			close(start)
+			wg.Wait()
+			close(responses)
+
+			ok := 0
+			for code := range responses {
+				if code == chat.ResponseCodeOk {
+					ok++
+				} else {
+					Expect(code).To(Equal(chat.ResponseCodeErrorUserAlreadyLogged))
+				}
+			}
+			Expect(ok).To(Equal(1))
+			Expect(tcpServer.User("user1").IsOnLine()).To(BeTrue())
+
+			for _, client := range connected {
+				_ = client.Close()
+			}
+			Eventually(func() bool {
+				return tcpServer.User("user1").IsOnLine()
+			}).Should(BeFalse())
+			Expect(sender.Close()).To(Succeed())
+		})
+
+		It("Registers a user once when many clients register it at once", func() {
+			const clients = 16
+			responses := make(chan uint16, clients)
+			wg := sync.WaitGroup{}
+			for i := 0; i < clients; i++ {
+				wg.Add(1)
+				go func() {
+					defer GinkgoRecover()
+					defer wg.Done()
+					client := tcp_client.NewChatClient(make(chan *chat.CommandMessage))
+					Expect(client.Connect(address)).To(Succeed())
+					// the registrations hash the passwords at the same time,
+					// slow with -race on a single CPU
+					ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+					defer cancel()
+					r, e := client.RegisterContext(ctx, "user4", password)
+					Expect(e).To(BeNil())
+					responses <- r.ResponseCode()
+					Expect(client.Close()).To(Succeed())
+				}()
+			}
+			wg.Wait()
+			close(responses)
+			ok := 0
+			for code := range responses {
+				if code == chat.ResponseCodeOk {
+					ok++
+				} else {
+					Expect(code).To(Equal(chat.ResponseCodeErrorUserAlreadyExists))
+				}
+			}
+			Expect(ok).To(Equal(1))
+			Expect(tcpServer.User("user4")).NotTo(BeNil())
+		})
+	})
+	Context("Protocol version", func() {
+		It("Answers to an unsupported version and to an unknown command with the correlationId", func() {
+			conn, err := net.Dial("tcp", address)
+			Expect(err).To(BeNil())
+			reader := bufio.NewReader(conn)
+
+			login := chat.NewCommandLoginWithCorrelation("user1", password, 7)
+			writeFrame(conn, chat.NewChatHeader(chat.CommandLoginVersion+1, login.Key()), login)
+			response := readGenericResponse(reader)
+			Expect(response.CorrelationId()).To(Equal(uint32(7)))
+			Expect(response.ResponseCode()).To(Equal(chat.ResponseCodeErrorUnsupportedVersion))
+			// the login is not executed
+			Expect(tcpServer.Users()["user1"].IsOnLine()).To(BeFalse())
+
+			unknown := chat.NewCorrelationIdCommand()
+			unknown.SetCorrelationId(8)
+			writeFrame(conn, chat.NewChatHeader(chat.Version1, 0x7FFF), unknown)
+			response = readGenericResponse(reader)
+			Expect(response.CorrelationId()).To(Equal(uint32(8)))
+			Expect(response.ResponseCode()).To(Equal(chat.ResponseCodeErrorUnknownCommand))
+
+			// the connection is still usable
+			writeFrame(conn, chat.NewChatHeaderFromCommand(login), login)
+			response = readGenericResponse(reader)
+			Expect(response.CorrelationId()).To(Equal(uint32(7)))
+			Expect(response.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+			Expect(conn.Close()).To(Succeed())
+		})
+	})
+	Context("Invalid frames", func() {
+		expectClosed := func(reader *bufio.Reader) {
+			_, err := reader.ReadByte()
+			Expect(err).To(HaveOccurred())
+		}
+
+		It("Answers to a frame too large and closes the connection", func() {
+			conn, err := net.Dial("tcp", address)
+			Expect(err).To(BeNil())
+			defer conn.Close()
+			reader := bufio.NewReader(conn)
+			_, err = conn.Write([]byte{0xFF, 0xFF, 0xFF, 0xFF})
+			Expect(err).To(BeNil())
+			response := readGenericResponse(reader)
+			Expect(response.CorrelationId()).To(BeZero())
+			Expect(response.ResponseCode()).To(Equal(chat.ResponseCodeErrorFrameTooLarge))
+			expectClosed(reader)
+		})
+
+		It("Answers to a malformed command with the correlationId and closes the connection", func() {
+			conn, err := net.Dial("tcp", address)
+			Expect(err).To(BeNil())
+			defer conn.Close()
+			reader := bufio.NewReader(conn)
+			// a login with the username longer than the frame
+			_, err = conn.Write([]byte{0x00, 0x00, 0x00, 0x0B, chat.Version1, 0x00, byte(chat.CommandLoginKey),
+				0x00, 0x00, 0x00, 0x05, 0x00, 0x09, 'u', 's', 'e'})
+			Expect(err).To(BeNil())
+			response := readGenericResponse(reader)
+			Expect(response.CorrelationId()).To(Equal(uint32(5)))
+			Expect(response.ResponseCode()).To(Equal(chat.ResponseCodeErrorMalformedFrame))
+			expectClosed(reader)
+		})
+
+		It("Sets the user offline when the connection is closed in the middle of a frame", func() {
+			conn, err := net.Dial("tcp", address)
+			Expect(err).To(BeNil())
+			reader := bufio.NewReader(conn)
+			login := chat.NewCommandLoginWithCorrelation("user1", password, 1)
+			Expect(chat.WriteCommandWithHeader(login, bufio.NewWriter(conn))).To(Succeed())
+			Expect(readGenericResponse(reader).ResponseCode()).To(Equal(chat.ResponseCodeOk))
+			_, err = conn.Write([]byte{0x00, 0x00})
+			Expect(err).To(BeNil())
+			Expect(conn.Close()).To(Succeed())
+			Eventually(func() bool {
+				return tcpServer.Users()["user1"].IsOnLine()
+			}).Should(BeFalse())
+		})
+	})
 	Context("Login", func() {
 
 		It("Login should success", func() {
 			receiver := make(chan *chat.CommandMessage)
 			client := tcp_client.NewChatClient(receiver)
 			Expect(client.Connect(address)).To(Succeed())
-			r, e := client.Login("user1")
+			r, e := client.Login("user1", password)
 			Expect(e).To(BeNil())
 			Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
 			Expect(client.Close()).To(Succeed())
 		})
 
+		It("Login should fail for an unknown user or a bad password", func() {
+			receiver := make(chan *chat.CommandMessage)
+			client := tcp_client.NewChatClient(receiver)
+			Expect(client.Connect(address)).To(Succeed())
+			r, e := client.Login("unknown", password)
+			Expect(e).To(BeNil())
+			Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeErrorUserNotFound))
+			r, e = client.Login("user1", "wrong")
+			Expect(e).To(BeNil())
+			Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeErrorBadCredentials))
+			Expect(tcpServer.Users()["user1"].IsOnLine()).To(BeFalse())
+			r, e = client.Register("user1", "other")
+			Expect(e).To(BeNil())
+			Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeErrorUserAlreadyExists))
+			r, e = client.Login("user1", "other")
+			Expect(e).To(BeNil())
+			Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeErrorBadCredentials))
+			Expect(client.Close()).To(Succeed())
+		})
+
 		It("Two Logins the second should raise an error", func() {
 			receiver := make(chan *chat.CommandMessage)
 			client := tcp_client.NewChatClient(receiver)
 			Expect(client.Connect(address)).To(Succeed())
-			r, e := client.Login("user1")
+			r, e := client.Login("user1", password)
 			Expect(e).To(BeNil())
 			Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
-			r, e = client.Login("user1")
+			r, e = client.Login("user1", password)
 			Expect(e).To(BeNil())
 			Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeErrorUserAlreadyLogged))
 			Expect(client.Close()).To(Succeed())
+			Eventually(func() bool {
+				return tcpServer.Users()["user1"].IsOnLine()
+			}).Should(BeFalse())
 			client = tcp_client.NewChatClient(receiver)
 			Expect(client.Connect(address)).To(Succeed())
-			r, e = client.Login("user1")
+			r, e = client.Login("user1", password)
 			Expect(e).To(BeNil())
 			Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
 			Expect(client.Close()).To(Succeed())
 		})
+		It("Logout should keep the connection open", func() {
+			receiver := make(chan *chat.CommandMessage)
+			client := tcp_client.NewChatClient(receiver)
+			Expect(client.Connect(address)).To(Succeed())
+			r, e := client.Logout()
+			Expect(e).To(BeNil())
+			Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeErrorUserNotLogged))
+			r, e = client.Login("user1", password)
+			Expect(e).To(BeNil())
+			Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+			r, e = client.Logout()
+			Expect(e).To(BeNil())
+			Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+			Expect(tcpServer.Users()["user1"].IsOnLine()).To(BeFalse())
+			r, e = client.Login("user1", password)
+			Expect(e).To(BeNil())
+			Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+			Expect(client.Close()).To(Succeed())
+		})
+
 		It("Exchange Messages between two clients", func() {
 			done := make(chan bool)
 			receiver1 := make(chan *chat.CommandMessage)
@@ -68,17 +393,19 @@ var _ = Describe("Tcp Server", func() {
 			}()
 			client1 := tcp_client.NewChatClient(receiver1)
 			Expect(client1.Connect(address)).To(Succeed())
-			r, e := client1.Login("user1")
+			r, e := client1.Login("user1", password)
 			Expect(e).To(BeNil())
 			Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
 			receiver2 := make(chan *chat.CommandMessage)
 			client2 := tcp_client.NewChatClient(receiver2)
 			Expect(client2.Connect(address)).To(Succeed())
-			r, e = client2.Login("user2")
+			r, e = client2.Login("user2", password)
 			Expect(e).To(BeNil())
 			Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
-			r, e = client2.SendMessage("Hello", "user1")
+			sent, e := client2.SendMessage("Hello", "user1")
 			Expect(e).To(BeNil())
+			Expect(sent.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+			Expect(sent.Id).NotTo(BeZero())
 
 			<-done
 			close(receiver1)
@@ -87,5 +414,485 @@ var _ = Describe("Tcp Server", func() {
 			Expect(client2.Close()).To(Succeed())
 		})
 
+		It("Refuses the messages without login and ignores the From sent by the client", func() {
+			readMessageSent := func(reader *bufio.Reader) *chat.MessageSentResponse {
+				frame, err := chat.ReadFullBufferFromSource(reader)
+				Expect(err).To(BeNil())
+				header := &chat.ChatHeader{}
+				Expect(header.Read(frame)).To(Succeed())
+				Expect(header.Key()).To(Equal(chat.MessageSentResponseKey))
+				response := &chat.MessageSentResponse{}
+				Expect(response.Read(frame)).To(Succeed())
+				return response
+			}
+			conn, err := net.Dial("tcp", address)
+			Expect(err).To(BeNil())
+			defer conn.Close()
+			reader := bufio.NewReader(conn)
+
+			spoofed := chat.NewCommandMessageWithCorrelationId("I am user1", "user1", "user3", 5, chat.ConvertTimeToUint64(time.Now()))
+			writeFrame(conn, chat.NewChatHeaderFromCommand(spoofed), spoofed)
+			response := readMessageSent(reader)
+			Expect(response.CorrelationId()).To(Equal(uint32(5)))
+			Expect(response.ResponseCode()).To(Equal(chat.ResponseCodeErrorUserNotLogged))
+
+			multi := chat.NewCommandMultiMessage("I am user1", "user1", []string{"user3"}, chat.ConvertTimeToUint64(time.Now()))
+			writeFrame(conn, chat.NewChatHeaderFromCommand(multi), multi)
+			frame, err := chat.ReadFullBufferFromSource(reader)
+			Expect(err).To(BeNil())
+			header := &chat.ChatHeader{}
+			Expect(header.Read(frame)).To(Succeed())
+			Expect(header.Key()).To(Equal(chat.MultiMessageResponseKey))
+			multiResponse := &chat.MultiMessageResponse{}
+			Expect(multiResponse.Read(frame)).To(Succeed())
+			Expect(multiResponse.ResponseCode()).To(Equal(chat.ResponseCodeErrorUserNotLogged))
+			Expect(tcpServer.User("user3").MailboxSize()).To(BeZero())
+
+			login := chat.NewCommandLoginWithCorrelation("user2", password, 6)
+			writeFrame(conn, chat.NewChatHeaderFromCommand(login), login)
+			Expect(readGenericResponse(reader).ResponseCode()).To(Equal(chat.ResponseCodeOk))
+			writeFrame(conn, chat.NewChatHeaderFromCommand(spoofed), spoofed)
+			Expect(readMessageSent(reader).ResponseCode()).To(Equal(chat.ResponseCodeOk))
+
+			user3 := tcpServer.User("user3")
+			Eventually(user3.MailboxSize).Should(Equal(1))
+			user3.mutex.Lock()
+			defer user3.mutex.Unlock()
+			Expect(user3.Messages[0].From).To(Equal("user2"))
+		})
+
+		It("Send a message to many users and to all users", func() {
+			receiver1 := make(chan *chat.CommandMessage, 2)
+			client1 := tcp_client.NewChatClient(receiver1)
+			Expect(client1.Connect(address)).To(Succeed())
+			r, e := client1.Login("user1", password)
+			Expect(e).To(BeNil())
+			Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+
+			receiver2 := make(chan *chat.CommandMessage, 2)
+			client2 := tcp_client.NewChatClient(receiver2)
+			Expect(client2.Connect(address)).To(Succeed())
+			r, e = client2.Login("user2", password)
+			Expect(e).To(BeNil())
+			Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+			r, e = client2.Logout()
+			Expect(e).To(BeNil())
+			Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+
+			receiver3 := make(chan *chat.CommandMessage, 2)
+			client3 := tcp_client.NewChatClient(receiver3)
+			Expect(client3.Connect(address)).To(Succeed())
+			r, e = client3.Login("user3", password)
+			Expect(e).To(BeNil())
+			Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+
+			m, e := client3.SendMessageToMany("Hello", []string{"user1", "user2", "unknown"})
+			Expect(e).To(BeNil())
+			Expect(m.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+			Expect(m.Delivered).To(Equal([]string{"user1"}))
+			Expect(m.Queued).To(Equal([]string{"user2"}))
+			Expect(m.NotFound).To(Equal([]string{"unknown"}))
+			Eventually(receiver1).Should(Receive())
+
+			m, e = client3.SendMessageToMany("Hello", []string{"unknown"})
+			Expect(e).To(BeNil())
+			Expect(m.ResponseCode()).To(Equal(chat.ResponseCodeErrorUserNotFound))
+
+			m, e = client3.Broadcast("Hello all")
+			Expect(e).To(BeNil())
+			Expect(m.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+			Expect(m.Delivered).To(ConsistOf("user1"))
+			Expect(m.Queued).To(ConsistOf("user2"))
+			Expect(m.NotFound).To(BeEmpty())
+			Eventually(receiver1).Should(Receive())
+
+			Expect(client1.Close()).To(Succeed())
+			Expect(client2.Close()).To(Succeed())
+			Expect(client3.Close()).To(Succeed())
+		})
+		It("Create, join, leave and post to a room", func() {
+			receiver1 := make(chan *chat.CommandMessage, 2)
+			client1 := tcp_client.NewChatClient(receiver1)
+			Expect(client1.Connect(address)).To(Succeed())
+			r, e := client1.Login("user1", password)
+			Expect(e).To(BeNil())
+			Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+
+			receiver2 := make(chan *chat.CommandMessage, 2)
+			client2 := tcp_client.NewChatClient(receiver2)
+			Expect(client2.Connect(address)).To(Succeed())
+			r, e = client2.Login("user2", password)
+			Expect(e).To(BeNil())
+			Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+
+			r, e = client1.CreateRoom("room")
+			Expect(e).To(BeNil())
+			Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+			r, e = client2.CreateRoom("room")
+			Expect(e).To(BeNil())
+			Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeErrorRoomAlreadyExists))
+			r, e = client2.JoinRoom("unknown")
+			Expect(e).To(BeNil())
+			Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeErrorRoomNotFound))
+
+			m, e := client2.SendRoomMessage("room", "Hello")
+			Expect(e).To(BeNil())
+			Expect(m.ResponseCode()).To(Equal(chat.ResponseCodeErrorNotRoomMember))
+
+			r, e = client2.JoinRoom("room")
+			Expect(e).To(BeNil())
+			Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+
+			// user3 is offline, the room messages are queued
+			client3 := tcp_client.NewChatClient(make(chan *chat.CommandMessage, 2))
+			Expect(client3.Connect(address)).To(Succeed())
+			r, e = client3.Login("user3", password)
+			Expect(e).To(BeNil())
+			Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+			r, e = client3.JoinRoom("room")
+			Expect(e).To(BeNil())
+			Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+			r, e = client3.Logout()
+			Expect(e).To(BeNil())
+			Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+
+			members, e := client1.RoomMembers("room")
+			Expect(e).To(BeNil())
+			Expect(members.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+			Expect(members.Members).To(Equal([]string{"user1", "user2", "user3"}))
+
+			m, e = client1.SendRoomMessage("room", "Hello room")
+			Expect(e).To(BeNil())
+			Expect(m.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+			Expect(m.Delivered).To(Equal([]string{"user2"}))
+			Expect(m.Queued).To(Equal([]string{"user3"}))
+			var msg *chat.CommandMessage
+			Eventually(receiver2).Should(Receive(&msg))
+			Expect(msg.Room).To(Equal("room"))
+			Expect(msg.From).To(Equal("user1"))
+			Expect(msg.Message).To(Equal("Hello room"))
+			Consistently(receiver1, 200*time.Millisecond).ShouldNot(Receive())
+
+			r, e = client2.LeaveRoom("room")
+			Expect(e).To(BeNil())
+			Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+			r, e = client2.LeaveRoom("room")
+			Expect(e).To(BeNil())
+			Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeErrorNotRoomMember))
+			Expect(tcpServer.rooms.membership()).To(Equal(map[string][]string{
+				"user1": {"room"},
+				"user3": {"room"},
+			}))
+
+			Expect(client1.Close()).To(Succeed())
+			Expect(client2.Close()).To(Succeed())
+			Expect(client3.Close()).To(Succeed())
+		})
+		It("Returns the history of a conversation by pages", func() {
+			receiver1 := make(chan *chat.CommandMessage, 10)
+			client1 := tcp_client.NewChatClient(receiver1)
+			Expect(client1.Connect(address)).To(Succeed())
+			r, e := client1.Login("user1", password)
+			Expect(e).To(BeNil())
+			Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+
+			client2 := tcp_client.NewChatClient(make(chan *chat.CommandMessage, 10))
+			Expect(client2.Connect(address)).To(Succeed())
+			r, e = client2.Login("user2", password)
+			Expect(e).To(BeNil())
+			Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+
+			for i := 0; i < 5; i++ {
+				sent, e := client2.SendMessage(fmt.Sprintf("Hello %d", i), "user1")
+				Expect(e).To(BeNil())
+				Expect(sent.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+				Eventually(receiver1).Should(Receive())
+			}
+			sent, e := client1.SendMessage("Hi", "user3")
+			Expect(e).To(BeNil())
+			Expect(sent.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+
+			// the newest messages first
+			history, e := client1.History("user2", 0, 0, 2)
+			Expect(e).To(BeNil())
+			Expect(history.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+			Expect(history.More).To(BeTrue())
+			Expect(history.Messages).To(HaveLen(2))
+			Expect(history.Messages[0].Message).To(Equal("Hello 3"))
+			Expect(history.Messages[1].Message).To(Equal("Hello 4"))
+
+			history, e = client1.History("user2", history.Messages[0].Id, 0, 10)
+			Expect(e).To(BeNil())
+			Expect(history.More).To(BeFalse())
+			Expect(history.Messages).To(HaveLen(3))
+			Expect(history.Messages[0].Message).To(Equal("Hello 0"))
+			Expect(history.Messages[0].From).To(Equal("user2"))
+			Expect(history.Messages[0].To).To(Equal("user1"))
+
+			// the same conversation seen by the other user
+			history, e = client2.History("user1", 0, history.Messages[0].Id, 2)
+			Expect(e).To(BeNil())
+			Expect(history.More).To(BeTrue())
+			Expect(history.Messages).To(HaveLen(2))
+			Expect(history.Messages[0].Message).To(Equal("Hello 1"))
+			Expect(history.Messages[1].Message).To(Equal("Hello 2"))
+
+			history, e = client1.History("unknown", 0, 0, 0)
+			Expect(e).To(BeNil())
+			Expect(history.ResponseCode()).To(Equal(chat.ResponseCodeErrorUserNotFound))
+
+			Expect(client1.Close()).To(Succeed())
+			Expect(client2.Close()).To(Succeed())
+		})
+		It("Splits the history pages larger than the max frame size", func() {
+			large := strings.Repeat("a", 30_000)
+			for i := 0; i < 50; i++ {
+				tcpServer.history.add(&UserMessage{Id: uint64(101 + i), From: "user2", To: "user1", Message: large, Sent: uint64(1000 + i)})
+			}
+			client1 := tcp_client.NewChatClient(make(chan *chat.CommandMessage, 10))
+			Expect(client1.Connect(address)).To(Succeed())
+			defer client1.Close()
+			r, e := client1.Login("user1", password)
+			Expect(e).To(BeNil())
+			Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+
+			// the newest messages first, the page is truncated to fit the frame
+			history, e := client1.History("user2", 0, 0, 50)
+			Expect(e).To(BeNil())
+			Expect(history.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+			Expect(history.More).To(BeTrue())
+			Expect(len(history.Messages)).To(BeNumerically(">", 0))
+			Expect(len(history.Messages)).To(BeNumerically("<", 50))
+			Expect(history.Messages[len(history.Messages)-1].Id).To(BeNumerically("==", 150))
+			frameSize := chat.NewChatHeaderFromCommand(history).SizeNeeded() + history.SizeNeeded()
+			Expect(frameSize).To(BeNumerically("<=", chat.DefaultMaxFrameSize))
+
+			// the pages cover the whole conversation
+			received := len(history.Messages)
+			for history.More {
+				history, e = client1.History("user2", history.Messages[0].Id, 0, 50)
+				Expect(e).To(BeNil())
+				Expect(history.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+				received += len(history.Messages)
+			}
+			Expect(received).To(Equal(50))
+
+			// the oldest messages first with after
+			history, e = client1.History("user2", 0, 100, 50)
+			Expect(e).To(BeNil())
+			Expect(history.More).To(BeTrue())
+			Expect(history.Messages[0].Id).To(BeNumerically("==", 101))
+			Expect(client1.Ping()).To(Succeed())
+		})
+		It("Pages the history by id when the messages have the same time", func() {
+			// the time is set by the client, many messages can have the same time
+			conn, err := net.Dial("tcp", address)
+			Expect(err).To(BeNil())
+			defer conn.Close()
+			reader := bufio.NewReader(conn)
+			login := chat.NewCommandLoginWithCorrelation("user2", password, 1)
+			writeFrame(conn, chat.NewChatHeaderFromCommand(login), login)
+			Expect(readGenericResponse(reader).ResponseCode()).To(Equal(chat.ResponseCodeOk))
+			ids := make([]uint64, 0)
+			for i := 0; i < 5; i++ {
+				message := chat.NewCommandMessageWithCorrelationId(fmt.Sprintf("Same time %d", i), "user2", "user1", uint32(2+i), 2000)
+				writeFrame(conn, chat.NewChatHeaderFromCommand(message), message)
+				frame, err := chat.ReadFullBufferFromSource(reader)
+				Expect(err).To(BeNil())
+				header := &chat.ChatHeader{}
+				Expect(header.Read(frame)).To(Succeed())
+				Expect(header.Key()).To(Equal(chat.MessageSentResponseKey))
+				sent := &chat.MessageSentResponse{}
+				Expect(sent.Read(frame)).To(Succeed())
+				Expect(sent.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+				ids = append(ids, sent.Id)
+			}
+
+			client1 := tcp_client.NewChatClient(make(chan *chat.CommandMessage, 10))
+			Expect(client1.Connect(address)).To(Succeed())
+			defer client1.Close()
+			r, e := client1.Login("user1", password)
+			Expect(e).To(BeNil())
+			Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+
+			// backward, the page boundary is between messages with the same time
+			read := make([]string, 0)
+			var beforeId uint64
+			for {
+				history, e := client1.History("user2", beforeId, 0, 2)
+				Expect(e).To(BeNil())
+				Expect(history.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+				page := make([]string, 0)
+				for _, message := range history.Messages {
+					Expect(message.Time).To(BeNumerically("==", 2000))
+					page = append(page, message.Message)
+				}
+				read = append(page, read...)
+				if !history.More {
+					break
+				}
+				beforeId = history.Messages[0].Id
+			}
+			Expect(read).To(Equal([]string{"Same time 0", "Same time 1", "Same time 2", "Same time 3", "Same time 4"}))
+
+			// forward, from the id of the first message
+			read = read[:0]
+			afterId := ids[0]
+			for {
+				history, e := client1.History("user2", 0, afterId, 2)
+				Expect(e).To(BeNil())
+				for _, message := range history.Messages {
+					read = append(read, message.Message)
+				}
+				if !history.More {
+					break
+				}
+				afterId = history.Messages[len(history.Messages)-1].Id
+			}
+			Expect(read).To(Equal([]string{"Same time 1", "Same time 2", "Same time 3", "Same time 4"}))
+		})
+		It("List the users with their status", func() {
+			receiver1 := make(chan *chat.CommandMessage)
+			client1 := tcp_client.NewChatClient(receiver1)
+			Expect(client1.Connect(address)).To(Succeed())
+			r, e := client1.Login("user1", password)
+			Expect(e).To(BeNil())
+			Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+			r, e = client1.Logout()
+			Expect(e).To(BeNil())
+			Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+
+			receiver2 := make(chan *chat.CommandMessage)
+			client2 := tcp_client.NewChatClient(receiver2)
+			Expect(client2.Connect(address)).To(Succeed())
+			r, e = client2.Login("user2", password)
+			Expect(e).To(BeNil())
+			Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+
+			users, e := client2.ListUsers()
+			Expect(e).To(BeNil())
+			Expect(users.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+			Expect(users.Online).To(Equal([]string{"user2"}))
+			Expect(users.Offline).To(Equal([]string{"user1", "user3"}))
+			Expect(users.LastLogin).To(HaveKey("user1"))
+			Expect(users.LastLogin).To(HaveKey("user2"))
+			_, err := time.Parse(time.RFC3339, users.LastLogin["user2"])
+			Expect(err).To(BeNil())
+
+			Expect(client1.Close()).To(Succeed())
+			Expect(client2.Close()).To(Succeed())
+		})
+		It("Refuses the list of the users without login", func() {
+			client := tcp_client.NewChatClient(make(chan *chat.CommandMessage))
+			Expect(client.Connect(address)).To(Succeed())
+			defer client.Close()
+			users, e := client.ListUsers()
+			Expect(e).To(BeNil())
+			Expect(users.ResponseCode()).To(Equal(chat.ResponseCodeErrorUserNotLogged))
+			Expect(users.Online).To(BeEmpty())
+			Expect(users.Offline).To(BeEmpty())
+			Expect(users.LastLogin).To(BeEmpty())
+		})
+		It("Keeps the messages until the ack and sends them again at the next login", func() {
+			receiver2 := make(chan *chat.CommandMessage)
+			client2 := tcp_client.NewChatClient(receiver2)
+			Expect(client2.Connect(address)).To(Succeed())
+			r, e := client2.Login("user2", password)
+			Expect(e).To(BeNil())
+			Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+			sent, e := client2.SendMessage("Hello", "user1")
+			Expect(e).To(BeNil())
+			Expect(sent.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+
+			// a raw connection receives the message and doesn't send the ack
+			conn, err := net.Dial("tcp", address)
+			Expect(err).To(BeNil())
+			reader := bufio.NewReader(conn)
+			login := chat.NewCommandLoginWithCorrelation("user1", password, 1)
+			Expect(chat.WriteCommandWithHeader(login, bufio.NewWriter(conn))).To(Succeed())
+			var firstId uint64
+			for firstId == 0 {
+				frame, err := chat.ReadFullBufferFromSource(reader)
+				Expect(err).To(BeNil())
+				header := &chat.ChatHeader{}
+				Expect(header.Read(frame)).To(Succeed())
+				if header.Key() == chat.CommandMessageKey {
+					msg := &chat.CommandMessage{}
+					Expect(msg.Read(frame)).To(Succeed())
+					Expect(msg.Message).To(Equal("Hello"))
+					firstId = msg.Id
+				}
+			}
+			Expect(conn.Close()).To(Succeed())
+			Eventually(func() bool {
+				return tcpServer.Users()["user1"].IsOnLine()
+			}).Should(BeFalse())
+			Expect(tcpServer.Users()["user1"].Messages).To(HaveLen(1))
+
+			receiver1 := make(chan *chat.CommandMessage, 1)
+			client1 := tcp_client.NewChatClient(receiver1)
+			Expect(client1.Connect(address)).To(Succeed())
+			r, e = client1.Login("user1", password)
+			Expect(e).To(BeNil())
+			Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+			var msg *chat.CommandMessage
+			Eventually(receiver1).Should(Receive(&msg))
+			Expect(msg.Id).To(Equal(firstId))
+			Eventually(func() int {
+				user := tcpServer.Users()["user1"]
+				user.mutex.Lock()
+				defer user.mutex.Unlock()
+				return len(user.Messages)
+			}).Should(Equal(0))
+
+			Expect(client1.Close()).To(Succeed())
+			Expect(client2.Close()).To(Succeed())
+		})
+		It("Notifies the sender when the message is delivered and read", func() {
+			receiver1 := make(chan *chat.CommandMessage, 1)
+			client1 := tcp_client.NewChatClient(receiver1)
+			Expect(client1.Connect(address)).To(Succeed())
+			r, e := client1.Login("user1", password)
+			Expect(e).To(BeNil())
+			Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+
+			status2 := make(chan *chat.CommandMessageStatus, 2)
+			client2 := tcp_client.NewChatClient(make(chan *chat.CommandMessage))
+			client2.NotifyMessageStatus(status2)
+			Expect(client2.Connect(address)).To(Succeed())
+			r, e = client2.Login("user2", password)
+			Expect(e).To(BeNil())
+			Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+
+			sent, e := client2.SendMessage("Hello", "unknown")
+			Expect(e).To(BeNil())
+			Expect(sent.ResponseCode()).To(Equal(chat.ResponseCodeErrorUserNotFound))
+			Expect(sent.Id).To(BeZero())
+
+			sent, e = client2.SendMessage("Hello", "user1")
+			Expect(e).To(BeNil())
+			Expect(sent.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+
+			var status *chat.CommandMessageStatus
+			Eventually(status2).Should(Receive(&status))
+			Expect(status.Id).To(Equal(sent.Id))
+			Expect(status.To).To(Equal("user1"))
+			Expect(status.Status).To(Equal(chat.MessageStatusDelivered))
+
+			var msg *chat.CommandMessage
+			Eventually(receiver1).Should(Receive(&msg))
+			Expect(msg.Id).To(Equal(sent.Id))
+			Expect(client1.MarkRead(msg.Id)).To(Succeed())
+			Eventually(status2).Should(Receive(&status))
+			Expect(status.Id).To(Equal(sent.Id))
+			Expect(status.Status).To(Equal(chat.MessageStatusRead))
+
+			// the receipt is removed after the read
+			Expect(client1.MarkRead(msg.Id)).To(Succeed())
+			Consistently(status2, 200*time.Millisecond).ShouldNot(Receive())
+
+			Expect(client1.Close()).To(Succeed())
+			Expect(client2.Close()).To(Succeed())
+		})
 	})
 })
@@ -0,0 +1,244 @@
+package tcp_server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"gsantomaggio/chat/server/chat"
+	"gsantomaggio/chat/server/tcp_client"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type testCertificate struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	certFile    string
+	keyFile     string
+}
+
+// newTestCertificate creates a certificate signed by parent, self-signed when parent is nil,
+// and writes the PEM files in dir.
+func newTestCertificate(dir, commonName string, parent *testCertificate, isCA bool) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).To(BeNil())
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	Expect(err).To(BeNil())
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if isCA {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	}
+	signerCert, signerKey := template, key
+	if parent != nil {
+		signerCert, signerKey = parent.certificate, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signerCert, &key.PublicKey, signerKey)
+	Expect(err).To(BeNil())
+	certificate, err := x509.ParseCertificate(der)
+	Expect(err).To(BeNil())
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	Expect(err).To(BeNil())
+
+	c := &testCertificate{
+		certificate: certificate,
+		key:         key,
+		certFile:    filepath.Join(dir, commonName+".crt"),
+		keyFile:     filepath.Join(dir, commonName+".key"),
+	}
+	Expect(os.WriteFile(c.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)).To(Succeed())
+	Expect(os.WriteFile(c.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600)).To(Succeed())
+	return c
+}
+
+var _ = Describe("TLS", func() {
+	const tlsAddress = "localhost:6668"
+	var tcpServer *TcpServer
+	var ca, otherCA *testCertificate
+
+	BeforeEach(func() {
+		dir := GinkgoT().TempDir()
+		ca = newTestCertificate(dir, "ca", nil, true)
+		otherCA = newTestCertificate(dir, "other-ca", nil, true)
+		serverCert := newTestCertificate(dir, "server", ca, false)
+		tlsConfig, err := NewServerTLSConfig(serverCert.certFile, serverCert.keyFile, ca.certFile)
+		Expect(err).To(BeNil())
+
+		tcpServer = NewTcpServer(tlsAddress, nil)
+		tcpServer.SetTLSConfig(tlsConfig)
+		Expect(tcpServer.StartInAThread()).To(Succeed())
+		time.Sleep(200 * time.Millisecond)
+
+		clientConfig, err := tcp_client.NewClientTLSConfig(ca.certFile, "localhost", "", "")
+		Expect(err).To(BeNil())
+		client := tcp_client.NewChatClient(make(chan *chat.CommandMessage))
+		Expect(client.ConnectTLS(tlsAddress, clientConfig)).To(Succeed())
+		for _, username := range []string{"user1", "user2"} {
+			r, e := client.Register(username, password)
+			Expect(e).To(BeNil())
+			Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+		}
+		Expect(client.Close()).To(Succeed())
+	})
+	AfterEach(func() {
+		tcpServer.Stop()
+	})
+
+	It("Login with the password over TLS", func() {
+		clientConfig, err := tcp_client.NewClientTLSConfig(ca.certFile, "localhost", "", "")
+		Expect(err).To(BeNil())
+		client := tcp_client.NewChatClient(make(chan *chat.CommandMessage))
+		Expect(client.ConnectTLS(tlsAddress, clientConfig)).To(Succeed())
+		r, e := client.Login("user1", password)
+		Expect(e).To(BeNil())
+		Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+		Expect(client.Close()).To(Succeed())
+	})
+
+	It("Login with the client certificate CN", func() {
+		clientCert := newTestCertificate(GinkgoT().TempDir(), "user1", ca, false)
+		clientConfig, err := tcp_client.NewClientTLSConfig(ca.certFile, "localhost", clientCert.certFile, clientCert.keyFile)
+		Expect(err).To(BeNil())
+		client := tcp_client.NewChatClient(make(chan *chat.CommandMessage))
+		Expect(client.ConnectTLS(tlsAddress, clientConfig)).To(Succeed())
+		r, e := client.Login("user2", password)
+		Expect(e).To(BeNil())
+		Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeErrorBadCredentials))
+		r, e = client.Login("user1", "")
+		Expect(e).To(BeNil())
+		Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+		Expect(client.Close()).To(Succeed())
+	})
+
+	It("Login with the version 1 of the login, without password, only with the client certificate", func() {
+		options := tcp_client.DefaultClientOptions()
+		options.ProtocolVersion = chat.Version1
+		clientConfig, err := tcp_client.NewClientTLSConfig(ca.certFile, "localhost", "", "")
+		Expect(err).To(BeNil())
+		client := tcp_client.NewChatClientWithOptions(make(chan *chat.CommandMessage), options)
+		Expect(client.ConnectTLS(tlsAddress, clientConfig)).To(Succeed())
+		// the password is not sent
+		r, e := client.Login("user1", password)
+		Expect(e).To(BeNil())
+		Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeErrorBadCredentials))
+		Expect(client.Close()).To(Succeed())
+
+		clientCert := newTestCertificate(GinkgoT().TempDir(), "user1", ca, false)
+		clientConfig, err = tcp_client.NewClientTLSConfig(ca.certFile, "localhost", clientCert.certFile, clientCert.keyFile)
+		Expect(err).To(BeNil())
+		client = tcp_client.NewChatClientWithOptions(make(chan *chat.CommandMessage), options)
+		Expect(client.ConnectTLS(tlsAddress, clientConfig)).To(Succeed())
+		r, e = client.Login("user1", "")
+		Expect(e).To(BeNil())
+		Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+		Expect(client.Close()).To(Succeed())
+	})
+
+	It("Sends the version 1 of the messages to a client logged in with the version 1", func() {
+		options := tcp_client.DefaultClientOptions()
+		options.ProtocolVersion = chat.Version1
+		clientCert := newTestCertificate(GinkgoT().TempDir(), "user1", ca, false)
+		clientConfig, err := tcp_client.NewClientTLSConfig(ca.certFile, "localhost", clientCert.certFile, clientCert.keyFile)
+		Expect(err).To(BeNil())
+		receiver := make(chan *chat.CommandMessage, 1)
+		client := tcp_client.NewChatClientWithOptions(receiver, options)
+		Expect(client.ConnectTLS(tlsAddress, clientConfig)).To(Succeed())
+		defer client.Close()
+		r, e := client.Login("user1", "")
+		Expect(e).To(BeNil())
+		Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+
+		senderConfig, err := tcp_client.NewClientTLSConfig(ca.certFile, "localhost", "", "")
+		Expect(err).To(BeNil())
+		sender := tcp_client.NewChatClient(make(chan *chat.CommandMessage))
+		Expect(sender.ConnectTLS(tlsAddress, senderConfig)).To(Succeed())
+		defer sender.Close()
+		r, e = sender.Login("user2", password)
+		Expect(e).To(BeNil())
+		Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+		sent, e := sender.SendMessage("base protocol", "user1")
+		Expect(e).To(BeNil())
+		Expect(sent.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+
+		var message *chat.CommandMessage
+		Eventually(receiver).Should(Receive(&message))
+		Expect(message.Version()).To(Equal(chat.Version1))
+		Expect(message.Message).To(Equal("base protocol"))
+		Expect(message.From).To(Equal("user2"))
+		Expect(message.Id).To(BeZero())
+		// the client can't send the ack of a message without id
+		Eventually(tcpServer.User("user1").MailboxSize).Should(BeZero())
+	})
+
+	It("Refuses a server certificate signed by an unknown CA", func() {
+		clientConfig, err := tcp_client.NewClientTLSConfig(otherCA.certFile, "localhost", "", "")
+		Expect(err).To(BeNil())
+		client := tcp_client.NewChatClient(make(chan *chat.CommandMessage))
+		Expect(client.ConnectTLS(tlsAddress, clientConfig)).NotTo(Succeed())
+	})
+
+	It("Ignores a client certificate signed by an unknown CA", func() {
+		clientCert := newTestCertificate(GinkgoT().TempDir(), "user1", otherCA, false)
+		clientConfig, err := tcp_client.NewClientTLSConfig(ca.certFile, "localhost", clientCert.certFile, clientCert.keyFile)
+		Expect(err).To(BeNil())
+		client := tcp_client.NewChatClient(make(chan *chat.CommandMessage))
+		Expect(client.ConnectTLS(tlsAddress, clientConfig)).To(Succeed())
+		// the certificate is not accepted, so the password is required
+		r, e := client.Login("user1", "")
+		Expect(e).To(BeNil())
+		Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeErrorBadCredentials))
+		r, e = client.Login("user1", password)
+		Expect(e).To(BeNil())
+		Expect(r.ResponseCode()).To(Equal(chat.ResponseCodeOk))
+		Expect(client.Close()).To(Succeed())
+	})
+
+	It("Refuses a plain TCP client", func() {
+		client := tcp_client.NewChatClient(make(chan *chat.CommandMessage))
+		Expect(client.Connect(tlsAddress)).To(Succeed())
+		_, e := client.Login("user1", password)
+		Expect(e).NotTo(BeNil())
+	})
+
+	It("Closes the connection when the client doesn't complete the TLS handshake", func() {
+		dir := GinkgoT().TempDir()
+		serverCert := newTestCertificate(dir, "server", ca, false)
+		tlsConfig, err := NewServerTLSConfig(serverCert.certFile, serverCert.keyFile, "")
+		Expect(err).To(BeNil())
+		options := DefaultServerOptions("localhost:6682")
+		options.TLSConfig = tlsConfig
+		server := NewTcpServerWithOptions(options, nil)
+		server.handshakeTimeout = 200 * time.Millisecond
+		Expect(server.StartInAThread()).To(Succeed())
+		defer server.Stop()
+
+		// the client connects and never sends the hello
+		conn, err := net.Dial("tcp", "localhost:6682")
+		Expect(err).To(BeNil())
+		defer conn.Close()
+		Expect(conn.SetReadDeadline(time.Now().Add(5 * time.Second))).To(Succeed())
+		start := time.Now()
+		_, err = conn.Read(make([]byte, 1))
+		Expect(err).To(MatchError(io.EOF))
+		Expect(time.Since(start)).To(BeNumerically("<", 2*time.Second))
+	})
+})
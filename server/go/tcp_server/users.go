@@ -1,21 +1,28 @@
 package tcp_server
 
 import (
-	"bufio"
-	"fmt"
 	"gsantomaggio/chat/server/chat"
+	"log/slog"
 	"net"
 	"sync"
 	"time"
 )
 
 type UserMessage struct {
+	Id      uint64
+	Room    string // empty for the direct messages
 	From    string
 	To      string
 	Message string
 	Sent    uint64
+	// inFlight is true when the message is written on the current connection
+	// and the ack is not received yet
+	inFlight bool
 }
 
+// User is a registered user with the mailbox.
+// LastLogin, isOnline, writer and Messages are protected by mutex:
+// the connections of the user and of the senders change them at the same time.
 type User struct {
 	Username   string
 	LastLogin  time.Time
@@ -23,90 +30,359 @@ type User struct {
 	isOnline   bool
 	Messages   []*UserMessage
 	chNotify   chan struct{}
-	mutex      sync.Mutex
-	chEvents   chan *Event
-	writer     *bufio.Writer
+	// stopped is set by shutdown, chNotify is closed and the notifications are ignored
+	stopped bool
+	// deleted is set by remove, the user is not saved anymore
+	deleted bool
+	// notifyDone is closed when the goroutine sending the mailbox exits
+	notifyDone  chan struct{}
+	mutex       sync.Mutex
+	events      *EventDispatcher
+	writer      *chat.ConnectionWriter
+	storage     Storage
+	credentials *Credentials
+	// messageVersion is the version of the CommandMessage written on writer, see AttachWriter
+	messageVersion byte
 }
 
-func NewUser(username string, chEvents chan *Event) *User {
+// NewUser creates a registered user. The user is offline until the first login.
+func NewUser(username string, credentials *Credentials, events *EventDispatcher, storage Storage) *User {
 	u := &User{
-		Username:  username,
-		LastLogin: time.Now(),
-		isOnline:  true,
-		Messages:  make([]*UserMessage, 0),
-		chNotify:  make(chan struct{}),
-		mutex:     sync.Mutex{},
-		chEvents:  chEvents,
+		Username:    username,
+		LastLogin:   time.Now(),
+		isOnline:    false,
+		Messages:    make([]*UserMessage, 0),
+		chNotify:    make(chan struct{}, 1),
+		notifyDone:  make(chan struct{}),
+		mutex:       sync.Mutex{},
+		events:      events,
+		storage:     storage,
+		credentials: credentials,
 	}
+	u.mutex.Lock()
+	u.persist()
+	u.mutex.Unlock()
 	u.sendMessageInAThread()
 	return u
 }
 
-func (u *User) SetOnline(online bool) {
-	u.isOnline = online
-	if online {
-		u.chNotify <- struct{}{}
+// restoreUser creates an offline user from the record saved by the storage.
+func restoreUser(record *UserRecord, events *EventDispatcher, storage Storage) *User {
+	u := &User{
+		Username:    record.Username,
+		LastLogin:   record.LastLogin,
+		isOnline:    false,
+		Messages:    record.Messages,
+		chNotify:    make(chan struct{}, 1),
+		notifyDone:  make(chan struct{}),
+		mutex:       sync.Mutex{},
+		events:      events,
+		storage:     storage,
+		credentials: record.Credentials,
+	}
+	if u.Messages == nil {
+		u.Messages = make([]*UserMessage, 0)
+	}
+	u.sendMessageInAThread()
+	return u
+}
+
+// persist saves the user and the mailbox in the storage.
+// The caller must hold u.mutex.
+func (u *User) persist() {
+	if u.storage == nil || u.deleted {
+		return
+	}
+	err := u.storage.SaveUser(&UserRecord{
+		Username:    u.Username,
+		LastLogin:   u.LastLogin,
+		Credentials: u.credentials,
+		Messages:    u.Messages,
+	})
+	if err != nil {
+		u.DispatchEvent(EventStorage, slog.LevelError, "Error saving user", slog.String(AttrError, err.Error()))
+	}
+}
+
+// VerifyPassword checks the password against the user credentials.
+// A user saved before the credentials were introduced has no credentials:
+// the login with the password is refused until the password is set with SetPassword.
+// The hash is computed without holding u.mutex, the credentials are replaced only by SetPassword.
+func (u *User) VerifyPassword(password string) bool {
+	u.mutex.Lock()
+	credentials := u.credentials
+	u.mutex.Unlock()
+	if credentials == nil {
+		u.DispatchEvent(EventLoginFailed, slog.LevelWarn, "User has no password, set it with SetPassword")
+		return false
+	}
+	return credentials.Verify(password)
+}
+
+// SetPassword replaces the credentials of the user with the password and saves the user.
+func (u *User) SetPassword(password string) error {
+	credentials, err := NewCredentials(password)
+	if err != nil {
+		return err
 	}
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.credentials = credentials
+	u.persist()
+	return nil
+}
+
+// notify wakes up the goroutine sending the mailbox. It doesn't block:
+// the notifications received while the goroutine is sending are merged,
+// the goroutine reads the whole mailbox anyway.
+func (u *User) notify() {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if u.stopped {
+		return
+	}
+	select {
+	case u.chNotify <- struct{}{}:
+	default:
+	}
+}
+
+// shutdown stops the goroutine sending the mailbox and saves the user.
+// The user can't receive messages anymore.
+func (u *User) shutdown() {
+	u.mutex.Lock()
+	if !u.stopped {
+		u.stopped = true
+		close(u.chNotify)
+	}
+	u.mutex.Unlock()
+	<-u.notifyDone
+	u.mutex.Lock()
+	u.writer = nil
+	u.isOnline = false
+	u.resetInFlight()
+	u.persist()
+	u.mutex.Unlock()
+}
+
+// remove stops the goroutine sending the mailbox like shutdown, without saving the user:
+// the user is deleted and the record must not be written again.
+func (u *User) remove() {
+	u.mutex.Lock()
+	u.deleted = true
+	if !u.stopped {
+		u.stopped = true
+		close(u.chNotify)
+	}
+	u.mutex.Unlock()
+	<-u.notifyDone
+	u.mutex.Lock()
+	u.writer = nil
+	u.isOnline = false
+	u.mutex.Unlock()
 }
 
-func (u *User) UpdateWriter(writer *bufio.Writer) {
+// currentWriter returns the writer of the connection of the user, nil when the user is offline.
+func (u *User) currentWriter() *chat.ConnectionWriter {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.writer
+}
+
+// AttachWriter sets the user online on the connection of the writer.
+// It returns false when the user is already online, on this or another connection:
+// the check and the update are atomic, so only one of the concurrent logins wins.
+// The messages not acknowledged on the previous connection are sent again
+// after notify. messageVersion is the version of CommandMessage known by the client:
+// with chat.Version1 the messages have no id, so they are removed from the mailbox
+// when they are written, without waiting for the ack.
+func (u *User) AttachWriter(writer *chat.ConnectionWriter, messageVersion byte) bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if u.isOnline || u.stopped {
+		return false
+	}
 	u.writer = writer
-	u.SetOnline(true)
+	u.messageVersion = messageVersion
+	u.isOnline = true
+	u.LastLogin = time.Now()
+	u.resetInFlight()
+	u.persist()
+	return true
+}
+
+// DetachWriter sets the user offline when it is online on the connection of the writer.
+// It returns false when the user is offline or online on another connection.
+// The messages received from now on are stored until the next login.
+func (u *User) DetachWriter(writer *chat.ConnectionWriter) bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if u.writer != writer || !u.isOnline {
+		return false
+	}
+	u.writer = nil
+	u.isOnline = false
+	u.resetInFlight()
+	return true
+}
+
+// resetInFlight marks all the messages to be sent again.
+// The caller must hold u.mutex.
+func (u *User) resetInFlight() {
+	for _, message := range u.Messages {
+		message.inFlight = false
+	}
+}
+
+// SendMessageStatus writes the status of a message sent by this user.
+// The status is discarded when the user is offline.
+func (u *User) SendMessageStatus(status *chat.CommandMessageStatus) error {
+	u.mutex.Lock()
+	writer := u.writer
+	u.mutex.Unlock()
+	if writer == nil {
+		return nil
+	}
+	return writer.Send(status)
+}
+
+// AckMessage removes the message acknowledged by the client from the mailbox.
+// It returns false when the message is not in the mailbox, for example
+// when the ack is received twice.
+func (u *User) AckMessage(id uint64) bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	for i, message := range u.Messages {
+		if message.Id == id {
+			u.Messages = append(u.Messages[:i], u.Messages[i+1:]...)
+			u.persist()
+			return true
+		}
+	}
+	return false
 }
 
 func (u *User) IsOnLine() bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
 	return u.isOnline
 }
 
-func (u *User) Close() {
-	u.SetOnline(false)
+// MailboxSize returns the number of messages waiting for the ack of the user.
+func (u *User) MailboxSize() int {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return len(u.Messages)
 }
 
-func (u *User) DispatchEvent(message string, isAnError bool, level int) {
-	if u.chEvents != nil {
-		u.chEvents <- NewEvent(message, isAnError, level)
-	}
+// Status returns the online status and the time of the last login.
+func (u *User) Status() (online bool, lastLogin time.Time) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.isOnline, u.LastLogin
+}
+
+// DispatchEvent sends an event of the user, the attribute AttrUser is added.
+func (u *User) DispatchEvent(kind EventKind, level slog.Level, message string, attrs ...slog.Attr) {
+	u.events.Dispatch(kind, level, message, append([]slog.Attr{slog.String(AttrUser, u.Username)}, attrs...)...)
 }
 
-func (u *User) AddMessage(from, to, message string, sent uint64) {
+// AddMessage stores the message in the user's mailbox.
+// room is the room where the message was posted, empty for the direct messages.
+// It returns true when the user is online and the message is sent immediately,
+// false when the message is queued until the next login.
+func (u *User) AddMessage(id uint64, room, from, to, message string, sent uint64) bool {
 	u.mutex.Lock()
 	u.Messages = append(u.Messages, &UserMessage{
+		Id:      id,
+		Room:    room,
 		From:    from,
 		To:      to,
 		Message: message,
 		Sent:    sent,
 	})
+	u.persist()
+	online := u.isOnline
 	u.mutex.Unlock()
-	if u.isOnline {
-		u.chNotify <- struct{}{}
-	} else {
-		u.DispatchEvent(fmt.Sprintf("User %s is offline and received a message from %s", u.Username, from), false, 4)
+	if online {
+		u.notify()
+		return true
 	}
+	u.DispatchEvent(EventMessageQueued, slog.LevelWarn, "User is offline, the message is queued",
+		slog.String(AttrPeer, from), slog.Uint64(AttrMessageId, id), slog.Int(AttrBytes, len(message)))
+	return false
 }
 
+// sendMessageInAThread writes the messages of the mailbox each time the user
+// is notified. The messages stay in the mailbox until the client sends the ack.
+// The messages are written without holding u.mutex: the writer blocks when the
+// client doesn't read, and the senders must not wait for it.
 func (u *User) sendMessageInAThread() {
 	go func() {
+		defer close(u.notifyDone)
 		for _ = range u.chNotify {
 			u.mutex.Lock()
+			writer := u.writer
+			messageVersion := u.messageVersion
+			if writer == nil {
+				// the user logged out, keep the messages for the next login
+				u.mutex.Unlock()
+				continue
+			}
+			messages := make([]*UserMessage, 0, len(u.Messages))
 			for _, message := range u.Messages {
 				if message.To != u.Username {
-					u.DispatchEvent(fmt.Sprintf("Message from %s to %s not sent", message.From, u.Username), false, 2)
+					u.DispatchEvent(EventDeliveryFailed, slog.LevelInfo, "Message for another user removed from the mailbox",
+						slog.String(AttrPeer, message.From), slog.Uint64(AttrMessageId, message.Id))
 					continue
 				}
-				err := chat.WriteCommandWithHeader(
-					chat.NewCommandMessageWithCorrelationId(
-						message.Message,
-						message.From, u.Username,
-						0, message.Sent),
-					u.writer)
-				u.DispatchEvent(fmt.Sprintf("Sent message from %s to %s message: %s", message.From, u.Username, message.Message), false, 2)
+				messages = append(messages, message)
+			}
+			u.Messages = messages
+
+			pending := make([]*chat.CommandMessage, 0)
+			pendingMessages := make([]*UserMessage, 0)
+			for _, message := range u.Messages {
+				if message.inFlight {
+					continue
+				}
+				commandMessage := chat.NewCommandMessageWithCorrelationId(
+					message.Message,
+					message.From, u.Username,
+					0, message.Sent)
+				commandMessage.Id = message.Id
+				commandMessage.Room = message.Room
+				commandMessage.SetVersion(messageVersion)
+				pending = append(pending, commandMessage)
+				pendingMessages = append(pendingMessages, message)
+				message.inFlight = true
+			}
+			u.mutex.Unlock()
+
+			for i, commandMessage := range pending {
+				err := writer.Send(commandMessage)
 				if err != nil {
-					u.DispatchEvent(fmt.Sprintf("Error sending message to %s: %v", u.Username, err), true, 3)
+					u.DispatchEvent(EventDeliveryFailed, slog.LevelError, "Error sending message",
+						slog.Uint64(AttrMessageId, commandMessage.Id), slog.String(AttrError, err.Error()))
+					// the messages not written are sent again at the next notification,
+					// unless the user is already on a new connection
+					u.mutex.Lock()
+					if u.writer == writer {
+						for _, message := range pendingMessages[i:] {
+							message.inFlight = false
+						}
+					}
+					u.mutex.Unlock()
 					break
 				}
+				u.DispatchEvent(EventMessageSent, slog.LevelDebug, "Message sent",
+					slog.String(AttrPeer, commandMessage.From), slog.Uint64(AttrMessageId, commandMessage.Id),
+					slog.Int(AttrBytes, len(commandMessage.Message)))
+				if messageVersion == chat.Version1 {
+					// the client of the base protocol can't send the ack
+					u.AckMessage(commandMessage.Id)
+				}
 			}
-			u.Messages = make([]*UserMessage, 0)
-			u.mutex.Unlock()
 		}
 	}()
 }